@@ -2,9 +2,14 @@ package alert
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Code describes a class of alerts.
@@ -13,6 +18,14 @@ type Code uint8
 const (
 	ERROR Code = iota
 	NEW_ITEM
+	RECOVERED
+	COMPLETE
+	STARTED
+	STOPPING
+	WARN
+	ITEM_GONE
+	DOWNLOAD_DIR_UNAVAILABLE
+	REPORT
 )
 
 func (c Code) String() string {
@@ -21,6 +34,22 @@ func (c Code) String() string {
 		return "ERROR"
 	case NEW_ITEM:
 		return "NEW_ITEM"
+	case RECOVERED:
+		return "RECOVERED"
+	case COMPLETE:
+		return "COMPLETE"
+	case STARTED:
+		return "STARTED"
+	case STOPPING:
+		return "STOPPING"
+	case WARN:
+		return "WARN"
+	case ITEM_GONE:
+		return "ITEM_GONE"
+	case DOWNLOAD_DIR_UNAVAILABLE:
+		return "DOWNLOAD_DIR_UNAVAILABLE"
+	case REPORT:
+		return "REPORT"
 	default:
 		return "UNKNOWN"
 	}
@@ -36,22 +65,425 @@ type Alerter interface {
 }
 
 type cmdAlerter struct {
-	cmd string
+	cmd  string   // the command as specified, for Command
+	args []string // the command's path, followed by its arguments
 }
 
 // NewCommand creates a new alerter that runs a specified command when an alert
 // is fired. The subprocess has its ALERT_CODE environment variable set to the
 // alert code, and its ALERT_DETAILS environment variable set to the alert
-// details.
-func NewCommand(cmd string) Alerter {
-	return &cmdAlerter{cmd}
+// details. If the alert is sent with a context returned by WithStdin, the
+// subprocess receives the context's data on its standard input. If the alert
+// is abandoned, the subprocess is killed, along with (on Unix) any processes
+// it started in its process group.
+//
+// The command is split into a program and its arguments at whitespace, as a
+// shell would, but without any expansion. Single quotes preserve everything
+// between them literally. Within double quotes, a backslash escapes a double
+// quote or another backslash. Outside of quotes, a backslash escapes any
+// character. For example, `notify-send "rssdl alert"` runs notify-send with a
+// single argument. A path containing spaces must be quoted.
+func NewCommand(cmd string) (Alerter, error) {
+	args, err := split(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse command %q: %v", cmd, err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return &cmdAlerter{cmd, args}, nil
+}
+
+// NewCommandArgs is like NewCommand, but takes the program and its arguments
+// directly rather than splitting a command.
+func NewCommandArgs(args ...string) Alerter {
+	qs := make([]string, len(args))
+	for i, a := range args {
+		qs[i] = quote(a)
+	}
+	return &cmdAlerter{strings.Join(qs, " "), append([]string(nil), args...)}
+}
+
+// Command returns the command run by an alerter created with NewCommand or
+// NewCommandArgs, in the form accepted by NewCommand. If the alerter was not
+// created with one of these functions, ok is false.
+func Command(a Alerter) (cmd string, ok bool) {
+	ca, ok := a.(*cmdAlerter)
+	if !ok {
+		return "", false
+	}
+	return ca.cmd, true
 }
 
 func (ca cmdAlerter) Alert(ctx context.Context, code Code, details string) error {
-	cmd := exec.CommandContext(ctx, ca.cmd)
+	cmd := exec.Command(ca.args[0], ca.args[1:]...)
 	cmd.Env = append(os.Environ(), fmt.Sprintf("ALERT_CODE=%s", code), fmt.Sprintf("ALERT_DETAILS=%s", details))
-	if err := cmd.Run(); err != nil {
+	// The command gets its own process group, so that if the alert is
+	// abandoned, any processes the command started are killed along with it.
+	setProcessGroup(cmd)
+	data := Stdin(ctx)
+	var stdin io.WriteCloser
+	if data != nil {
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return fmt.Errorf("alert command %q failed: %v", ca.cmd, err)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("alert command %q failed: %v", ca.cmd, err)
+	}
+	if stdin != nil {
+		// Standard input is written outside of Wait, which closes it once the
+		// command exits, so that a process left holding it open cannot keep
+		// Wait from returning.
+		go func() {
+			stdin.Write(data)
+			stdin.Close()
+		}()
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		err = <-done
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("alert command %q abandoned: %w", ca.cmd, ctx.Err())
+		}
 		return fmt.Errorf("alert command %q failed: %v", ca.cmd, err)
 	}
 	return nil
 }
+
+type stdinKey struct{}
+
+// WithStdin returns a context carrying data for the standard input of
+// commands run for alerts sent with it, by alerters created with NewCommand or
+// NewCommandArgs. If data is nil, ctx is returned unchanged.
+func WithStdin(ctx context.Context, data []byte) context.Context {
+	if data == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, stdinKey{}, data)
+}
+
+// Stdin returns the data carried by a context returned by WithStdin; nil if
+// there is none.
+func Stdin(ctx context.Context) []byte {
+	data, _ := ctx.Value(stdinKey{}).([]byte)
+	return data
+}
+
+// split splits a command into words, according to the rules described in
+// NewCommand.
+func split(cmd string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end == -1 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+
+		case c == '"':
+			inWord = true
+			for i++; ; i++ {
+				if i >= len(cmd) {
+					return nil, errors.New("unterminated double quote")
+				}
+				if cmd[i] == '"' {
+					break
+				}
+				if cmd[i] == '\\' && i+1 < len(cmd) && (cmd[i+1] == '"' || cmd[i+1] == '\\') {
+					i++
+				}
+				word.WriteByte(cmd[i])
+			}
+
+		case c == '\\':
+			inWord = true
+			if i+1 >= len(cmd) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			word.WriteByte(cmd[i])
+
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// quote quotes a word such that split will return it unchanged.
+func quote(word string) string {
+	if word != "" && !strings.ContainsAny(word, " \t\n'\"\\") {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// DefaultTimeout is the timeout used by WithTimeout if none is specified.
+const DefaultTimeout = time.Minute
+
+type timeoutAlerter struct {
+	a       Alerter
+	timeout time.Duration
+}
+
+// WithTimeout wraps an alerter such that each alert is abandoned if it is not
+// sent within the given timeout. If timeout is nonpositive, DefaultTimeout is
+// used.
+func WithTimeout(a Alerter, timeout time.Duration) Alerter {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &timeoutAlerter{a, timeout}
+}
+
+func (ta timeoutAlerter) Alert(ctx context.Context, code Code, details string) error {
+	ctx, cancel := context.WithTimeout(ctx, ta.timeout)
+	defer cancel()
+	return ta.a.Alert(ctx, code, details)
+}
+
+// DefaultRetryBackoff is the initial backoff used by WithRetries if none is
+// specified.
+const DefaultRetryBackoff = time.Second
+
+type retryingAlerter struct {
+	a       Alerter
+	retries int
+	backoff time.Duration
+}
+
+// WithRetries wraps an alerter such that failed alerts are retried up to the
+// given number of times, waiting the given backoff (doubling after each
+// attempt) between attempts. Retries stop early if the alert's context is
+// done. If backoff is nonpositive, DefaultRetryBackoff is used.
+func WithRetries(a Alerter, retries int, backoff time.Duration) Alerter {
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	return &retryingAlerter{a, retries, backoff}
+}
+
+func (ra retryingAlerter) Alert(ctx context.Context, code Code, details string) error {
+	backoff := ra.backoff
+	for i := 0; ; i++ {
+		err := ra.a.Alert(ctx, code, details)
+		if err == nil || i >= ra.retries {
+			if err != nil && i > 0 {
+				return fmt.Errorf("%v (after %d attempts)", err, i+1)
+			}
+			return err
+		}
+
+		tmr := time.NewTimer(backoff)
+		select {
+		case <-tmr.C:
+		case <-ctx.Done():
+			tmr.Stop()
+			return fmt.Errorf("%v (gave up after %d attempts: %w)", err, i+1, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// NopAlerter is an alerter which discards every alert.
+type NopAlerter struct{}
+
+func (NopAlerter) Alert(context.Context, Code, string) error { return nil }
+
+// Recorded is an alert received by a Recorder.
+type Recorded struct {
+	Code    Code
+	Details string
+	Time    time.Time // when the alert was received
+	Stdin   []byte    // the data the alert was sent with, as Stdin returns
+}
+
+// String formats the alert like "ERROR: details".
+func (r Recorded) String() string { return fmt.Sprintf("%v: %s", r.Code, r.Details) }
+
+// Recorder is an alerter which records every alert it receives, e.g. for
+// tests. The zero value is ready to use. It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex // protects alerts, err & changed
+	alerts  []Recorded
+	err     error
+	changed chan struct{} // closed when an alert is recorded; nil if no one is waiting
+}
+
+func (r *Recorder) Alert(ctx context.Context, code Code, details string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts = append(r.alerts, Recorded{code, details, time.Now(), Stdin(ctx)})
+	if r.changed != nil {
+		close(r.changed)
+		r.changed = nil
+	}
+	return r.err
+}
+
+// SetError sets the error returned by later alerts; nil to return no error.
+// Alerts are recorded regardless.
+func (r *Recorder) SetError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Alerts returns the alerts recorded so far, in the order they were received.
+func (r *Recorder) Alerts() []Recorded {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Recorded(nil), r.alerts...)
+}
+
+// Wait waits until at least n alerts have been recorded, or until the timeout
+// passes. It returns the alerts recorded so far, and whether there are at
+// least n of them.
+func (r *Recorder) Wait(n int, timeout time.Duration) ([]Recorded, bool) {
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+	for {
+		r.mu.Lock()
+		if len(r.alerts) >= n {
+			as := append([]Recorded(nil), r.alerts...)
+			r.mu.Unlock()
+			return as, true
+		}
+		if r.changed == nil {
+			r.changed = make(chan struct{})
+		}
+		changed := r.changed
+		r.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-tmr.C:
+			as := r.Alerts()
+			return as, len(as) >= n
+		}
+	}
+}
+
+// DefaultRateLimitPeriod is the period used by WithRateLimit if none is
+// specified.
+const DefaultRateLimitPeriod = 10 * time.Minute
+
+// RateLimiter is an alerter which limits the rate at which alerts are sent to
+// another alerter, created by WithRateLimit.
+type RateLimiter struct {
+	a        Alerter
+	interval time.Duration // how long the bucket takes to regain one alert
+	capacity time.Duration // how long the bucket takes to refill from empty
+
+	// now & afterFunc are time.Now & time.AfterFunc, except in tests.
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func())
+
+	mu           sync.Mutex // protects full, pending, pendingSince & dropped
+	full         time.Time  // when the bucket will be full, if no more alerts are sent
+	pending      uint64     // the number of alerts dropped since the last report
+	pendingSince time.Time  // when the first pending alert was dropped
+	dropped      uint64     // the number of alerts dropped in total
+}
+
+// WithRateLimit wraps an alerter such that at most the given number of alerts
+// are sent to it per period, as a token bucket: a burst of up to that many
+// alerts may be sent at once, after which the bucket refills evenly over the
+// period. Alerts beyond the limit are dropped, without error. Once the bucket
+// has refilled, a single WARN alert reports how many alerts were dropped. If
+// period is nonpositive, DefaultRateLimitPeriod is used.
+func WithRateLimit(a Alerter, alerts int, period time.Duration) *RateLimiter {
+	if period <= 0 {
+		period = DefaultRateLimitPeriod
+	}
+	if alerts < 1 {
+		alerts = 1
+	}
+	interval := period / time.Duration(alerts)
+	return &RateLimiter{
+		a:         a,
+		interval:  interval,
+		capacity:  interval * time.Duration(alerts),
+		now:       time.Now,
+		afterFunc: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+	}
+}
+
+func (rl *RateLimiter) Alert(ctx context.Context, code Code, details string) error {
+	rl.mu.Lock()
+	now := rl.now()
+	if rl.full.Before(now) {
+		rl.full = now
+	}
+	if rl.full.Sub(now)+rl.interval > rl.capacity {
+		if rl.pending == 0 {
+			rl.pendingSince = now
+			rl.afterFunc(rl.full.Sub(now), rl.report)
+		}
+		rl.pending++
+		rl.dropped++
+		rl.mu.Unlock()
+		return nil
+	}
+	rl.full = rl.full.Add(rl.interval)
+	rl.mu.Unlock()
+	return rl.a.Alert(ctx, code, details)
+}
+
+// report sends an alert reporting the alerts dropped since the last report,
+// once the bucket is full.
+func (rl *RateLimiter) report() {
+	rl.mu.Lock()
+	now := rl.now()
+	if now.Before(rl.full) {
+		// Alerts have been sent since the report was scheduled.
+		rl.afterFunc(rl.full.Sub(now), rl.report)
+		rl.mu.Unlock()
+		return
+	}
+	n, since := rl.pending, rl.pendingSince
+	rl.pending = 0
+	rl.full = now.Add(rl.interval)
+	rl.mu.Unlock()
+
+	// There is no one to report an error to; if the alerter is failing, the
+	// report would likely be lost anyway.
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	rl.a.Alert(ctx, WARN, fmt.Sprintf("Dropped %d alerts in the last %v", n, now.Sub(since).Round(time.Second)))
+}
+
+// Dropped returns the number of alerts that have been dropped.
+func (rl *RateLimiter) Dropped() uint64 {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.dropped
+}
@@ -0,0 +1,56 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandAlertAbandonedChildren(t *testing.T) {
+	// Not parallel, so that the goroutines of other tests do not come & go
+	// while this test counts its own.
+	dir, err := ioutil.TempDir("", "rssdl_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	// A command which starts a child which outlives it, & never reads its
+	// standard input.
+	a := NewCommandArgs("sh", "-c", `sleep 300 & echo $! > "$0"; wait`, pidFile)
+	goroutines := runtime.NumGoroutine()
+	start := time.Now()
+	err = WithTimeout(a, 100*time.Millisecond).Alert(WithStdin(context.Background(), bytes.Repeat([]byte("x"), 1<<20)), ERROR, "details")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Alert got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Alert took %v, want about the timeout", d)
+	}
+
+	// The child is killed along with the command, & nothing is left waiting
+	// on either of them.
+	pid, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Couldn't read child's PID: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", strings.TrimSpace(string(pid)), "stat"))
+		running := err == nil && !strings.Contains(string(stat), ") Z ")
+		leaked := runtime.NumGoroutine() > goroutines
+		if !running && !leaked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("After abandoning alert, child running = %v, goroutines = %d (want %d)", running, runtime.NumGoroutine(), goroutines)
+		}
+	}
+}
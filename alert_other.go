@@ -0,0 +1,15 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package alert
+
+import "os/exec"
+
+// setProcessGroup does nothing: process groups are only supported on Unix.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd. Processes it started are not killed, since
+// process groups are only supported on Unix.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
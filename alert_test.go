@@ -0,0 +1,393 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyAlerter fails the first `failures` alerts, then succeeds.
+type flakyAlerter struct {
+	failures int
+	calls    int
+}
+
+func (fa *flakyAlerter) Alert(ctx context.Context, code Code, details string) error {
+	fa.calls++
+	if fa.calls <= fa.failures {
+		return errors.New("notifier unavailable")
+	}
+	return nil
+}
+
+func TestWithRetries(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc      string
+		failures  int
+		retries   int
+		cancelled bool
+		wantCalls int
+		wantErr   *regexp.Regexp
+	}{
+		{
+			desc:      "succeeds_immediately",
+			retries:   3,
+			wantCalls: 1,
+		},
+		{
+			desc:      "succeeds_after_retries",
+			failures:  2,
+			retries:   3,
+			wantCalls: 3,
+		},
+		{
+			desc:      "no_retries",
+			failures:  1,
+			wantCalls: 1,
+			wantErr:   regexp.MustCompile("^notifier unavailable$"),
+		},
+		{
+			desc:      "retries_exhausted",
+			failures:  10,
+			retries:   2,
+			wantCalls: 3,
+			wantErr:   regexp.MustCompile(`notifier unavailable \(after 3 attempts\)`),
+		},
+		{
+			desc:      "context_cancelled",
+			failures:  10,
+			retries:   100,
+			cancelled: true,
+			wantCalls: 1,
+			wantErr:   regexp.MustCompile(`gave up after 1 attempts: context canceled`),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelled {
+				cancel()
+			}
+			fa := &flakyAlerter{failures: test.failures}
+			err := WithRetries(fa, test.retries, 5*time.Millisecond).Alert(ctx, ERROR, "details")
+			if test.wantErr == nil && err != nil {
+				t.Errorf("Alert got unexpected error: %v", err)
+			}
+			if test.wantErr != nil && (err == nil || !test.wantErr.MatchString(err.Error())) {
+				t.Errorf("Alert got error %q, wanted error matching pattern %q", err, test.wantErr)
+			}
+			if fa.calls != test.wantCalls {
+				t.Errorf("Alert called underlying alerter %d times, want %d", fa.calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNewCommand(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		cmd      string
+		wantArgs []string
+		wantErr  *regexp.Regexp
+	}{
+		{cmd: "/bin/alert", wantArgs: []string{"/bin/alert"}},
+		{cmd: "  notify-send   rssdl  ", wantArgs: []string{"notify-send", "rssdl"}},
+		{cmd: `notify-send "rssdl alert"`, wantArgs: []string{"notify-send", "rssdl alert"}},
+		{cmd: `'/path with/spaces' 'it''s' '$HOME'`, wantArgs: []string{"/path with/spaces", "its", "$HOME"}},
+		{cmd: `echo "a \"quoted\" \\ \n"`, wantArgs: []string{"echo", `a "quoted" \ \n`}},
+		{cmd: `echo a\ b \'c`, wantArgs: []string{"echo", "a b", "'c"}},
+		{cmd: `echo "" ''`, wantArgs: []string{"echo", "", ""}},
+		{cmd: "", wantErr: regexp.MustCompile("empty command")},
+		{cmd: "   ", wantErr: regexp.MustCompile("empty command")},
+		{cmd: "echo 'abc", wantErr: regexp.MustCompile("unterminated single quote")},
+		{cmd: `echo "abc`, wantErr: regexp.MustCompile("unterminated double quote")},
+		{cmd: `echo abc\`, wantErr: regexp.MustCompile("trailing backslash")},
+	} {
+		test := test
+		t.Run(test.cmd, func(t *testing.T) {
+			t.Parallel()
+			a, err := NewCommand(test.cmd)
+			if test.wantErr != nil {
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("NewCommand(%q) got error %v, wanted error matching pattern %q", test.cmd, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewCommand(%q) got unexpected error: %v", test.cmd, err)
+			}
+			if got := a.(*cmdAlerter).args; !reflect.DeepEqual(got, test.wantArgs) {
+				t.Errorf("NewCommand(%q) args = %q, want %q", test.cmd, got, test.wantArgs)
+			}
+			if got, ok := Command(a); !ok || got != test.cmd {
+				t.Errorf("Command(NewCommand(%q)) = %q, %v, want %q, true", test.cmd, got, ok, test.cmd)
+			}
+		})
+	}
+}
+
+func TestNewCommandArgs(t *testing.T) {
+	t.Parallel()
+
+	for _, args := range [][]string{
+		{"/bin/alert"},
+		{"notify-send", "rssdl alert"},
+		{"/path with/spaces", "it's", `"quoted"`, `back\slash`, ""},
+	} {
+		cmd, ok := Command(NewCommandArgs(args...))
+		if !ok {
+			t.Fatalf("Command(NewCommandArgs(%q)) not ok", args)
+		}
+		a, err := NewCommand(cmd)
+		if err != nil {
+			t.Fatalf("NewCommand(%q) got unexpected error: %v", cmd, err)
+		}
+		if got := a.(*cmdAlerter).args; !reflect.DeepEqual(got, args) {
+			t.Errorf("NewCommand(Command(NewCommandArgs(%q))) args = %q", args, got)
+		}
+	}
+}
+
+func TestCommandAlert(t *testing.T) {
+	t.Parallel()
+
+	a, err := NewCommand(`sh -c 'test "$ALERT_CODE" = "$0" && test "$ALERT_DETAILS" = "$1"' NEW_ITEM "some details"`)
+	if err != nil {
+		t.Fatalf("NewCommand got unexpected error: %v", err)
+	}
+	if err := a.Alert(context.Background(), NEW_ITEM, "some details"); err != nil {
+		t.Errorf("Alert got unexpected error: %v", err)
+	}
+	if err := a.Alert(context.Background(), NEW_ITEM, "other details"); err == nil {
+		t.Errorf("Alert with mismatched details got no error")
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	t.Parallel()
+
+	// An alerter which never finishes sending, until abandoned.
+	hung := alerterFunc(func(ctx context.Context, code Code, details string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	start := time.Now()
+	err := WithTimeout(hung, 10*time.Millisecond).Alert(context.Background(), ERROR, "details")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Alert got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Alert took %v, want about the timeout", d)
+	}
+
+	// The timeout includes retries, and is reported through them.
+	err = WithTimeout(WithRetries(&flakyAlerter{failures: 100}, 100, time.Hour), 10*time.Millisecond).Alert(context.Background(), ERROR, "details")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Alert with retries got error %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := WithTimeout(&flakyAlerter{}, 0).Alert(context.Background(), ERROR, "details"); err != nil {
+		t.Errorf("Alert with default timeout got unexpected error: %v", err)
+	}
+}
+
+func TestCommandAlertStdin(t *testing.T) {
+	t.Parallel()
+
+	a, err := NewCommand(`sh -c 'test "$(cat)" = "$0"' "some data"`)
+	if err != nil {
+		t.Fatalf("NewCommand got unexpected error: %v", err)
+	}
+	if err := a.Alert(WithStdin(context.Background(), []byte("some data")), NEW_ITEM, "details"); err != nil {
+		t.Errorf("Alert with stdin %q got unexpected error: %v", "some data", err)
+	}
+	if err := a.Alert(WithStdin(context.Background(), []byte("other data")), NEW_ITEM, "details"); err == nil {
+		t.Errorf("Alert with stdin %q got no error, want error", "other data")
+	}
+	if err := a.Alert(context.Background(), NEW_ITEM, "details"); err == nil {
+		t.Errorf("Alert without stdin got no error, want error")
+	}
+
+	// Commands need not read their standard input.
+	a, err = NewCommand("true")
+	if err != nil {
+		t.Fatalf("NewCommand got unexpected error: %v", err)
+	}
+	if err := a.Alert(WithStdin(context.Background(), bytes.Repeat([]byte("x"), 1<<20)), NEW_ITEM, "details"); err != nil {
+		t.Errorf("Alert with unread stdin got unexpected error: %v", err)
+	}
+}
+
+func TestCommandAlertAbandoned(t *testing.T) {
+	t.Parallel()
+
+	a, err := NewCommand("sleep 10")
+	if err != nil {
+		t.Fatalf("NewCommand got unexpected error: %v", err)
+	}
+	err = WithTimeout(a, 10*time.Millisecond).Alert(context.Background(), ERROR, "details")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Alert got error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if want := regexp.MustCompile(`^alert command "sleep 10" abandoned`); err == nil || !want.MatchString(err.Error()) {
+		t.Errorf("Alert got error %q, wanted error matching pattern %q", err, want)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	var r Recorder
+	if as, ok := r.Wait(1, 10*time.Millisecond); ok || len(as) != 0 {
+		t.Errorf("Wait before any alerts got (%v, %v), want ([], false)", as, ok)
+	}
+
+	go func() {
+		r.Alert(context.Background(), NEW_ITEM, "first")
+		r.Alert(context.Background(), ERROR, "second")
+	}()
+	as, ok := r.Wait(2, 5*time.Second)
+	if !ok {
+		t.Fatalf("Wait got %v, want 2 alerts", as)
+	}
+	var got []string
+	for _, a := range as {
+		got = append(got, a.String())
+	}
+	if want := []string{"NEW_ITEM: first", "ERROR: second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Wait got alerts %q, want %q", got, want)
+	}
+
+	// Alerts are recorded even when an error is returned.
+	wantErr := errors.New("alert failed")
+	r.SetError(wantErr)
+	if err := r.Alert(context.Background(), ERROR, "third"); err != wantErr {
+		t.Errorf("Alert after SetError got error %v, want %v", err, wantErr)
+	}
+	if as := r.Alerts(); len(as) != 3 || as[2].Details != "third" {
+		t.Errorf("Alerts got %v, want 3 alerts ending with %q", as, "third")
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	t.Parallel()
+
+	var r Recorder
+	clk := &fakeClock{now: time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)}
+	rl := WithRateLimit(&r, 3, 30*time.Minute)
+	rl.now, rl.afterFunc = clk.Now, clk.AfterFunc
+	alert := func(details string) {
+		if err := rl.Alert(context.Background(), ERROR, details); err != nil {
+			t.Errorf("Alert(%q) got unexpected error: %v", details, err)
+		}
+	}
+	check := func(desc string, want ...string) {
+		var got []string
+		for _, a := range r.Alerts() {
+			got = append(got, a.String())
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got alerts %q, want %q", desc, got, want)
+		}
+	}
+
+	// A burst fills the bucket; alerts beyond it are dropped.
+	for _, d := range []string{"1", "2", "3", "4", "5"} {
+		alert(d)
+	}
+	check("After burst", "ERROR: 1", "ERROR: 2", "ERROR: 3")
+	if got := rl.Dropped(); got != 2 {
+		t.Errorf("After burst, Dropped = %d, want 2", got)
+	}
+
+	// The bucket regains one alert per interval.
+	clk.Advance(10 * time.Minute)
+	alert("6")
+	alert("7")
+	check("After interval", "ERROR: 1", "ERROR: 2", "ERROR: 3", "ERROR: 6")
+
+	// The dropped alerts are reported once the bucket is full, which was delayed
+	// by the alert sent in the meantime.
+	clk.Advance(20 * time.Minute)
+	check("Before bucket is full", "ERROR: 1", "ERROR: 2", "ERROR: 3", "ERROR: 6")
+	clk.Advance(10 * time.Minute)
+	check("After bucket is full", "ERROR: 1", "ERROR: 2", "ERROR: 3", "ERROR: 6", "WARN: Dropped 3 alerts in the last 40m0s")
+	if got := rl.Dropped(); got != 3 {
+		t.Errorf("After report, Dropped = %d, want 3", got)
+	}
+
+	// The report uses an alert from the bucket.
+	alert("8")
+	alert("9")
+	alert("10")
+	clk.Advance(time.Hour)
+	check("After second burst", "ERROR: 1", "ERROR: 2", "ERROR: 3", "ERROR: 6", "WARN: Dropped 3 alerts in the last 40m0s", "ERROR: 8", "ERROR: 9", "WARN: Dropped 1 alerts in the last 30m0s")
+
+	// No further report is sent without more dropped alerts.
+	clk.Advance(time.Hour)
+	if got := len(r.Alerts()); got != 8 {
+		t.Errorf("After another hour, got %d alerts, want 8", got)
+	}
+}
+
+// fakeClock provides a time & timers controlled by a test.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	f  func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timers = append(c.timers, fakeTimer{c.now.Add(d), f})
+}
+
+// Advance advances the time, synchronously calling the functions of any
+// timers which expire in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			break
+		}
+		tmr := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = tmr.at
+		c.mu.Unlock()
+		tmr.f()
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type alerterFunc func(ctx context.Context, code Code, details string) error
+
+func (f alerterFunc) Alert(ctx context.Context, code Code, details string) error {
+	return f(ctx, code, details)
+}
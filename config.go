@@ -1,104 +1,1249 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"path/filepath"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/BranLwyd/rssdl/alert"
+	"github.com/BranLwyd/rssdl/cron"
 	"github.com/BranLwyd/rssdl/weekly"
-	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v2"
 
 	pb "github.com/BranLwyd/rssdl/rssdl_proto"
 )
 
 type Feed struct {
-	Name        string
-	URL         string
-	DownloadDir string
-	OrderRegexp *regexp.Regexp
-	CheckSpecs  []weekly.TickSpecification
-	Alerter     alert.Alerter
+	Name                 string
+	URL                  string
+	DownloadDir          string
+	OrderRegexp          *regexp.Regexp // nil if Mirror is set and no order regex is configured
+	LabelRegexp          *regexp.Regexp // if non-nil, captures a label naming items in alerts & filenames
+	CheckSpecs           []weekly.TickSpecification
+	CheckCron            *cron.Schedule // if non-nil, used instead of CheckSpecs
+	Alerter              alert.Alerter
+	LenientParse         bool
+	MaxPages             int              // the maximum number of feed pages to fetch; 0 if pagination is not followed
+	MaxItemAge           time.Duration    // the maximum age of items to download; 0 if items of any age are downloaded
+	OrderMin             string           // the minimum order to download; empty if there is no minimum
+	OrderMax             string           // the maximum order to download; empty if there is no maximum
+	OrderStart           string           // the order to start from if the state has none; empty to start from the beginning
+	DisableAfterMax      bool             // if set, stop checking once an item past OrderMax is found
+	SkipDates            []DateRange      // dates on which the feed is not checked
+	ParseRetries         int              // the number of times to retry a failed fetch & parse within a check
+	TLSConfig            *tls.Config      // TLS configuration for fetching & downloading; nil to use the default
+	TLSFiles             TLSFiles         // the files TLSConfig was loaded from; zero if it was not loaded from files
+	MaxFeedSize          int64            // the maximum size of the feed in bytes; 0 to use DefaultMaxFeedSize
+	FetchTimeout         time.Duration    // the maximum time to spend fetching the feed; 0 to use DefaultFetchTimeout
+	ContentTypeRegexp    *regexp.Regexp   // if non-nil, only items with a matching content type are downloaded
+	AlertRetries         int              // the number of times to retry a failed alert
+	AlertRetryBackoff    time.Duration    // the initial backoff between alert retries; 0 to use alert.DefaultRetryBackoff
+	AlertTimeout         time.Duration    // how long to wait for an alert to be sent, including retries; 0 to use alert.DefaultTimeout
+	GlobalDedupe         bool             // if set, skip items recently downloaded by any feed with GlobalDedupe set
+	SkipIfExists         SkipIfExists     // when to skip downloading an item whose file already exists
+	DownloadStallTimeout time.Duration    // how long a download may make no progress before it is aborted; 0 to use DefaultDownloadStallTimeout
+	CheckOnStart         bool             // if set, check immediately on startup if within a check window
+	CheckOnStartAlways   bool             // if set, check immediately on startup, even outside every check window
+	DedupeByHash         bool             // if set, discard downloads whose content duplicates a recent download
+	HardlinkDuplicates   bool             // if set, replace downloads discarded by DedupeByHash with hard links
+	StaleAfter           time.Duration    // if nonzero, how long the feed may go without a download before a WARN alert is fired
+	FilenameFallback     FilenameFallback // what to do when an item's URL has no filename
+	Headers              http.Header      // headers sent with each request; nil if none
+	RedirectHeaderHosts  []string         // hosts to which Headers are also sent when following a redirect
+	MaxRedirects         int              // the maximum number of redirects to follow per request; 0 to follow up to 10
+	KeepLastN            int              // the number of most recently downloaded files to keep; 0 to keep all
+	SecretQueryParams    []string         // query parameters whose values are redacted from logged URLs
+	DateLayouts          []string         // time layouts with which to parse publish dates the feed parser cannot
+	Mirror               bool             // if set, download every item not already downloaded, regardless of order
+	StagingDir           string           // if non-empty, items are downloaded here before being moved into DownloadDir
+	MaxStartupDelay      time.Duration    // the maximum random delay of the first check after startup; 0 for no delay
+	WriteMetadata        bool             // if set, a JSON file describing each downloaded item is written next to it
+	AllowedDownloadHosts []string         // if non-empty, the only hosts items may be downloaded from
+	DenyPrivateDownloads bool             // if set, items may not be downloaded from non-public addresses
+	RawTransfer          bool             // if set, items are saved without decoding their Content-Encoding
+	MinDownloadInterval  time.Duration    // the minimum interval between downloads; 0 if unlimited
+	MaxGoneChecks        int              // how many checks may find an item's link gone before it is given up on; 0 to use DefaultMaxGoneChecks
+	StopOnGone           bool             // if set, an item given up on blocks the feed rather than being skipped
+	TorrentWatchDir      string           // if non-empty, .torrent items are downloaded here rather than into DownloadDir
+	LinkIndex            bool             // if set, files already downloaded from an item's link by any feed with LinkIndex set are reused
+	RepackRegexp         *regexp.Regexp   // if non-nil, matches the titles of repacks, which are downloaded at the current order
+	NewestFirst          bool             // if set, the items to download in a check are downloaded newest first
+	MaxDownloads         int              // the maximum number of downloads at once, if NewestFirst is set
+	ItemJSONStdin        bool             // if set, NEW_ITEM alert commands receive the downloaded item as JSON on stdin
+	LatestOnly           bool             // if set, each check downloads only the item with the greatest order of those it would download
+	OrderRegression      OrderRegression  // what to do when the feed's orders appear to have regressed
+	FTPUser              string           // the user to log in as when downloading over FTP; empty for anonymous login
+	FTPPassword          string           // the password to log in with when downloading over FTP
+	ExtensionFilters     []ExtensionFilter
 }
 
+// SkipIfExists specifies when to skip downloading an item because a file with
+// the item's name already exists, based on a HEAD request for the item.
+type SkipIfExists uint8
+
+const (
+	NEVER SkipIfExists = iota // always download
+	SIZE                      // skip if the existing file's size matches the remote size
+	ETAG                      // as SIZE, but the remote ETag must also match the ETag recorded for the file, if any
+)
+
+func (s SkipIfExists) String() string {
+	switch s {
+	case NEVER:
+		return "NEVER"
+	case SIZE:
+		return "SIZE"
+	case ETAG:
+		return "ETAG"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// FilenameFallback specifies what to do when an item's URL has no filename to
+// download to.
+type FilenameFallback uint8
+
+const (
+	ERROR FilenameFallback = iota // fail the download
+	TITLE                         // name the file after the item's title
+)
+
+func (ff FilenameFallback) String() string {
+	switch ff {
+	case ERROR:
+		return "ERROR"
+	case TITLE:
+		return "TITLE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// OrderRegression specifies what to do when a feed's orders appear to have
+// regressed, e.g. because the format of its titles changed.
+type OrderRegression uint8
+
+const (
+	SKIP_AND_WARN OrderRegression = iota // skip the items, alerting once
+	RESET_ORDER                          // download the items, lowering the feed's order
+)
+
+func (r OrderRegression) String() string {
+	switch r {
+	case SKIP_AND_WARN:
+		return "SKIP_AND_WARN"
+	case RESET_ORDER:
+		return "RESET_ORDER"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// TLSFiles names the files a feed's TLS configuration was loaded from.
+type TLSFiles struct {
+	ClientCert string // the PEM-encoded client certificate; empty if none
+	ClientKey  string // the PEM-encoded private key for ClientCert; empty if none
+	CA         string // the PEM-encoded CA certificates; empty to use the system's
+}
+
+// dateLayout is the layout of dates in the configuration.
+const dateLayout = "2006-01-02"
+
+// DateRange is an inclusive range of dates, each in the format "2017-12-25".
+type DateRange struct {
+	From, To string
+}
+
+// Contains determines if the given time falls on a date within the range, in
+// the time's location.
+func (r DateRange) Contains(t time.Time) bool {
+	d := t.Format(dateLayout)
+	return r.From <= d && d <= r.To
+}
+
+// ExtensionFilter is a condition on the value of an extension element of a
+// feed's items, such as "torrent:seeders".
+type ExtensionFilter struct {
+	Prefix string         // the prefix of the element's namespace, e.g. "torrent"
+	Name   string         // the element's name, e.g. "seeders"
+	MinInt *int64         // if non-nil, the value must be an integer no less than MinInt
+	MaxInt *int64         // if non-nil, the value must be an integer no greater than MaxInt
+	Regexp *regexp.Regexp // if non-nil, the value must match Regexp
+}
+
+// Path returns the element's path, as "prefix:name".
+func (ef ExtensionFilter) Path() string { return ef.Prefix + ":" + ef.Name }
+
+// Matches determines if the given value of the element satisfies the filter.
+func (ef ExtensionFilter) Matches(value string) bool {
+	if ef.MinInt != nil || ef.MaxInt != nil {
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return false
+		}
+		if (ef.MinInt != nil && n < *ef.MinInt) || (ef.MaxInt != nil && n > *ef.MaxInt) {
+			return false
+		}
+	}
+	return ef.Regexp == nil || ef.Regexp.MatchString(value)
+}
+
+// Label returns the label of the item with the given title, as captured by
+// LabelRegexp, or the empty string if LabelRegexp is nil or does not match.
+func (f *Feed) Label(title string) string {
+	if f.LabelRegexp == nil {
+		return ""
+	}
+	m := f.LabelRegexp.FindStringSubmatch(title)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// ParseDate parses the given publish date with the first of DateLayouts that
+// it matches, reporting whether any did.
+func (f *Feed) ParseDate(date string) (time.Time, bool) {
+	date = strings.TrimSpace(date)
+	for _, l := range f.DateLayouts {
+		if t, err := time.Parse(l, date); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// TooOld determines if an item with the given publish time is too old to be
+// downloaded as of now. Items with no publish time are never too old.
+func (f *Feed) TooOld(published *time.Time, now time.Time) bool {
+	if f.MaxItemAge == 0 || published == nil {
+		return false
+	}
+	return published.Before(now.Add(-f.MaxItemAge))
+}
+
+// Skipped determines if the given time falls on one of SkipDates, when the
+// feed is not checked.
+func (f *Feed) Skipped(t time.Time) bool {
+	for _, r := range f.SkipDates {
+		if r.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Window returns the start & end of the check window containing the given
+// time. ok is false if the time is in no check window, or if the feed uses
+// CheckCron rather than check windows.
+func (f *Feed) Window(t time.Time) (start, end time.Time, ok bool) {
+	if f.CheckCron != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	for _, ts := range f.CheckSpecs {
+		if ts.Contains(t) {
+			return ts.Start.InWeekStarting(t, ts.WeekStart), ts.End.InWeekStarting(t, ts.WeekStart), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// InWindow determines if the given time is within one of the feed's check
+// windows.
+func (f *Feed) InWindow(t time.Time) bool {
+	_, _, ok := f.Window(t)
+	return ok
+}
+
+// NextChecks returns up to n of the feed's next scheduled checks strictly after
+// the given time, in order, as scheduled before any random delay. Checks on
+// SkipDates are omitted. Fewer than n checks are returned if there are no more
+// within the next several years.
+func (f *Feed) NextChecks(t time.Time, n int) []time.Time {
+	var next func(time.Time) time.Time
+	switch {
+	case f.CheckCron != nil:
+		next = f.CheckCron.Next
+	case len(f.CheckSpecs) > 0:
+		next = func(t time.Time) time.Time {
+			var nxt time.Time
+			for _, ts := range f.CheckSpecs {
+				if tck := ts.Next(t); nxt.IsZero() || tck.Before(nxt) {
+					nxt = tck
+				}
+			}
+			return nxt
+		}
+	default:
+		return nil
+	}
+
+	var checks []time.Time
+	for limit := t.AddDate(5, 0, 0); len(checks) < n; {
+		if t = next(t); t.IsZero() || t.After(limit) {
+			break
+		}
+		if !f.Skipped(t) {
+			checks = append(checks, t)
+		}
+	}
+	return checks
+}
+
+// Format describes the format of a configuration file.
+type Format uint8
+
+const (
+	TEXT Format = iota // protocol buffer text format
+	YAML               // YAML, with the same field names & structure as TEXT
+	JSON               // JSON, with the same field names & structure as TEXT
+)
+
+func (f Format) String() string {
+	switch f {
+	case TEXT:
+		return "TEXT"
+	case YAML:
+		return "YAML"
+	case JSON:
+		return "JSON"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ParseFormatName parses the name of a format (e.g. "yaml"), as returned by
+// Format.String. Names are case-insensitive.
+func ParseFormatName(name string) (Format, error) {
+	for _, f := range []Format{TEXT, YAML, JSON} {
+		if strings.EqualFold(name, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown config format %q", name)
+}
+
+// FormatForFilename determines the format of a configuration file based on
+// its extension. Files ending in ".yaml" or ".yml" are YAML, files ending in
+// ".json" are JSON, and all other files are TEXT.
+func FormatForFilename(filename string) Format {
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		return YAML
+	case ".json":
+		return JSON
+	default:
+		return TEXT
+	}
+}
+
+const (
+	defaultMaxPages = 10
+
+	// maxIncludeDepth is the maximum depth to which includes may be nested.
+	maxIncludeDepth = 10
+
+	// DefaultMaxFeedSize is the maximum size of a feed, in bytes, if none is
+	// specified.
+	DefaultMaxFeedSize = 10 << 20
+
+	// DefaultFetchTimeout is the maximum time to spend fetching a feed, if
+	// none is specified.
+	DefaultFetchTimeout = time.Minute
+
+	// DefaultDownloadStallTimeout is how long a download may make no progress
+	// before it is aborted, if none is specified.
+	DefaultDownloadStallTimeout = 10 * time.Minute
+
+	// DefaultMaxGoneChecks is how many checks may find an item's link gone
+	// before the item is given up on, if not specified.
+	DefaultMaxGoneChecks = 3
+
+	// DefaultRepackRegex matches the titles of repacks, if download_repacks is
+	// specified without a repack_regex.
+	DefaultRepackRegex = `(?i)\b(repack|proper)\b`
+
+	// DefaultMaxConcurrentDownloads is the maximum number of downloads at
+	// once, if download_newest_first is specified without
+	// max_concurrent_downloads.
+	DefaultMaxConcurrentDownloads = 1
+)
+
+var (
+	// ErrNoFeeds is returned when parsing a configuration that does not
+	// specify any feeds.
+	ErrNoFeeds = errors.New("config does not specify any feeds to watch")
+
+	// ErrMissingField is wrapped by a FeedError (or, for a top-level
+	// schedule, a plain error) when a required field is not specified.
+	ErrMissingField = errors.New("not specified")
+
+	errNoDefault = fmt.Errorf("%w and no default specified", ErrMissingField)
+)
+
+// FeedError describes a problem with a single feed in a configuration.
+type FeedError struct {
+	File      string // the name of the file specifying the feed, and any files including it; empty unless parsing files
+	FeedName  string // the name of the feed; may be empty if the feed has no name
+	FeedIndex int    // the index of the feed in the configuration
+	Field     string // the name of the problematic field; may be empty
+	Index     int    // the index into Field, if Field is repeated; -1 otherwise
+	Err       error
+}
+
+func (e *FeedError) Error() string {
+	var sb strings.Builder
+	if e.File != "" {
+		fmt.Fprintf(&sb, "%s: ", e.File)
+	}
+	if e.FeedName != "" {
+		fmt.Fprintf(&sb, "feed %q", e.FeedName)
+	} else {
+		fmt.Fprintf(&sb, "feed at index %d", e.FeedIndex)
+	}
+	if e.Field != "" {
+		fmt.Fprintf(&sb, " %s", e.Field)
+		if e.Index >= 0 {
+			fmt.Fprintf(&sb, "[%d]", e.Index)
+		}
+	}
+	fmt.Fprintf(&sb, ": %v", e.Err)
+	return sb.String()
+}
+
+func (e *FeedError) Unwrap() error { return e.Err }
+
+// Errors is returned when a configuration has more than one problem. Each
+// element describes a single problem, typically as a *FeedError.
+type Errors []error
+
+func (es Errors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Report specifies a weekly report summarizing every feed.
+type Report struct {
+	Spec    weekly.TickSpecification // ticks once a week, when the report is sent
+	Alerter alert.Alerter            // the alerter the report is sent to
+}
+
+// Config is a parsed configuration.
+type Config struct {
+	Feeds []*Feed
+
+	// Alerter receives alerts about the daemon as a whole, such as startup &
+	// shutdown, rather than about any single feed. It is specified by the
+	// top-level alert_command; nil if that is not set.
+	Alerter           alert.Alerter
+	AlertRetries      int           // the number of times to retry a failed alert
+	AlertRetryBackoff time.Duration // the initial backoff between alert retries; 0 to use alert.DefaultRetryBackoff
+	AlertTimeout      time.Duration // how long to wait for an alert to be sent, including retries; 0 to use alert.DefaultTimeout
+
+	// AlertRateLimit is the maximum number of alerts sent to each alert
+	// command per AlertRateLimitPeriod, shared by every feed using the
+	// command; 0 if unlimited.
+	AlertRateLimit       int
+	AlertRateLimitPeriod time.Duration // 0 to use alert.DefaultRateLimitPeriod
+
+	MaxConcurrentChecks     int           // the maximum number of feeds fetched & parsed at once; 0 if unlimited
+	MaxConcurrentFeedChecks int           // the maximum number of feeds checked at once, including downloads; 0 if unlimited
+	MinHostInterval         time.Duration // the minimum interval between requests to each host; 0 if unlimited
+	Report                  *Report       // the weekly report to send; nil if none
+
+	// Warnings describes likely mistakes in the configuration which do not
+	// prevent it from being used, such as an order regex whose capture group
+	// can match the empty string.
+	Warnings Errors
+}
+
+// Parse parses a configuration in protocol buffer text format.
 func Parse(cfg string) ([]*Feed, error) {
+	return ParseFormat(cfg, TEXT)
+}
+
+// ParseYAML parses a configuration in YAML format.
+func ParseYAML(cfg string) ([]*Feed, error) {
+	return ParseFormat(cfg, YAML)
+}
+
+// ParseJSON parses a configuration in JSON format.
+func ParseJSON(cfg string) ([]*Feed, error) {
+	return ParseFormat(cfg, JSON)
+}
+
+// ParseFormat parses a configuration in the given format. All formats are
+// validated identically and produce the same result. Unknown fields are
+// treated as an error.
+func ParseFormat(cfg string, format Format) ([]*Feed, error) {
+	return ParseOptions{}.Parse(cfg, format)
+}
+
+// ParseOptions configures how a configuration is parsed.
+type ParseOptions struct {
+	// AllowUnknownFields causes unknown fields in the configuration to be
+	// ignored, rather than treated as an error.
+	AllowUnknownFields bool
+
+	// StopAtFirstError causes parsing to stop at the first problem found,
+	// rather than reporting every problem with the configuration.
+	StopAtFirstError bool
+}
+
+// Parse parses a configuration in the given format, according to o, returning
+// only the configured feeds.
+func (o ParseOptions) Parse(cfg string, format Format) ([]*Feed, error) {
+	c, err := o.ParseConfig(cfg, format)
+	if err != nil {
+		return nil, err
+	}
+	return c.Feeds, nil
+}
+
+// ParseConfig parses a configuration in the given format, according to o.
+func (o ParseOptions) ParseConfig(cfg string, format Format) (*Config, error) {
+	c, err := o.unmarshal(cfg, format)
+	if err != nil {
+		return nil, err
+	}
+	return o.parse(c, nil)
+}
+
+// ParseFile parses the configuration file with the given name, in the format
+// determined by FormatForFilename, returning only the configured feeds. Unlike
+// Parse, the configuration may include other files.
+func ParseFile(filename string) ([]*Feed, error) {
+	return ParseOptions{}.ParseFile(filename)
+}
+
+// ParseFile parses the configuration file with the given name according to
+// o, returning only the configured feeds. See ParseFileConfig.
+func (o ParseOptions) ParseFile(filename string) ([]*Feed, error) {
+	c, err := o.ParseFileConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.Feeds, nil
+}
+
+// ParseFileConfig parses the configuration file with the given name, in the
+// format determined by FormatForFilename, according to o. Unlike ParseConfig,
+// the configuration may include other files.
+func (o ParseOptions) ParseFileConfig(filename string) (*Config, error) {
+	cfg, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return o.ParseFilesConfig([]NamedSource{{Name: filename, Config: string(cfg), Format: FormatForFilename(filename)}})
+}
+
+// NamedSource is the content of a single configuration file, as parsed by
+// ParseFiles.
+type NamedSource struct {
+	Name   string // the name of the file (e.g. its path), used in errors
+	Config string
+	Format Format
+}
+
+// ParseFiles parses a configuration split across several files, returning
+// only the configured feeds. See ParseOptions.ParseFilesConfig.
+func ParseFiles(srcs []NamedSource) ([]*Feed, error) {
+	return ParseOptions{}.ParseFiles(srcs)
+}
+
+// ParseFiles parses a configuration split across several files, according to
+// o, returning only the configured feeds. See ParseFilesConfig.
+func (o ParseOptions) ParseFiles(srcs []NamedSource) ([]*Feed, error) {
+	c, err := o.ParseFilesConfig(srcs)
+	if err != nil {
+		return nil, err
+	}
+	return c.Feeds, nil
+}
+
+// ParseFilesConfig parses a configuration split across several files,
+// according to o. The feeds & schedules of every file are combined, in order.
+// The other top-level fields (e.g. download_dir) apply to the feeds of every
+// file, and may be specified by at most one file, typically one holding only
+// these defaults. Files may include other files, relative to the directory of
+// the file named by NamedSource.Name. Problems with a feed are reported with
+// the name of the file that specified it.
+func (o ParseOptions) ParseFilesConfig(srcs []NamedSource) (*Config, error) {
+	c := &pb.Config{}
+	var files []string      // the name of the file specifying each feed
+	var defaultsFile string // the name of the file specifying other top-level fields
+	for _, src := range srcs {
+		sc, scFiles, err := o.load(src, nil)
+		if err != nil {
+			return nil, err
+		}
+		feeds, schedules := sc.Feed, sc.Schedule
+		sc.Feed, sc.Schedule = nil, nil
+		if !proto.Equal(sc, &pb.Config{}) {
+			if defaultsFile != "" {
+				return nil, fmt.Errorf("%s: top-level settings already specified in %s", src.Name, defaultsFile)
+			}
+			defaultsFile = src.Name
+			sc.Feed, sc.Schedule = c.Feed, c.Schedule
+			c = sc
+		}
+
+		c.Feed = append(c.Feed, feeds...)
+		c.Schedule = append(c.Schedule, schedules...)
+		files = append(files, scFiles...)
+	}
+	return o.parse(c, files)
+}
+
+// load unmarshals the configuration in src, resolving its includes. chain
+// holds the names of the files that included src, outermost first. The name
+// of the file specifying each feed of the returned configuration, along with
+// the files including it, is returned as files.
+func (o ParseOptions) load(src NamedSource, chain []string) (_ *pb.Config, files []string, _ error) {
+	name := src.Name
+	if len(chain) > 0 {
+		inc := make([]string, len(chain))
+		for i, fn := range chain {
+			inc[len(chain)-1-i] = fn
+		}
+		name = fmt.Sprintf("%s (included from %s)", src.Name, strings.Join(inc, ", included from "))
+	}
+	c, err := o.unmarshal(src.Config, src.Format)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for range c.Feed {
+		files = append(files, name)
+	}
+	if len(c.Include) == 0 {
+		return c, files, nil
+	}
+	chain = append(chain[:len(chain):len(chain)], src.Name)
+	if len(chain) > maxIncludeDepth {
+		return nil, nil, fmt.Errorf("%s: include: nested more than %d deep", name, maxIncludeDepth)
+	}
+
+	// Included defaults are overridden by those of later includes, and
+	// finally by those of the including file.
+	defaults := &pb.Config{}
+	var feeds []*pb.Feed
+	var schedules []*pb.Schedule
+	for i, inc := range c.Include {
+		fn := filepath.Clean(inc)
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(filepath.Dir(src.Name), fn)
+		}
+		for _, prev := range chain {
+			if filepath.Clean(prev) == fn {
+				return nil, nil, fmt.Errorf("%s: include[%d]: %q includes itself", name, i, inc)
+			}
+		}
+		cfg, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: include[%d]: %v", name, i, err)
+		}
+		ic, icFiles, err := o.load(NamedSource{Name: fn, Config: string(cfg), Format: FormatForFilename(fn)}, chain)
+		if err != nil {
+			return nil, nil, err
+		}
+		feeds = append(feeds, ic.Feed...)
+		schedules = append(schedules, ic.Schedule...)
+		files = append(files, icFiles...)
+		ic.Feed, ic.Schedule = nil, nil
+		overrideDefaults(defaults, ic)
+	}
+	c.Include = nil
+	feeds = append(c.Feed, feeds...)
+	schedules = append(c.Schedule, schedules...)
+	c.Feed, c.Schedule = nil, nil
+	overrideDefaults(defaults, c)
+	defaults.Feed, defaults.Schedule = feeds, schedules
+	return defaults, files, nil
+}
+
+// overrideDefaults sets each top-level setting specified by src in dst.
+func overrideDefaults(dst, src *pb.Config) {
+	if len(src.CheckSpec) > 0 {
+		// Replace, rather than append to, the default check specs.
+		dst.CheckSpec = nil
+	}
+	proto.Merge(dst, src)
+}
+
+// ReadDir reads each configuration file directly within dir, in lexical
+// order of filename, for parsing by ParseFiles. Configuration files are those
+// named with an extension of ".cfg", ".textproto", ".yaml", ".yml", or
+// ".json"; other files are ignored. The format of each file is determined by
+// FormatForFilename.
+func ReadDir(dir string) ([]NamedSource, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var srcs []NamedSource
+	for _, fi := range fis {
+		switch filepath.Ext(fi.Name()) {
+		case ".cfg", ".textproto", ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		fn := filepath.Join(dir, fi.Name())
+		cfg, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, NamedSource{Name: fn, Config: string(cfg), Format: FormatForFilename(fn)})
+	}
+	return srcs, nil
+}
+
+// unmarshal parses a configuration in the given format, without validating it.
+func (o ParseOptions) unmarshal(cfg string, format Format) (*pb.Config, error) {
 	c := &pb.Config{}
-	if err := proto.UnmarshalText(cfg, c); err != nil {
-		return nil, fmt.Errorf("could not parse config: %v", err)
+	switch format {
+	case TEXT:
+		if err := (prototext.UnmarshalOptions{DiscardUnknown: o.AllowUnknownFields}).Unmarshal([]byte(cfg), c); err != nil {
+			return nil, fmt.Errorf("could not parse config: %v", err)
+		}
+	case YAML:
+		if err := o.unmarshalYAML(cfg, c); err != nil {
+			return nil, fmt.Errorf("could not parse config: %v", err)
+		}
+	case JSON:
+		if strings.TrimSpace(cfg) == "" {
+			// Treat an empty document as an empty config, as the other formats do.
+			break
+		}
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: o.AllowUnknownFields}).Unmarshal([]byte(cfg), c); err != nil {
+			return nil, fmt.Errorf("could not parse config: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %v", format)
 	}
+	return c, nil
+}
+
+// parse validates a configuration. If files is non-nil, files[i] is the name
+// of the file that specified the i'th feed.
+func (o ParseOptions) parse(c *pb.Config, files []string) (*Config, error) {
 	if len(c.Feed) == 0 {
-		return nil, errors.New("config does not specify any feeds to watch")
+		return nil, ErrNoFeeds
 	}
 	feeds := make([]*Feed, 0, len(c.Feed))
-	names := make(map[string]struct{}, len(c.Feed))
+	names := make(map[string]int, len(c.Feed)) // feed name -> index
 
+	var errs, warnings Errors
+	var ga alert.Alerter
+	if c.AlertCommand != "" {
+		var err error
+		if ga, err = alert.NewCommand(c.AlertCommand); err != nil {
+			errs = append(errs, fmt.Errorf("alert_command: %v", err))
+			if o.StopAtFirstError {
+				return nil, errs[0]
+			}
+		}
+	}
+	if c.AlertRateLimitPeriodS != 0 && c.AlertRateLimit == 0 {
+		errs = append(errs, errors.New("alert_rate_limit_period_s: specified without alert_rate_limit"))
+		if o.StopAtFirstError {
+			return nil, errs[0]
+		}
+	}
+	var mhi time.Duration
+	if c.MinHostInterval != "" {
+		var err error
+		if mhi, err = time.ParseDuration(c.MinHostInterval); err != nil {
+			errs = append(errs, fmt.Errorf("min_host_interval: %v", err))
+		} else if mhi < 0 {
+			errs = append(errs, errors.New("min_host_interval: negative"))
+		}
+		if len(errs) > 0 && o.StopAtFirstError {
+			return nil, errs[0]
+		}
+	}
+	var rpt *Report
+	if c.Report != nil {
+		rpt = &Report{Alerter: ga}
+		if c.Report.Schedule == "" {
+			errs = append(errs, fmt.Errorf("report schedule: %w", ErrMissingField))
+		} else if wt, err := weekly.Parse(c.Report.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("report schedule: %v", err))
+		} else {
+			var jitter time.Duration
+			rpt.Spec = weekly.TickSpecification{Start: wt, End: wt, Frequency: 7 * 24 * time.Hour, Jitter: &jitter}
+		}
+		if c.Report.AlertCommand != "" {
+			var err error
+			if rpt.Alerter, err = alert.NewCommand(c.Report.AlertCommand); err != nil {
+				errs = append(errs, fmt.Errorf("report alert_command: %v", err))
+			}
+		} else if c.AlertCommand == "" {
+			errs = append(errs, fmt.Errorf("report alert_command: %w", errNoDefault))
+		}
+		if len(errs) > 0 && o.StopAtFirstError {
+			return nil, errs[0]
+		}
+	}
+	if len(c.Include) > 0 {
+		errs = append(errs, errors.New("include: only supported when parsing files, e.g. by ParseFile"))
+		if o.StopAtFirstError {
+			return nil, errs[0]
+		}
+	}
+	schedules := make(map[string]*pb.Schedule, len(c.Schedule))
+	for i, ns := range c.Schedule {
+		var err error
+		switch {
+		case ns.Name == "":
+			err = fmt.Errorf("schedule at index %d name: %w", i, ErrMissingField)
+		case len(ns.CheckSpec) == 0:
+			err = fmt.Errorf("schedule %q check_spec: %w", ns.Name, ErrMissingField)
+		default:
+			if _, ok := schedules[ns.Name]; ok {
+				err = fmt.Errorf("duplicate schedule name %q", ns.Name)
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if o.StopAtFirstError {
+				return nil, errs[0]
+			}
+			continue
+		}
+		schedules[ns.Name] = ns
+	}
 	for i, f := range c.Feed {
-		if f.Name == "" {
-			return nil, fmt.Errorf("feed at index %d has no name", i)
+		var file string
+		if files != nil {
+			file = files[i]
+		}
+		var ferrs Errors
+		fwarn := func(field string, err error) {
+			warnings = append(warnings, &FeedError{File: file, FeedName: f.Name, FeedIndex: i, Field: field, Index: -1, Err: err})
+		}
+		ferr := func(field string, err error) {
+			ferrs = append(ferrs, &FeedError{File: file, FeedName: f.Name, FeedIndex: i, Field: field, Index: -1, Err: err})
 		}
-		if _, ok := names[f.Name]; ok {
-			return nil, fmt.Errorf("duplicate feed name %q", f.Name)
+		ferrAt := func(field string, idx int, err error) {
+			ferrs = append(ferrs, &FeedError{File: file, FeedName: f.Name, FeedIndex: i, Field: field, Index: idx, Err: err})
+		}
+
+		if f.Name == "" {
+			ferr("name", ErrMissingField)
+		} else if j, ok := names[f.Name]; !ok {
+			names[f.Name] = i
+		} else if files != nil {
+			ferr("name", fmt.Errorf("duplicate feed name (also specified in %s)", files[j]))
+		} else {
+			ferr("name", errors.New("duplicate feed name"))
 		}
-		names[f.Name] = struct{}{}
 
 		if f.Url == "" {
-			return nil, fmt.Errorf("feed %q has no URL", f.Name)
+			ferr("url", ErrMissingField)
 		}
 
 		dd := defaultString(f.DownloadDir, c.DownloadDir)
 		if dd == "" {
-			return nil, fmt.Errorf("feed %q has no download_dir and no default specified", f.Name)
+			ferr("download_dir", errNoDefault)
+		}
+		if f.StagingDir != "" && filepath.Clean(f.StagingDir) == filepath.Clean(dd) {
+			ferr("staging_dir", errors.New("same as download_dir"))
+		}
+
+		// Title regexes are compiled with the feed's flags prefixed.
+		var flags string
+		for _, fl := range []struct {
+			set  bool
+			flag string
+		}{
+			{f.OrderRegexCaseInsensitive, "i"},
+			{f.OrderRegexMultiLine, "m"},
+			{f.OrderRegexDotAll, "s"},
+		} {
+			if fl.set {
+				flags += fl.flag
+			}
+		}
+		compileTitle := func(field, expr string) (*regexp.Regexp, error) {
+			if flags == "" {
+				return regexp.Compile(expr)
+			}
+			eff := "(?" + flags + ")" + expr
+			r, err := regexp.Compile(eff)
+			if err != nil {
+				return nil, fmt.Errorf("effective pattern %q: %v", eff, err)
+			}
+			for _, fl := range clearedFlags(expr, flags) {
+				fwarn(field, fmt.Errorf("inline flags clear %s", regexFlagOptions[fl]))
+			}
+			return r, nil
 		}
 
+		var re *regexp.Regexp
 		reStr := defaultString(f.OrderRegex, c.OrderRegex)
+		if f.Mirror {
+			// Mirrored feeds have no order, so the default order regex does
+			// not apply; a feed-specific one only breaks ties between items.
+			reStr = f.OrderRegex
+		}
 		if reStr == "" {
-			return nil, fmt.Errorf("feed %q has no order_regex and no default specified", f.Name)
+			if !f.Mirror {
+				ferr("order_regex", errNoDefault)
+			}
+		} else if r, err := compileTitle("order_regex", reStr); err != nil {
+			ferr("order_regex", err)
+		} else if r.NumSubexp() == 0 {
+			ferr("order_regex", fmt.Errorf("has %d capture groups, expected at least 1", r.NumSubexp()))
+		} else {
+			if !f.Mirror && r.NumSubexp() == 1 && captureMatchesEmpty(r) {
+				fwarn("order_regex", errors.New("capture group can match the empty string; items with an empty order are skipped"))
+			}
+			re = r
+		}
+
+		var labelRE *regexp.Regexp
+		if f.LabelRegex != "" {
+			if r, err := compileTitle("label_regex", f.LabelRegex); err != nil {
+				ferr("label_regex", err)
+			} else if r.NumSubexp() != 1 {
+				ferr("label_regex", fmt.Errorf("has %d capture groups, expected 1", r.NumSubexp()))
+			} else {
+				labelRE = r
+			}
+		}
+
+		var ctRE *regexp.Regexp
+		if f.ContentTypeRegex != "" {
+			r, err := regexp.Compile(f.ContentTypeRegex)
+			if err != nil {
+				ferr("content_type_regex", err)
+			}
+			ctRE = r
+		}
+
+		var repackRE *regexp.Regexp
+		switch {
+		case f.DownloadRepacks && f.RepackRegex != "":
+			r, err := compileTitle("repack_regex", f.RepackRegex)
+			if err != nil {
+				ferr("repack_regex", err)
+			}
+			repackRE = r
+		case f.DownloadRepacks:
+			repackRE = regexp.MustCompile(DefaultRepackRegex)
+		case f.RepackRegex != "":
+			ferr("repack_regex", errors.New("specified without download_repacks"))
+		}
+
+		var maxDLs int
+		if f.DownloadNewestFirst {
+			maxDLs = int(defaultUint32(f.MaxConcurrentDownloads, DefaultMaxConcurrentDownloads))
+		} else if f.MaxConcurrentDownloads != 0 {
+			ferr("max_concurrent_downloads", errors.New("specified without download_newest_first"))
+		}
+
+		orderMin, orderMax, orderStart := f.OrderMin, f.OrderMax, f.OrderStart
+		if re != nil && re.NumSubexp() > 1 {
+			// Bounds on composite orders are given as space-separated fields.
+			for _, b := range []struct {
+				field string
+				order *string
+			}{{"order_min", &orderMin}, {"order_max", &orderMax}, {"order_start", &orderStart}} {
+				if *b.order == "" {
+					continue
+				}
+				fields := strings.Fields(*b.order)
+				if len(fields) != re.NumSubexp() {
+					ferr(b.field, fmt.Errorf("has %d fields, expected %d (one per order_regex capture group)", len(fields), re.NumSubexp()))
+					continue
+				}
+				*b.order = compositeOrder(fields)
+			}
+		}
+		if orderMin != "" && orderMax != "" && orderMax < orderMin {
+			ferr("order_max", errors.New("before order_min"))
+		}
+		if f.DisableAfterMax && f.OrderMax == "" {
+			ferr("disable_after_max", errors.New("specified without order_max"))
+		}
+		if f.Mirror {
+			if f.OrderMin != "" {
+				ferr("order_min", errors.New("specified with mirror"))
+			}
+			if f.OrderMax != "" {
+				ferr("order_max", errors.New("specified with mirror"))
+			}
+			if f.OrderStart != "" {
+				ferr("order_start", errors.New("specified with mirror"))
+			}
+			if f.DownloadRepacks {
+				ferr("download_repacks", errors.New("specified with mirror"))
+			}
+			if f.LatestOnly {
+				ferr("latest_only", errors.New("specified with mirror"))
+			}
+		}
+		if f.LatestOnly && f.DownloadNewestFirst {
+			ferr("latest_only", errors.New("specified along with download_newest_first"))
+		}
+		var sie SkipIfExists
+		switch f.SkipIfExists {
+		case pb.Feed_NEVER:
+			sie = NEVER
+		case pb.Feed_SIZE:
+			sie = SIZE
+		case pb.Feed_ETAG:
+			sie = ETAG
+		default:
+			ferr("skip_if_exists", fmt.Errorf("unknown value %v", f.SkipIfExists))
+		}
+		var ff FilenameFallback
+		switch f.FilenameFallback {
+		case pb.Feed_ERROR:
+			ff = ERROR
+		case pb.Feed_TITLE:
+			ff = TITLE
+		default:
+			ferr("filename_fallback", fmt.Errorf("unknown value %v", f.FilenameFallback))
+		}
+		var regression OrderRegression
+		switch f.OrderRegression {
+		case pb.Feed_SKIP_AND_WARN:
+			regression = SKIP_AND_WARN
+		case pb.Feed_RESET_ORDER:
+			regression = RESET_ORDER
+			if f.Mirror {
+				ferr("order_regression", errors.New("specified with mirror"))
+			}
+		default:
+			ferr("order_regression", fmt.Errorf("unknown value %v", f.OrderRegression))
+		}
+		if f.FtpPassword != "" && f.FtpUser == "" {
+			ferr("ftp_password", errors.New("specified without ftp_user"))
+		}
+		var hdrs http.Header
+		for i, h := range f.Header {
+			if h.Name == "" || strings.ContainsAny(h.Name, ": \t\r\n") {
+				ferrAt("header", i, fmt.Errorf("bad name %q", h.Name))
+				continue
+			}
+			if strings.ContainsAny(h.Value, "\r\n") {
+				ferrAt("header", i, errors.New("value contains a newline"))
+				continue
+			}
+			if hdrs == nil {
+				hdrs = http.Header{}
+			}
+			hdrs.Add(h.Name, h.Value)
+		}
+		if len(f.RedirectHeaderHost) > 0 && len(f.Header) == 0 {
+			ferr("redirect_header_host", errors.New("specified without header"))
+		}
+		for i, l := range f.DateLayout {
+			if l == "" {
+				ferrAt("date_layout", i, errors.New("empty layout"))
+			}
+		}
+		for i, p := range f.SecretQueryParam {
+			if p == "" || strings.ContainsAny(p, "?&=#") {
+				ferrAt("secret_query_param", i, fmt.Errorf("bad name %q", p))
+			}
+		}
+		for i, h := range f.AllowedDownloadHost {
+			if h == "" || strings.ContainsAny(h, "/?#@ ") {
+				ferrAt("allowed_download_host", i, fmt.Errorf("bad host %q", h))
+			}
+		}
+		var efs []ExtensionFilter
+		for i, ief := range f.ItemExtensionFilter {
+			prefix, name, ok := cutPath(ief.Path)
+			if !ok {
+				ferrAt("item_extension_filter", i, fmt.Errorf("bad path %q (want \"prefix:name\")", ief.Path))
+				continue
+			}
+			ef := ExtensionFilter{Prefix: prefix, Name: name}
+			switch m := ief.Match.(type) {
+			case *pb.ItemExtensionFilter_MinInt:
+				ef.MinInt = &m.MinInt
+			case *pb.ItemExtensionFilter_MaxInt:
+				ef.MaxInt = &m.MaxInt
+			case *pb.ItemExtensionFilter_Regex:
+				re, err := regexp.Compile(m.Regex)
+				if err != nil {
+					ferrAt("item_extension_filter", i, fmt.Errorf("error parsing regex: %v", err))
+					continue
+				}
+				ef.Regexp = re
+			default:
+				ferrAt("item_extension_filter", i, fmt.Errorf("no min_int, max_int, or regex: %w", ErrMissingField))
+				continue
+			}
+			efs = append(efs, ef)
+		}
+		if f.HardlinkDuplicates && !f.DedupeByHash {
+			ferr("hardlink_duplicates", errors.New("specified without dedupe_by_hash"))
+		}
+		if f.DisableGlobalDedupe && !c.GlobalDedupe {
+			ferr("disable_global_dedupe", errors.New("specified without global_dedupe"))
 		}
-		re, err := regexp.Compile(reStr)
+
+		var sd []DateRange
+		for i, d := range f.SkipDate {
+			if _, err := time.Parse(dateLayout, d); err != nil {
+				ferrAt("skip_date", i, err)
+				continue
+			}
+			sd = append(sd, DateRange{From: d, To: d})
+		}
+		for i, r := range f.SkipRange {
+			if _, err := time.Parse(dateLayout, r.From); err != nil {
+				ferrAt("skip_range", i, fmt.Errorf("error parsing from: %v", err))
+			} else if _, err := time.Parse(dateLayout, r.To); err != nil {
+				ferrAt("skip_range", i, fmt.Errorf("error parsing to: %v", err))
+			} else if r.To < r.From {
+				ferrAt("skip_range", i, errors.New("to before from"))
+			} else {
+				sd = append(sd, DateRange{From: r.From, To: r.To})
+			}
+		}
+
+		mia := time.Duration(f.MaxItemAgeS) * time.Second
+		if f.MaxItemAge != "" {
+			if f.MaxItemAgeS != 0 {
+				ferr("max_item_age", errors.New("specified along with max_item_age_s"))
+			} else if d, err := time.ParseDuration(f.MaxItemAge); err != nil {
+				ferr("max_item_age", err)
+			} else if d < 0 {
+				ferr("max_item_age", errors.New("negative"))
+			} else {
+				mia = d
+			}
+		}
+
+		var mdi time.Duration
+		if f.MinDownloadInterval != "" {
+			if d, err := time.ParseDuration(f.MinDownloadInterval); err != nil {
+				ferr("min_download_interval", err)
+			} else if d < 0 {
+				ferr("min_download_interval", errors.New("negative"))
+			} else {
+				mdi = d
+			}
+		}
+
+		tc, err := tlsConfig(f)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing order_regex for feed %q: %v", f.Name, err)
+			ferr("", fmt.Errorf("bad TLS configuration: %v", err))
+		}
+		var tfs TLSFiles
+		if tc != nil {
+			tfs = TLSFiles{ClientCert: f.ClientCertFile, ClientKey: f.ClientKeyFile, CA: f.CaFile}
 		}
-		if re.NumSubexp() != 1 {
-			return nil, fmt.Errorf("order regex for feed %q has %d capture groups, expected 1", f.Name, re.NumSubexp())
+
+		var mp int
+		if f.FollowPagination {
+			mp = int(defaultUint32(f.MaxPages, defaultMaxPages))
+		} else if f.MaxPages != 0 {
+			ferr("max_pages", errors.New("specified without follow_pagination"))
 		}
 
 		var a alert.Alerter
 		if ac := defaultString(f.AlertCommand, c.AlertCommand); ac != "" {
-			a = alert.NewCommand(ac)
+			if a, err = alert.NewCommand(ac); err != nil {
+				ferr("alert_command", err)
+			}
+		} else if f.ItemJsonStdin {
+			ferr("item_json_stdin", errors.New("specified without alert_command"))
 		}
 
-		cs := f.CheckSpec
-		if len(cs) == 0 {
-			cs = c.CheckSpec
-		}
-		if len(cs) == 0 {
-			return nil, fmt.Errorf("feed %q has no check_spec and no default specified", f.Name)
+		var sched *cron.Schedule
+		var cs []*pb.CheckSpecification
+		csErr := func(i int, err error) { ferrAt("check_spec", i, err) }
+		switch {
+		case f.CheckCron != "":
+			if len(f.CheckSpec) != 0 {
+				ferr("check_cron", errors.New("specified along with check_spec"))
+			} else if f.CheckSpecRef != "" {
+				ferr("check_cron", errors.New("specified along with check_spec_ref"))
+			} else if f.CheckOnStart {
+				ferr("check_on_start", errors.New("specified along with check_cron"))
+			} else if sched, err = cron.Parse(f.CheckCron); err != nil {
+				ferr("check_cron", err)
+			}
+		case f.CheckSpecRef != "":
+			ns, ok := schedules[f.CheckSpecRef]
+			switch {
+			case len(f.CheckSpec) != 0:
+				ferr("check_spec_ref", errors.New("specified along with check_spec"))
+			case !ok:
+				ferr("check_spec_ref", fmt.Errorf("no schedule named %q", f.CheckSpecRef))
+			default:
+				cs = ns.CheckSpec
+				csErr = func(i int, err error) {
+					ferr("check_spec_ref", fmt.Errorf("schedule %q check_spec[%d]: %v", ns.Name, i, err))
+				}
+			}
+		default:
+			cs = f.CheckSpec
+			if len(cs) == 0 {
+				cs = c.CheckSpec
+			}
+			if len(cs) == 0 {
+				ferr("check_spec", errNoDefault)
+			}
 		}
-		ts := make([]weekly.TickSpecification, 0, len(cs))
+		var ts []weekly.TickSpecification
 		for i, cs := range cs {
 			if cs.Start == "" {
-				return nil, fmt.Errorf("feed %q check_spec[%d] has no start", f.Name, i)
+				csErr(i, errors.New("has no start"))
+				continue
 			}
 			start, err := weekly.Parse(cs.Start)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing start for feed %q check_spec[%d]: %v", f.Name, i, err)
+				csErr(i, fmt.Errorf("error parsing start: %v", err))
+				continue
 			}
 
 			if cs.End == "" {
-				return nil, fmt.Errorf("feed %q check_spec[%d] has no end", f.Name, i)
+				csErr(i, errors.New("has no end"))
+				continue
 			}
 			end, err := weekly.Parse(cs.End)
 			if err != nil {
-				return nil, fmt.Errorf("error parsing end for feed %q check_spec[%d]: %v", f.Name, i, err)
+				csErr(i, fmt.Errorf("error parsing end: %v", err))
+				continue
 			}
 
 			if end.Before(start) {
-				return nil, fmt.Errorf("feed %q check_spec[%d] has end before start", f.Name, i)
+				csErr(i, errors.New("has end before start"))
+				continue
 			}
 
 			if cs.FreqS == 0 {
-				return nil, fmt.Errorf("feed %q check_spec[%d] has missing or zero freq_s", f.Name, i)
+				csErr(i, errors.New("has missing or zero freq_s"))
+				continue
 			}
 			freq := time.Duration(cs.FreqS) * time.Second
 			ts = append(ts, weekly.TickSpecification{
@@ -107,17 +1252,630 @@ func Parse(cfg string) ([]*Feed, error) {
 				Frequency: freq,
 			})
 		}
+		if f.CheckJitter != "" {
+			if f.CheckCron != "" {
+				ferr("check_jitter", errors.New("specified along with check_cron"))
+			} else if d, err := time.ParseDuration(f.CheckJitter); err != nil {
+				ferr("check_jitter", err)
+			} else if d < 0 {
+				ferr("check_jitter", errors.New("negative"))
+			} else {
+				for i := range ts {
+					if d > ts[i].Frequency {
+						ferr("check_jitter", fmt.Errorf("greater than check frequency %v", ts[i].Frequency))
+						break
+					}
+					ts[i].Jitter = &d
+				}
+			}
+		}
 
+		if len(ferrs) > 0 {
+			if o.StopAtFirstError {
+				return nil, ferrs[0]
+			}
+			errs = append(errs, ferrs...)
+			continue
+		}
 		feeds = append(feeds, &Feed{
-			Name:        f.Name,
-			URL:         f.Url,
-			DownloadDir: dd,
-			OrderRegexp: re,
-			CheckSpecs:  ts,
-			Alerter:     a,
+			Name:                 f.Name,
+			URL:                  f.Url,
+			DownloadDir:          dd,
+			OrderRegexp:          re,
+			LabelRegexp:          labelRE,
+			CheckSpecs:           ts,
+			CheckCron:            sched,
+			Alerter:              a,
+			LenientParse:         f.LenientParse,
+			MaxPages:             mp,
+			MaxItemAge:           mia,
+			OrderMin:             orderMin,
+			OrderMax:             orderMax,
+			OrderStart:           orderStart,
+			DisableAfterMax:      f.DisableAfterMax,
+			SkipDates:            sd,
+			ParseRetries:         int(defaultUint32(f.ParseRetries, c.ParseRetries)),
+			TLSConfig:            tc,
+			TLSFiles:             tfs,
+			MaxFeedSize:          int64(defaultUint32(f.MaxFeedSizeBytes, c.MaxFeedSizeBytes)),
+			FetchTimeout:         time.Duration(defaultUint32(f.FetchTimeoutS, c.FetchTimeoutS)) * time.Second,
+			ContentTypeRegexp:    ctRE,
+			AlertRetries:         int(defaultUint32(f.AlertRetries, c.AlertRetries)),
+			AlertRetryBackoff:    time.Duration(defaultUint32(f.AlertRetryBackoffS, c.AlertRetryBackoffS)) * time.Second,
+			AlertTimeout:         time.Duration(defaultUint32(f.AlertTimeoutS, c.AlertTimeoutS)) * time.Second,
+			GlobalDedupe:         c.GlobalDedupe && !f.DisableGlobalDedupe,
+			SkipIfExists:         sie,
+			DownloadStallTimeout: time.Duration(defaultUint32(f.DownloadStallTimeoutS, c.DownloadStallTimeoutS)) * time.Second,
+			CheckOnStart:         f.CheckOnStart,
+			CheckOnStartAlways:   f.CheckOnStartAlways,
+			StaleAfter:           time.Duration(f.StaleAfterS) * time.Second,
+			DedupeByHash:         f.DedupeByHash,
+			HardlinkDuplicates:   f.HardlinkDuplicates,
+			FilenameFallback:     ff,
+			Headers:              hdrs,
+			RedirectHeaderHosts:  f.RedirectHeaderHost,
+			MaxRedirects:         int(f.MaxRedirects),
+			KeepLastN:            int(f.KeepLastN),
+			SecretQueryParams:    f.SecretQueryParam,
+			DateLayouts:          f.DateLayout,
+			Mirror:               f.Mirror,
+			StagingDir:           f.StagingDir,
+			MaxStartupDelay:      time.Duration(defaultUint32(f.MaxStartupDelayS, c.MaxStartupDelayS)) * time.Second,
+			WriteMetadata:        f.WriteMetadata,
+			AllowedDownloadHosts: f.AllowedDownloadHost,
+			DenyPrivateDownloads: f.DenyPrivateDownloads,
+			RawTransfer:          f.RawTransfer,
+			MinDownloadInterval:  mdi,
+			MaxGoneChecks:        int(f.MaxGoneChecks),
+			StopOnGone:           f.StopOnGone,
+			TorrentWatchDir:      f.TorrentWatchDir,
+			LinkIndex:            f.LinkIndex,
+			RepackRegexp:         repackRE,
+			NewestFirst:          f.DownloadNewestFirst,
+			MaxDownloads:         maxDLs,
+			ItemJSONStdin:        f.ItemJsonStdin,
+			LatestOnly:           f.LatestOnly,
+			OrderRegression:      regression,
+			FTPUser:              f.FtpUser,
+			FTPPassword:          f.FtpPassword,
+			ExtensionFilters:     efs,
 		})
 	}
-	return feeds, nil
+
+	switch len(errs) {
+	case 0:
+		return &Config{
+			Feeds:                   feeds,
+			Alerter:                 ga,
+			AlertRetries:            int(c.AlertRetries),
+			AlertRetryBackoff:       time.Duration(c.AlertRetryBackoffS) * time.Second,
+			AlertTimeout:            time.Duration(c.AlertTimeoutS) * time.Second,
+			AlertRateLimit:          int(c.AlertRateLimit),
+			AlertRateLimitPeriod:    time.Duration(c.AlertRateLimitPeriodS) * time.Second,
+			MaxConcurrentChecks:     int(c.MaxConcurrentChecks),
+			MaxConcurrentFeedChecks: int(c.MaxConcurrentFeedChecks),
+			MinHostInterval:         mhi,
+			Report:                  rpt,
+			Warnings:                warnings,
+		}, nil
+	case 1:
+		return nil, errs[0]
+	default:
+		return nil, errs
+	}
+}
+
+// Order returns the order of an item with the given title, as captured by the
+// feed's OrderRegexp, which must be non-nil; ok is false if the title does not
+// match. If OrderRegexp has multiple capture groups, the order is a composite
+// of the captured fields, as built by compositeOrder.
+func (f *Feed) Order(title string) (order string, ok bool) {
+	m := f.OrderRegexp.FindStringSubmatch(title)
+	switch len(m) {
+	case 0:
+		return "", false
+	case 2:
+		return m[1], true
+	default:
+		return compositeOrder(m[1:]), true
+	}
+}
+
+// orderFieldWidth is the width to which numeric fields of composite orders are
+// zero-padded.
+const orderFieldWidth = 10
+
+// compositeOrder combines the given fields into a single order, which compares
+// as the fields do in turn, provided that they contain no spaces: fields
+// consisting only of digits are zero-padded so that they compare numerically,
+// and fields are separated by spaces. If every field is empty, so is the
+// order.
+func compositeOrder(fields []string) string {
+	empty := true
+	padded := make([]string, len(fields))
+	for i, fld := range fields {
+		if fld != "" {
+			empty = false
+			if len(fld) < orderFieldWidth && strings.Trim(fld, "0123456789") == "" {
+				fld = strings.Repeat("0", orderFieldWidth-len(fld)) + fld
+			}
+		}
+		padded[i] = fld
+	}
+	if empty {
+		return ""
+	}
+	return strings.Join(padded, " ")
+}
+
+// regexFlagOptions names the options setting each flag applied to title
+// regexes.
+var regexFlagOptions = map[rune]string{
+	'i': "order_regex_case_insensitive",
+	'm': "order_regex_multi_line",
+	's': "order_regex_dot_all",
+}
+
+// clearedFlags returns those of the given flags (e.g. "is") which are cleared
+// by an inline flag group of the given regex, e.g. "(?-i)" or "(?m-is:...)".
+func clearedFlags(expr, flags string) string {
+	var cleared string
+	for i := 0; i < len(expr); i++ {
+		if expr[i] == '\\' {
+			i++
+			continue
+		}
+		if !strings.HasPrefix(expr[i:], "(?") {
+			continue
+		}
+		j := i + 2
+		for j < len(expr) && strings.IndexByte("imsU-", expr[j]) >= 0 {
+			j++
+		}
+		if j == len(expr) || (expr[j] != ')' && expr[j] != ':') {
+			continue
+		}
+		if k := strings.IndexByte(expr[i+2:j], '-'); k >= 0 {
+			for _, fl := range expr[i+2+k+1 : j] {
+				if strings.ContainsRune(flags, fl) && !strings.ContainsRune(cleared, fl) {
+					cleared += string(fl)
+				}
+			}
+		}
+	}
+	return cleared
+}
+
+// captureMatchesEmpty determines if the first capture group of the given
+// regexp can match the empty string.
+func captureMatchesEmpty(re *regexp.Regexp) bool {
+	sre, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return false
+	}
+	var find func(*syntax.Regexp) *syntax.Regexp
+	find = func(r *syntax.Regexp) *syntax.Regexp {
+		if r.Op == syntax.OpCapture && r.Cap == 1 {
+			return r
+		}
+		for _, sub := range r.Sub {
+			if c := find(sub); c != nil {
+				return c
+			}
+		}
+		return nil
+	}
+	c := find(sre)
+	return c != nil && matchesEmpty(c)
+}
+
+// matchesEmpty determines if the given regexp can match the empty string.
+// Assertions, such as ^ and \b, are assumed to be satisfiable.
+func matchesEmpty(r *syntax.Regexp) bool {
+	switch r.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary, syntax.OpStar, syntax.OpQuest:
+		return true
+	case syntax.OpLiteral:
+		return len(r.Rune) == 0
+	case syntax.OpCapture, syntax.OpPlus:
+		return matchesEmpty(r.Sub[0])
+	case syntax.OpRepeat:
+		return r.Min == 0 || matchesEmpty(r.Sub[0])
+	case syntax.OpConcat:
+		for _, sub := range r.Sub {
+			if !matchesEmpty(sub) {
+				return false
+			}
+		}
+		return true
+	case syntax.OpAlternate:
+		for _, sub := range r.Sub {
+			if matchesEmpty(sub) {
+				return true
+			}
+		}
+		return false
+	default:
+		// OpNoMatch, OpCharClass, OpAnyChar, and OpAnyCharNotNL each match
+		// exactly one character, if any.
+		return false
+	}
+}
+
+// Marshal serializes feeds into a configuration in protocol buffer text
+// format, which can be parsed with Parse. Each feed's settings are written out
+// in full, rather than relying on defaults.
+func Marshal(feeds []*Feed) (string, error) {
+	c, err := marshalFeeds(feeds)
+	if err != nil {
+		return "", err
+	}
+	return format(c), nil
+}
+
+// MarshalConfig serializes a configuration into protocol buffer text format,
+// which can be parsed with ParseConfig, as Marshal does. Settings of the
+// configuration as a whole, such as its alert command, are included.
+//
+// The output is canonical: configurations which parse to equivalent Configs
+// are serialized identically, so that the output may be diffed.
+func MarshalConfig(cfg *Config) (string, error) {
+	c, err := marshalFeeds(cfg.Feeds)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Alerter != nil {
+		ac, ok := alert.Command(cfg.Alerter)
+		if !ok {
+			return "", errors.New("config has an alerter that cannot be represented in a config")
+		}
+		c.AlertCommand = ac
+	}
+	c.AlertRetries = uint32(cfg.AlertRetries)
+	if c.AlertRetryBackoffS, err = seconds(cfg.AlertRetryBackoff); err != nil {
+		return "", fmt.Errorf("config has bad alert retry backoff: %v", err)
+	}
+	if c.AlertTimeoutS, err = seconds(cfg.AlertTimeout); err != nil {
+		return "", fmt.Errorf("config has bad alert timeout: %v", err)
+	}
+	c.AlertRateLimit = uint32(cfg.AlertRateLimit)
+	if c.AlertRateLimitPeriodS, err = seconds(cfg.AlertRateLimitPeriod); err != nil {
+		return "", fmt.Errorf("config has bad alert rate limit period: %v", err)
+	}
+	c.MaxConcurrentChecks = uint32(cfg.MaxConcurrentChecks)
+	c.MaxConcurrentFeedChecks = uint32(cfg.MaxConcurrentFeedChecks)
+	if cfg.MinHostInterval != 0 {
+		c.MinHostInterval = cfg.MinHostInterval.String()
+	}
+	if cfg.Report != nil {
+		ac, ok := alert.Command(cfg.Report.Alerter)
+		if !ok {
+			return "", errors.New("config has a report alerter that cannot be represented in a config")
+		}
+		c.Report = &pb.Report{Schedule: cfg.Report.Spec.Start.String(), AlertCommand: ac}
+	}
+	return format(c), nil
+}
+
+// format serializes c in multiline protocol buffer text format. The
+// serialization is stable: the protobuf library deliberately varies the
+// spacing after field names between builds, which format removes.
+func format(c *pb.Config) string {
+	return unstableSpaceRE.ReplaceAllString(prototext.MarshalOptions{Multiline: true}.Format(c), "$1: ")
+}
+
+var unstableSpaceRE = regexp.MustCompile(`(?m)^(\s*\w+): +`)
+
+// marshalFeeds converts feeds into a configuration, as Marshal serializes.
+func marshalFeeds(feeds []*Feed) (*pb.Config, error) {
+	c := &pb.Config{}
+	for _, f := range feeds {
+		if f.GlobalDedupe {
+			c.GlobalDedupe = true
+		}
+	}
+	for _, f := range feeds {
+		pf := &pb.Feed{
+			Name:                f.Name,
+			Url:                 f.URL,
+			DownloadDir:         f.DownloadDir,
+			LenientParse:        f.LenientParse,
+			OrderMin:            f.OrderMin,
+			OrderMax:            f.OrderMax,
+			OrderStart:          f.OrderStart,
+			DisableAfterMax:     f.DisableAfterMax,
+			DisableGlobalDedupe: c.GlobalDedupe && !f.GlobalDedupe,
+			CheckOnStart:        f.CheckOnStart,
+			CheckOnStartAlways:  f.CheckOnStartAlways,
+			DedupeByHash:        f.DedupeByHash,
+			HardlinkDuplicates:  f.HardlinkDuplicates,
+			RedirectHeaderHost:  f.RedirectHeaderHosts,
+			MaxRedirects:        uint32(f.MaxRedirects),
+			KeepLastN:           uint32(f.KeepLastN),
+			SecretQueryParam:    f.SecretQueryParams,
+			DateLayout:          f.DateLayouts,
+			Mirror:              f.Mirror,
+			StagingDir:          f.StagingDir,
+			WriteMetadata:       f.WriteMetadata,
+			AllowedDownloadHost: f.AllowedDownloadHosts,
+		}
+		pf.DenyPrivateDownloads = f.DenyPrivateDownloads
+		pf.RawTransfer = f.RawTransfer
+		if f.MinDownloadInterval != 0 {
+			pf.MinDownloadInterval = f.MinDownloadInterval.String()
+		}
+		pf.MaxGoneChecks = uint32(f.MaxGoneChecks)
+		pf.StopOnGone = f.StopOnGone
+		pf.TorrentWatchDir = f.TorrentWatchDir
+		pf.LinkIndex = f.LinkIndex
+		if f.RepackRegexp != nil {
+			pf.DownloadRepacks = true
+			pf.RepackRegex = f.RepackRegexp.String()
+		}
+		pf.DownloadNewestFirst = f.NewestFirst
+		pf.MaxConcurrentDownloads = uint32(f.MaxDownloads)
+		pf.ItemJsonStdin = f.ItemJSONStdin
+		pf.LatestOnly = f.LatestOnly
+		switch f.OrderRegression {
+		case SKIP_AND_WARN:
+			pf.OrderRegression = pb.Feed_SKIP_AND_WARN
+		case RESET_ORDER:
+			pf.OrderRegression = pb.Feed_RESET_ORDER
+		default:
+			return nil, fmt.Errorf("feed %q has bad order_regression %v", f.Name, f.OrderRegression)
+		}
+		pf.FtpUser = f.FTPUser
+		pf.FtpPassword = f.FTPPassword
+		names := make([]string, 0, len(f.Headers))
+		for n := range f.Headers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			for _, v := range f.Headers[n] {
+				pf.Header = append(pf.Header, &pb.Header{Name: n, Value: v})
+			}
+		}
+		switch f.SkipIfExists {
+		case NEVER:
+			pf.SkipIfExists = pb.Feed_NEVER
+		case SIZE:
+			pf.SkipIfExists = pb.Feed_SIZE
+		case ETAG:
+			pf.SkipIfExists = pb.Feed_ETAG
+		default:
+			return nil, fmt.Errorf("feed %q has bad skip_if_exists %v", f.Name, f.SkipIfExists)
+		}
+		switch f.FilenameFallback {
+		case ERROR:
+			pf.FilenameFallback = pb.Feed_ERROR
+		case TITLE:
+			pf.FilenameFallback = pb.Feed_TITLE
+		default:
+			return nil, fmt.Errorf("feed %q has bad filename_fallback %v", f.Name, f.FilenameFallback)
+		}
+		if f.OrderRegexp != nil {
+			pf.OrderRegex = f.OrderRegexp.String()
+		}
+		if f.LabelRegexp != nil {
+			pf.LabelRegex = f.LabelRegexp.String()
+		}
+		if f.ContentTypeRegexp != nil {
+			pf.ContentTypeRegex = f.ContentTypeRegexp.String()
+		}
+		if f.CheckCron != nil {
+			pf.CheckCron = f.CheckCron.String()
+		}
+		for i, ts := range f.CheckSpecs {
+			freqS, err := seconds(ts.Frequency)
+			if err != nil {
+				return nil, fmt.Errorf("feed %q check_spec[%d] has bad frequency: %v", f.Name, i, err)
+			}
+			pf.CheckSpec = append(pf.CheckSpec, &pb.CheckSpecification{
+				Start: ts.Start.String(),
+				End:   ts.End.String(),
+				FreqS: freqS,
+			})
+			var jitter string
+			if ts.Jitter != nil {
+				jitter = ts.Jitter.String()
+			}
+			if i > 0 && jitter != pf.CheckJitter {
+				return nil, fmt.Errorf("feed %q check_spec[%d] has jitter differing from check_spec[0]", f.Name, i)
+			}
+			pf.CheckJitter = jitter
+		}
+		if f.Alerter != nil {
+			ac, ok := alert.Command(f.Alerter)
+			if !ok {
+				return nil, fmt.Errorf("feed %q has an alerter that cannot be represented in a config", f.Name)
+			}
+			pf.AlertCommand = ac
+		}
+		if f.TLSConfig != nil {
+			if f.TLSFiles == (TLSFiles{}) {
+				return nil, fmt.Errorf("feed %q has a TLS configuration that cannot be represented in a config", f.Name)
+			}
+			pf.ClientCertFile, pf.ClientKeyFile, pf.CaFile = f.TLSFiles.ClientCert, f.TLSFiles.ClientKey, f.TLSFiles.CA
+		}
+		if f.MaxPages != 0 {
+			pf.FollowPagination = true
+			pf.MaxPages = uint32(f.MaxPages)
+		}
+		pf.ParseRetries = uint32(f.ParseRetries)
+		if f.MaxFeedSize < 0 || f.MaxFeedSize > math.MaxUint32 {
+			return nil, fmt.Errorf("feed %q has bad max feed size %d", f.Name, f.MaxFeedSize)
+		}
+		pf.MaxFeedSizeBytes = uint32(f.MaxFeedSize)
+		fetchTimeoutS, err := seconds(f.FetchTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad fetch timeout: %v", f.Name, err)
+		}
+		pf.FetchTimeoutS = fetchTimeoutS
+		downloadStallTimeoutS, err := seconds(f.DownloadStallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad download stall timeout: %v", f.Name, err)
+		}
+		pf.DownloadStallTimeoutS = downloadStallTimeoutS
+		staleAfterS, err := seconds(f.StaleAfter)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad stale after: %v", f.Name, err)
+		}
+		pf.StaleAfterS = staleAfterS
+		pf.AlertRetries = uint32(f.AlertRetries)
+		alertRetryBackoffS, err := seconds(f.AlertRetryBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad alert retry backoff: %v", f.Name, err)
+		}
+		pf.AlertRetryBackoffS = alertRetryBackoffS
+		alertTimeoutS, err := seconds(f.AlertTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad alert timeout: %v", f.Name, err)
+		}
+		pf.AlertTimeoutS = alertTimeoutS
+		maxStartupDelayS, err := seconds(f.MaxStartupDelay)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad max startup delay: %v", f.Name, err)
+		}
+		pf.MaxStartupDelayS = maxStartupDelayS
+		for _, ef := range f.ExtensionFilters {
+			if ef.MinInt != nil {
+				pf.ItemExtensionFilter = append(pf.ItemExtensionFilter, &pb.ItemExtensionFilter{Path: ef.Path(), Match: &pb.ItemExtensionFilter_MinInt{MinInt: *ef.MinInt}})
+			}
+			if ef.MaxInt != nil {
+				pf.ItemExtensionFilter = append(pf.ItemExtensionFilter, &pb.ItemExtensionFilter{Path: ef.Path(), Match: &pb.ItemExtensionFilter_MaxInt{MaxInt: *ef.MaxInt}})
+			}
+			if ef.Regexp != nil {
+				pf.ItemExtensionFilter = append(pf.ItemExtensionFilter, &pb.ItemExtensionFilter{Path: ef.Path(), Match: &pb.ItemExtensionFilter_Regex{Regex: ef.Regexp.String()}})
+			}
+		}
+		for _, r := range f.SkipDates {
+			if r.From == r.To {
+				pf.SkipDate = append(pf.SkipDate, r.From)
+			} else {
+				pf.SkipRange = append(pf.SkipRange, &pb.DateRange{From: r.From, To: r.To})
+			}
+		}
+		maxItemAgeS, err := seconds(f.MaxItemAge)
+		if err != nil {
+			return nil, fmt.Errorf("feed %q has bad max item age: %v", f.Name, err)
+		}
+		pf.MaxItemAgeS = maxItemAgeS
+		c.Feed = append(c.Feed, pf)
+	}
+	return c, nil
+}
+
+// tlsConfig creates a TLS configuration from a feed's client certificate & CA
+// settings. If none of these settings are specified, nil is returned.
+func tlsConfig(f *pb.Feed) (*tls.Config, error) {
+	if f.ClientCertFile == "" && f.ClientKeyFile == "" && f.CaFile == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	switch {
+	case f.ClientCertFile != "" && f.ClientKeyFile != "":
+		cert, err := tls.LoadX509KeyPair(f.ClientCertFile, f.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	case f.ClientCertFile != "":
+		return nil, errors.New("client_cert_file specified without client_key_file")
+	case f.ClientKeyFile != "":
+		return nil, errors.New("client_key_file specified without client_cert_file")
+	}
+	if f.CaFile != "" {
+		caPEM, err := ioutil.ReadFile(f.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("CA file contains no certificates")
+		}
+	}
+	return tc, nil
+}
+
+// cutPath splits an extension element's path, in the format "prefix:name",
+// into its prefix & name.
+func cutPath(path string) (prefix, name string, ok bool) {
+	i := strings.Index(path, ":")
+	if i < 0 || strings.ContainsAny(path, " \t\r\n") {
+		return "", "", false
+	}
+	prefix, name = path[:i], path[i+1:]
+	if prefix == "" || name == "" || strings.Contains(name, ":") {
+		return "", "", false
+	}
+	return prefix, name, true
+}
+
+// seconds converts a duration to a whole number of seconds, as used by the
+// configuration's "_s" fields.
+func seconds(d time.Duration) (uint32, error) {
+	if d < 0 || d%time.Second != 0 || d/time.Second > math.MaxUint32 {
+		return 0, fmt.Errorf("%v is not representable as a whole number of seconds", d)
+	}
+	return uint32(d / time.Second), nil
+}
+
+// unmarshalYAML parses a YAML configuration into c. The YAML is converted to
+// JSON, which is then parsed using the protobuf JSON mapping so that field
+// names match the protocol buffer definition.
+func (o ParseOptions) unmarshalYAML(cfg string, c *pb.Config) error {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(cfg), &v); err != nil {
+		return err
+	}
+	if v == nil {
+		// Empty document.
+		return nil
+	}
+	v, err := jsonCompatible(v)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: o.AllowUnknownFields}.Unmarshal(j, c)
+}
+
+// jsonCompatible converts a value decoded from YAML into a value that can be
+// encoded as JSON, by converting all maps to have string keys.
+func jsonCompatible(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			val, err := jsonCompatible(val)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = val
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			val, err := jsonCompatible(val)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = val
+		}
+		return s, nil
+	default:
+		return v, nil
+	}
 }
 
 func defaultString(val, defaultVal string) string {
@@ -1,11 +1,28 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/BranLwyd/rssdl/alert"
+	"github.com/BranLwyd/rssdl/cron"
 	"github.com/BranLwyd/rssdl/weekly"
 )
 
@@ -160,19 +177,43 @@ func TestParse(t *testing.T) {
 			},
 		},
 		{
-			desc:    "unparseable",
-			cfg:     `^#$mf90@#`,
-			wantErr: regexp.MustCompile("could not parse config"),
-		},
-		{
-			desc:    "no_feed",
-			cfg:     ``,
-			wantErr: regexp.MustCompile("config does not specify any feeds to watch"),
+			desc: "lenient_parse",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					lenient_parse: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					LenientParse: true,
+				},
+			},
 		},
 		{
-			desc: "no_name",
+			desc: "follow_pagination",
 			cfg: `
 				feed {
+					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
@@ -181,12 +222,55 @@ func TestParse(t *testing.T) {
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					follow_pagination: true
+				}
+				feed {
+					name: "other feed name"
+					url: "other feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					follow_pagination: true
+					max_pages: 3
 				}
 			`,
-			wantErr: regexp.MustCompile(`feed at index \d+ has no name`),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxPages: 10,
+				},
+				{
+					Name:        "other feed name",
+					URL:         "other feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxPages: 3,
+				},
+			},
 		},
 		{
-			desc: "duplicate_name",
+			desc: "max_item_age",
 			cfg: `
 				feed {
 					name: "feed name"
@@ -198,7 +282,29 @@ func TestParse(t *testing.T) {
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					max_item_age_s: 86400
 				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxItemAge: 24 * time.Hour,
+				},
+			},
+		},
+		{
+			desc: "max_item_age_duration",
+			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
@@ -209,15 +315,32 @@ func TestParse(t *testing.T) {
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					max_item_age: "168h"
 				}
 			`,
-			wantErr: regexp.MustCompile("duplicate feed name"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxItemAge: 168 * time.Hour,
+				},
+			},
 		},
 		{
-			desc: "no_url",
+			desc: "max_item_age_both_forms",
 			cfg: `
 				feed {
 					name: "feed name"
+					url: "feed url"
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
 					check_spec {
@@ -225,107 +348,185 @@ func TestParse(t *testing.T) {
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					max_item_age: "168h"
+					max_item_age_s: 86400
 				}
 			`,
-			wantErr: regexp.MustCompile("feed .* has no URL"),
+			wantErr: regexp.MustCompile("max_item_age: specified along with max_item_age_s"),
 		},
 		{
-			desc: "no_download_dir",
+			desc: "max_item_age_bad_duration",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
+					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					max_item_age: "a week"
 				}
 			`,
-			wantErr: regexp.MustCompile("has no download_dir"),
+			wantErr: regexp.MustCompile("max_item_age: time: invalid duration"),
 		},
 		{
-			desc: "no_order_regex",
+			desc: "headers",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					header {
+						name: "Authorization"
+						value: "Bearer token"
+					}
+					header {
+						name: "x-extra"
+						value: "one"
+					}
+					header {
+						name: "X-Extra"
+						value: "two"
+					}
+					redirect_header_host: "cdn.example.com"
+					max_redirects: 3
 				}
 			`,
-			wantErr: regexp.MustCompile("has no order_regex"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					Headers: http.Header{
+						"Authorization": {"Bearer token"},
+						"X-Extra":       {"one", "two"},
+					},
+					RedirectHeaderHosts: []string{"cdn.example.com"},
+					MaxRedirects:        3,
+				},
+			},
 		},
 		{
-			desc: "unparseable_order_regex",
+			desc: "label_regex",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
-					order_regex: ")"
+					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					label_regex: "(label_regex)"
 				}
 			`,
-			wantErr: regexp.MustCompile("error parsing order_regex"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					LabelRegexp: regexp.MustCompile("(label_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
 		},
 		{
-			desc: "order_regex_no_capture",
+			desc: "label_regex_capture_groups",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
-					order_regex: "order_regex"
+					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					label_regex: "(label)_(regex)"
 				}
 			`,
-			wantErr: regexp.MustCompile(`has \d+ capture groups, expected 1`),
+			wantErr: regexp.MustCompile("label_regex: has 2 capture groups, expected 1"),
 		},
 		{
-			desc: "order_regex_multi_capture",
+			desc: "label_regex_bad",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
-					order_regex: "(order)_(regex)"
+					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					label_regex: "(label_regex"
 				}
 			`,
-			wantErr: regexp.MustCompile(`has \d+ capture groups, expected 1`),
+			wantErr: regexp.MustCompile("label_regex: error parsing regexp"),
 		},
 		{
-			desc: "no_check_spec",
+			desc: "keep_last_n",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					keep_last_n: 5
 				}
 			`,
-			wantErr: regexp.MustCompile("has no check_spec"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					KeepLastN: 5,
+				},
+			},
 		},
 		{
-			desc: "no_check_start",
+			desc: "secret_query_param",
 			cfg: `
 				feed {
 					name: "feed name"
@@ -333,15 +534,33 @@ func TestParse(t *testing.T) {
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
 					check_spec {
+						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					secret_query_param: "apikey"
+					secret_query_param: "token"
 				}
 			`,
-			wantErr: regexp.MustCompile("has no start"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					SecretQueryParams: []string{"apikey", "token"},
+				},
+			},
 		},
 		{
-			desc: "unparseable_check_start",
+			desc: "check_jitter",
 			cfg: `
 				feed {
 					name: "feed name"
@@ -349,16 +568,32 @@ func TestParse(t *testing.T) {
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
 					check_spec {
-						start: "f49m1@30"
+						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					check_jitter: "10s"
 				}
 			`,
-			wantErr: regexp.MustCompile("error parsing start"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+							Jitter:    durationPtr(10 * time.Second),
+						},
+					},
+				},
+			},
 		},
 		{
-			desc: "no_check_end",
+			desc: "check_jitter_greater_than_freq",
 			cfg: `
 				feed {
 					name: "feed name"
@@ -367,14 +602,16 @@ func TestParse(t *testing.T) {
 					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					check_jitter: "61s"
 				}
 			`,
-			wantErr: regexp.MustCompile("has no end"),
+			wantErr: regexp.MustCompile("check_jitter: greater than check frequency 1m0s"),
 		},
 		{
-			desc: "unparseable_check_end",
+			desc: "check_jitter_negative",
 			cfg: `
 				feed {
 					name: "feed name"
@@ -383,15 +620,16 @@ func TestParse(t *testing.T) {
 					order_regex: "(order_regex)"
 					check_spec {
 						start: "Tue 12:00PM"
-						end: "f49m1@30"
+						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					check_jitter: "-1s"
 				}
 			`,
-			wantErr: regexp.MustCompile("error parsing end"),
+			wantErr: regexp.MustCompile("check_jitter: negative"),
 		},
 		{
-			desc: "check_end_before_check_start",
+			desc: "check_jitter_bad",
 			cfg: `
 				feed {
 					name: "feed name"
@@ -399,46 +637,4967 @@ func TestParse(t *testing.T) {
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
 					check_spec {
-						start: "Thu 12:00PM"
-						end: "Tue 12:00PM"
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
 						freq_s: 60
 					}
+					check_jitter: "soon"
 				}
 			`,
-			wantErr: regexp.MustCompile("has end before start"),
+			wantErr: regexp.MustCompile("check_jitter: time: invalid duration"),
 		},
 		{
-			desc: "no_check_freq",
+			desc: "check_jitter_with_check_cron",
 			cfg: `
 				feed {
 					name: "feed name"
 					url: "feed url"
 					download_dir: "/download/dir"
 					order_regex: "(order_regex)"
+					check_cron: "0 * * * *"
+					check_jitter: "10s"
+				}
+			`,
+			wantErr: regexp.MustCompile("check_jitter: specified along with check_cron"),
+		},
+		{
+			desc: "mirror",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
 					check_spec {
 						start: "Tue 12:00PM"
 						end: "Thu 12:00PM"
+						freq_s: 60
 					}
+					mirror: true
 				}
 			`,
-			wantErr: regexp.MustCompile("missing or zero freq_s"),
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					Mirror: true,
+				},
+			},
 		},
-	} {
-		test := test
+		{
+			desc: "mirror_ignores_default_order_regex",
+			cfg: `
+				order_regex: "(default_order_regex)"
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+				}
+				feed {
+					name: "tie broken"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					Mirror: true,
+				},
+				{
+					Name:        "tie broken",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					Mirror: true,
+				},
+			},
+		},
+		{
+			desc: "mirror_order_bounds",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+					order_min: "a"
+					order_max: "z"
+					order_start: "m"
+				}
+			`,
+			wantErr: regexp.MustCompile(`order_min: specified with mirror; .*order_max: specified with mirror; .*order_start: specified with mirror`),
+		},
+		{
+			desc: "max_startup_delay_s",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				max_startup_delay_s: 60
+				feed {
+					name: "default"
+					url: "feed url"
+				}
+				feed {
+					name: "override"
+					url: "feed url"
+					max_startup_delay_s: 5
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "default",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxStartupDelay: time.Minute,
+				},
+				{
+					Name:        "override",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxStartupDelay: 5 * time.Second,
+				},
+			},
+		},
+		{
+			desc: "staging_dir",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					staging_dir: "/staging/dir"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					StagingDir: "/staging/dir",
+				},
+			},
+		},
+		{
+			desc: "write_metadata",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					write_metadata: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					WriteMetadata: true,
+				},
+			},
+		},
+		{
+			desc: "staging_dir_same_as_download_dir",
+			cfg: `
+				download_dir: "/download/dir"
+				feed {
+					name: "feed name"
+					url: "feed url"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					staging_dir: "/download/dir/"
+				}
+			`,
+			wantErr: regexp.MustCompile("staging_dir: same as download_dir"),
+		},
+		{
+			desc: "date_layout",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					date_layout: "02.01.2006 15:04"
+					date_layout: "2006-01-02"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					DateLayouts: []string{"02.01.2006 15:04", "2006-01-02"},
+				},
+			},
+		},
+		{
+			desc: "date_layout_empty",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					date_layout: ""
+				}
+			`,
+			wantErr: regexp.MustCompile(`date_layout\[0\]: empty layout`),
+		},
+		{
+			desc: "secret_query_param_bad_name",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					secret_query_param: "apikey"
+					secret_query_param: "api&key"
+				}
+			`,
+			wantErr: regexp.MustCompile(`secret_query_param\[1\]: bad name "api&key"`),
+		},
+		{
+			desc: "download_guards",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					allowed_download_host: "cdn.example.com"
+					allowed_download_host: "example.com"
+					deny_private_downloads: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					AllowedDownloadHosts: []string{"cdn.example.com", "example.com"},
+					DenyPrivateDownloads: true,
+				},
+			},
+		},
+		{
+			desc: "max_gone_checks",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					max_gone_checks: 5
+					stop_on_gone: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxGoneChecks: 5,
+					StopOnGone:    true,
+				},
+			},
+		},
+		{
+			desc: "torrent_watch_dir",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					torrent_watch_dir: "/watch/dir"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					TorrentWatchDir: "/watch/dir",
+				},
+			},
+		},
+		{
+			desc: "link_index",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					link_index: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					LinkIndex: true,
+				},
+			},
+		},
+		{
+			desc: "download_repacks",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					download_repacks: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					RepackRegexp: regexp.MustCompile(DefaultRepackRegex),
+				},
+			},
+		},
+		{
+			desc: "repack_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					download_repacks: true
+					repack_regex: "(?i)\\b(repack|rerip)\\b"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					RepackRegexp: regexp.MustCompile(`(?i)\b(repack|rerip)\b`),
+				},
+			},
+		},
+		{
+			desc: "repack_regex_without_download_repacks",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					repack_regex: "PROPER"
+				}
+			`,
+			wantErr: regexp.MustCompile(`repack_regex: specified without download_repacks`),
+		},
+		{
+			desc: "bad_repack_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					download_repacks: true
+					repack_regex: "(PROPER"
+				}
+			`,
+			wantErr: regexp.MustCompile(`repack_regex: .*missing closing \)`),
+		},
+		{
+			desc: "download_repacks_with_mirror",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+					download_repacks: true
+				}
+			`,
+			wantErr: regexp.MustCompile(`download_repacks: specified with mirror`),
+		},
+		{
+			desc: "download_newest_first",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					download_newest_first: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					NewestFirst:  true,
+					MaxDownloads: 1,
+				},
+			},
+		},
+		{
+			desc: "max_concurrent_downloads",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					download_newest_first: true
+					max_concurrent_downloads: 3
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					NewestFirst:  true,
+					MaxDownloads: 3,
+				},
+			},
+		},
+		{
+			desc: "max_concurrent_downloads_without_download_newest_first",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					max_concurrent_downloads: 3
+				}
+			`,
+			wantErr: regexp.MustCompile(`max_concurrent_downloads: specified without download_newest_first`),
+		},
+		{
+			desc: "latest_only",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					latest_only: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					LatestOnly: true,
+				},
+			},
+		},
+		{
+			desc: "latest_only_with_download_newest_first",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					latest_only: true
+					download_newest_first: true
+				}
+			`,
+			wantErr: regexp.MustCompile(`latest_only: specified along with download_newest_first`),
+		},
+		{
+			desc: "latest_only_with_mirror",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+					latest_only: true
+				}
+			`,
+			wantErr: regexp.MustCompile(`latest_only: specified with mirror`),
+		},
+		{
+			desc: "order_regression",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					order_regression: RESET_ORDER
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					OrderRegression: RESET_ORDER,
+				},
+			},
+		},
+		{
+			desc: "order_regression_with_mirror",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+					order_regression: RESET_ORDER
+				}
+			`,
+			wantErr: regexp.MustCompile(`order_regression: specified with mirror`),
+		},
+		{
+			desc: "order_regex_flags",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "S01E(\\d+)"
+					label_regex: "^(.*) S01E"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					download_repacks: true
+					repack_regex: "repack$"
+					order_regex_case_insensitive: true
+					order_regex_multi_line: true
+					order_regex_dot_all: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:         "feed name",
+					URL:          "feed url",
+					DownloadDir:  "/download/dir",
+					OrderRegexp:  regexp.MustCompile(`(?ims)S01E(\d+)`),
+					LabelRegexp:  regexp.MustCompile(`(?ims)^(.*) S01E`),
+					RepackRegexp: regexp.MustCompile(`(?ims)repack$`),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "order_regex_flags_bad_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "S01E(\\d+"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					order_regex_case_insensitive: true
+				}
+			`,
+			wantErr: regexp.MustCompile(`order_regex: effective pattern "\(\?i\)S01E.*missing closing \)`),
+		},
+		{
+			desc: "ftp_credentials",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					ftp_user: "user"
+					ftp_password: "password"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					FTPUser:     "user",
+					FTPPassword: "password",
+				},
+			},
+		},
+		{
+			desc: "ftp_password_without_ftp_user",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					ftp_password: "password"
+				}
+			`,
+			wantErr: regexp.MustCompile(`ftp_password: specified without ftp_user`),
+		},
+		{
+			desc: "item_json_stdin",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					alert_command: "/bin/alert"
+					item_json_stdin: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					Alerter:       alert.NewCommandArgs("/bin/alert"),
+					ItemJSONStdin: true,
+				},
+			},
+		},
+		{
+			desc: "item_json_stdin_without_alert_command",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					item_json_stdin: true
+				}
+			`,
+			wantErr: regexp.MustCompile(`item_json_stdin: specified without alert_command`),
+		},
+		{
+			desc: "allowed_download_host_bad_host",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					allowed_download_host: "https://cdn.example.com/"
+				}
+			`,
+			wantErr: regexp.MustCompile(`allowed_download_host\[0\]: bad host "https://cdn.example.com/"`),
+		},
+		{
+			desc: "item_extension_filter",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					item_extension_filter {
+						path: "torrent:seeders"
+						min_int: 3
+					}
+					item_extension_filter {
+						path: "torrent:seeders"
+						max_int: 0
+					}
+					item_extension_filter {
+						path: "media:quality"
+						regex: "^1080p$"
+					}
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					ExtensionFilters: []ExtensionFilter{
+						{Prefix: "torrent", Name: "seeders", MinInt: int64Ptr(3)},
+						{Prefix: "torrent", Name: "seeders", MaxInt: int64Ptr(0)},
+						{Prefix: "media", Name: "quality", Regexp: regexp.MustCompile("^1080p$")},
+					},
+				},
+			},
+		},
+		{
+			desc: "item_extension_filter_bad_path",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					item_extension_filter {
+						path: "seeders"
+						min_int: 3
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`item_extension_filter\[0\]: bad path "seeders"`),
+		},
+		{
+			desc: "item_extension_filter_empty_prefix",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					item_extension_filter {
+						path: ":seeders"
+						min_int: 3
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`item_extension_filter\[0\]: bad path ":seeders"`),
+		},
+		{
+			desc: "item_extension_filter_no_match",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					item_extension_filter {
+						path: "torrent:seeders"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`item_extension_filter\[0\]: no min_int, max_int, or regex: not specified`),
+		},
+		{
+			desc: "item_extension_filter_bad_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					item_extension_filter {
+						path: "torrent:seeders"
+						regex: "("
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`item_extension_filter\[0\]: error parsing regex`),
+		},
+		{
+			desc: "header_bad_name",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					header {
+						name: "Bad Name"
+						value: "value"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`header\[0\]: bad name "Bad Name"`),
+		},
+		{
+			desc: "header_newline",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					header {
+						name: "Name"
+						value: "a\nb"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`header\[0\]: value contains a newline`),
+		},
+		{
+			desc: "redirect_header_host_without_header",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					redirect_header_host: "cdn.example.com"
+				}
+			`,
+			wantErr: regexp.MustCompile("redirect_header_host: specified without header"),
+		},
+		{
+			desc: "max_item_age_negative",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					max_item_age: "-1h"
+				}
+			`,
+			wantErr: regexp.MustCompile("max_item_age: negative"),
+		},
+		{
+			desc: "min_download_interval",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					min_download_interval: "90s"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MinDownloadInterval: 90 * time.Second,
+				},
+			},
+		},
+		{
+			desc: "min_download_interval_negative",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					min_download_interval: "-90s"
+				}
+			`,
+			wantErr: regexp.MustCompile("min_download_interval: negative"),
+		},
+		{
+			desc: "check_cron",
+			cfg: `
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_cron: "*/15 * * * *"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckCron:   cron.MustParse("*/15 * * * *"),
+				},
+			},
+		},
+		{
+			desc: "check_cron_and_check_spec",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					check_cron: "*/15 * * * *"
+				}
+			`,
+			wantErr: regexp.MustCompile("check_cron: specified along with check_spec"),
+		},
+		{
+			desc: "bad_check_cron",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_cron: "every 15 minutes"
+				}
+			`,
+			wantErr: regexp.MustCompile("check_cron: expected 5 fields"),
+		},
+		{
+			desc: "fetch_limits",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				max_feed_size_bytes: 1048576
+				fetch_timeout_s: 30
+				download_stall_timeout_s: 300
+				feed {
+					name: "feed name"
+					url: "feed url"
+				}
+				feed {
+					name: "other feed name"
+					url: "other feed url"
+					max_feed_size_bytes: 2048
+					fetch_timeout_s: 10
+					download_stall_timeout_s: 60
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxFeedSize:          1 << 20,
+					FetchTimeout:         30 * time.Second,
+					DownloadStallTimeout: 5 * time.Minute,
+				},
+				{
+					Name:        "other feed name",
+					URL:         "other feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					MaxFeedSize:          2048,
+					FetchTimeout:         10 * time.Second,
+					DownloadStallTimeout: time.Minute,
+				},
+			},
+		},
+		{
+			desc: "content_type_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					content_type_regex: "^video/"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					ContentTypeRegexp: regexp.MustCompile("^video/"),
+				},
+			},
+		},
+		{
+			desc: "bad_content_type_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					content_type_regex: "video/("
+				}
+			`,
+			wantErr: regexp.MustCompile("content_type_regex: error parsing regexp"),
+		},
+		{
+			desc: "alert_retries",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				alert_command: "/bin/alert"
+				alert_retries: 3
+				alert_timeout_s: 10
+				feed {
+					name: "feed name"
+					url: "feed url"
+					alert_retry_backoff_s: 5
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					Alerter:           alert.NewCommandArgs("/bin/alert"),
+					AlertRetries:      3,
+					AlertRetryBackoff: 5 * time.Second,
+					AlertTimeout:      10 * time.Second,
+				},
+			},
+		},
+		{
+			desc: "global_dedupe",
+			cfg: `
+				download_dir: "/download/dir"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				global_dedupe: true
+				feed {
+					name: "general"
+					url: "feed url"
+					order_regex: "(.*)"
+				}
+				feed {
+					name: "show"
+					url: "feed url"
+					order_regex: "Show (.*)"
+				}
+				feed {
+					name: "opt out"
+					url: "feed url"
+					order_regex: "Show (.*)"
+					disable_global_dedupe: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "general",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(.*)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					GlobalDedupe: true,
+				},
+				{
+					Name:        "show",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("Show (.*)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					GlobalDedupe: true,
+				},
+				{
+					Name:        "opt out",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("Show (.*)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "check_spec_ref",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Mon 12:00AM"
+					end: "Mon 1:00AM"
+					freq_s: 600
+				}
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+					check_spec {
+						start: "Wed 1:00AM"
+						end: "Wed 5:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_spec_ref: "overnight"
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 1:00AM"),
+							End:       weekly.MustParse("Tue 5:00AM"),
+							Frequency: 300 * time.Second,
+						},
+						{
+							Start:     weekly.MustParse("Wed 1:00AM"),
+							End:       weekly.MustParse("Wed 5:00AM"),
+							Frequency: 300 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "skip_if_exists",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					skip_if_exists: ETAG
+					check_on_start: true
+					dedupe_by_hash: true
+					stale_after_s: 604800
+					filename_fallback: TITLE
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					SkipIfExists:     ETAG,
+					CheckOnStart:     true,
+					DedupeByHash:     true,
+					StaleAfter:       7 * 24 * time.Hour,
+					FilenameFallback: TITLE,
+				},
+			},
+		},
+		{
+			desc: "order_bounds",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					order_min: "S02E01"
+					order_max: "S02E12"
+					order_start: "S02E03"
+					disable_after_max: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					OrderMin:        "S02E01",
+					OrderMax:        "S02E12",
+					OrderStart:      "S02E03",
+					DisableAfterMax: true,
+				},
+			},
+		},
+		{
+			desc: "skip_dates",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					skip_date: "2017-12-25"
+					skip_range {
+						from: "2017-12-31"
+						to: "2018-01-02"
+					}
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					SkipDates: []DateRange{
+						{From: "2017-12-25", To: "2017-12-25"},
+						{From: "2017-12-31", To: "2018-01-02"},
+					},
+				},
+			},
+		},
+		{
+			desc: "parse_retries",
+			cfg: `
+				parse_retries: 2
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+				feed {
+					name: "other feed name"
+					url: "other feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					parse_retries: 5
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					ParseRetries: 2,
+				},
+				{
+					Name:        "other feed name",
+					URL:         "other feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					ParseRetries: 5,
+				},
+			},
+		},
+		{
+			desc:    "unparseable",
+			cfg:     `^#$mf90@#`,
+			wantErr: regexp.MustCompile("could not parse config"),
+		},
+		{
+			desc:    "no_feed",
+			cfg:     ``,
+			wantErr: regexp.MustCompile("config does not specify any feeds to watch"),
+		},
+		{
+			desc: "no_name",
+			cfg: `
+				feed {
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`feed at index \d+ name: not specified`),
+		},
+		{
+			desc: "duplicate_name",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("duplicate feed name"),
+		},
+		{
+			desc: "no_url",
+			cfg: `
+				feed {
+					name: "feed name"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("feed .* url: not specified"),
+		},
+		{
+			desc: "no_download_dir",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("download_dir: not specified and no default specified"),
+		},
+		{
+			desc: "no_order_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("order_regex: not specified and no default specified"),
+		},
+		{
+			desc: "unparseable_order_regex",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: ")"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("order_regex: error parsing regexp"),
+		},
+		{
+			desc: "order_regex_no_capture",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "order_regex"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`has 0 capture groups, expected at least 1`),
+		},
+		{
+			desc: "order_regex_multi_capture",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "S(\\d+)E(\\d+)"
+					order_min: "1 5"
+					order_max: "2 10"
+					order_start: "1 7"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile(`S(\d+)E(\d+)`),
+					OrderMin:    "0000000001 0000000005",
+					OrderMax:    "0000000002 0000000010",
+					OrderStart:  "0000000001 0000000007",
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "order_regex_multi_capture_bad_order_min",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "S(\\d+)E(\\d+)"
+					order_min: "S01E05"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`order_min: has 1 fields, expected 2`),
+		},
+		{
+			desc: "no_check_spec",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+				}
+			`,
+			wantErr: regexp.MustCompile("check_spec: not specified and no default specified"),
+		},
+		{
+			desc: "no_check_start",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("has no start"),
+		},
+		{
+			desc: "unparseable_check_start",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "f49m1@30"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("error parsing start"),
+		},
+		{
+			desc: "no_check_end",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("has no end"),
+		},
+		{
+			desc: "unparseable_check_end",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "f49m1@30"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("error parsing end"),
+		},
+		{
+			desc: "check_end_before_check_start",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Thu 12:00PM"
+						end: "Tue 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("has end before start"),
+		},
+		{
+			desc: "no_check_freq",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("missing or zero freq_s"),
+		},
+		{
+			desc: "unparseable_skip_date",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					skip_date: "12/25/2017"
+				}
+			`,
+			wantErr: regexp.MustCompile(`skip_date\[0\]: parsing time`),
+		},
+		{
+			desc: "unparseable_skip_range_from",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					skip_range {
+						from: "2017-13-01"
+						to: "2018-01-02"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`skip_range\[0\]: error parsing from`),
+		},
+		{
+			desc: "unparseable_skip_range_to",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					skip_range {
+						from: "2017-12-31"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`skip_range\[0\]: error parsing to`),
+		},
+		{
+			desc: "skip_range_to_before_from",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					skip_range {
+						from: "2018-01-02"
+						to: "2017-12-31"
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile(`skip_range\[0\]: to before from`),
+		},
+		{
+			desc: "max_pages_without_follow_pagination",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					max_pages: 3
+				}
+			`,
+			wantErr: regexp.MustCompile("max_pages: specified without follow_pagination"),
+		},
+		{
+			desc: "disable_global_dedupe_without_global_dedupe",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					disable_global_dedupe: true
+				}
+			`,
+			wantErr: regexp.MustCompile("disable_global_dedupe: specified without global_dedupe"),
+		},
+		{
+			desc: "unknown_check_spec_ref",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_spec_ref: "daytime"
+				}
+			`,
+			wantErr: regexp.MustCompile(`check_spec_ref: no schedule named "daytime"`),
+		},
+		{
+			desc: "check_spec_ref_with_check_spec",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_spec_ref: "overnight"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			wantErr: regexp.MustCompile("check_spec_ref: specified along with check_spec"),
+		},
+		{
+			desc: "check_spec_ref_with_check_cron",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_spec_ref: "overnight"
+					check_cron: "0 * * * *"
+				}
+			`,
+			wantErr: regexp.MustCompile("check_cron: specified along with check_spec_ref"),
+		},
+		{
+			desc: "bad_referenced_schedule",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_spec_ref: "overnight"
+				}
+			`,
+			wantErr: regexp.MustCompile(`check_spec_ref: schedule "overnight" check_spec\[0\]: has no end`),
+		},
+		{
+			desc: "duplicate_schedule_name",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+				}
+				schedule {
+					name: "overnight"
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_spec_ref: "overnight"
+				}
+			`,
+			wantErr: regexp.MustCompile(`duplicate schedule name "overnight"`),
+		},
+		{
+			desc: "schedule_without_name",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule {
+					check_spec {
+						start: "Tue 1:00AM"
+						end: "Tue 5:00AM"
+						freq_s: 300
+					}
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_cron: "0 * * * *"
+				}
+			`,
+			wantErr: regexp.MustCompile("schedule at index 0 name: not specified"),
+		},
+		{
+			desc: "schedule_without_check_spec",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				schedule { name: "overnight" }
+				feed {
+					name: "feed name"
+					url: "feed url"
+					check_cron: "0 * * * *"
+				}
+			`,
+			wantErr: regexp.MustCompile(`schedule "overnight" check_spec: not specified`),
+		},
+		{
+			desc: "check_on_start_with_check_cron",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_cron: "0 * * * *"
+					check_on_start: true
+				}
+			`,
+			wantErr: regexp.MustCompile("check_on_start: specified along with check_cron"),
+		},
+		{
+			desc: "check_on_start_always_with_check_cron",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_cron: "0 * * * *"
+					check_on_start_always: true
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:               "feed name",
+					URL:                "feed url",
+					DownloadDir:        "/download/dir",
+					OrderRegexp:        regexp.MustCompile("(order_regex)"),
+					CheckCron:          cron.MustParse("0 * * * *"),
+					CheckOnStartAlways: true,
+				},
+			},
+		},
+		{
+			desc: "hardlink_duplicates_without_dedupe_by_hash",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					hardlink_duplicates: true
+				}
+			`,
+			wantErr: regexp.MustCompile("hardlink_duplicates: specified without dedupe_by_hash"),
+		},
+		{
+			desc: "bad_alert_command",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					alert_command: "/bin/alert 'unterminated"
+				}
+			`,
+			wantErr: regexp.MustCompile("alert_command: could not parse command .*: unterminated single quote"),
+		},
+		{
+			desc: "order_max_before_order_min",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					order_min: "S02E01"
+					order_max: "S01E12"
+				}
+			`,
+			wantErr: regexp.MustCompile("order_max: before order_min"),
+		},
+		{
+			desc: "disable_after_max_without_order_max",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					disable_after_max: true
+				}
+			`,
+			wantErr: regexp.MustCompile("disable_after_max: specified without order_max"),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			got, err := Parse(test.cfg)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case test.wantErr != nil:
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("Parse got error %q, wanted error matching pattern %q", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc    string
+		cfg     string
+		format  Format
+		want    []*Feed
+		wantErr *regexp.Regexp
+	}{
+		{
+			desc:   "text",
+			format: TEXT,
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:   "yaml",
+			format: YAML,
+			cfg: `
+download_dir: /download/dir
+check_spec:
+  - start: "Tue 12:00PM"
+    end: "Thu 12:00PM"
+    freq_s: 60
+feed:
+  - name: feed name
+    url: feed url
+    order_regex: "(order_regex)"
+    lenient_parse: true
+`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+					LenientParse: true,
+				},
+			},
+		},
+		{
+			desc:    "yaml_unparseable",
+			format:  YAML,
+			cfg:     "feed:\n\t- name: x\n",
+			wantErr: regexp.MustCompile("could not parse config"),
+		},
+		{
+			desc:    "yaml_unknown_field",
+			format:  YAML,
+			cfg:     "bogus_field: 1\n",
+			wantErr: regexp.MustCompile("could not parse config"),
+		},
+		{
+			desc:    "yaml_empty",
+			format:  YAML,
+			cfg:     ``,
+			wantErr: regexp.MustCompile("config does not specify any feeds to watch"),
+		},
+		{
+			desc:   "yaml_invalid",
+			format: YAML,
+			cfg: `
+feed:
+  - url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`feed at index \d+ name: not specified`),
+		},
+		{
+			desc:    "unknown_format",
+			format:  Format(255),
+			wantErr: regexp.MustCompile("unknown config format"),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseFormat(test.cfg, test.format)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case test.wantErr != nil:
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("ParseFormat got error %q, wanted error matching pattern %q", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatForFilename(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		filename string
+		want     Format
+	}{
+		{"rssdl.cfg", TEXT},
+		{"/etc/rssdl/config", TEXT},
+		{"rssdl.yaml", YAML},
+		{"/etc/rssdl/config.yml", YAML},
+		{"rssdl.json", JSON},
+	} {
+		if got := FormatForFilename(test.filename); got != test.want {
+			t.Errorf("FormatForFilename(%q) = %v, want %v", test.filename, got, test.want)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc string
+		cfg  string
+	}{
+		{
+			desc: "basic",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+		},
+		{
+			desc: "check_cron",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_cron: "0 9-17 * * 1-5"
+				}
+			`,
+		},
+		{
+			desc: "defaults",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				alert_command: "/bin/alert"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				check_spec {
+					start: "Thu 12:00PM"
+					end: "Fri 12:00PM"
+					freq_s: 30
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+				}
+				feed {
+					name: "other feed name"
+					url: "other feed url"
+					order_regex: "^Show - (\\d+)$"
+				}
+			`,
+		},
+		{
+			desc: "all_options",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Sun 12:00AM"
+						end: "Sat 11:59PM"
+						freq_s: 3600
+					}
+					alert_command: "/bin/alert"
+					lenient_parse: true
+					follow_pagination: true
+					max_pages: 3
+					max_item_age_s: 86400
+					order_min: "S02E01"
+					order_max: "S02E12"
+					order_start: "S02E03"
+					disable_after_max: true
+					parse_retries: 3
+					max_feed_size_bytes: 1048576
+					fetch_timeout_s: 30
+					content_type_regex: "^video/"
+					alert_retries: 3
+					alert_retry_backoff_s: 2
+					alert_timeout_s: 15
+					skip_if_exists: SIZE
+					download_stall_timeout_s: 120
+					check_on_start: true
+					check_on_start_always: true
+					dedupe_by_hash: true
+					hardlink_duplicates: true
+					stale_after_s: 1209600
+					filename_fallback: TITLE
+					header {
+						name: "Authorization"
+						value: "Bearer token"
+					}
+					redirect_header_host: "cdn.example.com"
+					max_redirects: 3
+					keep_last_n: 5
+					label_regex: "(label_regex)"
+					secret_query_param: "apikey"
+					date_layout: "02.01.2006 15:04"
+					staging_dir: "/staging/dir"
+					max_startup_delay_s: 30
+					write_metadata: true
+					allowed_download_host: "cdn.example.com"
+					deny_private_downloads: true
+					max_gone_checks: 5
+					stop_on_gone: true
+					torrent_watch_dir: "/watch/dir"
+					link_index: true
+					download_repacks: true
+					repack_regex: "(?i)rerip"
+					download_newest_first: true
+					max_concurrent_downloads: 4
+					item_json_stdin: true
+					raw_transfer: true
+					min_download_interval: "1m30s"
+					order_regression: RESET_ORDER
+					ftp_user: "user"
+					ftp_password: "password"
+					item_extension_filter {
+						path: "torrent:seeders"
+						min_int: 3
+					}
+					item_extension_filter {
+						path: "torrent:quality"
+						regex: "^1080p$"
+					}
+					skip_date: "2017-12-25"
+					skip_range {
+						from: "2017-12-31"
+						to: "2018-01-02"
+					}
+				}
+			`,
+		},
+		{
+			desc: "check_jitter",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					check_spec {
+						start: "Fri 12:00PM"
+						end: "Sat 12:00PM"
+						freq_s: 3600
+					}
+					check_jitter: "0s"
+				}
+			`,
+		},
+		{
+			desc: "mirror",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					mirror: true
+				}
+			`,
+		},
+		{
+			desc: "global_dedupe",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				global_dedupe: true
+				feed {
+					name: "general"
+					url: "feed url"
+				}
+				feed {
+					name: "opt out"
+					url: "feed url"
+					disable_global_dedupe: true
+				}
+			`,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			want, err := Parse(test.cfg)
+			if err != nil {
+				t.Fatalf("Parse got unexpected error: %v", err)
+			}
+			cfg, err := Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal got unexpected error: %v", err)
+			}
+			got, err := Parse(cfg)
+			if err != nil {
+				t.Fatalf("Parse(Marshal(...)) got unexpected error: %v\nMarshalled config:\n%s", err, cfg)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Parse(Marshal(feeds)) = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalConfig(t *testing.T) {
+	t.Parallel()
+
+	const cfg = `
+		alert_command: "/bin/alert"
+		alert_retries: 3
+		alert_retry_backoff_s: 5
+		alert_timeout_s: 30
+		alert_rate_limit: 10
+		alert_rate_limit_period_s: 600
+		max_concurrent_checks: 2
+		max_concurrent_feed_checks: 3
+		min_host_interval: "1m30s"
+		global_dedupe: true
+		report {
+			schedule: "Sun 9:00AM"
+			alert_command: "/bin/mail-report"
+		}
+		feed {
+			name: "feed name"
+			url: "feed url"
+			download_dir: "/download/dir"
+			order_regex: "(order_regex)"
+			check_spec {
+				start: "Tue 12:00PM"
+				end: "Thu 12:00PM"
+				freq_s: 60
+			}
+			download_repacks: true
+		}
+		feed {
+			name: "other feed"
+			url: "other feed url"
+			download_dir: "/download/dir"
+			mirror: true
+			check_cron: "0 9-17 * * 1-5"
+			header {
+				name: "Authorization"
+				value: "Bearer token"
+			}
+		}
+	`
+	want, err := ParseOptions{}.ParseConfig(cfg, TEXT)
+	if err != nil {
+		t.Fatalf("ParseConfig got unexpected error: %v", err)
+	}
+	out, err := MarshalConfig(want)
+	if err != nil {
+		t.Fatalf("MarshalConfig got unexpected error: %v", err)
+	}
+	got, err := ParseOptions{}.ParseConfig(out, TEXT)
+	if err != nil {
+		t.Fatalf("ParseConfig(MarshalConfig(...)) got unexpected error: %v\nMarshalled config:\n%s", err, out)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseConfig(MarshalConfig(cfg)) = %v, want %v", got, want)
+	}
+
+	// The same configuration, relying on defaults & a named schedule, is
+	// marshalled identically.
+	const defaultsCfg = `
+		alert_command: "/bin/alert"
+		alert_retries: 3
+		alert_retry_backoff_s: 5
+		alert_timeout_s: 30
+		alert_rate_limit: 10
+		alert_rate_limit_period_s: 600
+		max_concurrent_checks: 2
+		max_concurrent_feed_checks: 3
+		min_host_interval: "1m30s"
+		global_dedupe: true
+		report {
+			schedule: "Sun 9:00AM"
+			alert_command: "/bin/mail-report"
+		}
+		download_dir: "/download/dir"
+		schedule {
+			name: "weekly"
+			check_spec {
+				start: "Tue 12:00PM"
+				end: "Thu 12:00PM"
+				freq_s: 60
+			}
+		}
+		feed {
+			name: "feed name"
+			url: "feed url"
+			order_regex: "(order_regex)"
+			check_spec_ref: "weekly"
+			download_repacks: true
+			repack_regex: "(?i)\\b(repack|proper)\\b"
+		}
+		feed {
+			name: "other feed"
+			url: "other feed url"
+			mirror: true
+			check_cron: "0 9-17 * * 1-5"
+			header {
+				name: "Authorization"
+				value: "Bearer token"
+			}
+		}
+	`
+	c, err := ParseOptions{}.ParseConfig(defaultsCfg, TEXT)
+	if err != nil {
+		t.Fatalf("ParseConfig got unexpected error: %v", err)
+	}
+	if defaultsOut, err := MarshalConfig(c); err != nil {
+		t.Errorf("MarshalConfig got unexpected error: %v", err)
+	} else if defaultsOut != out {
+		t.Errorf("MarshalConfig of equivalent configs differ:\n%s\nvs:\n%s", defaultsOut, out)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc    string
+		feed    *Feed
+		wantErr *regexp.Regexp
+	}{
+		{
+			desc: "fractional_frequency",
+			feed: &Feed{
+				Name: "feed name",
+				CheckSpecs: []weekly.TickSpecification{
+					{
+						Start:     weekly.MustParse("Tue 12:00PM"),
+						End:       weekly.MustParse("Thu 12:00PM"),
+						Frequency: 1500 * time.Millisecond,
+					},
+				},
+			},
+			wantErr: regexp.MustCompile("check_spec.* has bad frequency"),
+		},
+		{
+			desc: "differing_jitter",
+			feed: &Feed{
+				Name: "feed name",
+				CheckSpecs: []weekly.TickSpecification{
+					{
+						Start:     weekly.MustParse("Tue 12:00PM"),
+						End:       weekly.MustParse("Tue 6:00PM"),
+						Frequency: time.Minute,
+						Jitter:    durationPtr(10 * time.Second),
+					},
+					{
+						Start:     weekly.MustParse("Thu 12:00PM"),
+						End:       weekly.MustParse("Thu 6:00PM"),
+						Frequency: time.Minute,
+					},
+				},
+			},
+			wantErr: regexp.MustCompile(`check_spec\[1\] has jitter differing`),
+		},
+		{
+			desc:    "fractional_max_item_age",
+			feed:    &Feed{Name: "feed name", MaxItemAge: time.Millisecond},
+			wantErr: regexp.MustCompile("has bad max item age"),
+		},
+		{
+			desc:    "unrepresentable_alerter",
+			feed:    &Feed{Name: "feed name", Alerter: alert.NopAlerter{}},
+			wantErr: regexp.MustCompile("alerter that cannot be represented"),
+		},
+		{
+			desc:    "tls_config",
+			feed:    &Feed{Name: "feed name", TLSConfig: &tls.Config{}},
+			wantErr: regexp.MustCompile("TLS configuration that cannot be represented"),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			_, err := Marshal([]*Feed{test.feed})
+			if err == nil || !test.wantErr.MatchString(err.Error()) {
+				t.Errorf("Marshal got error %q, wanted error matching pattern %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc    string
+		cfg     string
+		want    []*Feed
+		wantErr *regexp.Regexp
+	}{
+		{
+			desc: "basic",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "multi_check_spec",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							},
+							{
+								"start": "Thu 12:00PM",
+								"end": "Fri 12:00PM",
+								"freq_s": 30
+							}
+						]
+					}
+				]
+			}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+						{
+							Start:     weekly.MustParse("Thu 12:00PM"),
+							End:       weekly.MustParse("Fri 12:00PM"),
+							Frequency: 30 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "fallback_to_defaults",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url"
+					}
+				],
+				"download_dir": "/download/dir",
+				"order_regex": "(order_regex)",
+				"check_spec": [
+					{
+						"start": "Tue 12:00PM",
+						"end": "Thu 12:00PM",
+						"freq_s": 60
+					}
+				]
+			}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "override_defaults",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				],
+				"download_dir": "/bad/download/dir",
+				"order_regex": "(bad_order_regex)",
+				"check_spec": [
+					{
+						"start": "bad_check_start",
+						"end": "bad_check_end",
+						"freq_s": 120
+					}
+				]
+			}
+			`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:    "unparseable",
+			cfg:     `{"feed": [`,
+			wantErr: regexp.MustCompile("could not parse config"),
+		},
+		{
+			desc:    "no_feed",
+			cfg:     ``,
+			wantErr: regexp.MustCompile("config does not specify any feeds to watch"),
+		},
+		{
+			desc: "no_name",
+			cfg: `
+			{
+				"feed": [
+					{
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`feed at index \d+ name: not specified`),
+		},
+		{
+			desc: "duplicate_name",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					},
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`duplicate feed name`),
+		},
+		{
+			desc: "no_url",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`feed .* url: not specified`),
+		},
+		{
+			desc: "no_download_dir",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`download_dir: not specified and no default specified`),
+		},
+		{
+			desc: "unparseable_order_regex",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": ")",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`order_regex: error parsing regexp`),
+		},
+		{
+			desc: "order_regex_no_capture",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "order_regex",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`has 0 capture groups, expected at least 1`),
+		},
+		{
+			desc: "no_check_spec",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)"
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`check_spec: not specified and no default specified`),
+		},
+		{
+			desc: "check_end_before_check_start",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Thu 12:00PM",
+								"end": "Tue 12:00PM",
+								"freq_s": 60
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`has end before start`),
+		},
+		{
+			desc: "no_check_freq",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM"
+							}
+						]
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`missing or zero freq_s`),
+		},
+		{
+			desc: "unknown_field",
+			cfg: `
+			{
+				"feed": [
+					{
+						"name": "feed name",
+						"url": "feed url",
+						"download_dir": "/download/dir",
+						"order_regex": "(order_regex)",
+						"check_spec": [
+							{
+								"start": "Tue 12:00PM",
+								"end": "Thu 12:00PM",
+								"freq_s": 60
+							}
+						],
+						"bogus_field": "x"
+					}
+				]
+			}
+			`,
+			wantErr: regexp.MustCompile(`could not parse config`),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseJSON(test.cfg)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case test.wantErr != nil:
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("ParseJSON got error %q, wanted error matching pattern %q", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc    string
+		cfg     string
+		want    []*Feed
+		wantErr *regexp.Regexp
+	}{
+		{
+			desc: "basic",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "multi_check_spec",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+      - start: "Thu 12:00PM"
+        end: "Fri 12:00PM"
+        freq_s: 30
+`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+						{
+							Start:     weekly.MustParse("Thu 12:00PM"),
+							End:       weekly.MustParse("Fri 12:00PM"),
+							Frequency: 30 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "fallback_to_defaults",
+			cfg: `
+download_dir: /download/dir
+order_regex: "(order_regex)"
+check_spec:
+  - start: "Tue 12:00PM"
+    end: "Thu 12:00PM"
+    freq_s: 60
+feed:
+  - name: feed name
+    url: feed url
+`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc: "override_defaults",
+			cfg: `
+download_dir: /bad/download/dir
+order_regex: "(bad_order_regex)"
+check_spec:
+  - start: bad_check_start
+    end: bad_check_end
+    freq_s: 120
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			want: []*Feed{
+				{
+					Name:        "feed name",
+					URL:         "feed url",
+					DownloadDir: "/download/dir",
+					OrderRegexp: regexp.MustCompile("(order_regex)"),
+					CheckSpecs: []weekly.TickSpecification{
+						{
+							Start:     weekly.MustParse("Tue 12:00PM"),
+							End:       weekly.MustParse("Thu 12:00PM"),
+							Frequency: 60 * time.Second,
+						},
+					},
+				},
+			},
+		},
+		{
+			desc:    "unparseable",
+			cfg:     "feed:\n\t- name: x\n",
+			wantErr: regexp.MustCompile("could not parse config"),
+		},
+		{
+			desc:    "no_feed",
+			cfg:     ``,
+			wantErr: regexp.MustCompile("config does not specify any feeds to watch"),
+		},
+		{
+			desc: "no_name",
+			cfg: `
+feed:
+  - url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`feed at index \d+ name: not specified`),
+		},
+		{
+			desc: "duplicate_name",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`duplicate feed name`),
+		},
+		{
+			desc: "no_url",
+			cfg: `
+feed:
+  - name: feed name
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`feed .* url: not specified`),
+		},
+		{
+			desc: "no_download_dir",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`download_dir: not specified and no default specified`),
+		},
+		{
+			desc: "unparseable_order_regex",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: ")"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`order_regex: error parsing regexp`),
+		},
+		{
+			desc: "order_regex_no_capture",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: order_regex
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`has 0 capture groups, expected at least 1`),
+		},
+		{
+			desc: "no_check_spec",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+`,
+			wantErr: regexp.MustCompile(`check_spec: not specified and no default specified`),
+		},
+		{
+			desc: "check_end_before_check_start",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Thu 12:00PM"
+        end: "Tue 12:00PM"
+        freq_s: 60
+`,
+			wantErr: regexp.MustCompile(`has end before start`),
+		},
+		{
+			desc: "no_check_freq",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+`,
+			wantErr: regexp.MustCompile(`missing or zero freq_s`),
+		},
+		{
+			desc: "unknown_field",
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+    bogus_field: x
+`,
+			wantErr: regexp.MustCompile(`could not parse config`),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseYAML(test.cfg)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case test.wantErr != nil:
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("ParseYAML got error %q, wanted error matching pattern %q", err, test.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFormatName(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		name string
+		want Format
+	}{
+		{"text", TEXT},
+		{"TEXT", TEXT},
+		{"yaml", YAML},
+		{"Json", JSON},
+	} {
+		got, err := ParseFormatName(test.name)
+		if err != nil {
+			t.Errorf("ParseFormatName(%q) got unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseFormatName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+	if _, err := ParseFormatName("xml"); err == nil {
+		t.Errorf("ParseFormatName(%q) expected error", "xml")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	t.Parallel()
+
+	want := []*Feed{
+		{
+			Name:        "feed name",
+			URL:         "feed url",
+			DownloadDir: "/download/dir",
+			OrderRegexp: regexp.MustCompile("(order_regex)"),
+			CheckSpecs: []weekly.TickSpecification{
+				{
+					Start:     weekly.MustParse("Tue 12:00PM"),
+					End:       weekly.MustParse("Thu 12:00PM"),
+					Frequency: 60 * time.Second,
+				},
+			},
+		},
+	}
+
+	for _, test := range []struct {
+		desc   string
+		cfg    string
+		format Format
+	}{
+		{
+			desc:   "text",
+			format: TEXT,
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					order_regx: "(typo)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+		},
+		{
+			desc:   "yaml",
+			format: YAML,
+			cfg: `
+feed:
+  - name: feed name
+    url: feed url
+    download_dir: /download/dir
+    order_regex: "(order_regex)"
+    order_regx: "(typo)"
+    check_spec:
+      - start: "Tue 12:00PM"
+        end: "Thu 12:00PM"
+        freq_s: 60
+`,
+		},
+		{
+			desc:   "json",
+			format: JSON,
+			cfg: `{"feed": [{
+				"name": "feed name",
+				"url": "feed url",
+				"download_dir": "/download/dir",
+				"order_regex": "(order_regex)",
+				"order_regx": "(typo)",
+				"check_spec": [{"start": "Tue 12:00PM", "end": "Thu 12:00PM", "freq_s": 60}]
+			}]}`,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			// Unknown fields are an error by default.
+			wantErr := regexp.MustCompile("order_regx")
+			if _, err := (ParseOptions{}).Parse(test.cfg, test.format); err == nil || !wantErr.MatchString(err.Error()) {
+				t.Errorf("Parse got error %q, wanted error matching pattern %q", err, wantErr)
+			}
+
+			got, err := ParseOptions{AllowUnknownFields: true}.Parse(test.cfg, test.format)
+			if err != nil {
+				t.Fatalf("Parse with AllowUnknownFields got unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDateRangeContains(t *testing.T) {
+	t.Parallel()
+
+	r := DateRange{From: "2017-12-31", To: "2018-01-02"}
+	loc := time.FixedZone("UTC-8", -8*60*60)
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2017, 12, 30, 23, 59, 0, 0, time.UTC), false},
+		{time.Date(2017, 12, 31, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC), true},
+		{time.Date(2018, 1, 2, 23, 59, 0, 0, time.UTC), true},
+		{time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2018, 1, 3, 0, 0, 0, 0, time.UTC).In(loc), true}, // still Jan 2 in loc
+	} {
+		if got := r.Contains(test.t); got != test.want {
+			t.Errorf("%+v.Contains(%v) = %v, want %v", r, test.t, got, test.want)
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	t.Parallel()
+
+	const feed = `
+		feed {
+			name: "feed name"
+			url: "feed url"
+			download_dir: "/download/dir"
+			order_regex: "(order_regex)"
+			check_spec {
+				start: "Tue 12:00PM"
+				end: "Thu 12:00PM"
+				freq_s: 60
+			}
+			alert_command: "/bin/feed_alert"
+		}
+	`
+
+	for _, test := range []struct {
+		desc    string
+		cfg     string
+		want    *Config // Feeds is not compared
+		wantErr *regexp.Regexp
+	}{
+		{
+			desc: "no_alerter",
+			cfg:  feed,
+			want: &Config{},
+		},
+		{
+			desc: "alerter",
+			cfg: `
+				alert_command: "/bin/alert --daemon"
+				alert_retries: 2
+				alert_retry_backoff_s: 3
+				alert_timeout_s: 5
+			` + feed,
+			want: &Config{
+				Alerter:           alert.NewCommandArgs("/bin/alert", "--daemon"),
+				AlertRetries:      2,
+				AlertRetryBackoff: 3 * time.Second,
+				AlertTimeout:      5 * time.Second,
+			},
+		},
+		{
+			desc: "max_concurrent_checks",
+			cfg:  `max_concurrent_checks: 2` + feed,
+			want: &Config{MaxConcurrentChecks: 2},
+		},
+		{
+			desc: "max_concurrent_feed_checks",
+			cfg:  `max_concurrent_feed_checks: 3` + feed,
+			want: &Config{MaxConcurrentFeedChecks: 3},
+		},
+		{
+			desc: "min_host_interval",
+			cfg:  `min_host_interval: "90s"` + feed,
+			want: &Config{MinHostInterval: 90 * time.Second},
+		},
+		{
+			desc: "alert_rate_limit",
+			cfg: `
+				alert_rate_limit: 30
+				alert_rate_limit_period_s: 900
+			` + feed,
+			want: &Config{AlertRateLimit: 30, AlertRateLimitPeriod: 15 * time.Minute},
+		},
+		{
+			desc: "empty_order_warning",
+			cfg:  strings.Replace(feed, "(order_regex)", `S01E(\\d*)`, 1),
+			want: &Config{Warnings: Errors{&FeedError{
+				FeedName: "feed name",
+				Field:    "order_regex",
+				Index:    -1,
+				Err:      errors.New("capture group can match the empty string; items with an empty order are skipped"),
+			}}},
+		},
+		{
+			desc: "order_regex_flag_cleared_warning",
+			cfg:  strings.Replace(feed, `order_regex: "(order_regex)"`, `order_regex: "(?-i:S)01E(\\d+)" order_regex_case_insensitive: true order_regex_dot_all: true`, 1),
+			want: &Config{Warnings: Errors{&FeedError{
+				FeedName: "feed name",
+				Field:    "order_regex",
+				Index:    -1,
+				Err:      errors.New("inline flags clear order_regex_case_insensitive"),
+			}}},
+		},
+		{
+			desc: "no_empty_order_warning_when_mirroring",
+			cfg:  strings.Replace(feed, `order_regex: "(order_regex)"`, `order_regex: "S01E(\\d*)" mirror: true`, 1),
+			want: &Config{},
+		},
+		{
+			desc:    "bad_alerter",
+			cfg:     `alert_command: "'/bin/alert"` + feed,
+			wantErr: regexp.MustCompile("^alert_command: could not parse command"),
+		},
+		{
+			desc:    "alert_rate_limit_period_without_limit",
+			cfg:     `alert_rate_limit_period_s: 900` + feed,
+			wantErr: regexp.MustCompile("^alert_rate_limit_period_s: specified without alert_rate_limit$"),
+		},
+		{
+			desc: "report",
+			cfg: `
+				alert_command: "/bin/alert"
+				report { schedule: "Sun 9:00AM" }
+			` + feed,
+			want: &Config{
+				Alerter: alert.NewCommandArgs("/bin/alert"),
+				Report: &Report{
+					Spec:    weekly.TickSpecification{Start: weekly.MustParse("Sun 9:00AM"), End: weekly.MustParse("Sun 9:00AM"), Frequency: 7 * 24 * time.Hour, Jitter: new(time.Duration)},
+					Alerter: alert.NewCommandArgs("/bin/alert"),
+				},
+			},
+		},
+		{
+			desc: "report_alert_command",
+			cfg:  `report { schedule: "Mon 7:30AM" alert_command: "/bin/mail-report" }` + feed,
+			want: &Config{
+				Report: &Report{
+					Spec:    weekly.TickSpecification{Start: weekly.MustParse("Mon 7:30AM"), End: weekly.MustParse("Mon 7:30AM"), Frequency: 7 * 24 * time.Hour, Jitter: new(time.Duration)},
+					Alerter: alert.NewCommandArgs("/bin/mail-report"),
+				},
+			},
+		},
+		{
+			desc:    "report_without_schedule",
+			cfg:     `report { alert_command: "/bin/mail-report" }` + feed,
+			wantErr: regexp.MustCompile("^report schedule: not specified$"),
+		},
+		{
+			desc:    "report_bad_schedule",
+			cfg:     `report { schedule: "Sunday 9:00AM" alert_command: "/bin/mail-report" }` + feed,
+			wantErr: regexp.MustCompile("^report schedule: bad weekday$"),
+		},
+		{
+			desc:    "report_without_alert_command",
+			cfg:     `report { schedule: "Sun 9:00AM" }` + feed,
+			wantErr: regexp.MustCompile("^report alert_command: not specified and no default specified$"),
+		},
+		{
+			desc:    "bad_min_host_interval",
+			cfg:     `min_host_interval: "5"` + feed,
+			wantErr: regexp.MustCompile("^min_host_interval: .*missing unit"),
+		},
+		{
+			desc:    "negative_min_host_interval",
+			cfg:     `min_host_interval: "-5s"` + feed,
+			wantErr: regexp.MustCompile("^min_host_interval: negative$"),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseOptions{}.ParseConfig(test.cfg, TEXT)
+			if test.wantErr != nil {
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("ParseConfig got error %v, wanted error matching pattern %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfig got unexpected error: %v", err)
+			}
+			if len(got.Feeds) != 1 || got.Feeds[0].Name != "feed name" {
+				t.Errorf("ParseConfig got feeds %v, want one feed named %q", got.Feeds, "feed name")
+			}
+			got.Feeds = nil
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseConfig = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFiles(t *testing.T) {
+	t.Parallel()
+
+	const defaults = `
+		download_dir: "/download/dir"
+		order_regex: "(order_regex)"
+		schedule {
+			name: "weekdays"
+			check_spec {
+				start: "Mon 12:00PM"
+				end: "Fri 12:00PM"
+				freq_s: 60
+			}
+		}
+	`
+	feed := func(name string) string {
+		return fmt.Sprintf(`feed { name: %q url: "feed url" check_spec_ref: "weekdays" }`, name)
+	}
+
+	for _, test := range []struct {
+		desc      string
+		srcs      []NamedSource
+		wantFeeds []string // "name:download_dir"
+		wantErr   *regexp.Regexp
+	}{
+		{
+			desc: "combined",
+			srcs: []NamedSource{
+				{Name: "a.cfg", Config: feed("a1") + feed("a2")},
+				{Name: "b.yaml", Config: "feed:\n- name: b\n  url: feed url\n  download_dir: /b\n  check_spec_ref: weekdays\n", Format: YAML},
+				{Name: "defaults.cfg", Config: defaults},
+			},
+			wantFeeds: []string{"a1:/download/dir", "a2:/download/dir", "b:/b"},
+		},
+		{
+			desc: "duplicate_feed_name",
+			srcs: []NamedSource{
+				{Name: "defaults.cfg", Config: defaults},
+				{Name: "a.cfg", Config: feed("x")},
+				{Name: "b.cfg", Config: feed("y") + feed("x")},
+			},
+			wantErr: regexp.MustCompile(`^b\.cfg: feed "x" name: duplicate feed name \(also specified in a\.cfg\)$`),
+		},
+		{
+			desc: "feed_error",
+			srcs: []NamedSource{
+				{Name: "defaults.cfg", Config: defaults},
+				{Name: "a.cfg", Config: `feed { name: "a" check_spec_ref: "weekdays" }`},
+			},
+			wantErr: regexp.MustCompile(`^a\.cfg: feed "a" url: not specified$`),
+		},
+		{
+			desc: "parse_error",
+			srcs: []NamedSource{
+				{Name: "defaults.cfg", Config: defaults},
+				{Name: "a.cfg", Config: "feed {"},
+			},
+			wantErr: regexp.MustCompile(`^a\.cfg: could not parse config`),
+		},
+		{
+			desc: "multiple_defaults",
+			srcs: []NamedSource{
+				{Name: "defaults.cfg", Config: defaults},
+				{Name: "a.cfg", Config: `download_dir: "/a"` + feed("a")},
+			},
+			wantErr: regexp.MustCompile(`^a\.cfg: top-level settings already specified in defaults\.cfg$`),
+		},
+		{
+			desc:    "no_feeds",
+			srcs:    []NamedSource{{Name: "defaults.cfg", Config: defaults}},
+			wantErr: regexp.MustCompile(regexp.QuoteMeta(ErrNoFeeds.Error())),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			feeds, err := ParseFiles(test.srcs)
+			if test.wantErr != nil {
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("ParseFiles got error %v, wanted error matching pattern %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFiles got unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range feeds {
+				got = append(got, f.Name+":"+f.DownloadDir)
+			}
+			if !reflect.DeepEqual(got, test.wantFeeds) {
+				t.Errorf("ParseFiles got feeds %v, want %v", got, test.wantFeeds)
+			}
+		})
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	t.Parallel()
+
+	const (
+		checkSpec = `check_spec { start: "Tue 12:00PM" end: "Thu 12:00PM" freq_s: 60 }`
+		feed      = `feed { name: "main" url: "feed url" }`
+	)
+
+	for _, test := range []struct {
+		desc      string
+		files     map[string]string // relative to a temporary directory; main.cfg is parsed
+		wantFeeds []string          // "name:download_dir:order_regex"
+		wantErr   *regexp.Regexp
+	}{
+		{
+			desc: "includes",
+			files: map[string]string{
+				"main.cfg": `
+					include: "defaults.cfg"
+					include: "shows/a.cfg"
+					download_dir: "/main"
+				` + feed,
+				"defaults.cfg":   `download_dir: "/defaults" order_regex: "(defaults)"` + checkSpec,
+				"shows/a.cfg":    `include: "../common.yaml" feed { name: "a" url: "feed url" }`,
+				"common.yaml":    "order_regex: (common)\nfeed:\n- name: common\n  url: feed url\n",
+				"unincluded.cfg": `feed { name: "unincluded" }`,
+			},
+			wantFeeds: []string{"main:/main:(common)", "a:/main:(common)", "common:/main:(common)"},
+		},
+		{
+			desc: "feed_error",
+			files: map[string]string{
+				"main.cfg":    `include: "shows/a.cfg" download_dir: "/dl" order_regex: "(o)"` + checkSpec + feed,
+				"shows/a.cfg": `include: "b.cfg"`,
+				"shows/b.cfg": `feed { name: "b" }`,
+			},
+			wantErr: regexp.MustCompile(`^.*/shows/b\.cfg \(included from .*/shows/a\.cfg, included from .*/main\.cfg\): feed "b" url: not specified$`),
+		},
+		{
+			desc: "parse_error",
+			files: map[string]string{
+				"main.cfg": `include: "a.cfg"` + feed,
+				"a.cfg":    `feed {`,
+			},
+			wantErr: regexp.MustCompile(`^.*/a\.cfg \(included from .*/main\.cfg\): could not parse config`),
+		},
+		{
+			desc: "missing",
+			files: map[string]string{
+				"main.cfg": `include: "a.cfg"` + feed,
+			},
+			wantErr: regexp.MustCompile(`^.*/main\.cfg: include\[0\]: .*no such file`),
+		},
+		{
+			desc: "cycle",
+			files: map[string]string{
+				"main.cfg": `include: "a.cfg"` + feed,
+				"a.cfg":    `include: "./main.cfg"`,
+			},
+			wantErr: regexp.MustCompile(`^.*/a\.cfg \(included from .*/main\.cfg\): include\[0\]: "\./main\.cfg" includes itself$`),
+		},
+		{
+			desc: "too_deep",
+			files: func() map[string]string {
+				files := map[string]string{"main.cfg": `include: "0.cfg"` + feed}
+				for i := 0; i < maxIncludeDepth; i++ {
+					files[fmt.Sprintf("%d.cfg", i)] = fmt.Sprintf(`include: "%d.cfg"`, i+1)
+				}
+				return files
+			}(),
+			wantErr: regexp.MustCompile(`include: nested more than 10 deep$`),
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			dir, err := ioutil.TempDir("", "rssdl_config_test_")
+			if err != nil {
+				t.Fatalf("Couldn't create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			for fn, cfg := range test.files {
+				fn = filepath.Join(dir, fn)
+				if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+					t.Fatalf("Couldn't create directory: %v", err)
+				}
+				if err := ioutil.WriteFile(fn, []byte(cfg), 0600); err != nil {
+					t.Fatalf("Couldn't write config file: %v", err)
+				}
+			}
+
+			feeds, err := ParseFile(filepath.Join(dir, "main.cfg"))
+			if test.wantErr != nil {
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("ParseFile got error %v, wanted error matching pattern %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFile got unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range feeds {
+				got = append(got, fmt.Sprintf("%s:%s:%s", f.Name, f.DownloadDir, f.OrderRegexp))
+			}
+			if !reflect.DeepEqual(got, test.wantFeeds) {
+				t.Errorf("ParseFile got feeds %v, want %v", got, test.wantFeeds)
+			}
+		})
+	}
+
+	t.Run("string", func(t *testing.T) {
+		t.Parallel()
+		_, err := Parse(`include: "a.cfg" download_dir: "/dl" order_regex: "(o)"` + checkSpec + feed)
+		if want := "include: only supported when parsing files, e.g. by ParseFile"; err == nil || err.Error() != want {
+			t.Errorf("Parse got error %v, want %q", err, want)
+		}
+	})
+}
+
+func TestReadDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_config_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for fn, cfg := range map[string]string{
+		"defaults.cfg":  `download_dir: "/download/dir"`,
+		"b.textproto":   `feed { name: "b" }`,
+		"a.yaml":        `feed: [{name: a}]`,
+		"README":        "not a config file",
+		"a.cfg~":        "a backup",
+		"dir.cfg/c.cfg": `feed { name: "c" }`,
+		"z.json":        `{"feed": [{"name": "z"}]}`,
+	} {
+		fn = filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatalf("Couldn't create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(fn, []byte(cfg), 0600); err != nil {
+			t.Fatalf("Couldn't write config file: %v", err)
+		}
+	}
+
+	got, err := ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir got unexpected error: %v", err)
+	}
+	want := []NamedSource{
+		{Name: filepath.Join(dir, "a.yaml"), Config: `feed: [{name: a}]`, Format: YAML},
+		{Name: filepath.Join(dir, "b.textproto"), Config: `feed { name: "b" }`, Format: TEXT},
+		{Name: filepath.Join(dir, "defaults.cfg"), Config: `download_dir: "/download/dir"`, Format: TEXT},
+		{Name: filepath.Join(dir, "z.json"), Config: `{"feed": [{"name": "z"}]}`, Format: JSON},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseErrorTypes(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc    string
+		cfg     string
+		want    FeedError // Err is not compared
+		wantIs  error
+		wantMsg string
+	}{
+		{
+			desc: "no_name",
+			cfg: `
+				download_dir: "/download/dir"
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				feed { url: "feed url" }
+			`,
+			want:    FeedError{FeedIndex: 0, Field: "name", Index: -1},
+			wantIs:  ErrMissingField,
+			wantMsg: "feed at index 0 name: not specified",
+		},
+		{
+			desc: "no_url",
+			cfg: `
+				feed {
+					name: "first feed"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+				feed {
+					name: "second feed"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+				}
+			`,
+			want:    FeedError{FeedName: "second feed", FeedIndex: 1, Field: "url", Index: -1},
+			wantIs:  ErrMissingField,
+			wantMsg: `feed "second feed" url: not specified`,
+		},
+		{
+			desc: "no_default_download_dir",
+			cfg: `
+				order_regex: "(order_regex)"
+				check_spec {
+					start: "Tue 12:00PM"
+					end: "Thu 12:00PM"
+					freq_s: 60
+				}
+				feed {
+					name: "feed name"
+					url: "feed url"
+				}
+			`,
+			want:    FeedError{FeedName: "feed name", Field: "download_dir", Index: -1},
+			wantIs:  ErrMissingField,
+			wantMsg: `feed "feed name" download_dir: not specified and no default specified`,
+		},
+		{
+			desc: "bad_check_spec",
+			cfg: `
+				feed {
+					name: "feed name"
+					url: "feed url"
+					download_dir: "/download/dir"
+					order_regex: "(order_regex)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Thu 12:00PM"
+						freq_s: 60
+					}
+					check_spec {
+						start: "Thu 12:00PM"
+						end: "Fri 12:00PM"
+					}
+				}
+			`,
+			want:    FeedError{FeedName: "feed name", Field: "check_spec", Index: 1},
+			wantMsg: `feed "feed name" check_spec[1]: has missing or zero freq_s`,
+		},
+	} {
+		test := test
 		t.Run(test.desc, func(t *testing.T) {
 			t.Parallel()
-			got, err := Parse(test.cfg)
-			if !reflect.DeepEqual(got, test.want) {
-				t.Errorf("Got %v, want %v", got, test.want)
+			_, err := Parse(test.cfg)
+			if err == nil {
+				t.Fatalf("Parse got no error")
 			}
-			switch {
-			case test.wantErr == nil && err != nil:
-				t.Errorf("Unexpected error: %v", err)
-			case test.wantErr != nil:
+			if err.Error() != test.wantMsg {
+				t.Errorf("Parse got error %q, want %q", err, test.wantMsg)
+			}
+			var fe *FeedError
+			if !errors.As(err, &fe) {
+				t.Fatalf("Parse got error of type %T, want *FeedError", err)
+			}
+			got := *fe
+			got.Err = nil
+			if got != test.want {
+				t.Errorf("Parse got FeedError %+v, want %+v", got, test.want)
+			}
+			if test.wantIs != nil && !errors.Is(err, test.wantIs) {
+				t.Errorf("Parse got error %q, want error wrapping %q", err, test.wantIs)
+			}
+		})
+	}
+
+	t.Run("no_feeds", func(t *testing.T) {
+		t.Parallel()
+		if _, err := Parse(""); err != ErrNoFeeds {
+			t.Errorf("Parse got error %v, want %v", err, ErrNoFeeds)
+		}
+	})
+}
+
+func TestParseAllErrors(t *testing.T) {
+	t.Parallel()
+
+	const cfg = `
+		download_dir: "/download/dir"
+		check_spec {
+			start: "Tue 12:00PM"
+			end: "Thu 12:00PM"
+			freq_s: 60
+		}
+		feed {
+			name: "first feed"
+			url: "feed url"
+			order_regex: "no capture group"
+		}
+		feed {
+			name: "second feed"
+			url: "feed url"
+			order_regex: "(order_regex)"
+		}
+		feed {
+			name: "third feed"
+			order_regex: "(order_regex)"
+			check_spec {
+				start: "Thu 12:00PM"
+				end: "Tue 12:00PM"
+				freq_s: 60
+			}
+		}
+	`
+	want := []FeedError{
+		{FeedName: "first feed", FeedIndex: 0, Field: "order_regex", Index: -1},
+		{FeedName: "third feed", FeedIndex: 2, Field: "url", Index: -1},
+		{FeedName: "third feed", FeedIndex: 2, Field: "check_spec", Index: 0},
+	}
+	wantMsgs := []string{
+		`feed "first feed" order_regex: has 0 capture groups, expected at least 1`,
+		`feed "third feed" url: not specified`,
+		`feed "third feed" check_spec[0]: has end before start`,
+	}
+
+	t.Run("all", func(t *testing.T) {
+		t.Parallel()
+		_, err := Parse(cfg)
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Fatalf("Parse got error %v of type %T, want Errors", err, err)
+		}
+		if len(errs) != len(want) {
+			t.Fatalf("Parse got %d errors (%v), want %d", len(errs), errs, len(want))
+		}
+		for i, err := range errs {
+			if err.Error() != wantMsgs[i] {
+				t.Errorf("Error %d = %q, want %q", i, err, wantMsgs[i])
+			}
+			var fe *FeedError
+			if !errors.As(err, &fe) {
+				t.Errorf("Error %d has type %T, want *FeedError", i, err)
+				continue
+			}
+			got := *fe
+			got.Err = nil
+			if got != want[i] {
+				t.Errorf("Error %d = %+v, want %+v", i, got, want[i])
+			}
+		}
+	})
+
+	t.Run("stop_at_first_error", func(t *testing.T) {
+		t.Parallel()
+		_, err := ParseOptions{StopAtFirstError: true}.Parse(cfg, TEXT)
+		if err == nil || err.Error() != wantMsgs[0] {
+			t.Errorf("Parse got error %q, want %q", err, wantMsgs[0])
+		}
+	})
+}
+
+func TestTooOld(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc       string
+		maxItemAge time.Duration
+		published  *time.Time
+		want       bool
+	}{
+		{"disabled", 0, timePtr(now.Add(-1000 * time.Hour)), false},
+		{"newer", 24 * time.Hour, timePtr(now.Add(-23 * time.Hour)), false},
+		{"boundary", 24 * time.Hour, timePtr(now.Add(-24 * time.Hour)), false},
+		{"older", 24 * time.Hour, timePtr(now.Add(-24*time.Hour - time.Second)), true},
+		{"future", 24 * time.Hour, timePtr(now.Add(time.Hour)), false},
+		{"no_publish_time", 24 * time.Hour, nil, false},
+	} {
+		f := &Feed{MaxItemAge: test.maxItemAge}
+		if got := f.TooOld(test.published, now); got != test.want {
+			t.Errorf("[%s] TooOld(%v, %v) = %v, want %v", test.desc, test.published, now, got, test.want)
+		}
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+func TestWindow(t *testing.T) {
+	t.Parallel()
+
+	specs := []weekly.TickSpecification{
+		{Start: weekly.MustParse("Wed 7:00PM"), End: weekly.MustParse("Wed 9:00PM"), Frequency: time.Hour},
+		{Start: weekly.MustParse("Fri 6:00AM"), End: weekly.MustParse("Fri 7:00AM"), Frequency: 30 * time.Minute},
+	}
+	wed := func(h, m int) time.Time { return time.Date(2017, 8, 23, h, m, 0, 0, time.UTC) }
+	for _, test := range []struct {
+		desc               string
+		feed               *Feed
+		t                  time.Time
+		wantStart, wantEnd time.Time
+		wantOK             bool
+	}{
+		{"in_window", &Feed{CheckSpecs: specs}, wed(19, 30), wed(19, 0), wed(21, 0), true},
+		{"window_start", &Feed{CheckSpecs: specs}, wed(19, 0), wed(19, 0), wed(21, 0), true},
+		{"window_end", &Feed{CheckSpecs: specs}, wed(21, 0), time.Time{}, time.Time{}, false},
+		{"no_window", &Feed{CheckSpecs: specs}, wed(12, 0), time.Time{}, time.Time{}, false},
+		{"cron", &Feed{CheckSpecs: specs, CheckCron: cron.MustParse("* * * * *")}, wed(19, 30), time.Time{}, time.Time{}, false},
+	} {
+		start, end, ok := test.feed.Window(test.t)
+		if !start.Equal(test.wantStart) || !end.Equal(test.wantEnd) || ok != test.wantOK {
+			t.Errorf("[%s] Window(%v) = (%v, %v, %v), want (%v, %v, %v)", test.desc, test.t, start, end, ok, test.wantStart, test.wantEnd, test.wantOK)
+		}
+		if got := test.feed.InWindow(test.t); got != test.wantOK {
+			t.Errorf("[%s] InWindow(%v) = %v, want %v", test.desc, test.t, got, test.wantOK)
+		}
+	}
+}
+
+func TestNextChecks(t *testing.T) {
+	t.Parallel()
+
+	specs := []weekly.TickSpecification{
+		{Start: weekly.MustParse("Wed 7:00PM"), End: weekly.MustParse("Wed 9:00PM"), Frequency: time.Hour},
+		{Start: weekly.MustParse("Fri 6:00AM"), End: weekly.MustParse("Fri 7:00AM"), Frequency: 30 * time.Minute},
+	}
+	at := func(d, h, m int) time.Time { return time.Date(2017, 8, d, h, m, 0, 0, time.UTC) }
+	now := at(23, 19, 30) // a Wednesday, during a check window
+	for _, test := range []struct {
+		desc string
+		feed *Feed
+		n    int
+		want []time.Time
+	}{
+		{"check_specs", &Feed{CheckSpecs: specs}, 4, []time.Time{at(23, 20, 0), at(25, 6, 0), at(25, 6, 30), at(30, 19, 0)}},
+		{"skip_dates", &Feed{CheckSpecs: specs, SkipDates: []DateRange{{"2017-08-25", "2017-08-25"}}}, 4, []time.Time{at(23, 20, 0), at(30, 19, 0), at(30, 20, 0), time.Date(2017, 9, 1, 6, 0, 0, 0, time.UTC)}},
+		{"cron", &Feed{CheckSpecs: specs, CheckCron: cron.MustParse("0 12 * * *")}, 3, []time.Time{at(24, 12, 0), at(25, 12, 0), at(26, 12, 0)}},
+		{"all_skipped", &Feed{CheckSpecs: specs, SkipDates: []DateRange{{"2017-01-01", "2099-12-31"}}}, 3, nil},
+		{"no_schedule", &Feed{}, 3, nil},
+		{"none_wanted", &Feed{CheckSpecs: specs}, 0, nil},
+	} {
+		if got := test.feed.NextChecks(now, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%s] NextChecks(%v, %d) = %v, want %v", test.desc, now, test.n, got, test.want)
+		}
+	}
+}
+
+func TestExtensionFilterMatches(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc  string
+		ef    ExtensionFilter
+		value string
+		want  bool
+	}{
+		{"min_above", ExtensionFilter{MinInt: int64Ptr(3)}, "4", true},
+		{"min_boundary", ExtensionFilter{MinInt: int64Ptr(3)}, "3", true},
+		{"min_below", ExtensionFilter{MinInt: int64Ptr(3)}, "2", false},
+		{"min_whitespace", ExtensionFilter{MinInt: int64Ptr(3)}, " 10\n", true},
+		{"min_not_integer", ExtensionFilter{MinInt: int64Ptr(3)}, "lots", false},
+		{"max_below", ExtensionFilter{MaxInt: int64Ptr(0)}, "0", true},
+		{"max_above", ExtensionFilter{MaxInt: int64Ptr(0)}, "1", false},
+		{"max_negative", ExtensionFilter{MaxInt: int64Ptr(0)}, "-1", true},
+		{"range_inside", ExtensionFilter{MinInt: int64Ptr(1), MaxInt: int64Ptr(5)}, "5", true},
+		{"range_outside", ExtensionFilter{MinInt: int64Ptr(1), MaxInt: int64Ptr(5)}, "6", false},
+		{"regex_match", ExtensionFilter{Regexp: regexp.MustCompile("^(1080p|720p)$")}, "720p", true},
+		{"regex_no_match", ExtensionFilter{Regexp: regexp.MustCompile("^(1080p|720p)$")}, "480p", false},
+	} {
+		if got := test.ef.Matches(test.value); got != test.want {
+			t.Errorf("[%s] Matches(%q) = %v, want %v", test.desc, test.value, got, test.want)
+		}
+	}
+}
+
+func int64Ptr(n int64) *int64 { return &n }
+
+func durationPtr(d time.Duration) *time.Duration { return &d }
+
+func TestLabel(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc        string
+		labelRegexp *regexp.Regexp
+		title       string
+		want        string
+	}{
+		{"unset", nil, "Show - Episode 5", ""},
+		{"match", regexp.MustCompile(`^Show - (Episode \d+)`), "Show - Episode 5", "Episode 5"},
+		{"no_match", regexp.MustCompile(`^Show - (Episode \d+)`), "Show Special", ""},
+	} {
+		f := &Feed{LabelRegexp: test.labelRegexp}
+		if got := f.Label(test.title); got != test.want {
+			t.Errorf("[%s] Label(%q) = %q, want %q", test.desc, test.title, got, test.want)
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	t.Parallel()
+
+	single := &Feed{OrderRegexp: regexp.MustCompile(`S\d+E(\d+)`)}
+	multi := &Feed{OrderRegexp: regexp.MustCompile(`S(\d+)E(\d+)`)}
+	for _, test := range []struct {
+		f      *Feed
+		title  string
+		want   string
+		wantOK bool
+	}{
+		{single, "Show S01E09", "09", true},
+		{multi, "Show S01E09", "0000000001 0000000009", true},
+		{multi, "Show S1E123", "0000000001 0000000123", true},
+		{multi, "Show Special", "", false},
+		{&Feed{OrderRegexp: regexp.MustCompile(`(\d+)-(\w+)`)}, "2017-v2", "0000002017 v2", true},
+		{&Feed{OrderRegexp: regexp.MustCompile(`(\d*)-(\d*)`)}, "-", "", true},
+	} {
+		got, ok := test.f.Order(test.title)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("Order(%q) with order regex %q = (%q, %v), want (%q, %v)", test.title, test.f.OrderRegexp, got, ok, test.want, test.wantOK)
+		}
+	}
+
+	// Composite orders compare as their fields do, in turn.
+	for _, test := range []struct{ before, after string }{
+		{"Show S01E09", "Show S01E10"},
+		{"Show S01E99", "Show S02E01"},
+		{"Show S1E9", "Show S1E10"},
+		{"Show S01E10", "Show S2E1"},
+	} {
+		before, _ := multi.Order(test.before)
+		after, _ := multi.Order(test.after)
+		if before >= after {
+			t.Errorf("Order(%q) = %q, not before Order(%q) = %q", test.before, before, test.after, after)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	t.Parallel()
+
+	f := &Feed{DateLayouts: []string{"02.01.2006 15:04", "2006-01-02"}}
+	for _, test := range []struct {
+		date   string
+		want   time.Time
+		wantOK bool
+	}{
+		{"24.08.2017 19:30", time.Date(2017, 8, 24, 19, 30, 0, 0, time.UTC), true},
+		{" 2017-08-24\n", time.Date(2017, 8, 24, 0, 0, 0, 0, time.UTC), true},
+		{"Thursday", time.Time{}, false},
+		{"", time.Time{}, false},
+	} {
+		got, ok := f.ParseDate(test.date)
+		if ok != test.wantOK || !got.Equal(test.want) {
+			t.Errorf("ParseDate(%q) = (%v, %v), want (%v, %v)", test.date, got, ok, test.want, test.wantOK)
+		}
+	}
+	if _, ok := (&Feed{}).ParseDate("24.08.2017 19:30"); ok {
+		t.Errorf("ParseDate with no layouts succeeded, want failure")
+	}
+}
+
+func TestCaptureMatchesEmpty(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		re   string
+		want bool
+	}{
+		{`(\d+)`, false},
+		{`(\d*)`, true},
+		{`S(\d{2})`, false},
+		{`S(\d{0,2})`, true},
+		{`(a|b?)`, true},
+		{`(a|b)`, false},
+		{`(a?b)`, false},
+		{`(\b)`, true},
+		{`x*(?:y?)(z+)(w*)`, false},
+		{`^()$`, true},
+	} {
+		if got := captureMatchesEmpty(regexp.MustCompile(test.re)); got != test.want {
+			t.Errorf("captureMatchesEmpty(%q) = %v, want %v", test.re, got, test.want)
+		}
+	}
+}
+
+func TestClearedFlags(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		expr, flags string
+		want        string
+	}{
+		{`S01E(\d+)`, "ims", ""},
+		{`(?i)S01E(\d+)`, "i", ""},
+		{`(?-i)S01E(\d+)`, "i", "i"},
+		{`(?-i)S01E(\d+)`, "m", ""},
+		{`(?m-is:S)01E(\d+)`, "is", "is"},
+		{`(?s-i)S(?-s)01E(\d+)`, "ims", "is"},
+		{`\(?-i)S01E(\d+)`, "i", ""},
+		{`(?P<ep>-i)`, "i", ""},
+	} {
+		if got := clearedFlags(test.expr, test.flags); got != test.want {
+			t.Errorf("clearedFlags(%q, %q) = %q, want %q", test.expr, test.flags, got, test.want)
+		}
+	}
+}
+
+func TestParseTLS(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_config_test_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeCertificate(t, certFile, keyFile)
+	garbageFile := filepath.Join(dir, "garbage")
+	if err := ioutil.WriteFile(garbageFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Could not write %q: %v", garbageFile, err)
+	}
+	missingFile := filepath.Join(dir, "missing")
+
+	for _, test := range []struct {
+		desc                      string
+		certFile, keyFile, caFile string
+		wantCerts                 int
+		wantRootCAs               bool
+		wantErr                   *regexp.Regexp
+	}{
+		{
+			desc:      "client_cert",
+			certFile:  certFile,
+			keyFile:   keyFile,
+			wantCerts: 1,
+		},
+		{
+			desc:        "ca",
+			caFile:      certFile,
+			wantRootCAs: true,
+		},
+		{
+			desc:        "client_cert_and_ca",
+			certFile:    certFile,
+			keyFile:     keyFile,
+			caFile:      certFile,
+			wantCerts:   1,
+			wantRootCAs: true,
+		},
+		{
+			desc:     "cert_without_key",
+			certFile: certFile,
+			wantErr:  regexp.MustCompile("client_cert_file specified without client_key_file"),
+		},
+		{
+			desc:    "key_without_cert",
+			keyFile: keyFile,
+			wantErr: regexp.MustCompile("client_key_file specified without client_cert_file"),
+		},
+		{
+			desc:     "missing_cert",
+			certFile: missingFile,
+			keyFile:  keyFile,
+			wantErr:  regexp.MustCompile("could not load client certificate"),
+		},
+		{
+			desc:     "mismatched_cert_and_key",
+			certFile: keyFile,
+			keyFile:  certFile,
+			wantErr:  regexp.MustCompile("could not load client certificate"),
+		},
+		{
+			desc:    "missing_ca",
+			caFile:  missingFile,
+			wantErr: regexp.MustCompile("could not read CA file"),
+		},
+		{
+			desc:    "bad_ca",
+			caFile:  garbageFile,
+			wantErr: regexp.MustCompile("CA file contains no certificates"),
+		},
+	} {
+		// Subtests are not run in parallel, as they share the temporary directory.
+		t.Run(test.desc, func(t *testing.T) {
+			cfg := fmt.Sprintf(`
+				feed {
+					name: "feed"
+					url: "http://example.com/feed"
+					download_dir: "/tmp"
+					order_regex: "(.*)"
+					check_spec {
+						start: "Tue 12:00PM"
+						end: "Tue 1:00PM"
+						freq_s: 60
+					}
+					client_cert_file: %q
+					client_key_file: %q
+					ca_file: %q
+				}`, test.certFile, test.keyFile, test.caFile)
+			feeds, err := Parse(cfg)
+			if test.wantErr != nil {
 				if err == nil || !test.wantErr.MatchString(err.Error()) {
 					t.Errorf("Parse got error %q, wanted error matching pattern %q", err, test.wantErr)
 				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse got unexpected error: %v", err)
+			}
+			tc := feeds[0].TLSConfig
+			if tc == nil {
+				t.Fatalf("Parse got nil TLSConfig")
+			}
+			if got := len(tc.Certificates); got != test.wantCerts {
+				t.Errorf("Parse got %d client certificates, want %d", got, test.wantCerts)
+			}
+			if got := tc.RootCAs != nil; got != test.wantRootCAs {
+				t.Errorf("Parse got RootCAs set = %v, want %v", got, test.wantRootCAs)
+			}
+
+			// The files are kept, so that the configuration can be marshalled.
+			want := TLSFiles{ClientCert: test.certFile, ClientKey: test.keyFile, CA: test.caFile}
+			if got := feeds[0].TLSFiles; got != want {
+				t.Errorf("Parse got TLSFiles %+v, want %+v", got, want)
+			}
+			m, err := Marshal(feeds)
+			if err != nil {
+				t.Fatalf("Marshal got unexpected error: %v", err)
+			}
+			feeds, err = Parse(m)
+			if err != nil {
+				t.Fatalf("Parse(Marshal(...)) got unexpected error: %v\nMarshalled config:\n%s", err, m)
+			}
+			if got := feeds[0].TLSFiles; got != want {
+				t.Errorf("Parse(Marshal(feeds)) got TLSFiles %+v, want %+v", got, want)
 			}
 		})
 	}
 }
+
+// writeCertificate writes a self-signed certificate & its private key to the
+// given files, PEM-encoded.
+func writeCertificate(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rssdl test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Could not write %q: %v", certFile, err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Could not write %q: %v", keyFile, err)
+	}
+}
@@ -0,0 +1,243 @@
+// Package cron provides functionality for handling events that occur on a
+// cron-like schedule.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Schedule is a parsed cron expression. Expressions have five
+// space-separated fields: minute (0-59), hour (0-23), day of month (1-31),
+// month (1-12), and day of week (0-7, where both 0 and 7 are Sunday). Each
+// field is a comma-separated list of "*", single values, or ranges like "1-5",
+// optionally followed by a step like "*/15" or "1-5/2".
+//
+// As in cron, if both the day of month and day of week are restricted, a day
+// matches if it matches either field.
+type Schedule struct {
+	expr                          string
+	minute, hour, dom, month, dow bits
+	domRestricted, dowRestricted  bool
+}
+
+// bits is a set of small nonnegative integers.
+type bits uint64
+
+func (b bits) has(i int) bool { return b&(1<<uint(i)) != 0 }
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var (
+	minuteField = field{"minute", 0, 59}
+	hourField   = field{"hour", 0, 23}
+	domField    = field{"day of month", 1, 31}
+	monthField  = field{"month", 1, 12}
+	dowField    = field{"day of week", 0, 7}
+)
+
+// Parse parses a cron expression into a schedule.
+func Parse(expr string) (*Schedule, error) {
+	fs := strings.Fields(expr)
+	if len(fs) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fs))
+	}
+	s := &Schedule{expr: strings.Join(fs, " ")}
+	var err error
+	if s.minute, err = parseField(fs[0], minuteField); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fs[1], hourField); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fs[2], domField); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fs[3], monthField); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fs[4], dowField); err != nil {
+		return nil, err
+	}
+	if s.dow.has(7) {
+		s.dow |= 1 << 0
+	}
+	s.domRestricted, s.dowRestricted = fs[2] != "*", fs[4] != "*"
+
+	// Catch schedules that can never fire, such as "0 0 30 2 *".
+	if s.Next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).IsZero() {
+		return nil, errors.New("schedule never fires")
+	}
+	return s, nil
+}
+
+// MustParse is like Parse, but panics if the expression cannot be parsed.
+func MustParse(expr string) *Schedule {
+	s, err := Parse(expr)
+	if err != nil {
+		panic(fmt.Sprintf("Parse(%q): %v", expr, err))
+	}
+	return s
+}
+
+func parseField(val string, f field) (bits, error) {
+	var b bits
+	for _, part := range strings.Split(val, ",") {
+		rng, step := part, 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %s field %q", f.name, val)
+			}
+		}
+
+		var lo, hi int
+		switch {
+		case rng == "*":
+			lo, hi = f.min, f.max
+		case strings.Contains(rng, "-"):
+			i := strings.IndexByte(rng, '-')
+			var err error
+			if lo, err = strconv.Atoi(rng[:i]); err != nil {
+				return 0, fmt.Errorf("bad value in %s field %q", f.name, val)
+			}
+			if hi, err = strconv.Atoi(rng[i+1:]); err != nil {
+				return 0, fmt.Errorf("bad value in %s field %q", f.name, val)
+			}
+		default:
+			v, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("bad value in %s field %q", f.name, val)
+			}
+			lo, hi = v, v
+			if step != 1 {
+				// "5/15" means "5-max/15", as in common cron implementations.
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max {
+			return 0, fmt.Errorf("%s field %q out of range [%d, %d]", f.name, val, f.min, f.max)
+		}
+		if hi < lo {
+			return 0, fmt.Errorf("%s field %q has range end before start", f.name, val)
+		}
+		for i := lo; i <= hi; i += step {
+			b |= 1 << uint(i)
+		}
+	}
+	return b, nil
+}
+
+// Next returns the first time strictly after t that matches the schedule, in
+// t's location. If there is no such time within the next several years, the
+// zero time is returned.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+	for limit := t.Year() + 5; t.Year() <= limit; {
+		switch {
+		case !s.month.has(int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case !s.hour.has(t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case !s.minute.has(t.Minute()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom.has(t.Day()), s.dow.has(int(t.Weekday()))
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// String returns the cron expression the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// A Ticker holds a channel that delivers ticks of a clock at the times
+// specified by a schedule.
+type Ticker struct {
+	dropped uint64 // accessed atomically; first for 64-bit alignment
+
+	C    <-chan time.Time
+	done chan struct{}
+}
+
+// NewTicker returns a ticker that ticks according to the given schedule.
+func NewTicker(s *Schedule) *Ticker {
+	ch := make(chan time.Time)
+	t := &Ticker{
+		C:    ch,
+		done: make(chan struct{}),
+	}
+	go tick(ch, t.done, &t.dropped, s)
+	return t
+}
+
+// Ticks returns the channel on which ticks are delivered.
+func (t *Ticker) Ticks() <-chan time.Time {
+	return t.C
+}
+
+// Stop closes the ticker and releases any resources it has acquired.
+func (t *Ticker) Stop() {
+	close(t.done)
+}
+
+// DroppedTicks returns the number of ticks that have been dropped because the
+// receiver was not ready to receive them.
+func (t *Ticker) DroppedTicks() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func tick(ch chan<- time.Time, done chan struct{}, dropped *uint64, s *Schedule) {
+	nxt := time.Now()
+	for {
+		// Never schedule a tick in the past, e.g. if the system clock jumps.
+		if now := time.Now(); now.After(nxt) {
+			nxt = now
+		}
+		nxt = s.Next(nxt)
+		if nxt.IsZero() {
+			<-done
+			return
+		}
+
+		// Go to sleep until the next tick occurs.
+		tmr := time.NewTimer(time.Until(nxt))
+		select {
+		case <-tmr.C:
+			// Drop the tick if it is not ready to be received.
+			select {
+			case ch <- nxt:
+			default:
+				atomic.AddUint64(dropped, 1)
+			}
+
+		case <-done:
+			if !tmr.Stop() {
+				<-tmr.C
+			}
+			return
+		}
+	}
+}
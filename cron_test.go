@@ -0,0 +1,79 @@
+package cron
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		expr    string
+		wantErr *regexp.Regexp
+	}{
+		{expr: "* * * * *"},
+		{expr: "*/15 * * * *"},
+		{expr: "0 9-17/2 * * 1-5"},
+		{expr: "0,30 0 1,15 * 0,7"},
+		{expr: "5/10 * * * *"},
+		{expr: "* * * *", wantErr: regexp.MustCompile("expected 5 fields")},
+		{expr: "60 * * * *", wantErr: regexp.MustCompile("minute field .* out of range")},
+		{expr: "* 24 * * *", wantErr: regexp.MustCompile("hour field .* out of range")},
+		{expr: "* * 0 * *", wantErr: regexp.MustCompile("day of month field .* out of range")},
+		{expr: "* * * 13 *", wantErr: regexp.MustCompile("month field .* out of range")},
+		{expr: "* * * * 8", wantErr: regexp.MustCompile("day of week field .* out of range")},
+		{expr: "a * * * *", wantErr: regexp.MustCompile("bad value in minute field")},
+		{expr: "*/0 * * * *", wantErr: regexp.MustCompile("bad step in minute field")},
+		{expr: "30-10 * * * *", wantErr: regexp.MustCompile("range end before start")},
+		{expr: "0 0 30 2 *", wantErr: regexp.MustCompile("never fires")},
+	} {
+		test := test
+		t.Run(test.expr, func(t *testing.T) {
+			t.Parallel()
+			_, err := Parse(test.expr)
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("Parse(%q) got unexpected error: %v", test.expr, err)
+			case test.wantErr != nil && (err == nil || !test.wantErr.MatchString(err.Error())):
+				t.Errorf("Parse(%q) got error %q, wanted error matching pattern %q", test.expr, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	t.Parallel()
+
+	// 2017-08-23 is a Wednesday.
+	for _, test := range []struct {
+		expr string
+		t    time.Time
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC), time.Date(2017, 8, 23, 17, 31, 0, 0, time.UTC)},
+		{"* * * * *", time.Date(2017, 8, 23, 17, 30, 59, 0, time.UTC), time.Date(2017, 8, 23, 17, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC), time.Date(2017, 8, 23, 17, 45, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 8, 23, 23, 50, 0, 0, time.UTC), time.Date(2017, 8, 24, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC), time.Date(2017, 8, 23, 17, 45, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2017, 8, 25, 9, 0, 0, 0, time.UTC), time.Date(2017, 8, 28, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC), time.Date(2017, 8, 27, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, 12, 15, 0, 0, 0, 0, time.UTC), time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month & day of week are ORed when both are restricted.
+		{"0 0 1 * 1", time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC), time.Date(2017, 8, 28, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 1", time.Date(2017, 8, 28, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		if got := MustParse(test.expr).Next(test.t); !got.Equal(test.want) {
+			t.Errorf("Next(%q, %v) = %v, want %v", test.expr, test.t, got, test.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+	if got, want := MustParse("*/15  *  * * *").String(), "*/15 * * * *"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,859 @@
+// Package fetch provides functionality for fetching resources over HTTP (or
+// FTP) while enforcing limits on their size and on how long fetching them
+// takes.
+package fetch
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LimitError is returned when a fetch exceeds its size or time limit.
+type LimitError struct {
+	Size    int64         // the size limit that was exceeded, in bytes; 0 if the time limit was exceeded
+	Timeout time.Duration // the time limit that was exceeded; 0 if the size limit was exceeded
+}
+
+func (e *LimitError) Error() string {
+	if e.Size != 0 {
+		return fmt.Sprintf("feed exceeded %s", formatSize(e.Size))
+	}
+	return fmt.Sprintf("feed exceeded fetch timeout of %v", e.Timeout)
+}
+
+// formatSize formats a number of bytes for human consumption, e.g. "10MB".
+func formatSize(n int64) string {
+	switch {
+	case n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+// Body retrieves the body of the given URL. If the body is larger than
+// maxSize bytes, or retrieving it takes longer than timeout, a *LimitError is
+// returned. A maxSize or timeout of 0 means no limit.
+func Body(client *http.Client, url string, maxSize int64, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request for %q: %v", url, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &LimitError{Timeout: timeout}
+		}
+		return nil, fmt.Errorf("could not begin getting %q: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got unexpected status code when getting %q: %d", url, resp.StatusCode)
+	}
+
+	var r io.Reader = resp.Body
+	if maxSize != 0 {
+		// Read one byte past the limit, so that we can tell if it was exceeded.
+		r = &io.LimitedReader{R: resp.Body, N: maxSize + 1}
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &LimitError{Timeout: timeout}
+		}
+		return nil, fmt.Errorf("could not read %q: %v", url, err)
+	}
+	if maxSize != 0 && int64(len(body)) > maxSize {
+		return nil, &LimitError{Size: maxSize}
+	}
+	return body, nil
+}
+
+// Remote describes a remote resource, as reported by a HEAD request.
+type Remote struct {
+	Size int64  // the size of the resource in bytes; -1 if unknown
+	ETag string // the resource's entity tag; empty if unknown
+}
+
+// Head retrieves metadata about the resource at the given URL, without
+// retrieving its body. Servers which reject HEAD requests cause an error.
+func Head(client *http.Client, url string) (*Remote, error) {
+	resp, err := client.Head(url)
+	if err != nil {
+		return nil, fmt.Errorf("could not send HEAD for %q: %v", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got unexpected status code for HEAD of %q: %d", url, resp.StatusCode)
+	}
+	return &Remote{Size: resp.ContentLength, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// Matches determines if the local file at the given path appears to be a copy
+// of the remote resource: the file must exist and have the resource's size,
+// and if etag is non-empty, the resource must have that ETag. A resource of
+// unknown size matches no file.
+func (r *Remote) Matches(path, etag string) (bool, error) {
+	if r.Size < 0 {
+		return false, nil
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not stat %q: %v", path, err)
+	}
+	if !fi.Mode().IsRegular() || fi.Size() != r.Size {
+		return false, nil
+	}
+	return etag == "" || etag == r.ETag, nil
+}
+
+// ErrCancelled is returned when reading from a transfer that was cancelled
+// with Cancel.
+var ErrCancelled = errors.New("transfer cancelled")
+
+// StallError is returned when a transfer makes no progress for longer than its
+// stall timeout.
+type StallError struct {
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("transfer made no progress for %v", e.Timeout)
+}
+
+// Progress is a snapshot of the progress of a transfer.
+type Progress struct {
+	URL          string
+	Bytes        int64     // the number of bytes of the body read so far
+	Started      time.Time // when the transfer started
+	LastProgress time.Time // when bytes were last read; Started if none have been
+}
+
+// Rate returns the average rate of the transfer up to the given time, in bytes
+// per second.
+func (p Progress) Rate(now time.Time) float64 {
+	d := now.Sub(p.Started).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / d
+}
+
+// A Transfer is an in-progress GET of a URL. Its body is read by calling
+// Read. Its progress can be observed, and it can be cancelled, from other
+// goroutines.
+type Transfer struct {
+	Response *http.Response
+
+	stallTimeout time.Duration
+	onProgress   func(Progress)
+	cancel       context.CancelFunc
+	stallTimer   *time.Timer // nil if there is no stall timeout
+
+	mu        sync.Mutex // protects p, stalled, cancelled
+	p         Progress
+	stalled   bool
+	cancelled bool
+}
+
+// StartTransfer begins a GET of the given URL, returning once the response
+// headers are received. If stallTimeout is nonzero, the transfer is aborted
+// once it makes no progress for that long, including while awaiting the
+// response; reads then return a *StallError. If onProgress is non-nil, it is
+// called with the transfer's progress each time part of the body is read. The
+// transfer must be closed once it is no longer needed.
+func StartTransfer(client *http.Client, url string, stallTimeout time.Duration, onProgress func(Progress)) (*Transfer, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	t := &Transfer{
+		stallTimeout: stallTimeout,
+		onProgress:   onProgress,
+		cancel:       cancel,
+		p:            Progress{URL: url, Started: now, LastProgress: now},
+	}
+	if stallTimeout != 0 {
+		t.stallTimer = time.AfterFunc(stallTimeout, func() {
+			t.mu.Lock()
+			t.stalled = true
+			t.mu.Unlock()
+			cancel()
+		})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("could not create request for %q: %v", url, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Close()
+		return nil, t.err(fmt.Errorf("could not begin getting %q: %w", url, err))
+	}
+	t.Response = resp
+	return t, nil
+}
+
+// Read reads from the body of the response.
+func (t *Transfer) Read(p []byte) (int, error) {
+	n, err := t.Response.Body.Read(p)
+	if n > 0 {
+		if t.stallTimer != nil {
+			t.stallTimer.Reset(t.stallTimeout)
+		}
+		t.mu.Lock()
+		t.p.Bytes += int64(n)
+		t.p.LastProgress = time.Now()
+		prog := t.p
+		t.mu.Unlock()
+		if t.onProgress != nil {
+			t.onProgress(prog)
+		}
+	}
+	if err != nil && err != io.EOF {
+		err = t.err(err)
+	}
+	return n, err
+}
+
+// err translates an error caused by aborting the transfer into a *StallError
+// or ErrCancelled, as appropriate. Other errors are returned unchanged.
+func (t *Transfer) err(err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.cancelled:
+		return ErrCancelled
+	case t.stalled:
+		return &StallError{Timeout: t.stallTimeout}
+	default:
+		return err
+	}
+}
+
+// Progress returns the current progress of the transfer.
+func (t *Transfer) Progress() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.p
+}
+
+// Cancel aborts the transfer; subsequent reads return ErrCancelled. It is safe
+// to call Cancel concurrently with Read, and more than once.
+func (t *Transfer) Cancel() {
+	t.mu.Lock()
+	if !t.stalled {
+		t.cancelled = true
+	}
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// Close releases the resources held by the transfer, aborting it if it is
+// still in progress.
+func (t *Transfer) Close() error {
+	if t.stallTimer != nil {
+		t.stallTimer.Stop()
+	}
+	t.cancel()
+	if t.Response != nil {
+		return t.Response.Body.Close()
+	}
+	return nil
+}
+
+// HeaderTransport is an http.RoundTripper that adds headers to each request.
+// The headers are added to requests made when following a redirect only if
+// the redirect stays on the original request's scheme, host & port, or if the
+// redirect's host is one of RedirectHosts and does not downgrade the request
+// from HTTPS to HTTP.
+type HeaderTransport struct {
+	Base          http.RoundTripper // the transport to send requests with; http.DefaultTransport if nil
+	Header        http.Header       // the headers to add
+	RedirectHosts []string          // hosts to which the headers are also sent when redirected
+}
+
+func (t *HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if !t.forward(req) {
+		return base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for k, vs := range t.Header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	return base.RoundTrip(req)
+}
+
+// forward determines whether the headers should be added to the given request.
+func (t *HeaderTransport) forward(req *http.Request) bool {
+	if req.Response == nil {
+		return true
+	}
+	orig := req
+	for orig.Response != nil && orig.Response.Request != nil {
+		orig = orig.Response.Request
+	}
+	if req.URL.Scheme == orig.URL.Scheme && req.URL.Host == orig.URL.Host {
+		return true
+	}
+	if orig.URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return false
+	}
+	for _, h := range t.RedirectHosts {
+		if req.URL.Hostname() == h {
+			return true
+		}
+	}
+	return false
+}
+
+// LimitRedirects returns a function, suitable for use as an http.Client's
+// CheckRedirect, which stops following redirects after the given number.
+func LimitRedirects(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+		return nil
+	}
+}
+
+// HostError is returned when a request is refused because of the host or
+// address it would be sent to.
+type HostError struct {
+	Host   string // the refused host or address
+	Reason string
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("refused to connect to %q: %s", e.Host, e.Reason)
+}
+
+// HostTransport is an http.RoundTripper that refuses requests, including
+// those made when following a redirect, to hosts other than Hosts. Refused
+// requests fail with a *HostError.
+type HostTransport struct {
+	Base  http.RoundTripper // the transport to send requests with; http.DefaultTransport if nil
+	Hosts []string          // the hosts requests may be sent to, compared case-insensitively
+}
+
+func (t *HostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	for _, h := range t.Hosts {
+		if strings.EqualFold(host, h) {
+			base := t.Base
+			if base == nil {
+				base = http.DefaultTransport
+			}
+			return base.RoundTrip(req)
+		}
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, &HostError{Host: host, Reason: "host is not allowed"}
+}
+
+// DecodeTransport is an http.RoundTripper that decodes response bodies
+// compressed with the gzip or deflate content codings, regardless of the
+// request's Accept-Encoding header (which http.Transport's own transparent
+// decompression requires be unset). GET requests without an Accept-Encoding
+// header or a Range header are sent with "Accept-Encoding: gzip, deflate".
+// Decoded responses have no Content-Encoding or Content-Length, and their
+// Uncompressed field is set.
+type DecodeTransport struct {
+	Base http.RoundTripper // the transport to send requests with; http.DefaultTransport if nil
+}
+
+func (t *DecodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if req.Method == http.MethodGet && req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	var newReader func(io.Reader) (io.ReadCloser, error)
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		newReader = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case "deflate":
+		newReader = zlib.NewReader
+	default:
+		return resp, nil
+	}
+	// The decoded size is not known until the body is read, including for
+	// HEAD requests, whose Content-Length would be of the encoded body.
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	if req.Method != http.MethodHead {
+		resp.Body = &decodeReader{body: resp.Body, newReader: newReader}
+	}
+	return resp, nil
+}
+
+// decodeReader decodes a response body, creating its decoder on the first
+// read so that reading the encoding's header is subject to the same limits as
+// reading the rest of the body.
+type decodeReader struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.ReadCloser, error)
+	r         io.ReadCloser // nil until the first read
+	err       error         // the error creating r, if any
+}
+
+func (d *decodeReader) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		r, err := d.newReader(d.body)
+		if err != nil {
+			d.err = fmt.Errorf("could not decode body: %v", err)
+		} else {
+			d.r = r
+		}
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *decodeReader) Close() error {
+	return d.body.Close()
+}
+
+// DenyPrivate is suitable for use as a net.Dialer's Control function. It
+// refuses connections to addresses which are not public: loopback, private
+// (RFC 1918 & RFC 4193), link-local & unspecified addresses. Since it is
+// called with the resolved address, a host cannot evade it by resolving to
+// a different address once checked. Refused connections fail with a
+// *HostError.
+func DenyPrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return &HostError{Host: host, Reason: "address is not public"}
+	}
+	return nil
+}
+
+// FTPTransport is an http.RoundTripper that fetches ftp:// & ftps:// URLs,
+// suitable for registering with an http.Transport's RegisterProtocol. GET
+// requests retrieve the file named by the URL's path, relative to the login
+// directory; HEAD requests report its size as the response's Content-Length,
+// if the server supports SIZE. A file the server refuses to retrieve results
+// in a 404 response. The Content-Type is guessed from the file's extension.
+//
+// ftps:// URLs use explicit TLS ("AUTH TLS"), protecting both the control &
+// data connections. Data connections are always passive (EPSV, else PASV),
+// and are made to the address of the control connection.
+type FTPTransport struct {
+	User, Password string      // the credentials used for URLs without any; anonymous login if User is empty
+	TLSConfig      *tls.Config // the TLS configuration for ftps:// URLs; the default if nil
+
+	// DialContext dials the control & data connections; a net.Dialer's if nil.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (t *FTPTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	u := req.URL
+	if u.Scheme != "ftp" && u.Scheme != "ftps" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return nil, fmt.Errorf("unsupported method %q for FTP", req.Method)
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	if p == "" || strings.ContainsAny(p, "\r\n") {
+		return nil, fmt.Errorf("URL %q does not name a file", u.Redacted())
+	}
+
+	c, err := t.login(req.Context(), u)
+	if err != nil {
+		return nil, fmt.Errorf("could not log in to %q: %v", u.Host, err)
+	}
+	resp, err := c.retrieve(req, p)
+	if err != nil || resp.Body == http.NoBody {
+		c.quit()
+	}
+	return resp, err
+}
+
+func (t *FTPTransport) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if t.DialContext != nil {
+		return t.DialContext(ctx, network, address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// login connects to the server named by the given URL, logs in & switches to
+// binary transfers.
+func (t *FTPTransport) login(ctx context.Context, u *url.URL) (_ *ftpConn, err error) {
+	port := u.Port()
+	if port == "" {
+		port = "21"
+	}
+	conn, err := t.dial(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &ftpConn{
+		ctx:   ctx,
+		host:  host,
+		dial:  t.dial,
+		text:  textproto.NewConn(conn),
+		conns: []net.Conn{conn},
+		done:  make(chan struct{}),
+	}
+	go c.closeOnCancel()
+	defer func() {
+		if err != nil {
+			c.close()
+		}
+	}()
+
+	if _, _, err := c.read(2); err != nil {
+		return nil, err
+	}
+	if u.Scheme == "ftps" {
+		if _, _, err := c.cmd(2, "AUTH TLS"); err != nil {
+			return nil, fmt.Errorf("could not start TLS: %v", err)
+		}
+		cfg := &tls.Config{}
+		if t.TLSConfig != nil {
+			cfg = t.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		if cfg.ClientSessionCache == nil {
+			// Servers commonly require that data connections resume the
+			// control connection's TLS session.
+			cfg.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, c.ctxErr(err)
+		}
+		c.text, c.tls = textproto.NewConn(tc), cfg
+		if _, _, err := c.cmd(2, "PBSZ 0"); err != nil {
+			return nil, err
+		}
+		if _, _, err := c.cmd(2, "PROT P"); err != nil {
+			return nil, err
+		}
+	}
+
+	user, pass := t.User, t.Password
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	if user == "" {
+		user, pass = "anonymous", "anonymous@"
+	}
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return nil, err
+	}
+	switch code {
+	case 230:
+	case 331:
+		if _, _, err := c.cmd(2, "PASS %s", pass); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &textproto.Error{Code: code, Msg: msg}
+	}
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ftpConn is a logged-in FTP control connection, along with the data
+// connection of its transfer, if any.
+type ftpConn struct {
+	ctx  context.Context
+	host string // the address of the server, to which data connections are made
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+	text *textproto.Conn
+	tls  *tls.Config // the configuration for data connections; nil if they are not protected
+
+	mu        sync.Mutex
+	conns     []net.Conn    // the connections to close when done or canceled
+	done      chan struct{} // closed once the connections are closed
+	closeOnce sync.Once
+}
+
+// closeOnCancel closes the connections if the context is done before they are
+// closed otherwise, interrupting any blocked reads or writes.
+func (c *ftpConn) closeOnCancel() {
+	select {
+	case <-c.ctx.Done():
+		c.close()
+	case <-c.done:
+	}
+}
+
+func (c *ftpConn) close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+		close(c.done)
+	})
+}
+
+// quit ends the session, closing the connections once the server has replied
+// or a short time has passed.
+func (c *ftpConn) quit() {
+	c.mu.Lock()
+	c.conns[0].SetDeadline(time.Now().Add(5 * time.Second))
+	c.mu.Unlock()
+	c.cmd(2, "QUIT")
+	c.close()
+}
+
+// ctxErr returns the context's error in place of the given one if the context
+// is done, since the latter is then likely caused by closing the connections.
+func (c *ftpConn) ctxErr(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+// read reads a reply, which must have the given code as textproto.Reader's
+// ReadResponse requires (any code if 0).
+func (c *ftpConn) read(expectCode int) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(expectCode)
+	return code, msg, c.ctxErr(err)
+}
+
+// cmd sends a command and reads its reply, which must have the given code as
+// for read.
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if _, err := c.text.Cmd(format, args...); err != nil {
+		return 0, "", c.ctxErr(err)
+	}
+	return c.read(expectCode)
+}
+
+// retrieve responds to a request for the file at the given path. Responses
+// without a body have http.NoBody; otherwise, closing the body ends the
+// session.
+func (c *ftpConn) retrieve(req *http.Request, p string) (*http.Response, error) {
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		Header:        http.Header{},
+		Body:          http.NoBody,
+		ContentLength: -1,
+		Request:       req,
+	}
+	if typ := mime.TypeByExtension(path.Ext(p)); typ != "" {
+		resp.Header.Set("Content-Type", typ)
+	}
+	// The size is only informational, so servers without SIZE are tolerated.
+	if _, msg, err := c.cmd(213, "SIZE %s", p); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil && n >= 0 {
+			resp.ContentLength = n
+		}
+	} else if c.ctx.Err() != nil {
+		return nil, c.ctx.Err()
+	}
+	if req.Method == http.MethodHead {
+		return resp, nil
+	}
+
+	data, err := c.openData()
+	if err != nil {
+		return nil, fmt.Errorf("could not open data connection: %v", err)
+	}
+	if _, _, err := c.cmd(1, "RETR %s", p); err != nil {
+		data.Close()
+		var te *textproto.Error
+		if errors.As(err, &te) && te.Code == 550 {
+			resp.Status, resp.StatusCode, resp.ContentLength = "404 Not Found", 404, -1
+			resp.Header.Del("Content-Type")
+			return resp, nil
+		}
+		return nil, err
+	}
+	if c.tls != nil {
+		// Servers start TLS on the data connection once they have accepted
+		// the transfer.
+		tc := tls.Client(data, c.tls)
+		if err := tc.HandshakeContext(c.ctx); err != nil {
+			data.Close()
+			return nil, fmt.Errorf("could not start TLS on data connection: %v", c.ctxErr(err))
+		}
+		data = tc
+	}
+	resp.Body = &ftpBody{c: c, data: data}
+	return resp, nil
+}
+
+// openData opens a passive data connection, which is not yet protected by TLS
+// even if data connections should be.
+func (c *ftpConn) openData() (net.Conn, error) {
+	port, err := c.epsv()
+	if err != nil {
+		if c.ctx.Err() != nil {
+			return nil, c.ctx.Err()
+		}
+		if port, err = c.pasv(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := c.dial(c.ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		conn.Close()
+		return nil, c.ctxErr(net.ErrClosed)
+	default:
+	}
+	c.conns = append(c.conns, conn)
+	return conn, nil
+}
+
+// epsv requests a data port with EPSV, whose reply is of the form
+// "229 Entering Extended Passive Mode (|||6446|)".
+func (c *ftpConn) epsv() (int, error) {
+	_, msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return 0, err
+	}
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start+2 {
+		return 0, fmt.Errorf("malformed EPSV reply %q", msg)
+	}
+	fields := strings.Split(msg[start+2:end], msg[start+1:start+2])
+	if len(fields) != 4 {
+		return 0, fmt.Errorf("malformed EPSV reply %q", msg)
+	}
+	port, err := strconv.ParseUint(fields[2], 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("malformed EPSV reply %q", msg)
+	}
+	return int(port), nil
+}
+
+// pasv requests a data port with PASV, whose reply is of the form
+// "227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)". The reply's address is
+// ignored, as servers behind NAT commonly report a private one.
+func (c *ftpConn) pasv() (int, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	start := strings.IndexAny(msg, "0123456789")
+	end := strings.LastIndexAny(msg, "0123456789")
+	if start < 0 {
+		return 0, fmt.Errorf("malformed PASV reply %q", msg)
+	}
+	fields := strings.Split(msg[start:end+1], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("malformed PASV reply %q", msg)
+	}
+	p1, err1 := strconv.ParseUint(fields[4], 10, 8)
+	p2, err2 := strconv.ParseUint(fields[5], 10, 8)
+	if err1 != nil || err2 != nil || p1<<8|p2 == 0 {
+		return 0, fmt.Errorf("malformed PASV reply %q", msg)
+	}
+	return int(p1<<8 | p2), nil
+}
+
+// ftpBody is the body of a response to a GET request, read from the data
+// connection. Reaching the end of the data is an error unless the server
+// reports that the transfer completed, so that a dropped data connection is
+// not mistaken for the end of the file.
+type ftpBody struct {
+	c    *ftpConn
+	data net.Conn
+	done bool // whether the server has reported that the transfer completed
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	n, err := b.data.Read(p)
+	if err == io.EOF {
+		b.data.Close()
+		if _, _, err := b.c.read(2); err != nil {
+			return n, fmt.Errorf("transfer did not complete: %v", err)
+		}
+		b.done = true
+		return n, io.EOF
+	}
+	return n, b.c.ctxErr(err)
+}
+
+func (b *ftpBody) Close() error {
+	b.data.Close()
+	b.c.quit()
+	return nil
+}
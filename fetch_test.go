@@ -0,0 +1,735 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBody(t *testing.T) {
+	t.Parallel()
+
+	const content = "<rss></rss>"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/endless", func(w http.ResponseWriter, r *http.Request) {
+		// Stream forever, or until the client goes away.
+		buf := bytes.Repeat([]byte("a"), 1<<10)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		// Trickle data forever, or until the client goes away.
+		for {
+			if _, err := w.Write([]byte("a")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		desc        string
+		path        string
+		maxSize     int64
+		timeout     time.Duration
+		want        string
+		wantErr     *regexp.Regexp
+		wantLimited bool
+	}{
+		{
+			desc: "no_limits",
+			path: "/feed",
+			want: content,
+		},
+		{
+			desc:    "within_limits",
+			path:    "/feed",
+			maxSize: int64(len(content)),
+			timeout: time.Minute,
+			want:    content,
+		},
+		{
+			desc:    "bad_status",
+			path:    "/missing",
+			wantErr: regexp.MustCompile("unexpected status code .*: 404"),
+		},
+		{
+			desc:        "too_large",
+			path:        "/feed",
+			maxSize:     int64(len(content)) - 1,
+			wantErr:     regexp.MustCompile("feed exceeded 10 bytes"),
+			wantLimited: true,
+		},
+		{
+			desc:        "endless",
+			path:        "/endless",
+			maxSize:     10 << 20,
+			wantErr:     regexp.MustCompile("feed exceeded 10MB"),
+			wantLimited: true,
+		},
+		{
+			desc:        "timeout",
+			path:        "/slow",
+			maxSize:     10 << 20,
+			timeout:     100 * time.Millisecond,
+			wantErr:     regexp.MustCompile("feed exceeded fetch timeout of 100ms"),
+			wantLimited: true,
+		},
+	} {
+		// Subtests are not run in parallel, as they share the test server.
+		t.Run(test.desc, func(t *testing.T) {
+			got, err := Body(srv.Client(), srv.URL+test.path, test.maxSize, test.timeout)
+			if test.wantErr != nil {
+				if err == nil || !test.wantErr.MatchString(err.Error()) {
+					t.Errorf("Body got error %q, wanted error matching pattern %q", err, test.wantErr)
+				}
+				var le *LimitError
+				if got := errors.As(err, &le); got != test.wantLimited {
+					t.Errorf("Body got error of type %T, want *LimitError: %v", err, test.wantLimited)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Body got unexpected error: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Body = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeadMatches(t *testing.T) {
+	t.Parallel()
+
+	const content = "episode contents"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader([]byte(content)))
+	})
+	mux.HandleFunc("/no_head", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte(content))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "rssdl_fetch_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	same, different := filepath.Join(dir, "same"), filepath.Join(dir, "different")
+	if err := ioutil.WriteFile(same, []byte(content), 0640); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+	if err := ioutil.WriteFile(different, []byte(content+" (extended cut)"), 0640); err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	r, err := Head(srv.Client(), srv.URL+"/file")
+	if err != nil {
+		t.Fatalf("Head got unexpected error: %v", err)
+	}
+	if want := (Remote{Size: int64(len(content)), ETag: `"v1"`}); *r != want {
+		t.Errorf("Head = %+v, want %+v", *r, want)
+	}
+	for _, test := range []struct {
+		desc, path, etag string
+		want             bool
+	}{
+		{"match", same, "", true},
+		{"etag_match", same, `"v1"`, true},
+		{"etag_mismatch", same, `"v0"`, false},
+		{"size_mismatch", different, "", false},
+		{"missing", filepath.Join(dir, "missing"), "", false},
+	} {
+		got, err := r.Matches(test.path, test.etag)
+		if err != nil {
+			t.Errorf("[%s] Matches got unexpected error: %v", test.desc, err)
+		}
+		if got != test.want {
+			t.Errorf("[%s] Matches = %v, want %v", test.desc, got, test.want)
+		}
+	}
+
+	// A resource of unknown size matches nothing.
+	if got, err := (&Remote{Size: -1}).Matches(same, ""); err != nil || got {
+		t.Errorf("Matches with unknown size = %v, %v, want false, nil", got, err)
+	}
+
+	if _, err := Head(srv.Client(), srv.URL+"/no_head"); err == nil || !regexp.MustCompile("unexpected status code .*: 405").MatchString(err.Error()) {
+		t.Errorf("Head of server rejecting HEAD got error %v, want 405 error", err)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	t.Parallel()
+
+	const content = "episode contents"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	})
+	mux.HandleFunc("/half", func(w http.ResponseWriter, r *http.Request) {
+		// Send half of the body, then hang until the client goes away.
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write([]byte(content[:len(content)/2]))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// Subtests are not run in parallel, as they share the test server.
+	t.Run("complete", func(t *testing.T) {
+		var progress []int64
+		tr, err := StartTransfer(srv.Client(), srv.URL+"/file", time.Minute, func(p Progress) {
+			progress = append(progress, p.Bytes)
+		})
+		if err != nil {
+			t.Fatalf("StartTransfer got unexpected error: %v", err)
+		}
+		defer tr.Close()
+		got, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll got unexpected error: %v", err)
+		}
+		if string(got) != content {
+			t.Errorf("ReadAll = %q, want %q", got, content)
+		}
+		if p := tr.Progress(); p.Bytes != int64(len(content)) || p.URL != srv.URL+"/file" || p.LastProgress.Before(p.Started) {
+			t.Errorf("Progress() = %+v, want %d bytes from %q", p, len(content), srv.URL+"/file")
+		}
+		if len(progress) == 0 || progress[len(progress)-1] != int64(len(content)) {
+			t.Errorf("Progress callback got %v, want it to end with %d", progress, len(content))
+		}
+	})
+
+	t.Run("stalled", func(t *testing.T) {
+		tr, err := StartTransfer(srv.Client(), srv.URL+"/half", 100*time.Millisecond, nil)
+		if err != nil {
+			t.Fatalf("StartTransfer got unexpected error: %v", err)
+		}
+		defer tr.Close()
+		_, err = ioutil.ReadAll(tr)
+		var se *StallError
+		if !errors.As(err, &se) || se.Timeout != 100*time.Millisecond {
+			t.Errorf("ReadAll got error %v, want *StallError with timeout 100ms", err)
+		}
+		if got, want := tr.Progress().Bytes, int64(len(content)/2); got != want {
+			t.Errorf("Progress().Bytes = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		tr, err := StartTransfer(srv.Client(), srv.URL+"/half", 0, func(p Progress) {})
+		if err != nil {
+			t.Fatalf("StartTransfer got unexpected error: %v", err)
+		}
+		defer tr.Close()
+		// Cancel once the first half of the body has been read.
+		buf := make([]byte, len(content)/2)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			t.Fatalf("ReadFull got unexpected error: %v", err)
+		}
+		tr.Cancel()
+		if _, err := ioutil.ReadAll(tr); err != ErrCancelled {
+			t.Errorf("ReadAll after Cancel got error %v, want %v", err, ErrCancelled)
+		}
+	})
+}
+
+func TestHeaderTransport(t *testing.T) {
+	t.Parallel()
+
+	echo := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, r.Header.Get("Authorization")) }
+	cdnMux := http.NewServeMux()
+	cdnMux.HandleFunc("/echo", echo)
+	cdn := httptest.NewServer(cdnMux)
+	defer cdn.Close()
+	// Refer to the CDN as localhost so that it differs from the origin's host.
+	cdnURL := fmt.Sprintf("http://localhost:%d", cdn.Listener.Addr().(*net.TCPAddr).Port)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", echo)
+	mux.HandleFunc("/same", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/echo", http.StatusFound) })
+	mux.HandleFunc("/cross", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdnURL+"/echo", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/loop", http.StatusFound) })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		desc          string
+		path          string
+		redirectHosts []string
+		want          string
+	}{
+		{"direct", "/echo", nil, "secret"},
+		{"same_origin", "/same", nil, "secret"},
+		{"cross_origin", "/cross", nil, ""},
+		{"cross_origin_other_host_allowed", "/cross", []string{"cdn.example.com"}, ""},
+		{"cross_origin_allowed", "/cross", []string{"localhost"}, "secret"},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			client := &http.Client{Transport: &HeaderTransport{
+				Header:        http.Header{"Authorization": {"secret"}},
+				RedirectHosts: test.redirectHosts,
+			}}
+			got, err := Body(client, srv.URL+test.path, 0, 0)
+			if err != nil {
+				t.Fatalf("Body got unexpected error: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Authorization header seen by server = %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("limit_redirects", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: LimitRedirects(2)}
+		if _, err := Body(client, srv.URL+"/loop", 0, 0); err == nil || !regexp.MustCompile("stopped after 2 redirects").MatchString(err.Error()) {
+			t.Errorf("Body got error %v, want redirect limit error", err)
+		}
+	})
+}
+
+func TestHeaderTransportDowngrade(t *testing.T) {
+	t.Parallel()
+
+	orig, err := http.NewRequest(http.MethodGet, "https://example.com/feed", nil)
+	if err != nil {
+		t.Fatalf("NewRequest got unexpected error: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://cdn.example.com/file", nil)
+	if err != nil {
+		t.Fatalf("NewRequest got unexpected error: %v", err)
+	}
+	req.Response = &http.Response{Request: orig}
+	ht := &HeaderTransport{Header: http.Header{"Authorization": {"secret"}}, RedirectHosts: []string{"cdn.example.com"}}
+	if ht.forward(req) {
+		t.Errorf("forward of HTTPS to HTTP redirect = true, want false")
+	}
+	req.URL.Scheme = "https"
+	if !ht.forward(req) {
+		t.Errorf("forward of HTTPS to HTTPS redirect = false, want true")
+	}
+}
+
+func TestHostTransport(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "contents") })
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	// Refer to the server as localhost, as well as by its IP address.
+	localURL := fmt.Sprintf("http://localhost:%d", srv.Listener.Addr().(*net.TCPAddr).Port)
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, localURL+"/file", http.StatusFound)
+	})
+
+	for _, test := range []struct {
+		desc     string
+		url      string
+		hosts    []string
+		wantHost string // the refused host; empty if the request should succeed
+	}{
+		{"allowed", srv.URL + "/file", []string{"127.0.0.1"}, ""},
+		{"allowed_ignoring_case", localURL + "/file", []string{"LocalHost"}, ""},
+		{"not_allowed", srv.URL + "/file", []string{"example.com"}, "127.0.0.1"},
+		{"redirect_allowed", srv.URL + "/redirect", []string{"127.0.0.1", "localhost"}, ""},
+		{"redirect_not_allowed", srv.URL + "/redirect", []string{"127.0.0.1"}, "localhost"},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			client := &http.Client{Transport: &HostTransport{Hosts: test.hosts}}
+			tr, err := StartTransfer(client, test.url, 0, nil)
+			if err == nil {
+				tr.Close()
+			}
+			var he *HostError
+			switch {
+			case test.wantHost == "" && err != nil:
+				t.Errorf("StartTransfer got unexpected error: %v", err)
+			case test.wantHost != "" && (!errors.As(err, &he) || he.Host != test.wantHost):
+				t.Errorf("StartTransfer got error %v, want *HostError for %q", err, test.wantHost)
+			}
+		})
+	}
+}
+
+func TestDecodeTransport(t *testing.T) {
+	t.Parallel()
+
+	const contents = "contents"
+	var gzipped, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	io.WriteString(gw, contents)
+	gw.Close()
+	zw := zlib.NewWriter(&deflated)
+	io.WriteString(zw, contents)
+	zw.Close()
+
+	// The server uses the first encoding accepted by the request.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		body := []byte(contents)
+		switch enc := strings.TrimSpace(strings.Split(r.Header.Get("Accept-Encoding"), ",")[0]); enc {
+		case "gzip":
+			w.Header().Set("Content-Encoding", enc)
+			body = gzipped.Bytes()
+		case "deflate":
+			w.Header().Set("Content-Encoding", enc)
+			body = deflated.Bytes()
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		desc           string
+		method         string
+		acceptEncoding string
+		wantAccept     string // the Accept-Encoding header received by the server
+		wantLength     int64
+	}{
+		{"default", http.MethodGet, "", "gzip, deflate", -1},
+		{"gzip", http.MethodGet, "gzip", "gzip", -1},
+		{"deflate", http.MethodGet, "deflate", "deflate", -1},
+		{"identity", http.MethodGet, "identity", "identity", int64(len(contents))},
+		{"head", http.MethodHead, "", "", int64(len(contents))},
+		{"head_gzip", http.MethodHead, "gzip", "gzip", -1},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, srv.URL, nil)
+			if err != nil {
+				t.Fatalf("Couldn't create request: %v", err)
+			}
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			client := &http.Client{Transport: &DecodeTransport{}}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Do got unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Couldn't read body: %v", err)
+			}
+			if got := resp.Header.Get("X-Accept-Encoding"); got != test.wantAccept {
+				t.Errorf("Server got Accept-Encoding %q, want %q", got, test.wantAccept)
+			}
+			if resp.ContentLength != test.wantLength {
+				t.Errorf("Got ContentLength %d, want %d", resp.ContentLength, test.wantLength)
+			}
+			if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("Got Content-Encoding %q, want none", ce)
+			}
+			wantBody := contents
+			if test.method == http.MethodHead {
+				wantBody = ""
+			}
+			if string(body) != wantBody {
+				t.Errorf("Got body %q, want %q", body, wantBody)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, "not gzip")
+		}))
+		defer srv.Close()
+		client := &http.Client{Transport: &DecodeTransport{}}
+		tr, err := StartTransfer(client, srv.URL, 0, nil)
+		if err != nil {
+			t.Fatalf("StartTransfer got unexpected error: %v", err)
+		}
+		defer tr.Close()
+		if _, err := ioutil.ReadAll(tr); err == nil {
+			t.Errorf("Reading undecodable body got no error")
+		}
+	})
+}
+
+func TestDenyPrivate(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		address string
+		want    bool
+	}{
+		{"93.184.216.34:80", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:443", false},
+		{"[fd00::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+	} {
+		err := DenyPrivate("tcp", test.address, nil)
+		var he *HostError
+		if test.want && err != nil {
+			t.Errorf("DenyPrivate(%q) got unexpected error: %v", test.address, err)
+		}
+		if !test.want && !errors.As(err, &he) {
+			t.Errorf("DenyPrivate(%q) got error %v, want *HostError", test.address, err)
+		}
+	}
+
+	// Connections are refused once the host is resolved.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "contents") }))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{DialContext: (&net.Dialer{Control: DenyPrivate}).DialContext}}
+	localURL := fmt.Sprintf("http://localhost:%d", srv.Listener.Addr().(*net.TCPAddr).Port)
+	var he *HostError
+	if _, err := StartTransfer(client, localURL, 0, nil); !errors.As(err, &he) {
+		t.Errorf("StartTransfer of %q got error %v, want *HostError", localURL, err)
+	}
+}
+
+func TestFTPTransport(t *testing.T) {
+	t.Parallel()
+
+	// Borrow httptest's certificate for FTPS.
+	tlsSrv := httptest.NewTLSServer(nil)
+	defer tlsSrv.Close()
+	clientTLS := tlsSrv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, test := range []struct {
+		desc       string
+		srv        ftpServer
+		user, pass string // the transport's credentials
+		method     string
+		path       string // the URL's path & any userinfo, e.g. "user:pass@/file"
+		wantStatus int
+		wantLength int64
+		wantBody   string
+		wantType   string
+		wantErr    bool
+	}{
+		{desc: "get", method: "GET", path: "/dir/file.mp3", wantStatus: 200, wantLength: 8, wantBody: "contents", wantType: "audio/mpeg"},
+		{desc: "get_pasv", srv: ftpServer{noEPSV: true}, method: "GET", path: "/dir/file.mp3", wantStatus: 200, wantLength: 8, wantBody: "contents", wantType: "audio/mpeg"},
+		{desc: "get_tls", srv: ftpServer{tls: tlsSrv.TLS}, method: "GET", path: "/dir/file.mp3", wantStatus: 200, wantLength: 8, wantBody: "contents", wantType: "audio/mpeg"},
+		{desc: "head", method: "HEAD", path: "/dir/file.mp3", wantStatus: 200, wantLength: 8, wantType: "audio/mpeg"},
+		{desc: "not_found", method: "GET", path: "/dir/missing.mp3", wantStatus: 404, wantLength: -1},
+		{desc: "credentials", srv: ftpServer{user: "user", pass: "pass"}, user: "user", pass: "pass", method: "GET", path: "/dir/file.mp3", wantStatus: 200, wantLength: 8, wantBody: "contents", wantType: "audio/mpeg"},
+		{desc: "url_credentials", srv: ftpServer{user: "user", pass: "pass"}, user: "other", pass: "other", method: "GET", path: "user:pass@/dir/file.mp3", wantStatus: 200, wantLength: 8, wantBody: "contents", wantType: "audio/mpeg"},
+		{desc: "bad_credentials", srv: ftpServer{user: "user", pass: "pass"}, user: "user", pass: "wrong", method: "GET", path: "/dir/file.mp3", wantErr: true},
+		{desc: "no_file", method: "GET", path: "/", wantErr: true},
+		{desc: "bad_method", method: "POST", path: "/dir/file.mp3", wantErr: true},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			srv := test.srv
+			srv.files = map[string]string{"dir/file.mp3": "contents"}
+			addr := srv.start(t)
+			scheme := "ftp"
+			if srv.tls != nil {
+				scheme = "ftps"
+			}
+			u := fmt.Sprintf("%s://%s", scheme, addr) + test.path
+			if i := strings.Index(test.path, "@"); i >= 0 {
+				u = fmt.Sprintf("%s://%s%s", scheme, test.path[:i+1], addr) + test.path[i+1:]
+			}
+
+			tr := &http.Transport{}
+			tr.RegisterProtocol("ftp", &FTPTransport{User: test.user, Password: test.pass})
+			tr.RegisterProtocol("ftps", &FTPTransport{User: test.user, Password: test.pass, TLSConfig: clientTLS})
+			req, err := http.NewRequest(test.method, u, nil)
+			if err != nil {
+				t.Fatalf("Couldn't create request: %v", err)
+			}
+			resp, err := (&http.Client{Transport: tr}).Do(req)
+			if test.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("Do got no error, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Do got unexpected error: %v", err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Errorf("Couldn't read body: %v", err)
+			}
+			if resp.StatusCode != test.wantStatus || resp.ContentLength != test.wantLength || string(body) != test.wantBody || resp.Header.Get("Content-Type") != test.wantType {
+				t.Errorf("Do got status %d, length %d, body %q & type %q; want %d, %d, %q & %q", resp.StatusCode, resp.ContentLength, body, resp.Header.Get("Content-Type"), test.wantStatus, test.wantLength, test.wantBody, test.wantType)
+			}
+		})
+	}
+}
+
+// ftpServer is a minimal FTP server, sufficient for FTPTransport.
+type ftpServer struct {
+	files      map[string]string // file contents by path
+	user, pass string            // the required credentials; any are accepted if user is empty
+	noEPSV     bool              // whether to refuse EPSV, requiring PASV
+	tls        *tls.Config       // the configuration for AUTH TLS; refused if nil
+}
+
+// start starts the server, returning its address. The server is stopped when
+// the test finishes.
+func (s *ftpServer) start(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (s *ftpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	reply := func(code int, msg string) { text.PrintfLine("%d %s", code, msg) }
+	var dataLn net.Listener
+	defer func() {
+		if dataLn != nil {
+			dataLn.Close()
+		}
+	}()
+	listen := func() int {
+		if dataLn != nil {
+			dataLn.Close()
+		}
+		var err error
+		if dataLn, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return 0
+		}
+		return dataLn.Addr().(*net.TCPAddr).Port
+	}
+
+	var user string
+	var loggedIn, prot bool
+	reply(220, "Ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		switch {
+		case cmd == "AUTH" && s.tls != nil:
+			reply(234, "Starting TLS")
+			conn = tls.Server(conn, s.tls)
+			text = textproto.NewConn(conn)
+		case cmd == "PBSZ" || cmd == "TYPE":
+			reply(200, "OK")
+		case cmd == "PROT":
+			prot = arg == "P"
+			reply(200, "OK")
+		case cmd == "USER":
+			user = arg
+			reply(331, "Password required")
+		case cmd == "PASS":
+			if s.user != "" && (user != s.user || arg != s.pass) {
+				reply(530, "Login incorrect")
+				continue
+			}
+			loggedIn = true
+			reply(230, "Logged in")
+		case cmd == "QUIT":
+			reply(221, "Goodbye")
+			return
+		case !loggedIn:
+			reply(530, "Not logged in")
+		case cmd == "SIZE":
+			if f, ok := s.files[arg]; ok {
+				reply(213, fmt.Sprint(len(f)))
+			} else {
+				reply(550, "No such file")
+			}
+		case cmd == "EPSV" && !s.noEPSV:
+			reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", listen()))
+		case cmd == "PASV":
+			// Report a private address, which should be ignored.
+			port := listen()
+			reply(227, fmt.Sprintf("Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff))
+		case cmd == "RETR" && dataLn != nil:
+			f, ok := s.files[arg]
+			if !ok {
+				reply(550, "No such file")
+				continue
+			}
+			data, err := dataLn.Accept()
+			if err != nil {
+				reply(425, "Can't open data connection")
+				continue
+			}
+			reply(150, "Opening data connection")
+			if prot {
+				data = tls.Server(data, s.tls)
+			}
+			io.WriteString(data, f)
+			data.Close()
+			reply(226, "Transfer complete")
+		default:
+			reply(502, "Not implemented")
+		}
+	}
+}
@@ -0,0 +1,570 @@
+// Package health provides functionality for tracking the health of feeds
+// across checks.
+package health
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Status describes whether a feed is currently healthy.
+type Status uint8
+
+const (
+	OK Status = iota
+	ERROR
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case ERROR:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Health is a snapshot of the health of a single feed.
+type Health struct {
+	Status       Status
+	LastError    error     // the most recent error; nil if Status is OK
+	Since        time.Time // when the feed entered its current status; zero if the feed has never failed
+	FailedChecks int       // the number of consecutive failed checks
+
+	DownloadedBytes int64     // the total number of bytes downloaded for the feed
+	Download        *Download // the in-progress download; nil if there is none
+}
+
+// Download describes the progress of an in-progress download.
+type Download struct {
+	URL          string
+	Bytes        int64     // the number of bytes downloaded so far
+	Started      time.Time // when the download started
+	LastProgress time.Time // when bytes were last downloaded
+}
+
+// Disposition describes what a check did with a feed item.
+type Disposition uint8
+
+const (
+	DOWNLOADED        Disposition = iota // the item was downloaded
+	SKIPPED_ORDER                        // the item's order was not new, or was out of bounds
+	SKIPPED_FILTER                       // the item did not pass a filter, e.g. an extension filter or content type
+	SKIPPED_AGE                          // the item was older than the feed's maximum item age
+	SKIPPED_DUPLICATE                    // the item was already downloaded, or duplicated another download
+	FAILED_DOWNLOAD                      // the item could not be downloaded
+	FAILED_GONE                          // the item's link was not found in too many checks, so the item was given up on
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case DOWNLOADED:
+		return "downloaded"
+	case SKIPPED_ORDER:
+		return "skipped:order"
+	case SKIPPED_FILTER:
+		return "skipped:filter"
+	case SKIPPED_AGE:
+		return "skipped:age"
+	case SKIPPED_DUPLICATE:
+		return "skipped:duplicate"
+	case FAILED_DOWNLOAD:
+		return "failed:download"
+	case FAILED_GONE:
+		return "failed:gone"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// MarshalText renders the disposition as String does, e.g. for JSON.
+func (d Disposition) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// Decision describes what a check did with a single feed item, and why.
+type Decision struct {
+	Title       string
+	Order       string // the order extracted from the title; empty if the title did not match
+	Disposition Disposition
+	Reason      string // a description of why the item was skipped or failed; empty if downloaded
+}
+
+// Recovery describes a feed returning to the OK status after failing.
+type Recovery struct {
+	Downtime     time.Duration // how long the feed was in the ERROR status
+	FailedChecks int           // how many checks failed while the feed was in the ERROR status
+}
+
+// Tracker tracks the health of a single feed. It is safe for concurrent use.
+type Tracker struct {
+	r *Registry // the registry events are published to; nil if none
+
+	mu         sync.Mutex // protects h, downloaded, download, cancel, decisions
+	h          Health     // DownloadedBytes & Download are not used; see downloaded & download
+	downloaded int64
+	download   *Download
+	cancel     func() // cancels the in-progress download; nil if there is none
+	decisions  []Decision
+}
+
+// Failure records a failed check at the given time.
+func (t *Tracker) Failure(now time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.h.Status != ERROR {
+		t.h.Status, t.h.Since = ERROR, now
+	}
+	t.h.LastError = err
+	t.h.FailedChecks++
+}
+
+// Success records a successful check at the given time. If the feed was
+// previously failing, a description of the recovery is returned; otherwise,
+// nil is returned.
+func (t *Tracker) Success(now time.Time) *Recovery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.h.Status != ERROR {
+		return nil
+	}
+	r := &Recovery{
+		Downtime:     now.Sub(t.h.Since),
+		FailedChecks: t.h.FailedChecks,
+	}
+	t.h = Health{Status: OK, Since: now}
+	return r
+}
+
+// AddDownloadedBytes adds to the total number of bytes downloaded for the
+// feed.
+func (t *Tracker) AddDownloadedBytes(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.downloaded += n
+}
+
+// StartDownload records the start of a download from the given URL at the
+// given time. The download can be cancelled with CancelDownload, which calls
+// cancel.
+func (t *Tracker) StartDownload(url string, now time.Time, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.download = &Download{URL: url, Started: now, LastProgress: now}
+	t.cancel = cancel
+}
+
+// DownloadProgress records that the in-progress download has downloaded the
+// given total number of bytes as of the given time.
+func (t *Tracker) DownloadProgress(bytes int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.download == nil {
+		return
+	}
+	d := *t.download
+	d.Bytes, d.LastProgress = bytes, now
+	t.download = &d
+}
+
+// FinishDownload records that the in-progress download has finished, whether
+// successfully or not.
+func (t *Tracker) FinishDownload() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.download, t.cancel = nil, nil
+}
+
+// CancelDownload cancels the in-progress download, if any. It returns true if
+// there was a download to cancel.
+func (t *Tracker) CancelDownload() bool {
+	t.mu.Lock()
+	cancel := t.cancel
+	t.mu.Unlock()
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// Health returns a snapshot of the feed's current health.
+func (t *Tracker) Health() Health {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := t.h
+	h.DownloadedBytes = t.downloaded
+	h.Download = t.download
+	return h
+}
+
+// Decisions returns the decisions made about each item by the most recent
+// check, as recorded by SetDecisions. The returned slice must not be modified.
+func (t *Tracker) Decisions() []Decision {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.decisions
+}
+
+// SetDecisions records the decisions made about each item by a check,
+// replacing those of the previous check. ds must not be modified afterwards.
+func (t *Tracker) SetDecisions(ds []Decision) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decisions = ds
+}
+
+// Publish publishes the given event to the subscribers of the tracker's
+// registry, if any. It never blocks.
+func (t *Tracker) Publish(e Event) {
+	if t.r != nil {
+		t.r.publish(e)
+	}
+}
+
+// Registry holds the health trackers for a set of feeds, by feed name. It is
+// safe for concurrent use.
+type Registry struct {
+	mu                 sync.Mutex // protects trackers, checks, peakChecks, alerts & alertLimits
+	trackers           map[string]*Tracker
+	checks, peakChecks int                      // the number of checks running, currently & at most
+	alerts             int                      // the number of alerts being sent
+	alertLimits        map[string]func() uint64 // alert command -> the number of alerts its rate limit has dropped
+
+	subMu   sync.Mutex // protects subs
+	subs    map[*subscription]struct{}
+	dropped uint64 // accessed atomically
+}
+
+// NewRegistry returns a new, empty registry.
+func NewRegistry() *Registry {
+	return &Registry{trackers: map[string]*Tracker{}, alertLimits: map[string]func() uint64{}, subs: map[*subscription]struct{}{}}
+}
+
+// Tracker returns the tracker for the given feed, creating it if necessary.
+func (r *Registry) Tracker(name string) *Tracker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.trackers[name]
+	if t == nil {
+		t = &Tracker{r: r}
+		r.trackers[name] = t
+	}
+	return t
+}
+
+// Names returns the names of all feeds in the registry, in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.trackers))
+	for n := range r.trackers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Health returns a snapshot of the health of every feed in the registry, by
+// feed name.
+func (r *Registry) Health() map[string]Health {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := make(map[string]Health, len(r.trackers))
+	for n, t := range r.trackers {
+		h[n] = t.Health()
+	}
+	return h
+}
+
+// Decisions returns the decisions made about each item by the most recent check
+// of every feed in the registry, by feed name.
+func (r *Registry) Decisions() map[string][]Decision {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ds := make(map[string][]Decision, len(r.trackers))
+	for n, t := range r.trackers {
+		ds[n] = t.Decisions()
+	}
+	return ds
+}
+
+// CancelDownload cancels the in-progress download of the given feed, if any.
+// It returns true if there was a download to cancel.
+func (r *Registry) CancelDownload(name string) bool {
+	r.mu.Lock()
+	t := r.trackers[name]
+	r.mu.Unlock()
+	if t == nil {
+		return false
+	}
+	return t.CancelDownload()
+}
+
+// StartCheck records that a check of a feed has begun.
+func (r *Registry) StartCheck() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks++
+	if r.checks > r.peakChecks {
+		r.peakChecks = r.checks
+	}
+}
+
+// FinishCheck records that a check begun with StartCheck has finished.
+func (r *Registry) FinishCheck() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks--
+}
+
+// Checks returns the number of checks currently running, and the most that
+// have run at once.
+func (r *Registry) Checks() (current, peak int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checks, r.peakChecks
+}
+
+// StartAlert records that an alert has begun to be sent.
+func (r *Registry) StartAlert() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts++
+}
+
+// FinishAlert records that an alert begun with StartAlert has been sent, or
+// abandoned.
+func (r *Registry) FinishAlert() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts--
+}
+
+// Alerts returns the number of alerts currently being sent.
+func (r *Registry) Alerts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.alerts
+}
+
+// AddAlertLimit records that alerts sent to the given alert command are rate
+// limited. dropped returns the number of alerts the limit has dropped so far.
+func (r *Registry) AddAlertLimit(cmd string, dropped func() uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alertLimits[cmd] = dropped
+}
+
+// DroppedAlerts returns the number of alerts dropped by the rate limit of each
+// rate-limited alert command, by command.
+func (r *Registry) DroppedAlerts() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := make(map[string]uint64, len(r.alertLimits))
+	for cmd, dropped := range r.alertLimits {
+		d[cmd] = dropped()
+	}
+	return d
+}
+
+// Event is something that happened while checking a feed. It is one of
+// CheckStarted, CheckFinished, ItemDownloaded, or ItemSkipped.
+type Event interface {
+	event()
+}
+
+// CheckStarted is published when a check of a feed begins.
+type CheckStarted struct {
+	Feed string
+}
+
+// CheckFinished is published when a check of a feed ends, successfully or not.
+type CheckFinished struct {
+	Feed            string
+	ItemsSeen       int   // the number of items the check made a decision about
+	ItemsDownloaded int   // the number of items downloaded by the check
+	Err             error // the error that failed the check; nil if it succeeded
+}
+
+// ItemDownloaded is published when an item is downloaded.
+type ItemDownloaded struct {
+	Feed  string
+	Title string
+	Path  string // the path the item was saved to
+	Bytes int64
+}
+
+// ItemSkipped is published when a check decides not to download an item.
+type ItemSkipped struct {
+	Feed        string
+	Title       string
+	Disposition Disposition
+	Reason      string
+}
+
+func (CheckStarted) event()   {}
+func (CheckFinished) event()  {}
+func (ItemDownloaded) event() {}
+func (ItemSkipped) event()    {}
+
+// subscriptionBuffer is the number of events buffered for each subscriber.
+const subscriptionBuffer = 64
+
+type subscription struct {
+	ch chan Event
+}
+
+// Subscribe returns a channel on which events published by the registry's
+// trackers are delivered, and a function which ends the subscription and
+// closes the channel. Delivery never blocks the publisher: if the
+// subscriber falls behind, its oldest buffered event is dropped to make room
+// and counted by DroppedEvents.
+func (r *Registry) Subscribe() (<-chan Event, func()) {
+	sub := &subscription{ch: make(chan Event, subscriptionBuffer)}
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	r.subs[sub] = struct{}{}
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			r.subMu.Lock()
+			defer r.subMu.Unlock()
+			delete(r.subs, sub)
+			close(sub.ch)
+		})
+	}
+}
+
+// DroppedEvents returns the number of events dropped because a subscriber's
+// buffer was full.
+func (r *Registry) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&r.dropped)
+}
+
+func (r *Registry) publish(e Event) {
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+	for sub := range r.subs {
+		for {
+			select {
+			case sub.ch <- e:
+			default:
+				// Buffer full: drop the oldest event & try again.
+				select {
+				case <-sub.ch:
+					atomic.AddUint64(&r.dropped, 1)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// WriteMetrics writes the health of every feed in the registry to w, as
+// metrics in the Prometheus text exposition format.
+func (r *Registry) WriteMetrics(w io.Writer) error {
+	names, hs := r.Names(), r.Health()
+	bw := bufio.NewWriter(w)
+	for _, m := range []struct {
+		name, typ, help string
+		val             func(h Health) (float64, bool)
+	}{
+		{
+			"rssdl_feed_up", "gauge", "Whether the feed's most recent check succeeded.",
+			func(h Health) (float64, bool) {
+				if h.Status == OK {
+					return 1, true
+				}
+				return 0, true
+			},
+		},
+		{
+			"rssdl_feed_failed_checks", "gauge", "The number of consecutive failed checks of the feed.",
+			func(h Health) (float64, bool) { return float64(h.FailedChecks), true },
+		},
+		{
+			"rssdl_feed_status_since_seconds", "gauge", "When the feed entered its current status, in seconds since the epoch.",
+			func(h Health) (float64, bool) { return float64(h.Since.Unix()), !h.Since.IsZero() },
+		},
+		{
+			"rssdl_feed_downloaded_bytes_total", "counter", "The total number of bytes downloaded for the feed.",
+			func(h Health) (float64, bool) { return float64(h.DownloadedBytes), true },
+		},
+	} {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, n := range names {
+			if v, ok := m.val(hs[n]); ok {
+				fmt.Fprintf(bw, "%s{feed=\"%s\"} %v\n", m.name, labelEscaper.Replace(n), v)
+			}
+		}
+	}
+	checks, peakChecks := r.Checks()
+	for _, m := range []struct {
+		name, help string
+		val        int
+	}{
+		{"rssdl_checks_running", "The number of feeds currently being fetched & parsed.", checks},
+		{"rssdl_checks_running_peak", "The most feeds that have been fetched & parsed at once.", peakChecks},
+		{"rssdl_alerts_in_flight", "The number of alerts currently being sent.", r.Alerts()},
+	} {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.val)
+	}
+	if da := r.DroppedAlerts(); len(da) > 0 {
+		cmds := make([]string, 0, len(da))
+		for cmd := range da {
+			cmds = append(cmds, cmd)
+		}
+		sort.Strings(cmds)
+		const name = "rssdl_alerts_dropped_total"
+		fmt.Fprintf(bw, "# HELP %s The number of alerts dropped by the alert command's rate limit.\n# TYPE %s counter\n", name, name)
+		for _, cmd := range cmds {
+			fmt.Fprintf(bw, "%s{alert_command=\"%s\"} %d\n", name, labelEscaper.Replace(cmd), da[cmd])
+		}
+	}
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetricsFile writes metrics as WriteMetrics does, to the given file. The
+// file is replaced atomically, so that readers such as node_exporter's
+// textfile collector never see a partially-written file.
+func (r *Registry) WriteMetricsFile(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".rssdl_metrics_")
+	if err != nil {
+		return fmt.Errorf("could not create metrics file: %v", err)
+	}
+	defer func() {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove %q: %v", f.Name(), err)
+		}
+	}()
+	if err := r.WriteMetrics(f); err != nil {
+		return fmt.Errorf("could not write metrics file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close metrics file: %v", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("could not chmod metrics file: %v", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("could not rename metrics file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package health
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	errA, errB := errors.New("error A"), errors.New("error B")
+
+	t.Run("healthy", func(t *testing.T) {
+		t.Parallel()
+		var tr Tracker
+		if r := tr.Success(start); r != nil {
+			t.Errorf("Success() = %+v, want nil", r)
+		}
+		if r := tr.Success(start.Add(time.Minute)); r != nil {
+			t.Errorf("Success() = %+v, want nil", r)
+		}
+		if got, want := tr.Health(), (Health{}); got != want {
+			t.Errorf("Health() = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		t.Parallel()
+		var tr Tracker
+		tr.Failure(start, errA)
+		tr.Failure(start.Add(time.Minute), errB)
+		want := Health{
+			Status:       ERROR,
+			LastError:    errB,
+			Since:        start,
+			FailedChecks: 2,
+		}
+		if got := tr.Health(); got != want {
+			t.Errorf("Health() = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("recovered_once", func(t *testing.T) {
+		t.Parallel()
+		var tr Tracker
+		tr.Success(start)
+		tr.Failure(start.Add(time.Minute), errA)
+		tr.Failure(start.Add(2*time.Minute), errA)
+		tr.Failure(start.Add(3*time.Minute), errB)
+
+		r := tr.Success(start.Add(5 * time.Minute))
+		want := &Recovery{Downtime: 4 * time.Minute, FailedChecks: 3}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("Success() = %+v, want %+v", r, want)
+		}
+		if got, want := tr.Health(), (Health{Status: OK, Since: start.Add(5 * time.Minute)}); got != want {
+			t.Errorf("Health() = %+v, want %+v", got, want)
+		}
+		if r := tr.Success(start.Add(6 * time.Minute)); r != nil {
+			t.Errorf("Second Success() = %+v, want nil", r)
+		}
+	})
+
+	t.Run("fails_again_after_recovery", func(t *testing.T) {
+		t.Parallel()
+		var tr Tracker
+		tr.Failure(start, errA)
+		tr.Success(start.Add(time.Minute))
+		tr.Failure(start.Add(10*time.Minute), errB)
+
+		r := tr.Success(start.Add(12 * time.Minute))
+		want := &Recovery{Downtime: 2 * time.Minute, FailedChecks: 1}
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("Success() = %+v, want %+v", r, want)
+		}
+	})
+}
+
+func TestDownloadedBytes(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	var tr Tracker
+	tr.AddDownloadedBytes(100)
+	tr.Failure(start, errors.New("error"))
+	tr.AddDownloadedBytes(50)
+	tr.Success(start.Add(time.Minute)) // recovering does not reset the total
+	tr.AddDownloadedBytes(25)
+	if got, want := tr.Health().DownloadedBytes, int64(175); got != want {
+		t.Errorf("Health().DownloadedBytes = %d, want %d", got, want)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	err := errors.New("error")
+
+	r := NewRegistry()
+	if r.Tracker("feed1") != r.Tracker("feed1") {
+		t.Errorf("Tracker returned different trackers for the same name")
+	}
+	r.Tracker("feed2").Failure(start, err)
+
+	if got, want := r.Names(), []string{"feed1", "feed2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	want := map[string]Health{
+		"feed1": {},
+		"feed2": {Status: ERROR, LastError: err, Since: start, FailedChecks: 1},
+	}
+	if got := r.Health(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Health() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecisions(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	first := []Decision{{Title: "Show S01E01", Order: "01", Disposition: DOWNLOADED}}
+	second := []Decision{
+		{Title: "Show S01E01", Order: "01", Disposition: SKIPPED_ORDER, Reason: "order not new"},
+		{Title: "Other", Disposition: SKIPPED_ORDER, Reason: "title does not match"},
+	}
+	r.Tracker("feed1").SetDecisions(first)
+	r.Tracker("feed1").SetDecisions(second) // replaces the previous check's decisions
+	r.Tracker("feed2")
+
+	want := map[string][]Decision{"feed1": second, "feed2": nil}
+	if got := r.Decisions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decisions() = %+v, want %+v", got, want)
+	}
+
+	// Dispositions are rendered by name, e.g. in JSON.
+	b, err := json.Marshal(second[0])
+	if err != nil {
+		t.Fatalf("json.Marshal got unexpected error: %v", err)
+	}
+	if got, want := string(b), `{"Title":"Show S01E01","Order":"01","Disposition":"skipped:order","Reason":"order not new"}`; got != want {
+		t.Errorf("json.Marshal(%+v) = %s, want %s", second[0], got, want)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	r := NewRegistry()
+	r.Tracker("feed1").AddDownloadedBytes(1024)
+	r.Tracker(`feed "2"`).Failure(start, errors.New("error"))
+	r.Tracker(`feed "2"`).Failure(start.Add(time.Minute), errors.New("error"))
+	r.StartCheck()
+	r.StartCheck()
+	r.FinishCheck()
+	r.StartAlert()
+	r.StartAlert()
+	r.StartAlert()
+	r.FinishAlert()
+	r.AddAlertLimit(`/bin/alert "slack"`, func() uint64 { return 57 })
+	r.AddAlertLimit("/bin/alert", func() uint64 { return 0 })
+
+	const want = `# HELP rssdl_feed_up Whether the feed's most recent check succeeded.
+# TYPE rssdl_feed_up gauge
+rssdl_feed_up{feed="feed \"2\""} 0
+rssdl_feed_up{feed="feed1"} 1
+# HELP rssdl_feed_failed_checks The number of consecutive failed checks of the feed.
+# TYPE rssdl_feed_failed_checks gauge
+rssdl_feed_failed_checks{feed="feed \"2\""} 2
+rssdl_feed_failed_checks{feed="feed1"} 0
+# HELP rssdl_feed_status_since_seconds When the feed entered its current status, in seconds since the epoch.
+# TYPE rssdl_feed_status_since_seconds gauge
+rssdl_feed_status_since_seconds{feed="feed \"2\""} 1.5035094e+09
+# HELP rssdl_feed_downloaded_bytes_total The total number of bytes downloaded for the feed.
+# TYPE rssdl_feed_downloaded_bytes_total counter
+rssdl_feed_downloaded_bytes_total{feed="feed \"2\""} 0
+rssdl_feed_downloaded_bytes_total{feed="feed1"} 1024
+# HELP rssdl_checks_running The number of feeds currently being fetched & parsed.
+# TYPE rssdl_checks_running gauge
+rssdl_checks_running 1
+# HELP rssdl_checks_running_peak The most feeds that have been fetched & parsed at once.
+# TYPE rssdl_checks_running_peak gauge
+rssdl_checks_running_peak 2
+# HELP rssdl_alerts_in_flight The number of alerts currently being sent.
+# TYPE rssdl_alerts_in_flight gauge
+rssdl_alerts_in_flight 2
+# HELP rssdl_alerts_dropped_total The number of alerts dropped by the alert command's rate limit.
+# TYPE rssdl_alerts_dropped_total counter
+rssdl_alerts_dropped_total{alert_command="/bin/alert"} 0
+rssdl_alerts_dropped_total{alert_command="/bin/alert \"slack\""} 57
+`
+	var buf bytes.Buffer
+	if err := r.WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics got unexpected error: %v", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("WriteMetrics wrote:\n%s\nwant:\n%s", got, want)
+	}
+
+	dir, err := ioutil.TempDir("", "rssdl_health_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "rssdl.prom")
+	for i := 0; i < 2; i++ {
+		if err := r.WriteMetricsFile(fn); err != nil {
+			t.Fatalf("WriteMetricsFile got unexpected error: %v", err)
+		}
+	}
+	got, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Couldn't read metrics file: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("WriteMetricsFile wrote:\n%s\nwant:\n%s", got, want)
+	}
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 1 {
+		t.Errorf("After WriteMetricsFile, directory has %d files (err %v), want 1", len(fis), err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	r := NewRegistry()
+	tr := r.Tracker("feed1")
+	if r.CancelDownload("feed1") {
+		t.Errorf("CancelDownload with no download = true, want false")
+	}
+	if r.CancelDownload("missing") {
+		t.Errorf("CancelDownload of unknown feed = true, want false")
+	}
+
+	cancelled := false
+	tr.StartDownload("https://example.com/file", start, func() { cancelled = true })
+	tr.DownloadProgress(100, start.Add(time.Second))
+	want := &Download{URL: "https://example.com/file", Bytes: 100, Started: start, LastProgress: start.Add(time.Second)}
+	if got := tr.Health().Download; !reflect.DeepEqual(got, want) {
+		t.Errorf("Health().Download = %+v, want %+v", got, want)
+	}
+	if !r.CancelDownload("feed1") || !cancelled {
+		t.Errorf("CancelDownload did not cancel the download")
+	}
+
+	tr.FinishDownload()
+	if got := tr.Health().Download; got != nil {
+		t.Errorf("After FinishDownload, Health().Download = %+v, want nil", got)
+	}
+	if r.CancelDownload("feed1") {
+		t.Errorf("CancelDownload after FinishDownload = true, want false")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+	tr := r.Tracker("feed1")
+	tr.Publish(CheckStarted{Feed: "feed1"}) // no subscribers: dropped silently
+
+	events, cancel := r.Subscribe()
+	for i := 0; i < subscriptionBuffer+2; i++ {
+		tr.Publish(CheckFinished{Feed: "feed1", ItemsSeen: i})
+	}
+	if got, want := r.DroppedEvents(), uint64(2); got != want {
+		t.Errorf("DroppedEvents = %d, want %d", got, want)
+	}
+	// The oldest events were dropped to make room for newer ones.
+	if e := <-events; e != (CheckFinished{Feed: "feed1", ItemsSeen: 2}) {
+		t.Errorf("First event = %+v, want CheckFinished with ItemsSeen 2", e)
+	}
+
+	cancel()
+	cancel() // cancelling twice is harmless
+	tr.Publish(CheckStarted{Feed: "feed1"})
+	n := 0
+	for range events {
+		n++
+	}
+	if want := subscriptionBuffer - 1; n != want {
+		t.Errorf("After cancel, received %d buffered events, want %d", n, want)
+	}
+
+	// Trackers outside of a registry do not publish events.
+	(&Tracker{}).Publish(CheckStarted{Feed: "feed2"})
+}
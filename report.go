@@ -0,0 +1,160 @@
+// Package report provides functionality for summarizing what happened to
+// feeds over a week, e.g. for a weekly digest of downloads & problems.
+package report
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BranLwyd/rssdl/health"
+	"github.com/BranLwyd/rssdl/weekly"
+)
+
+// Feed summarizes what happened to a single feed over a week.
+type Feed struct {
+	Name         string
+	Downloaded   []string // the titles of the items downloaded, in the order they were downloaded
+	Bytes        int64    // the number of bytes downloaded
+	Checks       int      // the number of checks which finished
+	FailedChecks int      // the number of checks which failed
+
+	// The feed's outstanding problems when the report is made, which a
+	// Collector does not know of; the zero values if there are none.
+	Err          error     // the error the feed is failing with
+	ErrSince     time.Time // when the feed began failing
+	LastDownload time.Time // when the feed last downloaded an item, if it is stale
+}
+
+// Report summarizes what happened to feeds over a week.
+type Report struct {
+	Start, End time.Time // the week reported on, from Start until just before End
+	Feeds      []*Feed   // sorted by name
+}
+
+// String renders the report as text, e.g. for the body of an email.
+func (r *Report) String() string {
+	var items, failing, stale int
+	var bytes int64
+	for _, f := range r.Feeds {
+		items += len(f.Downloaded)
+		bytes += f.Bytes
+		if f.Err != nil {
+			failing++
+		}
+		if !f.LastDownload.IsZero() {
+			stale++
+		}
+	}
+
+	const dateLayout = "Mon Jan 2 2006"
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Weekly report for %s to %s\n", r.Start.Format(dateLayout), r.End.AddDate(0, 0, -1).Format(dateLayout))
+	fmt.Fprintf(&sb, "%s downloaded (%d bytes); %s failing; %s stale\n", plural(items, "item"), bytes, plural(failing, "feed"), plural(stale, "feed"))
+	for _, f := range r.Feeds {
+		fmt.Fprintf(&sb, "\n[%s] %s downloaded (%d bytes); %s, %d failed\n", f.Name, plural(len(f.Downloaded), "item"), f.Bytes, plural(f.Checks, "check"), f.FailedChecks)
+		for _, title := range f.Downloaded {
+			fmt.Fprintf(&sb, "  %s\n", title)
+		}
+		if f.Err != nil {
+			fmt.Fprintf(&sb, "  Failing since %s: %v\n", f.ErrSince.Format("Mon Jan 2 2006 3:04PM"), f.Err)
+		}
+		if !f.LastDownload.IsZero() {
+			fmt.Fprintf(&sb, "  Stale: no item downloaded since %s\n", f.LastDownload.Format("Mon Jan 2 2006 3:04PM"))
+		}
+	}
+	return sb.String()
+}
+
+// plural formats a count of things, e.g. "1 item" or "2 items".
+func plural(n int, thing string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, thing)
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
+
+// Collector records the events published by feed checks, by the week in which
+// they happened, to report on each week once it is over. It is safe for
+// concurrent use.
+type Collector struct {
+	weekStart time.Weekday
+
+	mu    sync.Mutex                 // protects weeks
+	weeks map[int64]map[string]*Feed // by the Unix time each week starts, then by feed name
+}
+
+// NewCollector returns a collector of events into weeks beginning at midnight
+// on the given day, as the weekly package has them.
+func NewCollector(weekStart time.Weekday) *Collector {
+	return &Collector{weekStart: weekStart, weeks: map[int64]map[string]*Feed{}}
+}
+
+// Record records an event which happened at the given time. Only
+// health.CheckFinished & health.ItemDownloaded events are reported on; others
+// are ignored.
+func (c *Collector) Record(now time.Time, e health.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch e := e.(type) {
+	case health.CheckFinished:
+		f := c.feed(now, e.Feed)
+		f.Checks++
+		if e.Err != nil {
+			f.FailedChecks++
+		}
+	case health.ItemDownloaded:
+		f := c.feed(now, e.Feed)
+		f.Downloaded = append(f.Downloaded, e.Title)
+		f.Bytes += e.Bytes
+	}
+}
+
+// feed returns the summary of the named feed for the week containing the
+// given time, creating it if need be. c.mu must be held.
+func (c *Collector) feed(now time.Time, name string) *Feed {
+	start := weekly.StartOfWeek(now, c.weekStart).Unix()
+	feeds, ok := c.weeks[start]
+	if !ok {
+		feeds = map[string]*Feed{}
+		c.weeks[start] = feeds
+	}
+	f, ok := feeds[name]
+	if !ok {
+		f = &Feed{Name: name}
+		feeds[name] = f
+	}
+	return f
+}
+
+// Report returns a report on the last full week before the given time, and
+// forgets the events of that week & any earlier week. The report includes
+// the named feeds, even if nothing happened to them, as well as any other
+// feed with events that week.
+func (c *Collector) Report(now time.Time, names []string) *Report {
+	end := weekly.StartOfWeek(now, c.weekStart)
+	start := weekly.StartOfWeek(end.AddDate(0, 0, -1), c.weekStart)
+
+	c.mu.Lock()
+	feeds := c.weeks[start.Unix()]
+	for s := range c.weeks {
+		if s < end.Unix() {
+			delete(c.weeks, s)
+		}
+	}
+	c.mu.Unlock()
+
+	r := &Report{Start: start, End: end}
+	for _, name := range names {
+		if _, ok := feeds[name]; !ok {
+			r.Feeds = append(r.Feeds, &Feed{Name: name})
+		}
+	}
+	for _, f := range feeds {
+		r.Feeds = append(r.Feeds, f)
+	}
+	sort.Slice(r.Feeds, func(i, j int) bool { return r.Feeds[i].Name < r.Feeds[j].Name })
+	return r
+}
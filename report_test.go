@@ -0,0 +1,73 @@
+package report
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BranLwyd/rssdl/health"
+)
+
+func TestCollectorReport(t *testing.T) {
+	t.Parallel()
+
+	// Sunday, October 4, 2026 begins the week reported on.
+	at := func(day, hour int) time.Time { return time.Date(2026, time.October, day, hour, 0, 0, 0, time.UTC) }
+	c := NewCollector(time.Sunday)
+	for _, e := range []struct {
+		at time.Time
+		e  health.Event
+	}{
+		{at(3, 23), health.ItemDownloaded{Feed: "show", Title: "Show S01E00", Bytes: 500}}, // the week before
+		{at(5, 12), health.CheckStarted{Feed: "show"}},
+		{at(5, 12), health.ItemDownloaded{Feed: "show", Title: "Show S01E01", Bytes: 1000}},
+		{at(5, 12), health.CheckFinished{Feed: "show", ItemsSeen: 1, ItemsDownloaded: 1}},
+		{at(7, 12), health.ItemDownloaded{Feed: "show", Title: "Show S01E02", Bytes: 2000}},
+		{at(7, 12), health.ItemSkipped{Feed: "show", Title: "Show S01E01", Disposition: health.SKIPPED_ORDER}},
+		{at(7, 12), health.CheckFinished{Feed: "show", ItemsSeen: 2, ItemsDownloaded: 1}},
+		{at(8, 12), health.CheckFinished{Feed: "broken", Err: errors.New("could not parse feed")}},
+		{at(10, 23), health.CheckFinished{Feed: "broken", Err: errors.New("could not parse feed")}},
+		{at(11, 1), health.ItemDownloaded{Feed: "show", Title: "Show S01E03", Bytes: 3000}}, // the week after
+	} {
+		c.Record(e.at, e.e)
+	}
+
+	r := c.Report(at(11, 9), []string{"show", "broken", "quiet"})
+	if !r.Start.Equal(at(4, 0)) || !r.End.Equal(at(11, 0)) {
+		t.Errorf("Report covers %v to %v, want %v to %v", r.Start, r.End, at(4, 0), at(11, 0))
+	}
+	// Outstanding problems are filled in by the caller.
+	for _, f := range r.Feeds {
+		switch f.Name {
+		case "broken":
+			f.Err, f.ErrSince = errors.New("could not parse feed"), at(8, 12)
+		case "quiet":
+			f.LastDownload = time.Date(2026, time.September, 10, 15, 4, 0, 0, time.UTC)
+		}
+	}
+	const want = `Weekly report for Sun Oct 4 2026 to Sat Oct 10 2026
+2 items downloaded (3000 bytes); 1 feed failing; 1 feed stale
+
+[broken] 0 items downloaded (0 bytes); 2 checks, 2 failed
+  Failing since Thu Oct 8 2026 12:00PM: could not parse feed
+
+[quiet] 0 items downloaded (0 bytes); 0 checks, 0 failed
+  Stale: no item downloaded since Thu Sep 10 2026 3:04PM
+
+[show] 2 items downloaded (3000 bytes); 2 checks, 0 failed
+  Show S01E01
+  Show S01E02
+`
+	if got := r.String(); got != want {
+		t.Errorf("Report text:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The week reported on is forgotten; the next week is reported on later.
+	if r := c.Report(at(11, 9), []string{"show"}); len(r.Feeds) != 1 || len(r.Feeds[0].Downloaded) != 0 {
+		t.Errorf("Report of the same week again has feeds %+v, want only an empty show", r.Feeds)
+	}
+	r = c.Report(at(18, 9), nil)
+	if len(r.Feeds) != 1 || r.Feeds[0].Name != "show" || len(r.Feeds[0].Downloaded) != 1 || r.Feeds[0].Downloaded[0] != "Show S01E03" {
+		t.Errorf("Report of the next week has feeds %+v, want show with Show S01E03", r.Feeds)
+	}
+}
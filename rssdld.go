@@ -3,31 +3,67 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/BranLwyd/rssdl/alert"
 	"github.com/BranLwyd/rssdl/config"
+	"github.com/BranLwyd/rssdl/cron"
+	"github.com/BranLwyd/rssdl/fetch"
+	"github.com/BranLwyd/rssdl/health"
+	"github.com/BranLwyd/rssdl/report"
+	"github.com/BranLwyd/rssdl/sanitize"
 	"github.com/BranLwyd/rssdl/state"
 	"github.com/BranLwyd/rssdl/weekly"
 	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/atom"
 )
 
 var (
-	configPath = flag.String("config", "", "Path to service configuration file.")
-	statePath  = flag.String("state", "", "Path to state file.")
+	configPath               = flag.String("config", "", "Path to service configuration file, or to a directory of configuration files (*.cfg, *.textproto, *.yaml, *.yml, *.json) whose feeds are combined.")
+	configFormat             = flag.String("config-format", "", "Format of the configuration file(s): text, yaml, or json. If unset, the format is determined by each file's extension.")
+	statePath                = flag.String("state", "", "Path to state file. If unset, the state file is named after the config file, and placed in $XDG_STATE_HOME/rssdl if $XDG_STATE_HOME is set, or next to the config file otherwise.")
+	allowUnknownConfigFields = flag.Bool("allow_unknown_config_fields", false, "If set, unknown fields in the configuration file are ignored rather than causing startup to fail.")
+	recoverState             = flag.Bool("recover-state", false, "If set, a corrupt state file is backed up and replaced with an empty state rather than causing startup to fail.")
+	probeStateWrite          = flag.Bool("probe_state_write", true, "If set, the state file is written at startup, so that an unwritable state file causes startup to fail rather than the first successful download.")
+	createStateDir           = flag.Bool("create_state_dir", true, "If set, the state file's directory is created at startup if it does not exist. Otherwise, a missing state directory causes startup to fail.")
+	metricsTextfile          = flag.String("metrics_textfile", "", "If set, feed metrics are periodically written to this file in the Prometheus text format, e.g. for node_exporter's textfile collector.")
+	metricsTextfileInterval  = flag.Duration("metrics_textfile_interval", time.Minute, "How often to write --metrics_textfile.")
+	feedNames                = flag.String("feeds", "", "If set, a comma-separated list of the names of the configured feeds to watch; other feeds are not watched.")
+	checkConfig              = flag.Bool("check_config", false, "If set, the configuration file is validated, every problem found is printed, and rssdld exits without watching any feeds.")
+	dumpConfig               = flag.Bool("dump_config", false, "If set, the fully resolved configuration of the feeds to watch is printed in canonical protocol buffer text format, with secrets redacted, and rssdld exits without watching any feeds.")
+	tempPrefix               = flag.String("temp_prefix", ".rssdl_", "The prefix of the names of temporary files written while downloading items (followed by \"download_\") or writing the state file (followed by \"state_\").")
+	sweepTempFiles           = flag.Duration("sweep_temp_files", 0, "If positive, temporary files (named as specified by --temp_prefix) last modified longer ago than this, e.g. left behind by a crash, are removed from the download & state directories at startup. Younger files are kept, since another rssdld instance may be writing them.")
+	checkName                = flag.String("check", "", "If set, the named feed is checked once, regardless of its schedule, a JSON report of the check's decisions is printed, and rssdld exits. Unless --commit is set, no item is downloaded and the state is not modified; the report describes what the check would download.")
+	checkCommit              = flag.Bool("commit", false, "If set, the check made by --check downloads items & records them in the state, as a scheduled check would.")
+	logDecisions             = flag.Bool("log_decisions", false, "If set, the decision made about every item of every check is logged, including items skipped silently because their order is not new.")
 )
 
 func main() {
@@ -35,156 +71,2499 @@ func main() {
 	if *configPath == "" {
 		log.Fatalf("--config is required")
 	}
-	if *statePath == "" {
-		log.Fatalf("--state is required")
+	if *metricsTextfileInterval <= 0 {
+		log.Fatalf("--metrics_textfile_interval must be positive")
 	}
 
 	// Parse config.
-	cfgBytes, err := ioutil.ReadFile(*configPath)
+	srcs, err := readConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Could not read config file: %v", err)
+		log.Fatalf("Could not read config: %v", err)
+	}
+	if *configFormat != "" {
+		cfgFormat, err := config.ParseFormatName(*configFormat)
+		if err != nil {
+			log.Fatalf("Could not parse --config-format: %v", err)
+		}
+		for i := range srcs {
+			srcs[i].Format = cfgFormat
+		}
+	}
+	cfg, err := config.ParseOptions{AllowUnknownFields: *allowUnknownConfigFields}.ParseFilesConfig(srcs)
+	if *checkConfig {
+		if err != nil {
+			errs, ok := err.(config.Errors)
+			if !ok {
+				errs = config.Errors{err}
+			}
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			os.Exit(1)
+		}
+		for _, w := range cfg.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", w)
+		}
+		fmt.Printf("Configuration OK (%d feeds)\n", len(cfg.Feeds))
+		return
 	}
-	feeds, err := config.Parse(string(cfgBytes))
 	if err != nil {
 		log.Fatalf("Could not parse config: %v", err)
 	}
+	for _, w := range cfg.Warnings {
+		log.Printf("Warning: %v", w)
+	}
+	if *feedNames != "" {
+		if cfg.Feeds, err = filterFeeds(cfg.Feeds, strings.Split(*feedNames, ",")); err != nil {
+			log.Fatalf("Could not parse --feeds: %v", err)
+		}
+	}
+	if *dumpConfig {
+		out, err := redactedConfig(cfg)
+		if err != nil {
+			log.Fatalf("Could not dump config: %v", err)
+		}
+		fmt.Print(out)
+		return
+	}
 
 	// Parse state.
-	s, err := state.Open(*statePath)
+	sp := *statePath
+	if sp == "" {
+		sp = defaultStatePath(*configPath)
+		log.Printf("Using state file %q", sp)
+	}
+	if *checkName != "" {
+		r, err := runCheck(cfg, sp, *checkName, *checkCommit)
+		if err != nil {
+			log.Fatalf("Could not check %q: %v", *checkName, err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			log.Fatalf("Could not write report: %v", err)
+		}
+		if r.Error != "" {
+			os.Exit(1)
+		}
+		return
+	}
+	if *sweepTempFiles > 0 {
+		sweepTemp(cfg.Feeds, sp, *sweepTempFiles)
+	}
+	s, err := state.Options{RecoverCorrupt: *recoverState, TempPrefix: *tempPrefix + "state_", NoCreateDir: !*createStateDir, NoProbeWrite: !*probeStateWrite}.Open(sp)
 	if err != nil {
 		log.Fatalf("Could not open state: %v", err)
 	}
 
-	// Start feed-checker goroutines.
-	for _, feed := range feeds {
-		go checkFeed(feed, s)
+	hr := health.NewRegistry()
+	alertsInFlight.hr = hr
+	if cfg.AlertRateLimit > 0 {
+		limitAlerts(cfg, hr)
+	}
+	alerter := cfg.Alerter
+	if alerter != nil && cfg.AlertRetries > 0 {
+		alerter = alert.WithRetries(alerter, cfg.AlertRetries, cfg.AlertRetryBackoff)
+	}
+	if alerter != nil {
+		alerter = alert.WithTimeout(alerter, cfg.AlertTimeout)
+	}
+
+	// Start feed-checker goroutines. They stop waiting between downloads once
+	// shutdown begins.
+	checkCtx, stopChecks := context.WithCancel(context.Background())
+	defer stopChecks()
+	lim := newCheckLimiter(cfg.MaxConcurrentChecks, hr)
+	if cfg.MaxConcurrentFeedChecks > 0 {
+		lim.feeds = make(chan struct{}, cfg.MaxConcurrentFeedChecks)
+	}
+	if cfg.MinHostInterval > 0 {
+		lim.hosts = newHostLimiter(cfg.MinHostInterval)
+	}
+	if cfg.Report != nil {
+		if err := startReports(cfg, s, hr); err != nil {
+			log.Fatalf("Could not start weekly report: %v", err)
+		}
+	}
+	var checks sync.WaitGroup
+	for _, feed := range cfg.Feeds {
+		sched, err := newScheduler(feed)
+		if err != nil {
+			log.Fatalf("[%s] Could not create scheduler: %v", feed.Name, err)
+		}
+		checks.Add(1)
+		go func(feed *config.Feed) {
+			defer checks.Done()
+			checkFeed(checkCtx, feed, sched, s, hr.Tracker(feed.Name), lim)
+		}(feed)
+	}
+	if *metricsTextfile != "" {
+		go writeMetrics(hr, *metricsTextfile, *metricsTextfileInterval)
+	}
+	log.Printf("Started watching %d feeds", len(cfg.Feeds))
+	sendAlert(alerter, alert.STARTED, fmt.Sprintf("Started watching %d feeds", len(cfg.Feeds)))
+
+	// Wait for a signal to shut down.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("Received %v, stopping", sig)
+	stopChecks()
+	sendAlertSync(alerter, alert.STOPPING, fmt.Sprintf("Stopping: received %v", sig), stopAlertTimeout)
+
+	// Let checks in progress finish, so that what they download is recorded
+	// in the state before it is closed.
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), stateCloseTimeout)
+	defer cancelWait()
+	if !waitChecks(waitCtx, &checks) {
+		log.Printf("Checks still running after %v; closing state without them", stateCloseTimeout)
+	}
+
+	// Write the state a final time, exiting unsuccessfully if it can't be
+	// written so that e.g. systemd marks the unit failed.
+	ctx, cancel := context.WithTimeout(context.Background(), stateCloseTimeout)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		log.Fatalf("Could not write state: %v", err)
+	}
+}
+
+// waitChecks waits for the checks counted by wg to finish, returning false if
+// ctx is done first.
+func waitChecks(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// writeMetrics writes the feeds' metrics to the given file immediately, then
+// again every interval.
+func writeMetrics(hr *health.Registry, filename string, interval time.Duration) {
+	tckr := time.NewTicker(interval)
+	defer tckr.Stop()
+	for {
+		if err := hr.WriteMetricsFile(filename); err != nil {
+			log.Printf("Could not write metrics: %v", err)
+		}
+		<-tckr.C
+	}
+}
+
+// startReports starts sending the configured weekly report, collecting the
+// events of feed checks from now on to report on.
+func startReports(cfg *config.Config, s *state.State, hr *health.Registry) error {
+	tckr, err := weekly.NewTicker([]weekly.TickSpecification{cfg.Report.Spec})
+	if err != nil {
+		return err
+	}
+	alerter := cfg.Report.Alerter
+	if cfg.AlertRetries > 0 {
+		alerter = alert.WithRetries(alerter, cfg.AlertRetries, cfg.AlertRetryBackoff)
+	}
+	alerter = alert.WithTimeout(alerter, cfg.AlertTimeout)
+	c := report.NewCollector(cfg.Report.Spec.WeekStart)
+	events, _ := hr.Subscribe()
+	go func() {
+		for e := range events {
+			c.Record(time.Now(), e)
+		}
+	}()
+	go func() {
+		for tck := range tckr.Ticks() {
+			r := weeklyReport(cfg, s, hr, c, tck)
+			log.Printf("Sending weekly report for the week of %s", r.Start.Format("Jan 2 2006"))
+			sendAlert(alerter, alert.REPORT, r.String())
+		}
+	}()
+	return nil
+}
+
+// weeklyReport returns the report on the last full week before now, with
+// each feed's outstanding problems: whether it is failing, and whether it is
+// stale, having downloaded nothing for its stale_after_s.
+func weeklyReport(cfg *config.Config, s *state.State, hr *health.Registry, c *report.Collector, now time.Time) *report.Report {
+	feeds := make(map[string]*config.Feed, len(cfg.Feeds))
+	names := make([]string, 0, len(cfg.Feeds))
+	for _, f := range cfg.Feeds {
+		feeds[f.Name] = f
+		names = append(names, f.Name)
+	}
+	r := c.Report(now, names)
+	hs := hr.Health()
+	for _, fr := range r.Feeds {
+		if h, ok := hs[fr.Name]; ok && h.Status == health.ERROR {
+			fr.Err, fr.ErrSince = h.LastError, h.Since
+		}
+		if f, ok := feeds[fr.Name]; ok && f.StaleAfter > 0 {
+			if ld := s.LastDownload(f.Name); !ld.IsZero() && now.Sub(ld) >= f.StaleAfter {
+				fr.LastDownload = ld
+			}
+		}
+	}
+	return r
+}
+
+// filterFeeds returns the feeds with the given names, in the order they are
+// configured. It is an error for a name not to match any feed.
+func filterFeeds(feeds []*config.Feed, names []string) ([]*config.Feed, error) {
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[strings.TrimSpace(n)] = true
+	}
+	var filtered []*config.Feed
+	for _, f := range feeds {
+		if want[f.Name] {
+			filtered = append(filtered, f)
+			delete(want, f.Name)
+		}
+	}
+	if len(want) > 0 {
+		var missing []string
+		for n := range want {
+			missing = append(missing, fmt.Sprintf("%q", n))
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no such feed(s): %s", strings.Join(missing, ", "))
+	}
+	return filtered, nil
+}
+
+// readConfig reads the configuration at the given path, which is either a
+// single configuration file or a directory of them.
+func readConfig(path string) ([]config.NamedSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return config.ReadDir(path)
+	}
+	cfg, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return []config.NamedSource{{Name: path, Config: string(cfg), Format: config.FormatForFilename(path)}}, nil
+}
+
+// defaultStatePath returns the path of the state file to use for the given
+// config file if --state is not specified. The state file is named after the
+// config file, e.g. "rssdl.textproto" uses "rssdl.state".
+func defaultStatePath(configPath string) string {
+	name := filepath.Base(configPath)
+	if ext := filepath.Ext(name); ext != ".state" {
+		// Never trim ".state", which would make the state file the config file.
+		name = strings.TrimSuffix(name, ext)
+	}
+	name += ".state"
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "rssdl", name)
+	}
+	return filepath.Join(filepath.Dir(configPath), name)
+}
+
+// checkDownloadDirs checks that the directories into which the feed's items
+// are downloaded & staged exist and are writable, returning an error
+// describing the first which is not. It is cheap, so it may be called before
+// every check's downloads; this notices e.g. a network mount having dropped.
+func checkDownloadDirs(f *config.Feed) error {
+	for _, dir := range []string{f.DownloadDir, f.TorrentWatchDir, f.StagingDir} {
+		if dir == "" {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		switch {
+		case os.IsNotExist(err):
+			return fmt.Errorf("%q does not exist", dir)
+		case err != nil:
+			return fmt.Errorf("could not check %q: %v", dir, err)
+		case !fi.IsDir():
+			return fmt.Errorf("%q is not a directory", dir)
+		}
+		if err := checkWritable(dir); err != nil {
+			return fmt.Errorf("%q is not writable: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// downloadTempPrefix returns the prefix of the names of temporary files to
+// which items are downloaded.
+func downloadTempPrefix() string { return *tempPrefix + "download_" }
+
+// sweepTemp removes temporary files last modified longer than maxAge ago from
+// the feeds' download directories & the state file's directory, as left behind
+// if rssdld crashes while downloading or writing the state. Problems are
+// logged, rather than preventing startup.
+func sweepTemp(feeds []*config.Feed, statePath string, maxAge time.Duration) {
+	type sweep struct{ dir, prefix string }
+	sweeps := map[sweep]bool{}
+	for _, f := range feeds {
+		sweeps[sweep{filepath.Clean(f.DownloadDir), downloadTempPrefix()}] = true
+		if f.StagingDir != "" {
+			sweeps[sweep{filepath.Clean(f.StagingDir), downloadTempPrefix()}] = true
+		}
+		if f.TorrentWatchDir != "" {
+			sweeps[sweep{filepath.Clean(f.TorrentWatchDir), downloadTempPrefix()}] = true
+		}
+	}
+	if rsp, err := filepath.EvalSymlinks(statePath); err == nil {
+		// The state is written next to the file the state file links to.
+		statePath = rsp
+	}
+	sweeps[sweep{filepath.Dir(statePath), *tempPrefix + "state_"}] = true
+
+	cutoff := time.Now().Add(-maxAge)
+	for sw := range sweeps {
+		removed, err := removeTempFiles(sw.dir, sw.prefix, cutoff)
+		for _, fn := range removed {
+			log.Printf("Removed stale temporary file %q", fn)
+		}
+		if err != nil {
+			log.Printf("Could not remove stale temporary files from %q: %v", sw.dir, err)
+		}
+	}
+}
+
+// removeTempFiles removes the regular files in dir whose names start with
+// prefix and which were last modified before cutoff, returning the names of
+// the removed files. Files modified more recently are kept, since they may be
+// being written.
+func removeTempFiles(dir, prefix string, cutoff time.Time) (removed []string, _ error) {
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var errs []string
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), prefix) || !fi.Mode().IsRegular() || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		fn := filepath.Join(dir, fi.Name())
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+			continue
+		}
+		removed = append(removed, fn)
 	}
-	select {}
+	if len(errs) > 0 {
+		return removed, errors.New(strings.Join(errs, "; "))
+	}
+	return removed, nil
 }
 
-func checkFeed(f *config.Feed, s *state.State) {
+// stopAlertTimeout bounds how long shutdown waits for the STOPPING alert.
+const stopAlertTimeout = 2 * time.Second
+
+// stateCloseTimeout bounds how long shutdown waits for checks in progress to
+// finish, and then for the final write of the state, e.g. if its storage has
+// gone away.
+const stateCloseTimeout = 10 * time.Second
+
+// checkFeed checks the feed each time sched ticks, until sched is stopped or
+// ctx is done. Once ctx is done, waits between downloads are abandoned, and
+// checkFeed returns when the check running, if any, is complete.
+func checkFeed(ctx context.Context, f *config.Feed, sched weekly.Scheduler, s *state.State, h *health.Tracker, lim *checkLimiter) {
 	parser := gofeed.NewParser()
+	client, dlClient := httpClient(f, false), httpClient(f, true)
+	pacer := newDownloadPacer(ctx, f, s)
+	alerter := f.Alerter
+	if alerter != nil && f.AlertRetries > 0 {
+		alerter = alert.WithRetries(alerter, f.AlertRetries, f.AlertRetryBackoff)
+	}
+	if alerter != nil {
+		alerter = alert.WithTimeout(alerter, f.AlertTimeout)
+	}
+	var hd *hashDedupe
+	if f.DedupeByHash {
+		hd = &hashDedupe{s: s, link: f.HardlinkDuplicates}
+	}
 	order := s.GetOrder(f.Name)
+	stored := order // the order last read from or written to state
 	orderModified := false
-
-	ticker, err := weekly.NewTicker(f.CheckSpecs)
-	if err != nil {
-		log.Fatalf("[%s] Could not create ticker: %v", f.Name, err)
+	if order == "" && f.OrderStart != "" {
+		// Record the starting order with the first check's results.
+		log.Printf("[%s] No order in state; starting from order_start %q", f.Name, f.OrderStart)
+		order, orderModified = f.OrderStart, true
 	}
+	var links []string // downloaded links not yet recorded in state
+	var dlBytes int64  // downloaded bytes not yet recorded in state
+	h.AddDownloadedBytes(s.DownloadedBytes(f.Name))
+	lastDownload := s.LastDownload(f.Name)
+	if lastDownload.IsZero() {
+		// Never downloaded: measure staleness from when the feed is first watched.
+		lastDownload = time.Now()
+	}
+	staleAlerted := false
+	emptyOrderAlerted := false
+	dirUnavailable := false
+	regressionAlerted := ""        // the link of the item last alerted about as having a regressed order
+	goneChecks := map[string]int{} // by link, the number of checks which found the item gone
 
 	log.Printf("Watching %q", f.Name)
-CHECK_LOOP:
-	for range ticker.C {
-		log.Printf("[%s] Checking", f.Name)
-		feed, err := parser.ParseURL(f.URL)
+	var dropped uint64
+	delay := startupDelay(f)
+	for {
+		var tck time.Time
+		select {
+		case t, ok := <-sched.Ticks():
+			if !ok {
+				return
+			}
+			tck = t
+		case <-ctx.Done():
+			return
+		}
+		if delay > 0 {
+			log.Printf("[%s] Delaying first check by %v", f.Name, delay)
+			tmr := time.NewTimer(delay)
+			select {
+			case <-tmr.C:
+			case <-ctx.Done():
+				tmr.Stop()
+				return
+			}
+			delay = 0
+		}
+		if f.Skipped(tck) {
+			log.Printf("[%s] Skipping check on skip date", f.Name)
+			continue
+		}
+		log.Printf("[%s] Checking (%s, scheduled %v, skew %v)", f.Name, window(f, tck), tck.Format(time.Kitchen), time.Since(tck))
+		if dt, ok := sched.(droppedTicker); ok {
+			if d := dt.DroppedTicks(); d != dropped {
+				log.Printf("[%s] %d check(s) dropped while the previous check was running (%d total)", f.Name, d-dropped, d)
+				dropped = d
+			}
+		}
+		if _, end, _ := f.Window(tck); !lim.acquire(end) {
+			log.Printf("[%s] Skipping check: too many concurrent checks until the check window ended", f.Name)
+			continue
+		}
+		h.Publish(health.CheckStarted{Feed: f.Name})
+		failed, complete, now := false, false, time.Now()
+		feed, err := fetchFeedWithRetries(ctx, client, lim.hosts, parser, f)
+		err = redactErr(err, f.SecretQueryParams)
+		lim.release()
+		if err != nil && ctx.Err() != nil {
+			// Shutting down, rather than a problem with the feed.
+			log.Printf("[%s] Stopped checking: %v", f.Name, err)
+			lim.finish()
+			h.Publish(health.CheckFinished{Feed: f.Name, Err: err})
+			return
+		}
 		if err != nil {
-			sendAlert(f.Alerter, alert.ERROR, fmt.Sprintf("[%s] Could not parse feed", f.Name))
-			fmt.Printf("[%s] Could not parse feed: %v", f.Name, err)
+			var le *fetch.LimitError
+			if errors.As(err, &le) {
+				sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Could not parse feed: %v", f.Name, le))
+			} else {
+				sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Could not parse feed", f.Name))
+			}
+			log.Printf("[%s] Could not parse feed: %v", f.Name, err)
+			err = fmt.Errorf("could not parse feed: %v", err)
+			h.Failure(time.Now(), err)
+			lim.finish()
+			h.Publish(health.CheckFinished{Feed: f.Name, Err: err})
 			continue
 		}
 		itms := feed.Items
 
 		// Order the feed's items, oldest first.
-		for _, itm := range itms {
-			if itm.PublishedParsed == nil {
-				sendAlert(f.Alerter, alert.ERROR, fmt.Sprintf("[%s] Item with no publish time", f.Name))
-				fmt.Printf("[%s] %q has no published time, or time could not be parsed", f.Name, itm.Title)
-				continue CHECK_LOOP
+		if itm := parseDates(f, itms); itm != nil {
+			sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Item with no publish time", f.Name))
+			log.Printf("[%s] %q has no published time, or time could not be parsed", f.Name, itm.Title)
+			err := fmt.Errorf("%q has no published time", itm.Title)
+			h.Failure(time.Now(), err)
+			lim.finish()
+			h.Publish(health.CheckFinished{Feed: f.Name, Err: err})
+			continue
+		}
+		sortItems(f, itms)
+
+		// Check the download directories once, rather than failing each
+		// download; while they are unavailable, nothing is downloaded.
+		dirErr := checkDownloadDirs(f)
+		switch {
+		case dirErr != nil && !dirUnavailable:
+			log.Printf("[%s] Download directory unavailable: %v", f.Name, dirErr)
+			sendAlert(alerter, alert.DOWNLOAD_DIR_UNAVAILABLE, fmt.Sprintf("[%s] Download directory unavailable: %v", f.Name, dirErr))
+			dirUnavailable = true
+		case dirErr == nil && dirUnavailable:
+			log.Printf("[%s] Download directory available again", f.Name)
+			sendAlert(alerter, alert.RECOVERED, fmt.Sprintf("[%s] Download directory available again", f.Name))
+			dirUnavailable = false
+		}
+
+		var decisions []health.Decision
+		var downloaded int
+		var checkErr error
+		retrying := false // if set, the check failed only on an item to retry, which isn't counted against the feed's health
+		var fetched map[*gofeed.Item]fetchResult
+		if f.NewestFirst && dirErr == nil {
+			fetched = fetchNewestFirst(ctx, f, s, h, dlClient, lim.hosts, pacer, alerter, hd, itms, order, links, now)
+		}
+		var latest *gofeed.Item
+		if f.LatestOnly {
+			latest = latestItem(f, s, itms, order, links, now)
+		}
+
+		// Rather than silently skipping every new item if the feed's orders
+		// regressed, alert, and download the items if configured to.
+		var reset map[*gofeed.Item]bool // if non-nil, the regressed items to download
+		if rs := regressedItems(f, s, itms, order, lastDownload); len(rs) == 0 {
+			regressionAlerted = ""
+		} else if newest := rs[len(rs)-1]; f.OrderRegression == config.RESET_ORDER {
+			o, _ := f.Order(newest.Title)
+			log.Printf("[%s] Order appears to have regressed from %q to %q (%s); resetting order", f.Name, order, o, newest.Title)
+			sendAlert(alerter, alert.WARN, fmt.Sprintf("[%s] Order appears to have regressed from %q to %q (%s); resetting order", f.Name, order, o, newest.Title))
+			reset = make(map[*gofeed.Item]bool, len(rs))
+			for _, itm := range rs {
+				reset[itm] = true
 			}
+			order, latest = "", nil
+		} else if newest.Link != regressionAlerted {
+			o, _ := f.Order(newest.Title)
+			log.Printf("[%s] Order appears to have regressed from %q to %q (%s); skipping", f.Name, order, o, newest.Title)
+			sendAlert(alerter, alert.WARN, fmt.Sprintf("[%s] Order appears to have regressed from %q to %q (%s); skipping, see order_regression", f.Name, order, o, newest.Title))
+			regressionAlerted = newest.Link
 		}
-		sort.SliceStable(itms, func(i, j int) bool { return itms[i].PublishedParsed.Before(*itms[j].PublishedParsed) })
 
 		for _, itm := range itms {
-			// Check order.
-			m := f.OrderRegexp.FindStringSubmatch(itm.Title)
-			if m == nil {
-				continue
+			var d decision
+			if reset != nil && !reset[itm] {
+				d = decision{Decision: health.Decision{Title: itm.Title, Disposition: health.SKIPPED_ORDER, Reason: "published before order reset"}}
+			} else {
+				d = decide(f, s, itm, order, links, now)
 			}
-			o := m[1]
-			if o <= order {
-				continue
+			if latest != nil {
+				d = supersede(d, itm, latest)
 			}
-
-			// Download.
-			log.Printf("[%s] Found %s", f.Name, itm.Title)
-			if err := download(itm.Link, f.DownloadDir); err != nil {
-				sendAlert(f.Alerter, alert.ERROR, fmt.Sprintf("[%s] Could not download item", f.Name))
-				fmt.Printf("[%s] Could not download %q: %v", f.Name, itm.Title, err)
+			if d.complete {
+				complete = true
+			}
+			if d.emptyOrder && !emptyOrderAlerted {
+				sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Order regex matched %q but captured an empty order; check the regex", f.Name, itm.Title))
+				emptyOrderAlerted = true
+			}
+			if d.Disposition == health.DOWNLOADED {
+				r, ok := fetched[itm]
+				if ok {
+					delete(fetched, itm)
+				} else if dirErr != nil {
+					// Fails the check, like any other failed download.
+					r = fetchResult{Decision: d.Decision}
+					r.Disposition, r.Reason = health.FAILED_DOWNLOAD, fmt.Sprintf("download directory unavailable: %v", dirErr)
+				} else {
+					r = fetchItem(ctx, f, s, h, dlClient, lim.hosts, pacer, alerter, hd, itm, d)
+				}
+				var record bool
+				if d, record = settleItem(f, alerter, goneChecks, itm, d, r); record {
+					links = append(links, itm.Link)
+				}
+				switch {
+				case r.exists:
+				case d.Disposition == health.FAILED_DOWNLOAD:
+					failed, checkErr, retrying = true, fmt.Errorf("could not download %q: %s", itm.Title, d.Reason), d.retry
+				case d.Disposition == health.DOWNLOADED, d.Disposition == health.SKIPPED_DUPLICATE:
+					dlBytes += r.n
+					lastDownload, staleAlerted = time.Now(), false
+					if err := s.SetLastDownload(f.Name, lastDownload); err != nil {
+						log.Printf("[%s] Could not record download time: %v", f.Name, err)
+					}
+				}
+			}
+			decisions = append(decisions, d.Decision)
+			switch d.Disposition {
+			case health.DOWNLOADED:
+				downloaded++
+			case health.FAILED_DOWNLOAD:
+			default:
+				h.Publish(health.ItemSkipped{Feed: f.Name, Title: itm.Title, Disposition: d.Disposition, Reason: d.Reason})
+			}
+			if *logDecisions {
+				log.Printf("[%s] Decision for %s (order %q): %v %s", f.Name, itm.Title, d.Order, d.Disposition, d.Reason)
+			} else if d.emptyOrder || (d.Disposition != health.DOWNLOADED && d.Disposition != health.SKIPPED_ORDER && d.Disposition != health.FAILED_DOWNLOAD) {
+				log.Printf("[%s] Skipping %s: %s", f.Name, itm.Title, d.Reason)
+			}
+			if failed {
 				break
-			} else {
-				sendAlert(f.Alerter, alert.NEW_ITEM, fmt.Sprintf("[%s] Got new item: %s", f.Name, o))
 			}
-			order, orderModified = o, true
+			if d.advance {
+				order, orderModified = d.Order, true
+			}
+		}
+		if reset != nil && order == "" {
+			// No regressed item advanced the order; keep the feed's order.
+			order = stored
+		}
+		// Items fetched newest first but not reached above, e.g. because an
+		// older item failed to download, don't advance the order. Their links
+		// are recorded so that later checks skip them, advancing the order past
+		// them once every older item is downloaded.
+		for _, itm := range itms {
+			r, ok := fetched[itm]
+			if !ok {
+				continue
+			}
+			switch r.Disposition {
+			case health.DOWNLOADED, health.SKIPPED_DUPLICATE:
+				links = append(links, itm.Link)
+				dlBytes += r.n
+				if !r.exists {
+					decisions = append(decisions, r.Decision)
+					if r.Disposition == health.DOWNLOADED {
+						downloaded++
+					}
+					lastDownload, staleAlerted = time.Now(), false
+					if err := s.SetLastDownload(f.Name, lastDownload); err != nil {
+						log.Printf("[%s] Could not record download time: %v", f.Name, err)
+					}
+				}
+			}
 		}
-		if orderModified {
-			if err := s.SetOrder(f.Name, order); err != nil {
+		h.SetDecisions(decisions)
+		if orderModified || len(links) > 0 {
+			if o, err := recordOrder(f, s, stored, order, links, dlBytes, reset != nil && orderModified); err != nil {
 				// TODO: if writing fails, retry writes independently of checks
 				// (otherwise, pending writes may stay in memory for a week!)
-				sendAlert(f.Alerter, alert.ERROR, fmt.Sprintf("[%s] Error updating order", f.Name))
-				fmt.Printf("[%s] Could not update order: %v", f.Name, err)
+				sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Error updating order", f.Name))
+				log.Printf("[%s] Could not update order: %v", f.Name, err)
+				checkErr = fmt.Errorf("could not update order: %v", err)
+				failed, retrying = true, false
 			} else {
-				orderModified = false
+				order, stored = o, o
+				orderModified, links, dlBytes = false, nil, 0
 			}
 		}
+		// A check fails at most once, however many of its items failed.
+		if failed {
+			if !retrying {
+				h.Failure(time.Now(), checkErr)
+			}
+		} else if r := h.Success(time.Now()); r != nil {
+			log.Printf("[%s] Recovered after %v (%d failed checks)", f.Name, r.Downtime, r.FailedChecks)
+			sendAlert(alerter, alert.RECOVERED, fmt.Sprintf("[%s] Recovered after %v (%d failed checks)", f.Name, r.Downtime, r.FailedChecks))
+		}
+		lim.finish()
+		h.Publish(health.CheckFinished{Feed: f.Name, ItemsSeen: len(decisions), ItemsDownloaded: downloaded, Err: checkErr})
+		if f.StaleAfter > 0 && !staleAlerted && time.Since(lastDownload) >= f.StaleAfter {
+			log.Printf("[%s] No item downloaded since %v", f.Name, lastDownload.Format(time.RFC1123))
+			sendAlert(alerter, alert.WARN, fmt.Sprintf("[%s] Stale: no item downloaded in %v", f.Name, time.Since(lastDownload).Round(time.Minute)))
+			staleAlerted = true
+		}
+		if complete && !orderModified {
+			log.Printf("[%s] Found item past order_max; feed is complete, no longer watching", f.Name)
+			// Alert only the first time, rather than after every restart.
+			if s.CompletedOrderMax(f.Name) != f.OrderMax {
+				if err := s.SetCompletedOrderMax(f.Name, f.OrderMax); err != nil {
+					log.Printf("[%s] Could not record completion: %v", f.Name, err)
+				}
+				sendAlert(alerter, alert.COMPLETE, fmt.Sprintf("[%s] Feed complete", f.Name))
+			}
+			sched.Stop()
+			return
+		}
 	}
 }
 
-func download(dlURL, dir string) error {
-	// Figure out eventual filename (and sanity check the URL).
-	u, err := url.Parse(dlURL)
+// checkReport is the result of a single check of a feed, as printed in JSON by
+// --check.
+type checkReport struct {
+	Feed      string            `json:"feed"`
+	Committed bool              `json:"committed"` // if unset, nothing was downloaded & the state was not modified
+	Order     string            `json:"order"`     // the feed's order before the check
+	NewOrder  string            `json:"new_order"` // the feed's order after the check; if not committed, what it would be
+	Decisions []health.Decision `json:"decisions"` // if not committed, items which would be downloaded are DOWNLOADED
+	Error     string            `json:"error,omitempty"`
+}
+
+// runCheck checks the named feed once, returning a report of the check. Unless
+// commit is set, no item is downloaded and the state is not modified; the
+// report describes what the check would do.
+func runCheck(cfg *config.Config, statePath, name string, commit bool) (checkReport, error) {
+	feeds, err := filterFeeds(cfg.Feeds, []string{name})
 	if err != nil {
-		return fmt.Errorf("could not parse URL %q: %v", dlURL, err)
+		return checkReport{}, err
 	}
-	bp := path.Base(u.Path)
-	if strings.HasSuffix(bp, ".") || strings.HasSuffix(bp, "/") {
-		return fmt.Errorf("URL %q has no filename", dlURL)
+	f := feeds[0]
+	s, err := state.Options{RecoverCorrupt: commit && *recoverState, TempPrefix: *tempPrefix + "state_", NoCreateDir: !*createStateDir, NoProbeWrite: !commit || !*probeStateWrite}.Open(statePath)
+	if err != nil {
+		return checkReport{}, fmt.Errorf("could not open state: %v", err)
+	}
+	lim := newCheckLimiter(0, health.NewRegistry())
+	if cfg.MinHostInterval > 0 {
+		lim.hosts = newHostLimiter(cfg.MinHostInterval)
+	}
+	if !commit {
+		return previewCheck(f, s, lim.hosts), nil
 	}
-	fn := filepath.Join(dir, bp)
 
-	// Download to a temporary file first so publishing is atomic.
-	f, err := ioutil.TempFile(dir, ".rssdl_download_")
+	r := commitCheck(f, s, lim)
+	ctx, cancel := context.WithTimeout(context.Background(), stateCloseTimeout)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		return r, fmt.Errorf("could not write state: %v", err)
+	}
+	return r, nil
+}
+
+// previewCheck determines what a single check of the feed would do, without
+// downloading any item or modifying s. Checks requiring network access for
+// each item, such as for an existing copy of it, are not made.
+func previewCheck(f *config.Feed, s *state.State, hosts *hostLimiter) checkReport {
+	order := s.GetOrder(f.Name)
+	r := checkReport{Feed: f.Name, Order: order, NewOrder: order}
+	if order == "" {
+		order = f.OrderStart
+	}
+	feed, err := fetchFeedWithRetries(context.Background(), httpClient(f, false), hosts, gofeed.NewParser(), f)
 	if err != nil {
-		return fmt.Errorf("could not create file: %v", err)
+		r.Error = fmt.Sprintf("could not parse feed: %v", redactErr(err, f.SecretQueryParams))
+		return r
 	}
-	defer func() {
-		f.Close()
-		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
-			fmt.Printf("Could not remove %q: %v", f.Name(), err)
+	itms := feed.Items
+	if itm := parseDates(f, itms); itm != nil {
+		r.Error = fmt.Sprintf("%q has no published time", itm.Title)
+		return r
+	}
+	sortItems(f, itms)
+
+	var links []string
+	now := time.Now()
+	var latest *gofeed.Item
+	if f.LatestOnly {
+		latest = latestItem(f, s, itms, order, links, now)
+	}
+	for _, itm := range itms {
+		d := decide(f, s, itm, order, links, now)
+		if latest != nil {
+			d = supersede(d, itm, latest)
+		}
+		r.Decisions = append(r.Decisions, d.Decision)
+		if d.Disposition == health.DOWNLOADED {
+			links = append(links, itm.Link)
+		}
+		if d.advance {
+			order = d.Order
 		}
+	}
+	r.NewOrder = order
+	return r
+}
+
+// commitCheck makes a single check of the feed as checkFeed does, downloading
+// items & recording them in s.
+func commitCheck(f *config.Feed, s *state.State, lim *checkLimiter) checkReport {
+	r := checkReport{Feed: f.Name, Committed: true, Order: s.GetOrder(f.Name)}
+
+	// Check now, regardless of the feed's startup delay & skip dates.
+	fc := *f
+	fc.MaxStartupDelay, fc.SkipDates = 0, nil
+	h := lim.hr.Tracker(f.Name)
+	events, unsubscribe := lim.hr.Subscribe()
+	defer unsubscribe()
+	sched := weekly.NewManualTicker()
+	defer sched.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		checkFeed(ctx, &fc, sched, s, h, lim)
 	}()
-	resp, err := http.Get(dlURL)
-	if err != nil {
-		return fmt.Errorf("could not begin getting %q: %v", dlURL, err)
+	sched.Tick(time.Now())
+	for e := range events {
+		if cf, ok := e.(health.CheckFinished); ok {
+			if cf.Err != nil {
+				r.Error = cf.Err.Error()
+			}
+			break
+		}
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("got unexpected status code when getting %q: %s", dlURL, resp.StatusCode)
+	// Wait for the check to be complete, so that it modifies s no further.
+	cancel()
+	<-done
+	r.NewOrder, r.Decisions = s.GetOrder(f.Name), h.Decisions()
+	return r
+}
+
+// limitAlerts wraps the configuration's alerters with its alert rate limit,
+// recording each limit in the health registry. Alerters with the same alert
+// command, such as those of feeds sharing the top-level alert_command, share a
+// limit.
+func limitAlerts(cfg *config.Config, hr *health.Registry) {
+	limited := map[string]alert.Alerter{}
+	limit := func(a alert.Alerter) alert.Alerter {
+		if a == nil {
+			return nil
+		}
+		cmd, _ := alert.Command(a)
+		if la, ok := limited[cmd]; ok {
+			return la
+		}
+		rl := alert.WithRateLimit(a, cfg.AlertRateLimit, cfg.AlertRateLimitPeriod)
+		hr.AddAlertLimit(cmd, rl.Dropped)
+		limited[cmd] = rl
+		return rl
 	}
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		return fmt.Errorf("could not read %q: %v", dlURL, err)
+	cfg.Alerter = limit(cfg.Alerter)
+	for _, f := range cfg.Feeds {
+		f.Alerter = limit(f.Alerter)
 	}
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("could not close file: %v", err)
+}
+
+// droppedTicker is implemented by schedulers that count ticks dropped because
+// the previous check was still running.
+type droppedTicker interface {
+	DroppedTicks() uint64
+}
+
+// newScheduler returns a scheduler that ticks according to the feed's
+// check_cron, if specified, or its check_specs otherwise. The scheduler ticks
+// immediately as well if the feed checks on start.
+func newScheduler(f *config.Feed) (weekly.Scheduler, error) {
+	if f.CheckCron != nil {
+		t := cron.NewTicker(f.CheckCron)
+		if now := time.Now(); f.CheckOnStartAlways && f.CheckCron.Next(now).Sub(now) > weekly.ImmediateTickMargin {
+			return weekly.WithInitialTick(t, now), nil
+		}
+		return t, nil
 	}
-	if err := os.Chmod(f.Name(), 0640); err != nil {
-		return fmt.Errorf("could not chmod file: %v", err)
+	return weekly.TickerOptions{
+		FireImmediatelyIfActive: f.CheckOnStart,
+		FireImmediately:         f.CheckOnStartAlways,
+	}.NewTicker(f.CheckSpecs)
+}
+
+// sortItems sorts items oldest first, by publish time. Items published at the
+// same time (e.g. a burst of releases) are sorted by their order, then by GUID,
+// so that the result is deterministic regardless of the order in which the
+// feed lists them. Every item must have a publish time.
+func sortItems(f *config.Feed, itms []*gofeed.Item) {
+	orders := make(map[*gofeed.Item]string, len(itms))
+	if f.OrderRegexp != nil {
+		for _, itm := range itms {
+			if o, ok := f.Order(itm.Title); ok {
+				orders[itm] = o
+			}
+		}
 	}
-	if err := os.Rename(f.Name(), fn); err != nil {
-		return fmt.Errorf("could not rename file: %v", err)
+	sort.SliceStable(itms, func(i, j int) bool {
+		a, b := itms[i], itms[j]
+		if !a.PublishedParsed.Equal(*b.PublishedParsed) {
+			return a.PublishedParsed.Before(*b.PublishedParsed)
+		}
+		if oa, ob := orders[a], orders[b]; oa != ob {
+			return oa < ob
+		}
+		return a.GUID < b.GUID
+	})
+}
+
+// parseDates fills in the publish time of items whose publish time gofeed
+// could not parse, using the feed's own date layouts, if any. It returns the
+// first item with no publish time, or nil if every item has one.
+func parseDates(f *config.Feed, itms []*gofeed.Item) *gofeed.Item {
+	for _, itm := range itms {
+		if itm.PublishedParsed == nil {
+			if t, ok := f.ParseDate(itm.Published); ok {
+				itm.PublishedParsed = &t
+			}
+		}
+		if itm.PublishedParsed == nil {
+			return itm
+		}
 	}
 	return nil
 }
 
-func sendAlert(a alert.Alerter, code alert.Code, details string) {
-	const alertTimeout = time.Minute
+// window describes the check window containing the given scheduled check time.
+func window(f *config.Feed, t time.Time) string {
+	if f.CheckCron != nil {
+		return fmt.Sprintf("cron %q", f.CheckCron)
+	}
+	for _, ts := range f.CheckSpecs {
+		if ts.Contains(t) {
+			return fmt.Sprintf("window %s - %s", ts.Start, ts.End)
+		}
+	}
+	return "unknown window"
+}
 
-	if a != nil {
-		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
-			defer cancel()
-			if err := a.Alert(ctx, code, details); err != nil {
-				log.Printf("Error while alerting ([%s] %s): %v", code, details, err)
-			}
-		}()
+// checkLimiter bounds the number of feeds fetched & parsed at once, recording
+// how many are in a health registry, as well as the number of feeds checked at
+// once. It also holds the limiter spacing out the requests checks make to
+// each host.
+type checkLimiter struct {
+	sem   chan struct{} // nil if unlimited
+	feeds chan struct{} // bounds whole checks, including downloads; nil if unlimited
+	hr    *health.Registry
+	hosts *hostLimiter // nil if requests are not spaced out
+}
+
+// newCheckLimiter returns a limiter allowing max concurrent checks; if max is
+// 0, checks are unlimited. Whole checks are unlimited until feeds is set.
+func newCheckLimiter(max int, hr *health.Registry) *checkLimiter {
+	l := &checkLimiter{hr: hr}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+// acquire waits until a check may begin. If deadline is non-zero and the check
+// cannot begin before then, it returns false. Otherwise, release must be
+// called once the feed is fetched & parsed, and finish once the check is
+// complete.
+func (l *checkLimiter) acquire(deadline time.Time) bool {
+	if !acquireSlot(l.feeds, deadline) {
+		return false
+	}
+	if !acquireSlot(l.sem, deadline) {
+		if l.feeds != nil {
+			<-l.feeds
+		}
+		return false
+	}
+	l.hr.StartCheck()
+	return true
+}
+
+// acquireSlot waits until sem has room, taking a slot. If deadline is
+// non-zero and sem has no room before then, it returns false. A nil sem always
+// has room.
+func acquireSlot(sem chan struct{}, deadline time.Time) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		tmr := time.NewTimer(time.Until(deadline))
+		defer tmr.Stop()
+		timeout = tmr.C
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// release records that the feed of a check begun by acquire is fetched &
+// parsed.
+func (l *checkLimiter) release() {
+	l.hr.FinishCheck()
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// finish records that a check begun by acquire is complete.
+func (l *checkLimiter) finish() {
+	if l.feeds != nil {
+		<-l.feeds
+	}
+}
+
+// hostLimiter spaces out the requests made to each host, across all feeds, by
+// at least a minimum interval, so that feeds sharing a server do not hammer
+// it when their checks overlap. Hosts are compared case-insensitively; ports
+// are ignored. Requests made when following a redirect are not spaced out.
+type hostLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex           // protects next
+	next map[string]time.Time // by host, the earliest time of the next request
+}
+
+// newHostLimiter returns a limiter spacing out requests to each host by the
+// given interval.
+func newHostLimiter(interval time.Duration) *hostLimiter {
+	return &hostLimiter{interval: interval, next: map[string]time.Time{}}
+}
+
+// wait waits until a request may be made to the host of the given URL, and
+// reserves the host for the limiter's interval from then. A nil limiter never
+// waits. If ctx is done first, ctx's error is returned, and the request should
+// not be made.
+func (l *hostLimiter) wait(ctx context.Context, rawURL string) error {
+	if l == nil {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		// The request will fail without reaching any host.
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	l.mu.Lock()
+	now := time.Now()
+	t := l.next[host]
+	if t.Before(now) {
+		t = now
+	}
+	l.next[host] = t.Add(l.interval)
+	l.mu.Unlock()
+	if !t.After(now) {
+		return nil
+	}
+	tmr := time.NewTimer(t.Sub(now))
+	defer tmr.Stop()
+	select {
+	case <-tmr.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadPacer spaces out a feed's downloads by its MinDownloadInterval,
+// measured from the end of each successful download. The time at which the
+// next download may begin is kept in the state, so that it survives restarts.
+// Downloads wait for one another, so that at most one is in progress.
+type downloadPacer struct {
+	ctx   context.Context // once done, waits are abandoned
+	f     *config.Feed
+	s     *state.State
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+
+	sem  chan struct{} // held from acquire until release
+	next time.Time     // protected by sem
+}
+
+// newDownloadPacer returns a pacer for the feed's downloads, or nil if the
+// feed's downloads are not spaced out.
+func newDownloadPacer(ctx context.Context, f *config.Feed, s *state.State) *downloadPacer {
+	if f.MinDownloadInterval <= 0 {
+		return nil
+	}
+	return &downloadPacer{
+		ctx:   ctx,
+		f:     f,
+		s:     s,
+		now:   time.Now,
+		after: time.After,
+		sem:   make(chan struct{}, 1),
+		next:  s.NextDownload(f.Name),
+	}
+}
+
+// acquire waits until a download may begin. Unless an error is returned,
+// release must be called once the download is complete. An error is returned
+// if the pacer's context is done before the download may begin. A nil pacer
+// never waits.
+func (p *downloadPacer) acquire() error {
+	if p == nil {
+		return nil
+	}
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+	if d := p.next.Sub(p.now()); d > 0 {
+		log.Printf("[%s] Waiting %v before downloading, per min_download_interval", p.f.Name, d.Round(time.Second))
+		select {
+		case <-p.after(d):
+		case <-p.ctx.Done():
+			<-p.sem
+			return p.ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release records that a download begun by acquire is complete. If it
+// succeeded, the next download may not begin until the feed's
+// MinDownloadInterval has passed.
+func (p *downloadPacer) release(succeeded bool) {
+	if p == nil {
+		return
+	}
+	if succeeded {
+		p.next = p.now().Add(p.f.MinDownloadInterval)
+		if err := p.s.SetNextDownload(p.f.Name, p.next); err != nil {
+			log.Printf("[%s] Could not record next download time: %v", p.f.Name, err)
+		}
+	}
+	<-p.sem
+}
+
+// startupDelay returns a random delay of up to the feed's MaxStartupDelay, by
+// which to delay its first check so that feeds' first checks are staggered.
+func startupDelay(f *config.Feed) time.Duration {
+	if f.MaxStartupDelay <= 0 {
+		return 0
+	}
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		log.Printf("[%s] Could not seed RNG; not delaying first check: %v", f.Name, err)
+		return 0
+	}
+	rnd := rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+	return time.Duration(rnd.Int63n(int64(f.MaxStartupDelay))).Round(time.Millisecond)
+}
+
+// decision is what a check should do with a feed item, as determined by
+// decide.
+type decision struct {
+	health.Decision                // Disposition is DOWNLOADED if the item should be downloaded
+	advance         bool           // if set, the item's order becomes the feed's order
+	prevOrder       string         // the feed's order when the item was decided
+	complete        bool           // if set, the feed is complete; see config.Feed.DisableAfterMax
+	emptyOrder      bool           // if set, the title matched the order regex, but the captured order is empty
+	repack          bool           // if set, the item is a repack of an item at the current order; see config.Feed.RepackRegexp
+	retry           bool           // if set, the item's link was gone, but may not have propagated yet; see config.Feed.MaxGoneChecks
+	checkType       *regexp.Regexp // if non-nil, the content type the download must have
+}
+
+// decide determines what to do with the given item, given the feed's current
+// order, the links downloaded but not yet recorded in s, and the current time.
+// Checks requiring network access, such as for an existing copy of the item,
+// are left to the caller.
+func decide(f *config.Feed, s *state.State, itm *gofeed.Item, order string, links []string, now time.Time) decision {
+	d := decision{Decision: health.Decision{Title: itm.Title}}
+	skip := func(disp health.Disposition, advance bool, format string, a ...interface{}) decision {
+		d.Disposition, d.Reason, d.advance = disp, fmt.Sprintf(format, a...), advance
+		return d
+	}
+
+	// Check order, unless mirroring, in which case items are considered
+	// regardless of their order.
+	if !f.Mirror {
+		o, ok := f.Order(itm.Title)
+		if !ok {
+			return skip(health.SKIPPED_ORDER, false, "title does not match order regex")
+		}
+		if o == "" {
+			// An empty order would compare before every other order, so that
+			// the item is never downloaded. This is almost certainly a mistake
+			// in the order regex.
+			d.emptyOrder = true
+			return skip(health.SKIPPED_ORDER, false, "title matches order regex, but captured order is empty")
+		}
+		d.Order, d.prevOrder = o, order
+		if o == order && isRepack(f, s, itm) {
+			// Download the repack, without changing the order.
+			d.repack = true
+		} else if o <= order {
+			return skip(health.SKIPPED_ORDER, false, "order %q is not after current order %q", o, order)
+		}
+
+		// Check order bounds. Items outside the bounds do not affect the order.
+		if f.OrderMin != "" && o < f.OrderMin {
+			return skip(health.SKIPPED_ORDER, false, "order %q is before order_min %q", o, f.OrderMin)
+		}
+		if f.OrderMax != "" && o > f.OrderMax {
+			d.complete = f.DisableAfterMax
+			return skip(health.SKIPPED_ORDER, false, "order %q is after order_max %q", o, f.OrderMax)
+		}
+	}
+
+	// Check age. Items that are too old still advance the order, so that they
+	// are not reconsidered on every check.
+	if f.TooOld(itm.PublishedParsed, now) {
+		return skip(health.SKIPPED_AGE, true, "published %v, older than maximum item age", *itm.PublishedParsed)
+	}
+
+	// Check extension filters. Items that fail them do not advance the order,
+	// so that they are reconsidered on later checks.
+	if reason, ok := extensionFiltersPass(f, itm); !ok {
+		return skip(health.SKIPPED_FILTER, false, "%s (will retry)", reason)
+	}
+
+	// Skip links that have already been downloaded, even if the order
+	// indicates the item is new (e.g. a feed republishing an item under a new
+	// title).
+	if s.HasDownloaded(f.Name, itm.Link) || containsString(links, itm.Link) {
+		return skip(health.SKIPPED_DUPLICATE, true, "%q already downloaded", redactURL(itm.Link, f.SecretQueryParams))
+	}
+
+	// Skip links that another feed has already downloaded, if participating
+	// in global deduplication.
+	if f.GlobalDedupe && s.HasDownloadedGlobally(itm.Link) {
+		return skip(health.SKIPPED_DUPLICATE, true, "%q already downloaded by another feed", redactURL(itm.Link, f.SecretQueryParams))
+	}
+
+	// Check content type, as advertised by the item's enclosures. If the item
+	// doesn't advertise a content type, the response's content type is checked
+	// when downloading instead.
+	checkType, ok := enclosureTypeAllowed(f.ContentTypeRegexp, itm)
+	if !ok {
+		return skip(health.SKIPPED_FILTER, true, "no enclosure with an allowed content type")
+	}
+	d.Disposition, d.advance, d.checkType = health.DOWNLOADED, true, checkType
+	return d
+}
+
+// regressedItems returns the items suggesting that the feed's orders have
+// regressed, oldest first: if no item's order is after the feed's order, those
+// published after since (the feed's last download) whose orders are before
+// it, and whose links have not been downloaded.
+func regressedItems(f *config.Feed, s *state.State, itms []*gofeed.Item, order string, since time.Time) []*gofeed.Item {
+	if f.Mirror || order == "" {
+		return nil
+	}
+	var rs []*gofeed.Item
+	for _, itm := range itms {
+		o, ok := f.Order(itm.Title)
+		switch {
+		case !ok || o == "":
+		case o > order:
+			return nil
+		case o < order && itm.PublishedParsed.After(since) && !s.HasDownloaded(f.Name, itm.Link):
+			rs = append(rs, itm)
+		}
+	}
+	return rs
+}
+
+// latestItem returns the item to download for a LatestOnly feed: of the items
+// decide would download, the one with the greatest order, or the last of those
+// published if several share it. It returns nil if no item would be
+// downloaded.
+func latestItem(f *config.Feed, s *state.State, itms []*gofeed.Item, order string, links []string, now time.Time) *gofeed.Item {
+	var latest *gofeed.Item
+	var latestOrder string
+	for _, itm := range itms {
+		d := decide(f, s, itm, order, links, now)
+		if d.Disposition == health.DOWNLOADED && (latest == nil || d.Order >= latestOrder) {
+			latest, latestOrder = itm, d.Order
+		}
+	}
+	return latest
+}
+
+// supersede skips the given item, decided by decide, if it would be downloaded
+// but is not the latest item found by latestItem. The item does not advance
+// the order itself; downloading the latest item advances the order past it,
+// so that it is skipped for good.
+func supersede(d decision, itm, latest *gofeed.Item) decision {
+	if d.Disposition == health.DOWNLOADED && itm != latest {
+		d.Disposition, d.Reason, d.advance = health.SKIPPED_ORDER, fmt.Sprintf("superseded by %q (latest_only)", latest.Title), false
+	}
+	return d
+}
+
+// isRepack determines if the given item, whose order is the feed's current
+// order, is a repack to download: its title matches the feed's RepackRegexp,
+// and its GUID has not been downloaded.
+func isRepack(f *config.Feed, s *state.State, itm *gofeed.Item) bool {
+	return f.RepackRegexp != nil && f.RepackRegexp.MatchString(itm.Title) && itm.GUID != "" && !s.HasDownloadedGUID(f.Name, itm.GUID)
+}
+
+// recordOrder records order as the feed's order in s, along with the given
+// downloaded links & bytes, returning the feed's resulting order. The order is
+// recorded only if the feed's order in s is still stored, the order last read
+// from or written to s: if the order was changed elsewhere, e.g. lowered to
+// download items again, the changed order is kept; and an order before stored
+// is rejected, so that the order never regresses, unless force is set. Either
+// way, a warning is logged, and the links & bytes are still recorded.
+func recordOrder(f *config.Feed, s *state.State, stored, order string, links []string, dlBytes int64, force bool) (string, error) {
+	if force {
+		switch err := s.CompareAndSetOrder(f.Name, stored, order, true); {
+		case err == nil:
+			stored = order
+		case !errors.Is(err, state.ErrOrderConflict):
+			return "", err
+		}
+	}
+	err := s.CompareAndUpdate(f.Name, stored, order, links, dlBytes)
+	switch {
+	case errors.Is(err, state.ErrOrderConflict):
+		cur := s.GetOrder(f.Name)
+		log.Printf("[%s] Warning: order changed from %q to %q during check; keeping %q rather than %q", f.Name, stored, cur, cur, order)
+		return cur, s.CompareAndUpdate(f.Name, cur, cur, links, dlBytes)
+	case errors.Is(err, state.ErrOrderRegression):
+		log.Printf("[%s] Warning: not lowering order from %q to %q", f.Name, stored, order)
+		return stored, s.CompareAndUpdate(f.Name, stored, stored, links, dlBytes)
+	case err != nil:
+		return "", err
+	}
+	return order, nil
+}
+
+// fetchResult is the result of fetching an item decided to be downloaded.
+type fetchResult struct {
+	health.Decision
+	n      int64 // the number of bytes downloaded
+	exists bool  // if set, an existing copy of the item was found, so it was not downloaded
+}
+
+// settleItem determines what a check did with an item decided to be
+// downloaded, given the result of fetching it, & whether the item's link should
+// be recorded so that later checks skip it. goneChecks counts, by link, the
+// checks which found an item gone; once maxGoneChecks checks have, the item is
+// given up on.
+func settleItem(f *config.Feed, alerter alert.Alerter, goneChecks map[string]int, itm *gofeed.Item, d decision, r fetchResult) (decision, bool) {
+	d.Decision = r.Decision
+	if r.exists {
+		return d, true
+	}
+	switch d.Disposition {
+	case health.FAILED_GONE:
+		goneChecks[itm.Link]++
+		checks, limit := goneChecks[itm.Link], maxGoneChecks(f)
+		if checks < limit {
+			// Likely not yet propagated: fail the check, but don't count it
+			// against the feed's health.
+			d.Disposition, d.Reason = health.FAILED_DOWNLOAD, fmt.Sprintf("%s (gone in %d of %d checks; will retry)", d.Reason, checks, limit)
+			d.retry = true
+			return d, false
+		}
+		if checks == limit {
+			log.Printf("[%s] Giving up on %s: gone in %d checks", f.Name, itm.Title, checks)
+			sendAlert(alerter, alert.ITEM_GONE, fmt.Sprintf("[%s] Item gone: %s", f.Name, itm.Title))
+		}
+		d.Reason = fmt.Sprintf("%s (gave up after %d checks)", d.Reason, checks)
+		if f.StopOnGone {
+			d.Disposition = health.FAILED_DOWNLOAD
+			return d, false
+		}
+		delete(goneChecks, itm.Link)
+		return d, true
+	case health.DOWNLOADED, health.SKIPPED_DUPLICATE:
+		delete(goneChecks, itm.Link)
+		return d, true
+	}
+	return d, false
+}
+
+// fetchItem downloads the given item, as decided by decide, unless an
+// existing copy of it is found.
+func fetchItem(ctx context.Context, f *config.Feed, s *state.State, h *health.Tracker, client *http.Client, hosts *hostLimiter, pacer *downloadPacer, alerter alert.Alerter, hd *hashDedupe, itm *gofeed.Item, d decision) fetchResult {
+	// Check for an existing copy of the item, if configured.
+	exists, etag := existingCopy(ctx, client, hosts, s, f, itm.Link)
+	if exists {
+		d.Disposition, d.Reason = health.SKIPPED_DUPLICATE, fmt.Sprintf("%q already exists locally", redactURL(itm.Link, f.SecretQueryParams))
+		return fetchResult{Decision: d.Decision, exists: true}
+	}
+	dd, n := downloadItem(ctx, f, s, h, client, hosts, pacer, alerter, hd, itm, d, etag)
+	return fetchResult{Decision: dd, n: n}
+}
+
+// fetchNewestFirst fetches the items, ordered oldest first, that a check
+// starting at the given order & pending links would download, newest first
+// and with up to f.MaxDownloads at once. The check then processes the results
+// oldest first as usual, so that the order only advances past an item once
+// every older item is downloaded.
+//
+// Items are decided as if every older item is downloaded successfully. If one
+// is not, the check stops there, and the results for newer items are left in
+// the returned map.
+func fetchNewestFirst(ctx context.Context, f *config.Feed, s *state.State, h *health.Tracker, client *http.Client, hosts *hostLimiter, pacer *downloadPacer, alerter alert.Alerter, hd *hashDedupe, itms []*gofeed.Item, order string, links []string, now time.Time) map[*gofeed.Item]fetchResult {
+	type candidate struct {
+		itm *gofeed.Item
+		d   decision
+	}
+	var cs []candidate
+	links = append([]string(nil), links...)
+	for _, itm := range itms {
+		d := decide(f, s, itm, order, links, now)
+		if d.Disposition == health.DOWNLOADED {
+			cs = append(cs, candidate{itm, d})
+			links = append(links, itm.Link)
+		}
+		if d.advance {
+			order = d.Order
+		}
+	}
+	if len(cs) > 1 {
+		log.Printf("[%s] Downloading %d items newest first", f.Name, len(cs))
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	fetched := make(map[*gofeed.Item]fetchResult, len(cs))
+	sem := make(chan struct{}, f.MaxDownloads)
+	for i := len(cs) - 1; i >= 0; i-- {
+		c := cs[i]
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := fetchItem(ctx, f, s, h, client, hosts, pacer, alerter, hd, c.itm, c.d)
+			mu.Lock()
+			defer mu.Unlock()
+			fetched[c.itm] = r
+		}()
+	}
+	wg.Wait()
+	return fetched
+}
+
+// downloadItem downloads the given item, as decided by decide, returning the
+// updated decision and the number of bytes downloaded. The item's ETag, if
+// known, is recorded on success.
+func downloadItem(ctx context.Context, f *config.Feed, s *state.State, h *health.Tracker, client *http.Client, hosts *hostLimiter, pacer *downloadPacer, alerter alert.Alerter, hd *hashDedupe, itm *gofeed.Item, dd decision, etag string) (health.Decision, int64) {
+	d := dd.Decision
+	log.Printf("[%s] Found %s", f.Name, itm.Title)
+	label := f.Label(itm.Title)
+	var title string
+	if f.FilenameFallback == config.TITLE {
+		title = itm.Title
+		if label != "" {
+			title = label
+		}
+	}
+	dir := f.DownloadDir
+	if f.TorrentWatchDir != "" && isTorrent(itm) {
+		dir = f.TorrentWatchDir
+	}
+	if f.LinkIndex {
+		if prev, dst, ok := reuseIndexedFile(f, s, itm.Link, dir); ok {
+			if prev == dst {
+				d.Disposition, d.Reason = health.SKIPPED_DUPLICATE, fmt.Sprintf("%q already downloaded to %q", redactURL(itm.Link, f.SecretQueryParams), prev)
+				return d, 0
+			}
+			log.Printf("[%s] Linked %q to %q, previously downloaded from the same link", f.Name, prev, dst)
+			recordLinkPath(s, f, itm.Link, dst)
+			d.Disposition, d.Reason = health.SKIPPED_DUPLICATE, fmt.Sprintf("%q already downloaded to %q; linked", redactURL(itm.Link, f.SecretQueryParams), prev)
+			return d, 0
+		}
+	}
+	if err := pacer.acquire(); err != nil {
+		log.Printf("[%s] Not downloading %s: stopped waiting for min_download_interval: %v", f.Name, itm.Title, err)
+		d.Disposition, d.Reason = health.FAILED_DOWNLOAD, fmt.Sprintf("stopped waiting for min_download_interval: %v", err)
+		return d, 0
+	}
+	if err := hosts.wait(ctx, itm.Link); err != nil {
+		pacer.release(false)
+		log.Printf("[%s] Not downloading %s: stopped waiting for min_host_interval: %v", f.Name, itm.Title, err)
+		d.Disposition, d.Reason = health.FAILED_DOWNLOAD, fmt.Sprintf("stopped waiting for min_host_interval: %v", err)
+		return d, 0
+	}
+	n, path, dupOf, err := download(client, itm.Link, dir, downloadOptions{
+		secretParams: f.SecretQueryParams,
+		title:        title,
+		staging:      f.StagingDir,
+		unique:       dd.repack,
+		checkType:    dd.checkType,
+		stallTimeout: stallTimeout(f),
+		dedupe:       hd,
+	}, h)
+	pacer.release(err == nil)
+	if err != nil {
+		var cte *contentTypeError
+		if errors.As(err, &cte) {
+			d.Disposition, d.Reason = health.SKIPPED_FILTER, err.Error()
+			return d, 0
+		}
+		var se *statusError
+		if errors.As(err, &se) && se.gone() {
+			// checkFeed decides whether to alert & give up on the item.
+			log.Printf("[%s] Could not download %q: %v", f.Name, itm.Title, err)
+			d.Disposition, d.Reason = health.FAILED_GONE, err.Error()
+			return d, 0
+		}
+		var he *fetch.HostError
+		if errors.As(err, &he) {
+			// Retrying won't help; skip the item, but make sure it is noticed.
+			sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Refused to download item: %v", f.Name, he))
+			log.Printf("[%s] Refused to download %q: %v", f.Name, itm.Title, err)
+			d.Disposition, d.Reason = health.SKIPPED_FILTER, err.Error()
+			return d, 0
+		}
+		sendAlert(alerter, alert.ERROR, fmt.Sprintf("[%s] Could not download item", f.Name))
+		log.Printf("[%s] Could not download %q: %v", f.Name, itm.Title, err)
+		d.Disposition, d.Reason = health.FAILED_DOWNLOAD, err.Error()
+		return d, 0
+	} else if dupOf != "" {
+		d.Disposition, d.Reason = health.SKIPPED_DUPLICATE, fmt.Sprintf("content duplicates %q", dupOf)
+	} else {
+		if label == "" {
+			label = d.Order
+		}
+		if label == "" {
+			label = itm.Title
+		}
+		var stdin []byte
+		if f.ItemJSONStdin {
+			if stdin, err = json.Marshal(newItemJSON{Feed: f.Name, Path: path, Order: d.Order, Item: itm}); err != nil {
+				log.Printf("[%s] Could not marshal %q as JSON: %v", f.Name, itm.Title, err)
+			}
+		}
+		details := fmt.Sprintf("[%s] Got new item: %s (%d bytes)", f.Name, label, n)
+		if dd.advance && dd.prevOrder != "" && dd.prevOrder != d.Order {
+			details += fmt.Sprintf("; order advanced from %s to %s", dd.prevOrder, d.Order)
+		}
+		sendAlertStdin(alerter, alert.NEW_ITEM, details, stdin)
+		h.Publish(health.ItemDownloaded{Feed: f.Name, Title: itm.Title, Path: path, Bytes: n})
+		if f.WriteMetadata && path != "" {
+			if err := writeMetadata(path, newItemMetadata(f, itm, d.Order, n, time.Now())); err != nil {
+				log.Printf("[%s] Could not write metadata for %q: %v", f.Name, path, err)
+			}
+		}
+	}
+	h.AddDownloadedBytes(n)
+	if etag != "" {
+		recordETag(s, f, itm.Link, etag)
+	}
+	if f.KeepLastN > 0 && path != "" {
+		pruneFiles(s, f, path)
+	}
+	if f.GlobalDedupe {
+		// Record the download immediately, rather than with the order, so
+		// that other feeds checking concurrently see it.
+		if err := s.RecordGlobalDownload(itm.Link); err != nil {
+			log.Printf("[%s] Could not record %q for global deduplication: %v", f.Name, redactURL(itm.Link, f.SecretQueryParams), err)
+		}
+	}
+	if f.LinkIndex && path != "" {
+		recordLinkPath(s, f, itm.Link, path)
+	}
+	if f.RepackRegexp != nil && itm.GUID != "" {
+		// Record the GUID, so that a repack is downloaded only once.
+		if err := s.RecordDownloadedGUID(f.Name, itm.GUID); err != nil {
+			log.Printf("[%s] Could not record GUID of %q: %v", f.Name, itm.Title, err)
+		}
+	}
+	return d, n
+}
+
+// reuseIndexedFile finds the file most recently downloaded from the given link
+// in the link index, if it still exists, so that it need not be downloaded
+// again. If the file is not already in dir, it is hard linked into dir under
+// the same name. It returns the indexed path & the path in dir, which are equal
+// if the file was already in dir.
+func reuseIndexedFile(f *config.Feed, s *state.State, link, dir string) (prev, dst string, ok bool) {
+	prev, ok = s.LinkPath(link)
+	if !ok {
+		return "", "", false
+	}
+	if fi, err := os.Stat(prev); err != nil || !fi.Mode().IsRegular() {
+		return "", "", false
+	}
+	if filepath.Dir(prev) == filepath.Clean(dir) {
+		return prev, prev, true
+	}
+	dst = filepath.Join(dir, filepath.Base(prev))
+	if err := publishLink(prev, dst); err != nil {
+		// e.g. dir is on another filesystem; download the item as usual.
+		log.Printf("[%s] Could not link %q to %q: %v", f.Name, prev, dst, err)
+		return "", "", false
+	}
+	return prev, dst, true
+}
+
+// recordLinkPath records the path of the file downloaded from the given link in
+// the link index, logging any error.
+func recordLinkPath(s *state.State, f *config.Feed, link, path string) {
+	if err := s.RecordLinkPath(link, path); err != nil {
+		log.Printf("[%s] Could not record %q in the link index: %v", f.Name, redactURL(link, f.SecretQueryParams), err)
+	}
+}
+
+// extensionFiltersPass determines if the given item satisfies the feed's
+// extension filters. If not, a description of the failed filter is returned.
+func extensionFiltersPass(f *config.Feed, itm *gofeed.Item) (reason string, ok bool) {
+	for _, ef := range f.ExtensionFilters {
+		exts := itm.Extensions[ef.Prefix][ef.Name]
+		if len(exts) == 0 {
+			return fmt.Sprintf("no %s element", ef.Path()), false
+		}
+		if v := exts[0].Value; !ef.Matches(v) {
+			return fmt.Sprintf("%s value %q does not satisfy filter", ef.Path(), v), false
+		}
+	}
+	return "", true
+}
+
+// httpClient returns the HTTP client to use for fetching the given feed or, if
+// download is set, for downloading its items. Only the latter is restricted to
+// the feed's allowed download hosts & to public addresses, supports ftp:// &
+// ftps:// URLs, and decodes compressed content itself (unless the feed uses raw
+// transfers).
+func httpClient(f *config.Feed, download bool) *http.Client {
+	allowHosts := download && len(f.AllowedDownloadHosts) > 0
+	denyPrivate := download && f.DenyPrivateDownloads
+	if f.TLSConfig == nil && f.Headers == nil && f.MaxRedirects == 0 && !download {
+		return http.DefaultClient
+	}
+	c := &http.Client{}
+	var t *http.Transport
+	if f.TLSConfig != nil {
+		t = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     f.TLSConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+	if denyPrivate {
+		if t == nil {
+			t = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		t.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   fetch.DenyPrivate,
+		}).DialContext
+	}
+	if download && f.RawTransfer {
+		if t == nil {
+			t = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		t.DisableCompression = true
+	}
+	if download {
+		if t == nil {
+			t = http.DefaultTransport.(*http.Transport).Clone()
+		}
+		ftp := &fetch.FTPTransport{
+			User:        f.FTPUser,
+			Password:    f.FTPPassword,
+			TLSConfig:   f.TLSConfig,
+			DialContext: t.DialContext,
+		}
+		t.RegisterProtocol("ftp", ftp)
+		t.RegisterProtocol("ftps", ftp)
+	}
+	if t != nil {
+		c.Transport = t
+	}
+	if download && !f.RawTransfer {
+		// Decode beneath HeaderTransport, so that a configured Accept-Encoding
+		// header does not leave content encoded.
+		c.Transport = &fetch.DecodeTransport{Base: c.Transport}
+	}
+	if f.Headers != nil {
+		c.Transport = &fetch.HeaderTransport{
+			Base:          c.Transport,
+			Header:        f.Headers,
+			RedirectHosts: f.RedirectHeaderHosts,
+		}
+	}
+	if allowHosts {
+		c.Transport = &fetch.HostTransport{Base: c.Transport, Hosts: f.AllowedDownloadHosts}
+	}
+	if f.MaxRedirects != 0 {
+		c.CheckRedirect = fetch.LimitRedirects(f.MaxRedirects)
+	}
+	return c
+}
+
+// fetchFeedWithRetries calls fetchFeed, retrying with exponential backoff up
+// to the feed's configured number of retries if fetchFeed fails. If ctx is
+// done while waiting to retry, ctx's error is returned.
+func fetchFeedWithRetries(ctx context.Context, client *http.Client, hosts *hostLimiter, parser *gofeed.Parser, f *config.Feed) (*gofeed.Feed, error) {
+	const (
+		initialBackoff = 2 * time.Second
+		maxBackoff     = 5 * time.Minute
+	)
+
+	backoff := initialBackoff
+	for i := 0; ; i++ {
+		feed, err := fetchFeed(ctx, client, hosts, parser, f)
+		var le *fetch.LimitError
+		if err == nil || i >= f.ParseRetries || errors.As(err, &le) {
+			// Don't retry feeds that exceed their limits; they are likely to
+			// exceed them again.
+			return feed, err
+		}
+		log.Printf("[%s] Could not parse feed (attempt %d of %d), retrying in %v: %v", f.Name, i+1, f.ParseRetries+1, backoff, redactErr(err, f.SecretQueryParams))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// fetchFeed retrieves and parses the given feed. If pagination is enabled for
+// the feed, subsequent pages (as specified by rel="next" links) are fetched as
+// well, and their items are appended to the returned feed's items. Each page
+// is requested once hosts allows.
+func fetchFeed(ctx context.Context, client *http.Client, hosts *hostLimiter, parser *gofeed.Parser, f *config.Feed) (*gofeed.Feed, error) {
+	feed, body, err := fetchPage(ctx, client, hosts, parser, f, f.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{f.URL: {}}
+	page, pageURL := feed, f.URL
+	for i := 1; i < f.MaxPages; i++ {
+		nxt, err := nextPageURL(page, body, pageURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not determine next page after %q: %v", pageURL, err)
+		}
+		if nxt == "" {
+			break
+		}
+		if _, ok := seen[nxt]; ok {
+			log.Printf("[%s] Pagination loop detected at %q; not following", f.Name, redactURL(nxt, f.SecretQueryParams))
+			break
+		}
+		seen[nxt] = struct{}{}
+
+		pageURL = nxt
+		if page, body, err = fetchPage(ctx, client, hosts, parser, f, pageURL); err != nil {
+			return nil, fmt.Errorf("could not fetch page %d: %v", i+1, err)
+		}
+		feed.Items = append(feed.Items, page.Items...)
+	}
+	return feed, nil
+}
+
+// fetchPage retrieves and parses a single page of the given feed, returning
+// the parsed page along with the body it was parsed from. If the page does not
+// parse and lenient parsing is enabled, the page is sanitized and parsed
+// again.
+func fetchPage(ctx context.Context, client *http.Client, hosts *hostLimiter, parser *gofeed.Parser, f *config.Feed, pageURL string) (*gofeed.Feed, []byte, error) {
+	maxSize, timeout := f.MaxFeedSize, f.FetchTimeout
+	if maxSize == 0 {
+		maxSize = config.DefaultMaxFeedSize
+	}
+	if timeout == 0 {
+		timeout = config.DefaultFetchTimeout
+	}
+	if err := hosts.wait(ctx, pageURL); err != nil {
+		return nil, nil, err
+	}
+	body, err := fetch.Body(client, pageURL, maxSize, timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	feed, err := parser.Parse(bytes.NewReader(body))
+	if err == nil || !f.LenientParse {
+		return feed, body, err
+	}
+	body = sanitize.XML(body)
+	feed, lenientErr := parser.Parse(bytes.NewReader(body))
+	if lenientErr != nil {
+		return nil, nil, fmt.Errorf("%v (lenient parse also failed: %v)", err, lenientErr)
+	}
+	log.Printf("[%s] Feed parsed in lenient mode (strict parse failed: %v)", f.Name, err)
+	return feed, body, nil
+}
+
+// nextPageURL returns the absolute URL of the page following the given page,
+// as specified by a link with rel="next": a native link element for Atom
+// feeds, or an atom:link element for other feeds. body is the document the
+// page was parsed from; gofeed does not keep the links of Atom feeds, so they
+// are parsed from it again. If there is no next page, the empty string is
+// returned.
+func nextPageURL(page *gofeed.Feed, body []byte, pageURL string) (string, error) {
+	var href string
+	if page.FeedType == "atom" {
+		af, err := (&atom.Parser{}).Parse(bytes.NewReader(body))
+		if err != nil {
+			return "", fmt.Errorf("could not parse Atom links: %v", err)
+		}
+		for _, l := range af.Links {
+			if l.Rel == "next" && l.Href != "" {
+				href = l.Href
+				break
+			}
+		}
+	} else {
+		for _, l := range page.Extensions["atom"]["link"] {
+			if l.Attrs["rel"] == "next" && l.Attrs["href"] != "" {
+				href = l.Attrs["href"]
+				break
+			}
+		}
+	}
+	if href == "" {
+		return "", nil
+	}
+
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL %q: %v", pageURL, err)
+	}
+	nxt, err := base.Parse(href)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL %q: %v", href, err)
+	}
+	return nxt.String(), nil
+}
+
+// enclosureTypeAllowed determines if the given item may be downloaded based on
+// the content types advertised by its enclosures: if any enclosure advertises
+// a content type, at least one must match re. If no enclosure advertises a
+// content type, the item is allowed, and the returned regexp should be used
+// to check the content type of the download instead (otherwise, it is nil).
+func enclosureTypeAllowed(re *regexp.Regexp, itm *gofeed.Item) (checkType *regexp.Regexp, ok bool) {
+	if re == nil {
+		return nil, true
+	}
+	advertised := false
+	for _, e := range itm.Enclosures {
+		if e.Type == "" {
+			continue
+		}
+		advertised = true
+		if re.MatchString(e.Type) {
+			return nil, true
+		}
+	}
+	if advertised {
+		return nil, false
+	}
+	return re, true
+}
+
+// isTorrent determines if the given item is a .torrent file, by the extension
+// of its link's path or the content types advertised by its enclosures.
+func isTorrent(itm *gofeed.Item) bool {
+	if u, err := url.Parse(itm.Link); err == nil && strings.EqualFold(path.Ext(u.Path), ".torrent") {
+		return true
+	}
+	for _, e := range itm.Enclosures {
+		if mt, _, err := mime.ParseMediaType(e.Type); err == nil && mt == "application/x-bittorrent" {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeError is returned by download when the downloaded content's type
+// is not allowed.
+type contentTypeError struct {
+	contentType string
+}
+
+func (e *contentTypeError) Error() string {
+	return fmt.Sprintf("content type %q not allowed", e.contentType)
+}
+
+// statusError is returned by download when the server responds with a status
+// other than 200 OK.
+type statusError struct {
+	url  string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("got unexpected status code when getting %q: %d", e.url, e.code)
+}
+
+// gone determines if the status indicates that the item does not exist, which
+// may be only until it propagates to the server.
+func (e *statusError) gone() bool {
+	return e.code == http.StatusNotFound || e.code == http.StatusGone
+}
+
+// existingCopy determines if the item at the given link should be skipped
+// because a copy already exists in the feed's download directory, according to
+// the feed's SkipIfExists setting. It also returns the item's ETag, if known,
+// so that it can be recorded once the item is downloaded. Errors checking for a
+// copy are logged, and the item is treated as not existing.
+func existingCopy(ctx context.Context, client *http.Client, hosts *hostLimiter, s *state.State, f *config.Feed, link string) (exists bool, etag string) {
+	if f.SkipIfExists == config.NEVER {
+		return false, ""
+	}
+	fn, err := downloadFilename(link)
+	if err != nil {
+		return false, ""
+	}
+	if err := hosts.wait(ctx, link); err != nil {
+		log.Printf("[%s] Could not check for an existing copy of %q: %v", f.Name, redactURL(link, f.SecretQueryParams), err)
+		return false, ""
+	}
+	r, err := fetch.Head(client, link)
+	if err != nil {
+		log.Printf("[%s] Could not check for an existing copy of %q: %v", f.Name, redactURL(link, f.SecretQueryParams), redactErr(err, f.SecretQueryParams))
+		return false, ""
+	}
+	var wantETag string
+	if f.SkipIfExists == config.ETAG {
+		wantETag = s.ETag(f.Name, fn)
+	}
+	exists, err = r.Matches(filepath.Join(f.DownloadDir, fn), wantETag)
+	if err != nil {
+		log.Printf("[%s] Could not check for an existing copy of %q: %v", f.Name, redactURL(link, f.SecretQueryParams), redactErr(err, f.SecretQueryParams))
+		return false, r.ETag
+	}
+	if exists && r.ETag != "" && wantETag == "" {
+		// Record the ETag, so that later checks can compare against it.
+		recordETag(s, f, link, r.ETag)
+	}
+	return exists, r.ETag
+}
+
+// recordETag records the ETag of the file downloaded from the given link.
+func recordETag(s *state.State, f *config.Feed, link, etag string) {
+	fn, err := downloadFilename(link)
+	if err != nil {
+		return
+	}
+	if err := s.SetETag(f.Name, fn, etag); err != nil {
+		log.Printf("[%s] Could not record ETag for %q: %v", f.Name, redactURL(link, f.SecretQueryParams), err)
+	}
+}
+
+// downloadFilename returns the name of the file that the given URL is
+// downloaded to, within the download directory.
+func downloadFilename(dlURL string) (string, error) {
+	u, err := url.Parse(dlURL)
+	if err != nil {
+		return "", fmt.Errorf("could not parse URL %q: %v", dlURL, err)
+	}
+	bp := path.Base(u.Path)
+	if strings.HasSuffix(bp, ".") || strings.HasSuffix(bp, "/") {
+		return "", fmt.Errorf("URL %q has no filename", dlURL)
+	}
+	return bp, nil
+}
+
+// downloadSchemes are the URL schemes items may be downloaded with.
+var downloadSchemes = map[string]bool{"http": true, "https": true, "ftp": true, "ftps": true}
+
+// namesDirectory determines if the given URL names a directory, i.e. its path
+// ends in "/".
+func namesDirectory(dlURL string) bool {
+	u, err := url.Parse(dlURL)
+	return err == nil && strings.HasSuffix(u.Path, "/")
+}
+
+// titleFilename returns a filename based on the given item title, for a file
+// with the given Content-Type. The title is lowercased, runs of spaces are
+// replaced by dots, and characters other than letters, digits, dots, dashes &
+// underscores are removed. An extension is added if one is known for the
+// content type. If the title has no usable characters, it returns "".
+func titleFilename(title, contentType string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case unicode.IsSpace(r) || r == '.':
+			if s := sb.String(); s != "" && !strings.HasSuffix(s, ".") {
+				sb.WriteByte('.')
+			}
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			sb.WriteRune(r)
+		}
+	}
+	name := strings.TrimSuffix(sb.String(), ".")
+	if name == "" {
+		return ""
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		if exts, err := mime.ExtensionsByType(mt); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// maxGoneChecks returns how many checks may find an item's link gone before
+// the item is given up on.
+func maxGoneChecks(f *config.Feed) int {
+	if f.MaxGoneChecks == 0 {
+		return config.DefaultMaxGoneChecks
+	}
+	return f.MaxGoneChecks
+}
+
+// stallTimeout returns how long a download for the given feed may make no
+// progress before it is aborted.
+func stallTimeout(f *config.Feed) time.Duration {
+	if f.DownloadStallTimeout == 0 {
+		return config.DefaultDownloadStallTimeout
+	}
+	return f.DownloadStallTimeout
+}
+
+// hashDedupe configures discarding downloads whose content duplicates that of
+// a recent download.
+type hashDedupe struct {
+	s    *state.State
+	link bool // if set, a discarded download is replaced with a hard link to the existing file
+}
+
+// downloadOptions configures a download made by download.
+type downloadOptions struct {
+	secretParams []string       // query parameters whose values are redacted, as redactURL does
+	title        string         // names the file if the URL does not
+	staging      string         // the directory to download into before moving into place; empty if none
+	unique       bool           // if set, an existing file is not replaced
+	checkType    *regexp.Regexp // the content types allowed; nil if any is
+	stallTimeout time.Duration
+	dedupe       *hashDedupe // nil if downloads are not deduplicated by content
+}
+
+// download downloads the file at the given URL into the given directory,
+// returning the number of bytes downloaded and the path of the downloaded
+// file. The download's progress is published to h, through which it can also
+// be cancelled. If the download makes no progress for o.stallTimeout, it is
+// aborted.
+//
+// If o.title is non-empty and the URL has no filename or names a directory,
+// the file is named after the title instead, as titleFilename does.
+//
+// If o.staging is non-empty, the file is downloaded into the staging directory
+// instead, and moved into dir only once complete. If moving it fails, the
+// file is left in the staging directory.
+//
+// If o.unique is set and a file already exists with the download's filename,
+// the file is downloaded under a new name, as uniqueFilename chooses, rather
+// than replacing it.
+//
+// If o.checkType is non-nil, the response's content type must match it, or a
+// *contentTypeError is returned.
+//
+// If o.dedupe is non-nil and the downloaded content duplicates a recent
+// download that still exists, the download is discarded (or hard linked, per
+// o.dedupe) and the existing file's path is returned as dupOf. If the download
+// is discarded, the returned path is empty.
+//
+// The values of the query parameters named by o.secretParams are redacted
+// from returned errors and from the URL published to h.
+func download(client *http.Client, dlURL, dir string, o downloadOptions, h *health.Tracker) (n int64, path, dupOf string, err error) {
+	defer func() { err = redactErr(err, o.secretParams) }()
+
+	if u, err := url.Parse(dlURL); err == nil && !downloadSchemes[strings.ToLower(u.Scheme)] {
+		return 0, "", "", fmt.Errorf("URL %q has unsupported scheme %q", dlURL, u.Scheme)
+	}
+
+	// Figure out eventual filename (and sanity check the URL). A filename
+	// based on the title is determined once the content type is known.
+	bp, err := downloadFilename(dlURL)
+	if o.title != "" && (err != nil || namesDirectory(dlURL)) {
+		bp, err = "", nil
+	}
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	// Download to a temporary file first so publishing is atomic.
+	tmpDir := dir
+	if o.staging != "" {
+		tmpDir = o.staging
+	}
+	f, err := ioutil.TempFile(tmpDir, downloadTempPrefix())
+	if err != nil {
+		return 0, "", "", fmt.Errorf("could not create file: %v", err)
+	}
+	defer func() {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove %q: %v", f.Name(), err)
+		}
+	}()
+	tr, err := fetch.StartTransfer(client, dlURL, o.stallTimeout, func(p fetch.Progress) {
+		h.DownloadProgress(p.Bytes, p.LastProgress)
+	})
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer tr.Close()
+	h.StartDownload(redactURL(dlURL, o.secretParams), tr.Progress().Started, tr.Cancel)
+	defer h.FinishDownload()
+	resp := tr.Response
+	if resp.StatusCode != 200 {
+		return 0, "", "", &statusError{dlURL, resp.StatusCode}
+	}
+	if bp == "" {
+		if bp = titleFilename(o.title, resp.Header.Get("Content-Type")); bp == "" {
+			return 0, "", "", fmt.Errorf("URL %q has no filename, and title %q has no usable characters", dlURL, o.title)
+		}
+	}
+	fn := filepath.Join(dir, bp)
+	if o.unique {
+		fn = uniqueFilename(fn)
+	}
+	if o.checkType != nil {
+		ct, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || !o.checkType.MatchString(ct) {
+			return 0, "", "", &contentTypeError{resp.Header.Get("Content-Type")}
+		}
+	}
+	hash := sha256.New()
+	n, err = io.Copy(io.MultiWriter(f, hash), tr)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("could not read %q: %v", dlURL, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, "", "", fmt.Errorf("could not close file: %v", err)
+	}
+	if err := os.Chmod(f.Name(), 0640); err != nil {
+		return 0, "", "", fmt.Errorf("could not chmod file: %v", err)
+	}
+
+	var sum string
+	if o.dedupe != nil {
+		sum = hex.EncodeToString(hash.Sum(nil))
+		if existing, ok := o.dedupe.s.HashPath(sum); ok && existing != fn {
+			if _, err := os.Stat(existing); err == nil {
+				if o.dedupe.link {
+					if err := publishLink(existing, fn); err != nil {
+						return 0, "", "", fmt.Errorf("could not link duplicate file: %v", err)
+					}
+					return n, fn, existing, nil
+				}
+				return n, "", existing, nil
+			}
+		}
+	}
+	if o.staging != "" {
+		staged := filepath.Join(o.staging, bp)
+		if err := os.Rename(f.Name(), staged); err != nil {
+			return 0, "", "", fmt.Errorf("could not rename file: %v", err)
+		}
+		if err := publishFile(os.Rename, staged, fn); err != nil {
+			return 0, "", "", fmt.Errorf("could not move %q from staging directory: %v", staged, err)
+		}
+	} else if err := publishFile(os.Rename, f.Name(), fn); err != nil {
+		return 0, "", "", fmt.Errorf("could not rename file: %v", err)
+	}
+	if o.dedupe != nil {
+		if err := o.dedupe.s.RecordHash(sum, fn); err != nil {
+			log.Printf("Could not record hash of %q: %v", fn, err)
+		}
+	}
+	return n, fn, "", nil
+}
+
+// uniqueFilename returns the given filename if no file exists there, or else
+// the first filename of the form "name.N.ext" at which no file exists.
+func uniqueFilename(fn string) string {
+	if _, err := os.Lstat(fn); os.IsNotExist(err) {
+		return fn
+	}
+	ext := filepath.Ext(fn)
+	base := strings.TrimSuffix(fn, ext)
+	for i := 1; ; i++ {
+		c := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if _, err := os.Lstat(c); os.IsNotExist(err) {
+			return c
+		}
+	}
+}
+
+// pruneFiles records that the file at the given path was downloaded for the
+// given feed, and deletes the files previously downloaded for the feed beyond
+// the feed's KeepLastN most recent.
+func pruneFiles(s *state.State, f *config.Feed, path string) {
+	pruned, err := s.AddFile(f.Name, path, f.KeepLastN)
+	if err != nil {
+		// Don't delete files the state may still refer to.
+		log.Printf("[%s] Could not record downloaded file %q: %v", f.Name, path, err)
+		return
+	}
+	for _, p := range pruned {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("[%s] Could not remove %q: %v", f.Name, p, err)
+			continue
+		}
+		log.Printf("[%s] Removed %q", f.Name, p)
+		if f.WriteMetadata {
+			if err := os.Remove(p + metadataSuffix); err != nil && !os.IsNotExist(err) {
+				log.Printf("[%s] Could not remove %q: %v", f.Name, p+metadataSuffix, err)
+			}
+		}
+	}
+}
+
+// metadataSuffix is appended to a downloaded file's path to name its metadata
+// file.
+const metadataSuffix = ".json"
+
+// itemMetadata describes a downloaded item. It is written as JSON next to the
+// downloaded file, if the feed's WriteMetadata is set.
+type itemMetadata struct {
+	Title      string     `json:"title"`
+	Link       string     `json:"link"`
+	Enclosure  string     `json:"enclosure,omitempty"`
+	GUID       string     `json:"guid,omitempty"`
+	Published  *time.Time `json:"published,omitempty"`
+	Order      string     `json:"order,omitempty"`
+	Feed       string     `json:"feed"`
+	Downloaded time.Time  `json:"downloaded"`
+	Bytes      int64      `json:"bytes"`
+}
+
+// newItemMetadata describes the given item, of which n bytes were downloaded
+// at the given time.
+func newItemMetadata(f *config.Feed, itm *gofeed.Item, order string, n int64, downloaded time.Time) itemMetadata {
+	md := itemMetadata{
+		Title:      itm.Title,
+		Link:       redactURL(itm.Link, f.SecretQueryParams),
+		GUID:       itm.GUID,
+		Published:  itm.PublishedParsed,
+		Order:      order,
+		Feed:       f.Name,
+		Downloaded: downloaded.UTC().Truncate(time.Second),
+		Bytes:      n,
+	}
+	if len(itm.Enclosures) > 0 {
+		md.Enclosure = redactURL(itm.Enclosures[0].URL, f.SecretQueryParams)
+	}
+	return md
+}
+
+// newItemJSON describes a downloaded item. It is written as JSON to the
+// standard input of the NEW_ITEM alert command, if the feed's ItemJSONStdin is
+// set.
+type newItemJSON struct {
+	Feed  string       `json:"feed"`
+	Path  string       `json:"path,omitempty"`
+	Order string       `json:"order,omitempty"`
+	Item  *gofeed.Item `json:"item"`
+}
+
+// writeMetadata atomically writes the given metadata as the metadata file of
+// the downloaded file at path, by writing it to a temporary file in the same
+// directory & renaming that into place.
+func writeMetadata(path string, md itemMetadata) error {
+	buf, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal metadata: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), downloadTempPrefix())
+	if err != nil {
+		return fmt.Errorf("could not create metadata file: %v", err)
+	}
+	defer func() {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove %q: %v", f.Name(), err)
+		}
+	}()
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("could not write metadata file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close metadata file: %v", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("could not chmod metadata file: %v", err)
+	}
+	if err := os.Rename(f.Name(), path+metadataSuffix); err != nil {
+		return fmt.Errorf("could not rename metadata file: %v", err)
+	}
+	return nil
+}
+
+// publishLink atomically replaces dst with a hard link to the file at
+// existing, by linking it to a temporary name in dst's directory and renaming
+// that to dst.
+func publishLink(existing, dst string) error {
+	tmp := filepath.Join(filepath.Dir(dst), downloadTempPrefix()+"link_"+filepath.Base(dst))
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(existing, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// publishFile atomically moves the file at src to dst using rename (normally
+// os.Rename). If src & dst are on different filesystems, src is instead copied
+// to a temporary file in dst's directory, which is synced & renamed to dst,
+// and src is removed.
+func publishFile(rename func(oldpath, newpath string) error, src, dst string) error {
+	err := rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dst), downloadTempPrefix())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if err := os.Remove(out.Name()); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove %q: %v", out.Name(), err)
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Chmod(fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := rename(out.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// redactURL returns s with secrets removed from any URLs it contains, so that
+// it may be logged: the values of the given query parameters, and any
+// password in the URLs' userinfo, are replaced by "…". s may be a URL, or
+// text such as an error message which contains URLs.
+func redactURL(s string, params []string) string {
+	s = userinfoPasswordRE.ReplaceAllString(s, "${1}…@")
+	if len(params) == 0 {
+		return s
+	}
+	qps := make([]string, len(params))
+	for i, p := range params {
+		qps[i] = regexp.QuoteMeta(p)
+	}
+	re := regexp.MustCompile(`([?&;](?:` + strings.Join(qps, "|") + `)=)[^&;#\s"'<>]*`)
+	return re.ReplaceAllString(s, "${1}…")
+}
+
+var userinfoPasswordRE = regexp.MustCompile(`(://[^/?#@\s"':]*:)[^/?#@\s"']*@`)
+
+// redactedConfig serializes cfg as config.MarshalConfig does, with secrets
+// redacted: the secrets in each feed's URL, as redactURL redacts them, and the
+// values of each feed's headers.
+func redactedConfig(cfg *config.Config) (string, error) {
+	c := *cfg
+	c.Feeds = make([]*config.Feed, len(cfg.Feeds))
+	for i, f := range cfg.Feeds {
+		rf := *f
+		rf.URL = redactURL(f.URL, f.SecretQueryParams)
+		if f.FTPPassword != "" {
+			rf.FTPPassword = "…"
+		}
+		if f.Headers != nil {
+			rf.Headers = make(http.Header, len(f.Headers))
+			for n, vs := range f.Headers {
+				for range vs {
+					rf.Headers[n] = append(rf.Headers[n], "…")
+				}
+			}
+		}
+		c.Feeds[i] = &rf
+	}
+	return config.MarshalConfig(&c)
+}
+
+// redactErr returns an error whose message is err's with secrets removed, as
+// redactURL does. The returned error wraps err. If err is nil, nil is
+// returned.
+func redactErr(err error, params []string) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err, params}
+}
+
+type redactedError struct {
+	err    error
+	params []string
+}
+
+func (e *redactedError) Error() string { return redactURL(e.err.Error(), e.params) }
+func (e *redactedError) Unwrap() error { return e.err }
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sendAlert(a alert.Alerter, code alert.Code, details string) {
+	sendAlertStdin(a, code, details, nil)
+}
+
+// sendAlertStdin is like sendAlert, but an alert command run for the alert
+// receives stdin on its standard input, as alert.WithStdin arranges.
+func sendAlertStdin(a alert.Alerter, code alert.Code, details string, stdin []byte) {
+	if a == nil {
+		return
+	}
+	if !alertsInFlight.send(func() { alertWithContext(alert.WithStdin(context.Background(), stdin), a, code, details) }) {
+		log.Printf("Dropped alert ([%s] %s): %d alerts already being sent", code, details, cap(alertsInFlight.sem))
+	}
+}
+
+// maxAlertsInFlight is the most alerts sendAlert sends at once. It bounds the
+// goroutines left waiting on alert commands which hang until their deadline.
+const maxAlertsInFlight = 64
+
+// alertsInFlight limits the alerts sent by sendAlert. main sets its registry.
+var alertsInFlight = &alertLimiter{sem: make(chan struct{}, maxAlertsInFlight)}
+
+// alertLimiter bounds the number of alerts sent in the background at once,
+// recording how many are in a health registry, if any.
+type alertLimiter struct {
+	sem chan struct{}
+	hr  *health.Registry // nil if alerts in flight are not recorded
+}
+
+// send calls f, which sends an alert, in a new goroutine. If as many alerts
+// as the limiter allows are already being sent, it instead returns false
+// without calling f.
+func (l *alertLimiter) send(f func()) bool {
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		return false
+	}
+	if l.hr != nil {
+		l.hr.StartAlert()
+	}
+	go func() {
+		defer func() {
+			if l.hr != nil {
+				l.hr.FinishAlert()
+			}
+			<-l.sem
+		}()
+		f()
+	}()
+	return true
+}
+
+// sendAlertSync is like sendAlert, but waits up to timeout for the alert to be
+// sent before returning.
+func sendAlertSync(a alert.Alerter, code alert.Code, details string, timeout time.Duration) {
+	if a == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	alertWithContext(ctx, a, code, details)
+}
+
+// alertWithContext sends an alert, logging any error. The alerter is expected
+// to apply its own deadline (see alert.WithTimeout).
+func alertWithContext(ctx context.Context, a alert.Alerter, code alert.Code, details string) {
+	if err := a.Alert(ctx, code, details); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Abandoned alert ([%s] %s) at its deadline: %v", code, details, err)
+			return
+		}
+		log.Printf("Error while alerting ([%s] %s): %v", code, details, err)
 	}
 }
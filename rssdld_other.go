@@ -0,0 +1,21 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// checkWritable checks that files may be created in the given directory, by
+// creating & removing a temporary file there, since access(2) is only
+// available on Unix.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, downloadTempPrefix())
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,15 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import "syscall"
+
+// accessWriteSearch is the mode for syscall.Access checking that files may be
+// created in a directory (W_OK | X_OK).
+const accessWriteSearch = 0x2 | 0x1
+
+// checkWritable checks that files may be created in the given directory.
+func checkWritable(dir string) error {
+	return syscall.Access(dir, accessWriteSearch)
+}
@@ -0,0 +1,124 @@
+// Package sanitize provides functionality for repairing slightly-malformed
+// feed XML so that it can be parsed.
+package sanitize
+
+import (
+	"bytes"
+)
+
+var (
+	cdataStart = []byte("<![CDATA[")
+	cdataEnd   = []byte("]]>")
+	closeTag   = []byte("</")
+)
+
+// XML attempts to repair common problems in malformed XML: bare ampersands
+// are escaped, characters that are not allowed in XML documents are stripped,
+// and unclosed CDATA sections are closed before the next closing tag. The
+// content of well-formed CDATA sections is left untouched. XML does not modify
+// its input.
+func XML(in []byte) []byte {
+	in = stripInvalidChars(in)
+	var out bytes.Buffer
+	out.Grow(len(in))
+	for len(in) > 0 {
+		i := bytes.Index(in, cdataStart)
+		if i == -1 {
+			escapeAmpersands(&out, in)
+			break
+		}
+		escapeAmpersands(&out, in[:i])
+		in = in[i:]
+
+		// Copy the CDATA section verbatim, closing it if necessary. A
+		// section is considered unclosed if there is no end marker before
+		// the next CDATA section begins.
+		sect := in[len(cdataStart):]
+		if k := bytes.Index(sect, cdataStart); k != -1 {
+			sect = sect[:k]
+		}
+		if j := bytes.Index(sect, cdataEnd); j != -1 {
+			j += len(cdataStart) + len(cdataEnd)
+			out.Write(in[:j])
+			in = in[j:]
+			continue
+		}
+		j := len(cdataStart) + len(sect)
+		if k := bytes.Index(sect, closeTag); k != -1 {
+			j = len(cdataStart) + k
+		}
+		out.Write(in[:j])
+		out.Write(cdataEnd)
+		in = in[j:]
+	}
+	return out.Bytes()
+}
+
+// stripInvalidChars removes control characters that are not permitted by the
+// XML specification (everything below 0x20 except tab, newline, and carriage
+// return). Other bytes are kept as they are, rather than decoded as UTF-8, so
+// that documents in other encodings, such as ISO-8859-1, are not corrupted.
+func stripInvalidChars(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for _, c := range in {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// escapeAmpersands writes in to out, replacing any ampersand that does not
+// begin an entity or character reference with "&amp;".
+func escapeAmpersands(out *bytes.Buffer, in []byte) {
+	for {
+		i := bytes.IndexByte(in, '&')
+		if i == -1 {
+			out.Write(in)
+			return
+		}
+		out.Write(in[:i])
+		if isReference(in[i+1:]) {
+			out.WriteByte('&')
+		} else {
+			out.WriteString("&amp;")
+		}
+		in = in[i+1:]
+	}
+}
+
+// isReference determines if the given bytes (which directly follow an
+// ampersand) form the remainder of an entity or character reference, such as
+// "amp;", "#38;", or "#x26;".
+func isReference(b []byte) bool {
+	end := bytes.IndexByte(b, ';')
+	if end <= 0 {
+		return false
+	}
+	ref := b[:end]
+	switch {
+	case ref[0] == '#' && len(ref) > 2 && (ref[1] == 'x' || ref[1] == 'X'):
+		return allBytes(ref[2:], isHexDigit)
+	case ref[0] == '#':
+		return len(ref) > 1 && allBytes(ref[1:], isDigit)
+	default:
+		return isNameStart(ref[0]) && allBytes(ref[1:], isNameChar)
+	}
+}
+
+func allBytes(b []byte, pred func(byte) bool) bool {
+	for _, c := range b {
+		if !pred(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool    { return '0' <= c && c <= '9' }
+func isHexDigit(c byte) bool { return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F') }
+func isNameStart(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c == '_' || c == ':' || c >= 0x80
+}
+func isNameChar(c byte) bool { return isNameStart(c) || isDigit(c) || c == '-' || c == '.' }
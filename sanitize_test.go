@@ -0,0 +1,115 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestXML(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		desc string
+		in   string
+		want string
+	}{
+		{
+			desc: "well_formed",
+			in:   `<a b="c">d &amp; e &#38; f &#x26; g</a>`,
+			want: `<a b="c">d &amp; e &#38; f &#x26; g</a>`,
+		},
+		{
+			desc: "bare_ampersand",
+			in:   `<a>b & c</a>`,
+			want: `<a>b &amp; c</a>`,
+		},
+		{
+			desc: "bare_ampersand_at_end",
+			in:   `b &`,
+			want: `b &amp;`,
+		},
+		{
+			desc: "ampersand_in_url",
+			in:   `<link>http://example.com/?a=1&b=2</link>`,
+			want: `<link>http://example.com/?a=1&amp;b=2</link>`,
+		},
+		{
+			desc: "bad_character_reference",
+			in:   `<a>&#xZZ; &#; &#12a;</a>`,
+			want: `<a>&amp;#xZZ; &amp;#; &amp;#12a;</a>`,
+		},
+		{
+			desc: "control_characters",
+			in:   "<a>b\x00c\x08d\x1be\tf\r\ng</a>",
+			want: "<a>bcde\tf\r\ng</a>",
+		},
+		{
+			desc: "latin1",
+			in:   "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><a>caf\xe9 \xabna\xefve\xbb\x01 \x85\xff</a>",
+			want: "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><a>caf\xe9 \xabna\xefve\xbb \x85\xff</a>",
+		},
+		{
+			desc: "closed_cdata",
+			in:   `<a><![CDATA[b & c]]> & d</a>`,
+			want: `<a><![CDATA[b & c]]> &amp; d</a>`,
+		},
+		{
+			desc: "unclosed_cdata",
+			in:   `<a><![CDATA[b & c</a><d>e & f</d>`,
+			want: `<a><![CDATA[b & c]]></a><d>e &amp; f</d>`,
+		},
+		{
+			desc: "unclosed_cdata_at_end",
+			in:   `<a><![CDATA[b & c`,
+			want: `<a><![CDATA[b & c]]>`,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			if got := string(XML([]byte(test.in))); got != test.want {
+				t.Errorf("XML(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestXMLFixtures(t *testing.T) {
+	t.Parallel()
+
+	for _, fn := range []string{
+		"bare_ampersand.xml",
+		"control_chars.xml",
+		"unclosed_cdata.xml",
+	} {
+		fn := fn
+		t.Run(fn, func(t *testing.T) {
+			t.Parallel()
+			in, err := ioutil.ReadFile(filepath.Join("testdata", fn))
+			if err != nil {
+				t.Fatalf("Couldn't read fixture: %v", err)
+			}
+			if err := wellFormed(in); err == nil {
+				t.Fatalf("Fixture %q is already well-formed", fn)
+			}
+			if err := wellFormed(XML(in)); err != nil {
+				t.Errorf("Sanitized %q is not well-formed: %v", fn, err)
+			}
+		})
+	}
+}
+
+func wellFormed(doc []byte) error {
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		if _, err := d.Token(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
@@ -1,32 +1,148 @@
 package state
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/proto"
 
 	pb "github.com/BranLwyd/rssdl/rssdl_proto"
 )
 
 type State struct {
-	filename string
+	filename   string
+	tempPrefix string
 
-	mu sync.RWMutex // protects s
-	s  *pb.State
+	mu     sync.RWMutex // protects s, seq, closed
+	s      *pb.State
+	seq    uint64 // incremented each time s is marshalled
+	closed bool   // if set, s may no longer be modified
+
+	writeMu    sync.Mutex // protects writtenSeq; held while writing to disk
+	writtenSeq uint64     // the sequence number of the most recently written state
+}
+
+// FeedState is an immutable view of the state of a single feed.
+type FeedState struct {
+	Order           string
+	DownloadedLinks []string  // most recent last
+	DownloadedBytes int64     // the total number of bytes downloaded
+	LastDownload    time.Time // when an item was most recently downloaded; zero if never
+}
+
+// MaxDownloadedLinks is the maximum number of downloaded links remembered per
+// feed. Once this many links are remembered, the oldest links are forgotten.
+const MaxDownloadedLinks = 200
+
+// MaxGlobalDownloadedLinks is the maximum number of links remembered for global
+// deduplication, across all feeds. Once this many links are remembered, the
+// oldest links are forgotten.
+const MaxGlobalDownloadedLinks = 1000
+
+// MaxFileHashes is the maximum number of file content hashes remembered, across
+// all feeds. Once this many hashes are remembered, the oldest hashes are
+// forgotten.
+const MaxFileHashes = 1000
+
+// MaxLinkPaths is the maximum number of downloaded files remembered by link,
+// across all feeds. Once this many files are remembered, the oldest files are
+// forgotten.
+const MaxLinkPaths = 1000
+
+// ErrClosed is returned when modifying a state that has been closed.
+var ErrClosed = errors.New("state is closed")
+
+// ErrOrderConflict is returned when conditionally setting a feed's order, if
+// the feed's order is not the expected order, e.g. because it was changed
+// concurrently.
+var ErrOrderConflict = errors.New("order changed concurrently")
+
+// ErrOrderRegression is returned when conditionally setting a feed's order, if
+// the new order is before the feed's current order.
+var ErrOrderRegression = errors.New("order is before current order")
+
+// DefaultTempPrefix is the prefix of the temporary files to which the state is
+// written before replacing the state file, if no other prefix is specified.
+const DefaultTempPrefix = ".rssdl_state_"
+
+// Options configures how a state file is opened.
+type Options struct {
+	// RecoverCorrupt, if set, causes a state file that cannot be parsed to be
+	// backed up (with a ".corrupt" suffix) and replaced with an empty state.
+	RecoverCorrupt bool
+	// TempPrefix is the prefix of the temporary files to which the state is
+	// written before replacing the state file. If empty, DefaultTempPrefix is
+	// used.
+	TempPrefix string
+	// NoCreateDir, if set, causes opening a state file whose directory does
+	// not exist to fail, naming the directory, rather than creating it.
+	NoCreateDir bool
+	// NoProbeWrite, if set, skips writing the state when it is opened, which
+	// otherwise ensures that an unwritable location is reported immediately
+	// (at the cost of modifying the state file's mtime). The state is then
+	// first written when it is modified.
+	NoProbeWrite bool
 }
 
+// Open opens the state stored in the given file, creating the file (and its
+// directory) if it does not exist.
 func Open(filename string) (*State, error) {
+	return Options{}.Open(filename)
+}
+
+// OpenOrRecover is like Open, but if the state file cannot be parsed, it is
+// backed up (with a ".corrupt" suffix) and an empty state is used instead.
+func OpenOrRecover(filename string) (*State, error) {
+	return Options{RecoverCorrupt: true}.Open(filename)
+}
+
+// Open opens the state stored in the given file according to o, creating the
+// file if it does not exist (unless o.NoProbeWrite is set, in which case it is
+// created once the state is modified). The file's directory is created if it
+// does not exist, unless o.NoCreateDir is set.
+func (o Options) Open(filename string) (*State, error) {
+	// Create the state file's directory if needed, since the state file is
+	// written to a temporary file in the same directory.
+	dir := filepath.Dir(filename)
+	if o.NoCreateDir {
+		fi, err := os.Stat(dir)
+		switch {
+		case os.IsNotExist(err):
+			return nil, fmt.Errorf("state directory %q does not exist", dir)
+		case err != nil:
+			return nil, fmt.Errorf("could not check state directory: %v", err)
+		case !fi.IsDir():
+			return nil, fmt.Errorf("state directory %q is not a directory", dir)
+		}
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create state directory: %v", err)
+	}
+
 	var s *pb.State
 	sBytes, err := ioutil.ReadFile(filename)
 	if err == nil {
 		s = &pb.State{}
 		if err := proto.Unmarshal(sBytes, s); err != nil {
-			return nil, fmt.Errorf("could not parse state: %v", err)
+			if !o.RecoverCorrupt {
+				return nil, fmt.Errorf("could not parse state: %v", err)
+			}
+
+			// Corrupt state file. Back it up and return an empty state.
+			backup := filename + ".corrupt"
+			if err := os.Rename(filename, backup); err != nil {
+				return nil, fmt.Errorf("could not back up corrupt state file: %v", err)
+			}
+			log.Printf("ERROR: Could not parse state file %q (%v). Backed up to %q; starting fresh", filename, err, backup)
+			s = &pb.State{}
 		}
 	} else {
 		if !os.IsNotExist(err) {
@@ -39,11 +155,22 @@ func Open(filename string) (*State, error) {
 	}
 
 	state := &State{
-		filename: filename,
-		s:        s,
+		filename:   filename,
+		tempPrefix: o.TempPrefix,
+		s:          s,
+	}
+	if state.tempPrefix == "" {
+		state.tempPrefix = DefaultTempPrefix
+	}
+	if o.NoProbeWrite {
+		return state, nil
 	}
 	// Write immediately so we'll fail out now if the state is in an unwritable location.
-	if err := state.write(); err != nil {
+	sBytes, seq, err := state.marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := state.write(sBytes, seq); err != nil {
 		return nil, fmt.Errorf("could not write state file: %v", err)
 	}
 	return state, nil
@@ -59,51 +186,592 @@ func (s *State) GetOrder(name string) string {
 	return fs.Order
 }
 
+// Snapshot returns a copy of the current state of every feed, by feed name.
+func (s *State) Snapshot() map[string]FeedState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap := make(map[string]FeedState, len(s.s.FeedState))
+	for name, fs := range s.s.FeedState {
+		snap[name] = FeedState{
+			Order:           fs.Order,
+			DownloadedLinks: append([]string(nil), fs.DownloadedLink...),
+			DownloadedBytes: int64(fs.DownloadedBytes),
+			LastDownload:    unixTime(fs.LastDownloadTime),
+		}
+	}
+	return snap
+}
+
+// HasDownloaded determines if the given link is among the most recently
+// downloaded links for the given feed.
+func (s *State) HasDownloaded(name, link string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return false
+	}
+	for _, l := range fs.DownloadedLink {
+		if l == link {
+			return true
+		}
+	}
+	return false
+}
+
+// HasDownloadedGlobally determines if the given link, once canonicalized, is
+// among the most recently downloaded links recorded with
+// RecordGlobalDownload, by any feed.
+func (s *State) HasDownloadedGlobally(link string) bool {
+	link = canonicalLink(link)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, l := range s.s.GlobalDownloadedLink {
+		if l == link {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordGlobalDownload records the given link as downloaded, for the purposes
+// of HasDownloadedGlobally. The link is recorded in memory even if writing the
+// state fails, in which case it is written along with the next update.
+func (s *State) RecordGlobalDownload(link string) error {
+	link = canonicalLink(link)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.s.GlobalDownloadedLink = append(s.s.GlobalDownloadedLink, link)
+	if over := len(s.s.GlobalDownloadedLink) - MaxGlobalDownloadedLinks; over > 0 {
+		s.s.GlobalDownloadedLink = append([]string(nil), s.s.GlobalDownloadedLink[over:]...)
+	}
+	sBytes, seq, err := s.marshal()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// HashPath returns the path of the most recently downloaded file with the given
+// content hash recorded with RecordHash, if any.
+func (s *State) HashPath(sha256 string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.s.FileHash) - 1; i >= 0; i-- {
+		if fh := s.s.FileHash[i]; fh.Sha256 == sha256 {
+			return fh.Path, true
+		}
+	}
+	return "", false
+}
+
+// RecordHash records that a file with the given content hash was downloaded to
+// the given path, for the purposes of HashPath.
+func (s *State) RecordHash(sha256, path string) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	fhs := make([]*pb.State_FileHash, 0, len(s.s.FileHash)+1)
+	for _, fh := range s.s.FileHash {
+		if fh.Sha256 != sha256 {
+			fhs = append(fhs, fh)
+		}
+	}
+	fhs = append(fhs, &pb.State_FileHash{Sha256: sha256, Path: path})
+	if over := len(fhs) - MaxFileHashes; over > 0 {
+		fhs = fhs[over:]
+	}
+	s.s.FileHash = fhs
+	sBytes, seq, err := s.marshal()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// LinkPath returns the path of the most recently downloaded file recorded with
+// RecordLinkPath for the given link, once canonicalized, if any.
+func (s *State) LinkPath(link string) (string, bool) {
+	link = canonicalLink(link)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.s.LinkPath) - 1; i >= 0; i-- {
+		if lp := s.s.LinkPath[i]; lp.Link == link {
+			return lp.Path, true
+		}
+	}
+	return "", false
+}
+
+// RecordLinkPath records that the given link was downloaded to the given path,
+// for the purposes of LinkPath.
+func (s *State) RecordLinkPath(link, path string) error {
+	link = canonicalLink(link)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	lps := make([]*pb.State_LinkPath, 0, len(s.s.LinkPath)+1)
+	for _, lp := range s.s.LinkPath {
+		if lp.Link != link {
+			lps = append(lps, lp)
+		}
+	}
+	lps = append(lps, &pb.State_LinkPath{Link: link, Path: path})
+	if over := len(lps) - MaxLinkPaths; over > 0 {
+		lps = lps[over:]
+	}
+	s.s.LinkPath = lps
+	sBytes, seq, err := s.marshal()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// canonicalLink returns a canonical form of the given link, so that
+// superficially different links to the same resource compare equal: the
+// scheme & host are lowercased, default ports and fragments are removed, and
+// query parameters are sorted. Links that cannot be parsed are returned
+// unchanged.
+func canonicalLink(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	u.Fragment, u.RawFragment = "", ""
+	if u.RawQuery != "" {
+		if q, err := url.ParseQuery(u.RawQuery); err == nil {
+			u.RawQuery = q.Encode()
+		}
+	}
+	return u.String()
+}
+
+// ETag returns the ETag recorded for the given file downloaded by the given
+// feed, or the empty string if none is recorded.
+func (s *State) ETag(name, filename string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return ""
+	}
+	for _, fe := range fs.FileEtag {
+		if fe.Filename == filename {
+			return fe.Etag
+		}
+	}
+	return ""
+}
+
+// SetETag records the ETag of the given file downloaded by the given feed.
+// ETags are remembered for as many files as links are remembered; once that
+// many ETags are recorded, the oldest are forgotten.
+func (s *State) SetETag(name, filename, etag string) error {
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		fes := make([]*pb.State_FileETag, 0, len(fs.FileEtag)+1)
+		for _, fe := range fs.FileEtag {
+			if fe.Filename != filename {
+				fes = append(fes, fe)
+			}
+		}
+		fes = append(fes, &pb.State_FileETag{Filename: filename, Etag: etag})
+		if over := len(fes) - MaxDownloadedLinks; over > 0 {
+			fes = fes[over:]
+		}
+		fs.FileEtag = fes
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// HasDownloadedGUID determines if the given item GUID is among the most
+// recently downloaded GUIDs recorded for the given feed with
+// RecordDownloadedGUID.
+func (s *State) HasDownloadedGUID(name, guid string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return false
+	}
+	for _, g := range fs.DownloadedGuid {
+		if g == guid {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordDownloadedGUID records the given item GUID as downloaded by the given
+// feed, for the purposes of HasDownloadedGUID. GUIDs are remembered for as many
+// items as links are.
+func (s *State) RecordDownloadedGUID(name, guid string) error {
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		fs.DownloadedGuid = append(fs.DownloadedGuid, guid)
+		if over := len(fs.DownloadedGuid) - MaxDownloadedLinks; over > 0 {
+			fs.DownloadedGuid = append([]string(nil), fs.DownloadedGuid[over:]...)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// DownloadedBytes returns the total number of bytes downloaded for the given
+// feed.
+func (s *State) DownloadedBytes(name string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return 0
+	}
+	return int64(fs.DownloadedBytes)
+}
+
+// ResetDownloadedBytes resets the total number of bytes downloaded for the
+// given feed to zero.
+func (s *State) ResetDownloadedBytes(name string) error {
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		fs.DownloadedBytes = 0
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// LastDownload returns when an item was most recently downloaded for the given
+// feed, or the zero time if no item has been downloaded.
+func (s *State) LastDownload(name string) time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return time.Time{}
+	}
+	return unixTime(fs.LastDownloadTime)
+}
+
+// NextDownload returns the earliest time at which an item may next be
+// downloaded for the given feed, or the zero time if there is no such time.
+func (s *State) NextDownload(name string) time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return time.Time{}
+	}
+	return unixTime(fs.NextDownloadTime)
+}
+
+// SetNextDownload records the earliest time at which an item may next be
+// downloaded for the given feed. The time is recorded to the second, rounded
+// up, so that it is never earlier than t.
+func (s *State) SetNextDownload(name string, t time.Time) error {
+	secs := t.Unix()
+	if t.After(time.Unix(secs, 0)) {
+		secs++
+	}
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		fs.NextDownloadTime = secs
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// SetLastDownload records when an item was most recently downloaded for the
+// given feed.
+func (s *State) SetLastDownload(name string, t time.Time) error {
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		fs.LastDownloadTime = t.Unix()
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// CompletedOrderMax returns the order_max at which the given feed was found
+// complete, or the empty string if it has not been found complete.
+func (s *State) CompletedOrderMax(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fs := s.s.FeedState[name]
+	if fs == nil {
+		return ""
+	}
+	return fs.CompletedOrderMax
+}
+
+// SetCompletedOrderMax records that the given feed was found complete at the
+// given order_max.
+func (s *State) SetCompletedOrderMax(name, orderMax string) error {
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		fs.CompletedOrderMax = orderMax
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// AddFile records that the file at the given path was downloaded for the given
+// feed, keeping at most keep of the most recently recorded paths. The paths
+// that are no longer kept are forgotten & returned, oldest first, so that the
+// files can be deleted.
+func (s *State) AddFile(name, path string, keep int) ([]string, error) {
+	var pruned []string
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		files := make([]string, 0, len(fs.DownloadedFile)+1)
+		for _, f := range fs.DownloadedFile {
+			if f != path {
+				files = append(files, f)
+			}
+		}
+		files = append(files, path)
+		if over := len(files) - keep; over > 0 {
+			pruned, files = files[:over], files[over:]
+		}
+		fs.DownloadedFile = files
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pruned, s.write(sBytes, seq)
+}
+
+func unixTime(secs int64) time.Time {
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// SetOrder sets the order for the given feed, regardless of its current
+// order. To guard against the order changing concurrently or regressing, use
+// CompareAndSetOrder instead.
 func (s *State) SetOrder(name, order string) error {
+	return s.Update(name, order, nil, 0)
+}
+
+// CompareAndSetOrder sets the order for the given feed to newOrder, if its
+// current order is oldOrder; otherwise, ErrOrderConflict is returned. Unless
+// force is set, a newOrder before oldOrder (comparing orders as strings, as
+// checks do) is rejected with ErrOrderRegression, so that e.g. a misbehaving
+// feed cannot cause items to be downloaded again. Setting force deliberately
+// lowers the order.
+func (s *State) CompareAndSetOrder(name, oldOrder, newOrder string, force bool) error {
+	return s.compareAndUpdate(name, oldOrder, newOrder, force, nil, 0)
+}
+
+// Update sets the order for the given feed, records the given links as
+// downloaded, and adds downloadedBytes to the feed's total downloaded bytes,
+// writing the state once.
+func (s *State) Update(name, order string, links []string, downloadedBytes int64) error {
+	sBytes, seq, err := s.modify(name, func(fs *pb.State_FeedState) {
+		update(fs, order, links, downloadedBytes)
+	})
+	if err != nil {
+		return err
+	}
+	// Write outside of s.mu so that readers are not blocked on disk I/O.
+	return s.write(sBytes, seq)
+}
+
+// CompareAndUpdate is like Update, but only sets the order as
+// CompareAndSetOrder does without force. If the order is not set, neither are
+// the links & downloaded bytes recorded.
+func (s *State) CompareAndUpdate(name, oldOrder, newOrder string, links []string, downloadedBytes int64) error {
+	return s.compareAndUpdate(name, oldOrder, newOrder, false, links, downloadedBytes)
+}
+
+func (s *State) compareAndUpdate(name, oldOrder, newOrder string, force bool, links []string, downloadedBytes int64) error {
+	sBytes, seq, err := s.tryModify(name, func(fs *pb.State_FeedState) error {
+		if fs.Order != oldOrder {
+			return fmt.Errorf("%w: order is %q, expected %q", ErrOrderConflict, fs.Order, oldOrder)
+		}
+		if !force && newOrder < oldOrder {
+			return fmt.Errorf("%w: %q is before %q", ErrOrderRegression, newOrder, oldOrder)
+		}
+		update(fs, newOrder, links, downloadedBytes)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(sBytes, seq)
+}
+
+// update sets the order of the given feed state, records the given links as
+// downloaded, and adds downloadedBytes to its total downloaded bytes.
+func update(fs *pb.State_FeedState, order string, links []string, downloadedBytes int64) {
+	fs.Order = order
+	fs.DownloadedLink = append(fs.DownloadedLink, links...)
+	if over := len(fs.DownloadedLink) - MaxDownloadedLinks; over > 0 {
+		fs.DownloadedLink = append([]string(nil), fs.DownloadedLink[over:]...)
+	}
+	fs.DownloadedBytes += uint64(downloadedBytes)
+}
+
+// modify applies the given modification to the state of the given feed
+// (creating it if necessary), returning the serialized state as marshal does.
+func (s *State) modify(name string, mod func(fs *pb.State_FeedState)) ([]byte, uint64, error) {
+	return s.tryModify(name, func(fs *pb.State_FeedState) error {
+		mod(fs)
+		return nil
+	})
+}
+
+// tryModify is like modify, but the modification may fail, in which case its
+// error is returned and the state is not serialized. The modification must not
+// modify the feed's state if it fails.
+func (s *State) tryModify(name string, mod func(fs *pb.State_FeedState) error) ([]byte, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.closed {
+		return nil, 0, ErrClosed
+	}
 
 	// If s.write encounters an error, we may end up with in-memory state not matching written state.
 	// But that's fine -- we'll retry writes, and in the meantime we don't want to re-download already-downloaded links.
 
 	fs := s.s.FeedState[name]
-	if fs == nil {
+	created := fs == nil
+	if created {
+		fs = &pb.State_FeedState{}
+	}
+	if err := mod(fs); err != nil {
+		return nil, 0, err
+	}
+	if created {
 		if s.s.FeedState == nil {
 			s.s.FeedState = map[string]*pb.State_FeedState{}
 		}
-		fs = &pb.State_FeedState{}
 		s.s.FeedState[name] = fs
 	}
-	fs.Order = order
-	return s.write()
+	return s.marshal()
 }
 
-// Assumes that s.mu is already locked. (needs at least a read-lock)
-func (s *State) write() error {
+// marshal serializes the state, returning the serialized state along with a
+// sequence number that increases with each call. Assumes that s.mu is already
+// write-locked.
+func (s *State) marshal() ([]byte, uint64, error) {
 	sBytes, err := proto.Marshal(s.s)
 	if err != nil {
-		return fmt.Errorf("could not marshal state proto: %v", err)
+		return nil, 0, fmt.Errorf("could not marshal state proto: %v", err)
 	}
+	s.seq++
+	return sBytes, s.seq, nil
+}
 
-	// Use a temporary file so that updates are atomic.
-	f, err := ioutil.TempFile(filepath.Dir(s.filename), ".rssdl_state_")
+// write writes a serialized state (as returned by marshal) to disk. Writes are
+// serialized, and a state is not written if a state with a later sequence
+// number has already been written, so that an older state can never replace a
+// newer one.
+func (s *State) write(sBytes []byte, seq uint64) error {
+	return s.writeFile(sBytes, seq, false)
+}
+
+// Close writes the state to disk a final time, syncing the file to stable
+// storage, so that changes whose writes failed (e.g. due to a full disk) are
+// not lost. Afterwards, modifications fail with ErrClosed. If the write fails,
+// Close may be called again to retry it.
+//
+// If ctx is done before the write completes, an error wrapping ctx's error is
+// returned, and the write continues in the background.
+func (s *State) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	sBytes, seq, err := s.marshal()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.writeFile(sBytes, seq, true) }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("could not write state file: %w", ctx.Err())
+	}
+}
+
+// writeFile implements write, additionally syncing the file to stable storage
+// if sync is set.
+func (s *State) writeFile(sBytes []byte, seq uint64, sync bool) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if seq <= s.writtenSeq {
+		return nil
+	}
+
+	// Use a temporary file so that updates are atomic. If the state file is a
+	// symlink, the file it links to is replaced instead, so that the symlink
+	// is kept and the temporary file is on the same filesystem.
+	fn := s.filename
+	if rfn, err := filepath.EvalSymlinks(fn); err == nil {
+		fn = rfn
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fn), s.tempPrefix)
 	if err != nil {
 		return fmt.Errorf("could not create state file: %v", err)
 	}
 	defer func() {
 		f.Close()
 		if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
-			fmt.Printf("Could not remove %q: %v", f.Name(), err)
+			log.Printf("Could not remove %q: %v", f.Name(), err)
 		}
 	}()
 	if _, err := f.Write(sBytes); err != nil {
 		return fmt.Errorf("could not write state file: %v", err)
 	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("could not sync state file: %v", err)
+		}
+	}
 	if err := f.Close(); err != nil {
 		return fmt.Errorf("could not close state file: %v", err)
 	}
-	if err := os.Rename(f.Name(), s.filename); err != nil {
+	if err := os.Rename(f.Name(), fn); err != nil {
 		return fmt.Errorf("could not rename state file: %v", err)
 	}
+	if sync {
+		// Sync the directory as well, so that the rename is durable.
+		d, err := os.Open(filepath.Dir(fn))
+		if err != nil {
+			return fmt.Errorf("could not open state directory: %v", err)
+		}
+		err = d.Sync()
+		d.Close()
+		if err != nil {
+			return fmt.Errorf("could not sync state directory: %v", err)
+		}
+	}
+	s.writtenSeq = seq
 	return nil
 }
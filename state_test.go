@@ -1,11 +1,17 @@
 package state
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -70,6 +76,97 @@ func TestOpen(t *testing.T) {
 		}
 	})
 
+	t.Run("missing_directory", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, "a", "b", "state")
+
+		s, err := Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if err := s.SetOrder("key1", "val1"); err != nil {
+			t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key1", "val1", err)
+		}
+		if _, err := os.Stat(fn); err != nil {
+			t.Errorf("Couldn't stat state file: %v", err)
+		}
+	})
+
+	t.Run("missing_directory_not_created", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		missing := filepath.Join(dir, "a", "b")
+
+		_, err = Options{NoCreateDir: true}.Open(filepath.Join(missing, "state"))
+		if want := fmt.Sprintf("state directory %q does not exist", missing); err == nil || err.Error() != want {
+			t.Errorf("Open got error %v, want %q", err, want)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+			t.Errorf("Open created directory (stat error: %v)", err)
+		}
+
+		// An existing directory is fine.
+		fn := filepath.Join(dir, "state")
+		if _, err := (Options{NoCreateDir: true}).Open(fn); err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if _, err := os.Stat(fn); err != nil {
+			t.Errorf("Couldn't stat state file: %v", err)
+		}
+	})
+
+	t.Run("no_probe_write", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, "state")
+
+		// The state file is not written until the state is modified.
+		s, err := Options{NoProbeWrite: true}.Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("Open wrote state file (stat error: %v)", err)
+		}
+		if err := s.SetOrder("key1", "val1"); err != nil {
+			t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key1", "val1", err)
+		}
+
+		// Reopening an existing state file leaves it untouched.
+		mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatalf("Couldn't set state file times: %v", err)
+		}
+		s, err = Options{NoProbeWrite: true}.Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if v := s.GetOrder("key1"); v != "val1" {
+			t.Errorf("s.GetOrder(%q) = %q, want %q", "key1", v, "val1")
+		}
+		if fi, err := os.Stat(fn); err != nil {
+			t.Errorf("Couldn't stat state file: %v", err)
+		} else if !fi.ModTime().Equal(mtime) {
+			t.Errorf("After Open, state file mtime = %v, want %v", fi.ModTime(), mtime)
+		}
+	})
+
 	t.Run("changes_kept_when_write_fails", func(t *testing.T) {
 		t.Parallel()
 
@@ -88,7 +185,7 @@ func TestOpen(t *testing.T) {
 			t.Fatalf("Couldn't modify directory permissions: %v", err)
 		}
 		if err := s.SetOrder("key1", "val1"); err == nil {
-			t.Fatal("s.SetOrder(%q, %q) expected error", "key1", "val1")
+			t.Fatalf("s.SetOrder(%q, %q) expected error", "key1", "val1")
 		}
 		if err := os.Chmod(dir, 0700); err != nil {
 			t.Fatalf("Couldn't modify directory permissions: %v", err)
@@ -130,6 +227,47 @@ func TestOpen(t *testing.T) {
 		}
 	})
 
+	t.Run("unparseable_recovered", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, "state")
+
+		if err := ioutil.WriteFile(fn, []byte("garbage"), 0600); err != nil {
+			t.Fatalf("Couldn't create state file: %v", err)
+		}
+
+		s, err := OpenOrRecover(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if v := s.GetOrder("key1"); v != "" {
+			t.Errorf("s.GetOrder(%q) = %q, want %q", "key1", v, "")
+		}
+		backup, err := ioutil.ReadFile(fn + ".corrupt")
+		if err != nil {
+			t.Fatalf("Couldn't read backup state file: %v", err)
+		}
+		if string(backup) != "garbage" {
+			t.Errorf("Backup state file contains %q, want %q", backup, "garbage")
+		}
+
+		if err := s.SetOrder("key1", "val1"); err != nil {
+			t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key1", "val1", err)
+		}
+		s, err = Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if v := s.GetOrder("key1"); v != "val1" {
+			t.Errorf("s.GetOrder(%q) = %q, want %q", "key1", v, "val1")
+		}
+	})
+
 	t.Run("unreadable", func(t *testing.T) {
 		t.Parallel()
 
@@ -175,3 +313,890 @@ func TestOpen(t *testing.T) {
 		}
 	})
 }
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got, want := s.Snapshot(), map[string]FeedState{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("s.Snapshot() = %v, want %v", got, want)
+	}
+
+	if err := s.SetOrder("key1", "val1"); err != nil {
+		t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key1", "val1", err)
+	}
+	if err := s.SetOrder("key2", "val2"); err != nil {
+		t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key2", "val2", err)
+	}
+	snap := s.Snapshot()
+	want := map[string]FeedState{
+		"key1": {Order: "val1"},
+		"key2": {Order: "val2"},
+	}
+	if !reflect.DeepEqual(snap, want) {
+		t.Errorf("s.Snapshot() = %v, want %v", snap, want)
+	}
+
+	// Later changes must not be visible in an earlier snapshot.
+	if err := s.SetOrder("key1", "val3"); err != nil {
+		t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key1", "val3", err)
+	}
+	if !reflect.DeepEqual(snap, want) {
+		t.Errorf("Snapshot changed to %v after SetOrder, want %v", snap, want)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	t.Parallel()
+
+	const (
+		writers = 8
+		writes  = 25
+	)
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			for j := 0; j < writes; j++ {
+				if err := s.SetOrder(key, fmt.Sprintf("val%03d", j)); err != nil {
+					t.Errorf("s.SetOrder(%q, ...) got unexpected error: %v", key, err)
+				}
+			}
+		}(i)
+	}
+	readersDone := make(chan struct{})
+	go func() {
+		defer close(readersDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for name, fs := range s.Snapshot() {
+				if got := s.GetOrder(name); got < fs.Order {
+					t.Errorf("s.GetOrder(%q) = %q, older than snapshot value %q", name, got, fs.Order)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-readersDone
+
+	// The last write must have won for every key.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	want := fmt.Sprintf("val%03d", writes-1)
+	for i := 0; i < writers; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if v := s.GetOrder(key); v != want {
+			t.Errorf("s.GetOrder(%q) = %q, want %q", key, v, want)
+		}
+	}
+}
+
+func TestDownloadedLinks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if s.HasDownloaded("key1", "link1") {
+		t.Errorf("s.HasDownloaded(%q, %q) = true, want false", "key1", "link1")
+	}
+	if err := s.Update("key1", "val1", []string{"link1", "link2"}, 0); err != nil {
+		t.Errorf("s.Update got unexpected error: %v", err)
+	}
+	if err := s.SetOrder("key1", "val2"); err != nil {
+		t.Errorf("s.SetOrder(%q, %q) got unexpected error: %v", "key1", "val2", err)
+	}
+
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for _, link := range []string{"link1", "link2"} {
+		if !s.HasDownloaded("key1", link) {
+			t.Errorf("s.HasDownloaded(%q, %q) = false, want true", "key1", link)
+		}
+		if s.HasDownloaded("key2", link) {
+			t.Errorf("s.HasDownloaded(%q, %q) = true, want false", "key2", link)
+		}
+	}
+	if v := s.GetOrder("key1"); v != "val2" {
+		t.Errorf("s.GetOrder(%q) = %q, want %q", "key1", v, "val2")
+	}
+
+	// Only the most recent links are remembered.
+	var links []string
+	for i := 0; i < MaxDownloadedLinks; i++ {
+		links = append(links, fmt.Sprintf("new_link%d", i))
+	}
+	if err := s.Update("key1", "val3", links, 0); err != nil {
+		t.Errorf("s.Update got unexpected error: %v", err)
+	}
+	if s.HasDownloaded("key1", "link1") {
+		t.Errorf("s.HasDownloaded(%q, %q) = true, want false", "key1", "link1")
+	}
+	if got := s.Snapshot()["key1"].DownloadedLinks; !reflect.DeepEqual(got, links) {
+		t.Errorf("Snapshot has downloaded links %v, want %v", got, links)
+	}
+}
+
+func TestCompareAndSetOrder(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for _, test := range []struct {
+		oldOrder, newOrder string
+		force              bool
+		wantErr            error
+		wantOrder          string
+	}{
+		{"", "05", false, nil, "05"},
+		{"04", "06", false, ErrOrderConflict, "05"},
+		{"05", "03", false, ErrOrderRegression, "05"},
+		{"05", "05", false, nil, "05"},
+		{"05", "03", true, nil, "03"},
+		{"05", "07", true, ErrOrderConflict, "03"},
+	} {
+		if err := s.CompareAndSetOrder("key1", test.oldOrder, test.newOrder, test.force); !errors.Is(err, test.wantErr) {
+			t.Errorf("s.CompareAndSetOrder(%q, %q, %q, %v) got error %v, want %v", "key1", test.oldOrder, test.newOrder, test.force, err, test.wantErr)
+		}
+		if got := s.GetOrder("key1"); got != test.wantOrder {
+			t.Errorf("After s.CompareAndSetOrder(%q, %q, %q, %v), order = %q, want %q", "key1", test.oldOrder, test.newOrder, test.force, got, test.wantOrder)
+		}
+	}
+
+	// A rejected update records nothing, not even the feed.
+	if err := s.CompareAndUpdate("key1", "03", "01", []string{"link1"}, 10); !errors.Is(err, ErrOrderRegression) {
+		t.Errorf("s.CompareAndUpdate got error %v, want %v", err, ErrOrderRegression)
+	}
+	if err := s.CompareAndUpdate("key2", "01", "02", []string{"link1"}, 10); !errors.Is(err, ErrOrderConflict) {
+		t.Errorf("s.CompareAndUpdate got error %v, want %v", err, ErrOrderConflict)
+	}
+	if s.HasDownloaded("key1", "link1") || s.DownloadedBytes("key1") != 0 {
+		t.Errorf("s.CompareAndUpdate recorded links or bytes despite failing")
+	}
+	if _, ok := s.Snapshot()["key2"]; ok {
+		t.Errorf("s.CompareAndUpdate created feed %q despite failing", "key2")
+	}
+
+}
+
+func TestDownloadedGUIDs(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if s.HasDownloadedGUID("key1", "guid1") {
+		t.Errorf("s.HasDownloadedGUID(%q, %q) = true, want false", "key1", "guid1")
+	}
+	if err := s.RecordDownloadedGUID("key1", "guid1"); err != nil {
+		t.Errorf("s.RecordDownloadedGUID got unexpected error: %v", err)
+	}
+
+	// GUIDs are persisted, per feed.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if !s.HasDownloadedGUID("key1", "guid1") {
+		t.Errorf("s.HasDownloadedGUID(%q, %q) = false, want true", "key1", "guid1")
+	}
+	if s.HasDownloadedGUID("key2", "guid1") {
+		t.Errorf("s.HasDownloadedGUID(%q, %q) = true, want false", "key2", "guid1")
+	}
+
+	// Only the most recent GUIDs are remembered.
+	for i := 0; i < MaxDownloadedLinks; i++ {
+		if err := s.RecordDownloadedGUID("key1", fmt.Sprintf("new_guid%d", i)); err != nil {
+			t.Fatalf("s.RecordDownloadedGUID got unexpected error: %v", err)
+		}
+	}
+	if s.HasDownloadedGUID("key1", "guid1") {
+		t.Errorf("s.HasDownloadedGUID(%q, %q) = true, want false", "key1", "guid1")
+	}
+	if !s.HasDownloadedGUID("key1", "new_guid0") {
+		t.Errorf("s.HasDownloadedGUID(%q, %q) = false, want true", "key1", "new_guid0")
+	}
+}
+
+func TestDownloadedBytes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.DownloadedBytes("key1"); got != 0 {
+		t.Errorf("s.DownloadedBytes(%q) = %d, want 0", "key1", got)
+	}
+	if err := s.Update("key1", "val1", []string{"link1"}, 100); err != nil {
+		t.Errorf("s.Update got unexpected error: %v", err)
+	}
+	if err := s.Update("key1", "val2", []string{"link2", "link3"}, 250); err != nil {
+		t.Errorf("s.Update got unexpected error: %v", err)
+	}
+	if err := s.Update("key2", "val1", []string{"link4"}, 7); err != nil {
+		t.Errorf("s.Update got unexpected error: %v", err)
+	}
+	if got := s.DownloadedBytes("key1"); got != 350 {
+		t.Errorf("s.DownloadedBytes(%q) = %d, want 350", "key1", got)
+	}
+
+	// Totals are persisted.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for key, want := range map[string]int64{"key1": 350, "key2": 7} {
+		if got := s.DownloadedBytes(key); got != want {
+			t.Errorf("After reopen, s.DownloadedBytes(%q) = %d, want %d", key, got, want)
+		}
+		if got := s.Snapshot()[key].DownloadedBytes; got != want {
+			t.Errorf("After reopen, snapshot of %q has %d downloaded bytes, want %d", key, got, want)
+		}
+	}
+
+	// Totals can be reset, without affecting other state.
+	if err := s.ResetDownloadedBytes("key1"); err != nil {
+		t.Errorf("s.ResetDownloadedBytes(%q) got unexpected error: %v", "key1", err)
+	}
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.DownloadedBytes("key1"); got != 0 {
+		t.Errorf("After reset, s.DownloadedBytes(%q) = %d, want 0", "key1", got)
+	}
+	if got := s.DownloadedBytes("key2"); got != 7 {
+		t.Errorf("After reset, s.DownloadedBytes(%q) = %d, want 7", "key2", got)
+	}
+	if got := s.GetOrder("key1"); got != "val2" {
+		t.Errorf("After reset, s.GetOrder(%q) = %q, want %q", "key1", got, "val2")
+	}
+}
+
+func TestGlobalDownloadedLinks(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	const link = "https://tracker.example/dl?id=1&fmt=mkv"
+	if s.HasDownloadedGlobally(link) {
+		t.Errorf("s.HasDownloadedGlobally(%q) = true, want false", link)
+	}
+
+	// A download by one feed is seen by another, including under a
+	// superficially different link.
+	if err := s.Update("general", "val1", []string{link}, 0); err != nil {
+		t.Errorf("s.Update got unexpected error: %v", err)
+	}
+	if err := s.RecordGlobalDownload(link); err != nil {
+		t.Errorf("s.RecordGlobalDownload(%q) got unexpected error: %v", link, err)
+	}
+	const otherLink = "HTTPS://Tracker.example:443/dl?fmt=mkv&id=1#details"
+	if s.HasDownloaded("show", otherLink) {
+		t.Errorf("s.HasDownloaded(%q, %q) = true, want false", "show", otherLink)
+	}
+	if !s.HasDownloadedGlobally(otherLink) {
+		t.Errorf("s.HasDownloadedGlobally(%q) = false, want true", otherLink)
+	}
+
+	// Global links are persisted.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if !s.HasDownloadedGlobally(link) {
+		t.Errorf("After reopen, s.HasDownloadedGlobally(%q) = false, want true", link)
+	}
+
+	// Only the most recent links are remembered.
+	for i := 0; i < MaxGlobalDownloadedLinks; i++ {
+		if err := s.RecordGlobalDownload(fmt.Sprintf("https://tracker.example/dl?id=new%d", i)); err != nil {
+			t.Fatalf("s.RecordGlobalDownload got unexpected error: %v", err)
+		}
+	}
+	if s.HasDownloadedGlobally(link) {
+		t.Errorf("s.HasDownloadedGlobally(%q) = true, want false", link)
+	}
+	if l := "https://tracker.example/dl?id=new0"; !s.HasDownloadedGlobally(l) {
+		t.Errorf("s.HasDownloadedGlobally(%q) = false, want true", l)
+	}
+}
+
+func TestCanonicalLink(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		link, want string
+	}{
+		{"https://example.com/a/b", "https://example.com/a/b"},
+		{"HTTP://Example.COM:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:8443/a", "https://example.com:8443/a"},
+		{"http://[::1]:80/a", "http://[::1]/a"},
+		{"https://example.com/a#frag", "https://example.com/a"},
+		{"https://example.com/a?b=2&a=1", "https://example.com/a?a=1&b=2"},
+		{"https://example.com/Path", "https://example.com/Path"},
+		{"not a url", "not a url"},
+	} {
+		if got := canonicalLink(test.link); got != test.want {
+			t.Errorf("canonicalLink(%q) = %q, want %q", test.link, got, test.want)
+		}
+	}
+}
+
+func TestETags(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.ETag("key1", "file1"); got != "" {
+		t.Errorf("s.ETag(%q, %q) = %q, want %q", "key1", "file1", got, "")
+	}
+	for _, fe := range []struct{ filename, etag string }{
+		{"file1", `"a"`},
+		{"file2", `"b"`},
+		{"file1", `"c"`},
+	} {
+		if err := s.SetETag("key1", fe.filename, fe.etag); err != nil {
+			t.Errorf("s.SetETag(%q, %q, %q) got unexpected error: %v", "key1", fe.filename, fe.etag, err)
+		}
+	}
+
+	// ETags are persisted, and are per-feed.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for _, test := range []struct{ name, filename, want string }{
+		{"key1", "file1", `"c"`},
+		{"key1", "file2", `"b"`},
+		{"key2", "file1", ""},
+	} {
+		if got := s.ETag(test.name, test.filename); got != test.want {
+			t.Errorf("s.ETag(%q, %q) = %q, want %q", test.name, test.filename, got, test.want)
+		}
+	}
+
+	// Only the most recent ETags are remembered.
+	for i := 0; i < MaxDownloadedLinks; i++ {
+		if err := s.SetETag("key1", fmt.Sprintf("new_file%d", i), "etag"); err != nil {
+			t.Fatalf("s.SetETag got unexpected error: %v", err)
+		}
+	}
+	if got := s.ETag("key1", "file1"); got != "" {
+		t.Errorf("s.ETag(%q, %q) = %q, want %q", "key1", "file1", got, "")
+	}
+	if got := s.ETag("key1", "new_file0"); got != "etag" {
+		t.Errorf("s.ETag(%q, %q) = %q, want %q", "key1", "new_file0", got, "etag")
+	}
+}
+
+func TestFileHashes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if p, ok := s.HashPath("hash1"); ok {
+		t.Errorf("s.HashPath(%q) = %q, true, want false", "hash1", p)
+	}
+	for _, fh := range []struct{ hash, path string }{
+		{"hash1", "/dl/a"},
+		{"hash2", "/dl/b"},
+		{"hash1", "/dl/c"},
+	} {
+		if err := s.RecordHash(fh.hash, fh.path); err != nil {
+			t.Errorf("s.RecordHash(%q, %q) got unexpected error: %v", fh.hash, fh.path, err)
+		}
+	}
+
+	// Hashes are persisted, and the most recent path for a hash is used.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for hash, want := range map[string]string{"hash1": "/dl/c", "hash2": "/dl/b"} {
+		if got, ok := s.HashPath(hash); !ok || got != want {
+			t.Errorf("s.HashPath(%q) = %q, %v, want %q, true", hash, got, ok, want)
+		}
+	}
+
+	// Only the most recent hashes are remembered.
+	for i := 0; i < MaxFileHashes; i++ {
+		if err := s.RecordHash(fmt.Sprintf("new_hash%d", i), "/dl/new"); err != nil {
+			t.Fatalf("s.RecordHash got unexpected error: %v", err)
+		}
+	}
+	if _, ok := s.HashPath("hash1"); ok {
+		t.Errorf("s.HashPath(%q) = _, true, want false", "hash1")
+	}
+	if _, ok := s.HashPath("new_hash0"); !ok {
+		t.Errorf("s.HashPath(%q) = _, false, want true", "new_hash0")
+	}
+}
+
+func TestLinkPaths(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	const link = "https://tracker.example/dl?id=1&fmt=mkv"
+	if p, ok := s.LinkPath(link); ok {
+		t.Errorf("s.LinkPath(%q) = %q, true, want false", link, p)
+	}
+	for _, lp := range []struct{ link, path string }{
+		{link, "/dl/a"},
+		{"https://tracker.example/dl?id=2", "/dl/b"},
+		{link, "/other/a"},
+	} {
+		if err := s.RecordLinkPath(lp.link, lp.path); err != nil {
+			t.Errorf("s.RecordLinkPath(%q, %q) got unexpected error: %v", lp.link, lp.path, err)
+		}
+	}
+
+	// Paths are persisted, the most recent path for a link is used, and links
+	// are canonicalized.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for l, want := range map[string]string{
+		"HTTPS://Tracker.example:443/dl?fmt=mkv&id=1#details": "/other/a",
+		"https://tracker.example/dl?id=2":                     "/dl/b",
+	} {
+		if got, ok := s.LinkPath(l); !ok || got != want {
+			t.Errorf("s.LinkPath(%q) = %q, %v, want %q, true", l, got, ok, want)
+		}
+	}
+
+	// Only the most recent paths are remembered.
+	for i := 0; i < MaxLinkPaths; i++ {
+		if err := s.RecordLinkPath(fmt.Sprintf("https://tracker.example/dl?id=new%d", i), "/dl/new"); err != nil {
+			t.Fatalf("s.RecordLinkPath got unexpected error: %v", err)
+		}
+	}
+	if _, ok := s.LinkPath(link); ok {
+		t.Errorf("s.LinkPath(%q) = _, true, want false", link)
+	}
+	if _, ok := s.LinkPath("https://tracker.example/dl?id=new0"); !ok {
+		t.Errorf("s.LinkPath(%q) = _, false, want true", "https://tracker.example/dl?id=new0")
+	}
+}
+
+func TestLastDownload(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.LastDownload("key1"); !got.IsZero() {
+		t.Errorf("s.LastDownload(%q) = %v, want zero time", "key1", got)
+	}
+	want := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	if err := s.SetLastDownload("key1", want); err != nil {
+		t.Fatalf("s.SetLastDownload got unexpected error: %v", err)
+	}
+
+	// The download time is persisted.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.LastDownload("key1"); !got.Equal(want) {
+		t.Errorf("s.LastDownload(%q) = %v, want %v", "key1", got, want)
+	}
+	if got := s.Snapshot()["key1"].LastDownload; !got.Equal(want) {
+		t.Errorf("Snapshot has last download %v, want %v", got, want)
+	}
+	if got := s.LastDownload("key2"); !got.IsZero() {
+		t.Errorf("s.LastDownload(%q) = %v, want zero time", "key2", got)
+	}
+}
+
+func TestNextDownload(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.NextDownload("key1"); !got.IsZero() {
+		t.Errorf("s.NextDownload(%q) = %v, want zero time", "key1", got)
+	}
+	next := time.Date(2017, 8, 23, 17, 30, 0, 500, time.UTC)
+	if err := s.SetNextDownload("key1", next); err != nil {
+		t.Fatalf("s.SetNextDownload got unexpected error: %v", err)
+	}
+
+	// The time is persisted, rounded up to the second.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got, want := s.NextDownload("key1"), time.Date(2017, 8, 23, 17, 30, 1, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("s.NextDownload(%q) = %v, want %v", "key1", got, want)
+	}
+	if got := s.NextDownload("key2"); !got.IsZero() {
+		t.Errorf("s.NextDownload(%q) = %v, want zero time", "key2", got)
+	}
+}
+
+func TestCompletedOrderMax(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got := s.CompletedOrderMax("key1"); got != "" {
+		t.Errorf("s.CompletedOrderMax(%q) = %q, want %q", "key1", got, "")
+	}
+	if err := s.SetCompletedOrderMax("key1", "08"); err != nil {
+		t.Fatalf("s.SetCompletedOrderMax got unexpected error: %v", err)
+	}
+
+	// The order_max is persisted.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got, want := s.CompletedOrderMax("key1"), "08"; got != want {
+		t.Errorf("s.CompletedOrderMax(%q) = %q, want %q", "key1", got, want)
+	}
+	if got := s.CompletedOrderMax("key2"); got != "" {
+		t.Errorf("s.CompletedOrderMax(%q) = %q, want %q", "key2", got, "")
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "state")
+
+	s, err := Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	for _, test := range []struct {
+		path string
+		want []string
+	}{
+		{"/dl/a", nil},
+		{"/dl/b", nil},
+		{"/dl/a", nil}, // re-downloading a file makes it the newest
+		{"/dl/c", []string{"/dl/b"}},
+		{"/dl/d", []string{"/dl/a"}},
+	} {
+		got, err := s.AddFile("key1", test.path, 2)
+		if err != nil {
+			t.Fatalf("s.AddFile(%q) got unexpected error: %v", test.path, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("s.AddFile(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	// Files are persisted, and are tracked per feed.
+	s, err = Open(fn)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got, err := s.AddFile("key1", "/dl/e", 2); err != nil || !reflect.DeepEqual(got, []string{"/dl/c"}) {
+		t.Errorf("s.AddFile(%q) = %q, %v, want %q, nil", "/dl/e", got, err, []string{"/dl/c"})
+	}
+	if got, err := s.AddFile("key2", "/dl/f", 1); err != nil || got != nil {
+		t.Errorf("s.AddFile(%q) = %q, %v, want nil, nil", "/dl/f", got, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+
+	t.Run("flushes_failed_writes", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, "state")
+
+		s, err := Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+
+		// Fail to write a change, leaving the state dirty, then fail to close.
+		if err := os.Chmod(dir, 0500); err != nil {
+			t.Fatalf("Couldn't modify directory permissions: %v", err)
+		}
+		if err := s.SetOrder("key1", "val1"); err == nil {
+			t.Fatalf("s.SetOrder(%q, %q) expected error", "key1", "val1")
+		}
+		if err := s.Close(context.Background()); err == nil {
+			t.Errorf("s.Close with unwritable directory expected error")
+		}
+
+		// Once the directory is writable again, retrying the close writes the
+		// change.
+		if err := os.Chmod(dir, 0700); err != nil {
+			t.Fatalf("Couldn't modify directory permissions: %v", err)
+		}
+		if err := s.Close(context.Background()); err != nil {
+			t.Errorf("s.Close got unexpected error: %v", err)
+		}
+		if err := s.SetOrder("key2", "val2"); err != ErrClosed {
+			t.Errorf("s.SetOrder after Close got error %v, want %v", err, ErrClosed)
+		}
+
+		s, err = Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if v := s.GetOrder("key1"); v != "val1" {
+			t.Errorf("s.GetOrder(%q) = %q, want %q", "key1", v, "val1")
+		}
+		if v := s.GetOrder("key2"); v != "" {
+			t.Errorf("s.GetOrder(%q) = %q, want %q", "key2", v, "")
+		}
+	})
+
+	t.Run("records_after_close", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, "state")
+
+		s, err := Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if err := s.Close(context.Background()); err != nil {
+			t.Fatalf("s.Close got unexpected error: %v", err)
+		}
+		if err := s.RecordGlobalDownload("http://example.com/item"); err != ErrClosed {
+			t.Errorf("s.RecordGlobalDownload after Close got error %v, want %v", err, ErrClosed)
+		}
+		if err := s.RecordHash("abcd", "/dl/item"); err != ErrClosed {
+			t.Errorf("s.RecordHash after Close got error %v, want %v", err, ErrClosed)
+		}
+		if err := s.RecordLinkPath("http://example.com/item", "/dl/item"); err != ErrClosed {
+			t.Errorf("s.RecordLinkPath after Close got error %v, want %v", err, ErrClosed)
+		}
+
+		s, err = Open(fn)
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+		if s.HasDownloadedGlobally("http://example.com/item") {
+			t.Errorf("s.HasDownloadedGlobally after record after Close = true, want false")
+		}
+		if p, ok := s.HashPath("abcd"); ok {
+			t.Errorf("s.HashPath after record after Close = %q, want none", p)
+		}
+		if p, ok := s.LinkPath("http://example.com/item"); ok {
+			t.Errorf("s.LinkPath after record after Close = %q, want none", p)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		t.Parallel()
+
+		dir, err := ioutil.TempDir("", "rssdl_state_test_")
+		if err != nil {
+			t.Fatalf("Couldn't create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		s, err := Open(filepath.Join(dir, "state"))
+		if err != nil {
+			t.Fatalf("Couldn't open state: %v", err)
+		}
+
+		// Simulate hung storage by blocking writes.
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := s.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("s.Close with hung write got error %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestWriteSymlink(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "rssdl_state_test_")
+	if err != nil {
+		t.Fatalf("Couldn't create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "target", "state")
+	if err := os.Mkdir(filepath.Dir(target), 0700); err != nil {
+		t.Fatalf("Couldn't create directory: %v", err)
+	}
+	if err := ioutil.WriteFile(target, nil, 0600); err != nil {
+		t.Fatalf("Couldn't write state: %v", err)
+	}
+	link := filepath.Join(dir, "state")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("Couldn't create symlink: %v", err)
+	}
+
+	s, err := Open(link)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if err := s.SetOrder("key1", "val1"); err != nil {
+		t.Fatalf("s.SetOrder got unexpected error: %v", err)
+	}
+
+	// The symlink is kept, and the file it links to is updated.
+	if fi, err := os.Lstat(link); err != nil {
+		t.Errorf("Couldn't stat state file: %v", err)
+	} else if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("After write, state file has mode %v, want symlink", fi.Mode())
+	}
+	s, err = Open(target)
+	if err != nil {
+		t.Fatalf("Couldn't open state: %v", err)
+	}
+	if got, want := s.GetOrder("key1"), "val1"; got != want {
+		t.Errorf("s.GetOrder(%q) = %q, want %q", "key1", got, want)
+	}
+}
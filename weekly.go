@@ -10,14 +10,36 @@ import (
 	"fmt"
 	"math/rand"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// A Scheduler delivers ticks on some schedule. Ticker is the weekly
+// implementation; other packages (such as cron) provide others.
+type Scheduler interface {
+	// Ticks returns the channel on which ticks are delivered.
+	Ticks() <-chan time.Time
+
+	// Stop stops delivering ticks and releases any resources the scheduler
+	// has acquired.
+	Stop()
+}
+
+var _ Scheduler = (*Ticker)(nil)
+
 // A Ticker holds a channel that delivers ticks of a clock at intervals.
 // It starts & stops ticking at the same time each week.
 type Ticker struct {
 	C    <-chan time.Time
 	done chan struct{}
+	src  *Ticker     // the ticker being filtered, for tickers returned by Filter
+	st   *SpecTicker // the underlying ticker, for tickers returned by NewTicker
+}
+
+// Ticks returns the channel on which ticks are delivered.
+func (t *Ticker) Ticks() <-chan time.Time {
+	return t.C
 }
 
 // Stop closes the ticker and releases any resources it has acquired.
@@ -25,11 +47,244 @@ func (t *Ticker) Stop() {
 	close(t.done)
 }
 
+// DroppedTicks returns the number of ticks that have been dropped because the
+// receiver was not ready to receive them.
+func (t *Ticker) DroppedTicks() uint64 {
+	var n uint64
+	if t.src != nil {
+		n += t.src.DroppedTicks()
+	}
+	if t.st != nil {
+		n += t.st.DroppedTicks()
+	}
+	return n
+}
+
+// Filter returns a ticker that delivers only those ticks of t for which keep
+// returns true. Stopping the returned ticker also stops t; t should not be
+// used directly once it has been passed to Filter.
+func Filter(t *Ticker, keep func(time.Time) bool) *Ticker {
+	ch := make(chan time.Time)
+	ft := &Ticker{
+		C:    ch,
+		done: make(chan struct{}),
+		src:  t,
+	}
+	go filter(ch, ft.done, t, keep)
+	return ft
+}
+
+func filter(ch chan<- time.Time, done chan struct{}, t *Ticker, keep func(time.Time) bool) {
+	defer t.Stop()
+	for {
+		select {
+		case tck := <-t.C:
+			if !keep(tck) {
+				continue
+			}
+			select {
+			case ch <- tck:
+			case <-done:
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// WithInitialTick returns a scheduler that delivers a tick for the given time
+// as soon as it is received, then delivers the ticks of s. Stopping the
+// returned scheduler also stops s; s should not be used directly once it has
+// been passed to WithInitialTick.
+func WithInitialTick(s Scheduler, tck time.Time) Scheduler {
+	it := &initialTicker{
+		c:    make(chan time.Time),
+		done: make(chan struct{}),
+		src:  s,
+	}
+	go it.forward(tck)
+	return it
+}
+
+type initialTicker struct {
+	c        chan time.Time
+	done     chan struct{}
+	stopOnce sync.Once
+	src      Scheduler
+}
+
+func (t *initialTicker) Ticks() <-chan time.Time {
+	return t.c
+}
+
+func (t *initialTicker) Stop() {
+	t.stopOnce.Do(func() { close(t.done) })
+}
+
+// DroppedTicks returns the number of ticks dropped by the underlying
+// scheduler, if it counts them.
+func (t *initialTicker) DroppedTicks() uint64 {
+	if dt, ok := t.src.(interface{ DroppedTicks() uint64 }); ok {
+		return dt.DroppedTicks()
+	}
+	return 0
+}
+
+func (t *initialTicker) forward(tck time.Time) {
+	defer t.src.Stop()
+	select {
+	case t.c <- tck:
+	case <-t.done:
+		return
+	}
+	for {
+		select {
+		case tck := <-t.src.Ticks():
+			select {
+			case t.c <- tck:
+			case <-t.done:
+				return
+			}
+
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// A ManualTicker is a Scheduler whose ticks are delivered on demand, by calling
+// Tick, rather than according to a schedule.
+type ManualTicker struct {
+	c        chan time.Time
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var _ Scheduler = (*ManualTicker)(nil)
+
+// NewManualTicker returns a ticker that ticks only when Tick is called.
+func NewManualTicker() *ManualTicker {
+	return &ManualTicker{
+		c:    make(chan time.Time),
+		done: make(chan struct{}),
+	}
+}
+
+// Ticks returns the channel on which ticks are delivered.
+func (t *ManualTicker) Ticks() <-chan time.Time {
+	return t.c
+}
+
+// Tick delivers a tick for the given time, blocking until it is received or
+// the ticker is stopped. It returns true if the tick was received.
+func (t *ManualTicker) Tick(tck time.Time) bool {
+	select {
+	case t.c <- tck:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// Stop stops the ticker; subsequent calls to Tick return false. It is safe to
+// call Stop more than once.
+func (t *ManualTicker) Stop() {
+	t.stopOnce.Do(func() { close(t.done) })
+}
+
+// A Tick is a single tick delivered by a SpecTicker.
+type Tick struct {
+	Time      time.Time         // when the tick actually occurred
+	Scheduled time.Time         // when the tick was scheduled to occur
+	Spec      TickSpecification // the specification that produced the tick
+}
+
+// A SpecTicker is like a Ticker, but each tick also describes the tick
+// specification that produced it.
+type SpecTicker struct {
+	dropped uint64 // accessed atomically; first for 64-bit alignment
+
+	C    <-chan Tick
+	done chan struct{}
+	src  *SpecTicker // the ticker being filtered, for tickers returned by FilterTicks
+}
+
+// Stop closes the ticker and releases any resources it has acquired.
+func (t *SpecTicker) Stop() {
+	close(t.done)
+}
+
+// DroppedTicks returns the number of ticks that have been dropped because the
+// receiver was not ready to receive them.
+func (t *SpecTicker) DroppedTicks() uint64 {
+	n := atomic.LoadUint64(&t.dropped)
+	if t.src != nil {
+		n += t.src.DroppedTicks()
+	}
+	return n
+}
+
+// FilterTicks is like Filter, for SpecTickers.
+func FilterTicks(t *SpecTicker, keep func(Tick) bool) *SpecTicker {
+	ch := make(chan Tick)
+	ft := &SpecTicker{
+		C:    ch,
+		done: make(chan struct{}),
+		src:  t,
+	}
+	go filterTicks(ch, ft.done, t, keep)
+	return ft
+}
+
+func filterTicks(ch chan<- Tick, done chan struct{}, t *SpecTicker, keep func(Tick) bool) {
+	defer t.Stop()
+	for {
+		select {
+		case tck := <-t.C:
+			if !keep(tck) {
+				continue
+			}
+			select {
+			case ch <- tck:
+			case <-done:
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
 // TickSpecification is used with NewTicker. It specifies a period each week
 // when ticks occur, and how frequently ticks occur during that period.
+//
+// Each tick is delayed by a random amount, so that ticks from many tickers
+// with the same specification are spread out. By default the delay is up to
+// Frequency; Jitter overrides this.
+//
+// Start and End fall in the same week, which begins on WeekStart. A period
+// may therefore wrap past Saturday (e.g. from Sat 10:00PM to Sun 2:00AM) if
+// the week begins on some other day.
 type TickSpecification struct {
-	Start, End Time          // when to start and stop ticking each week
-	Frequency  time.Duration // how often to tick while ticking
+	Start, End Time           // when to start and stop ticking each week
+	Frequency  time.Duration  // how often to tick while ticking
+	Jitter     *time.Duration // if non-nil, the maximum delay of each tick (0 to tick exactly on schedule); at most Frequency
+	WeekStart  time.Weekday   // the day each week begins; Sunday by default
+}
+
+// Contains determines if the given time falls within the period each week
+// when ticks occur.
+func (ts TickSpecification) Contains(t time.Time) bool {
+	return !t.Before(ts.Start.InWeekStarting(t, ts.WeekStart)) && t.Before(ts.End.InWeekStarting(t, ts.WeekStart))
+}
+
+// Next returns the first tick strictly after the given time, as scheduled
+// before its random delay.
+func (ts TickSpecification) Next(t time.Time) time.Time {
+	return nextTick(t, ts)
 }
 
 type ticker struct {
@@ -50,33 +305,212 @@ func (h *tickerHeap) Pop() interface{} {
 	return val
 }
 
-// NewTicker returns a ticker that starts and stops ticking at the same time each week.
-func NewTicker(tickSpecs []TickSpecification) (*Ticker, error) {
-	// Create heap of tickers based on tick specifications.
+func newTickerHeap(now time.Time, tickSpecs []TickSpecification) (tickerHeap, error) {
 	var tickers tickerHeap
-	now := time.Now()
 	if len(tickSpecs) == 0 {
 		return nil, errors.New("no tick specifications")
 	}
 	for _, ts := range tickSpecs {
-		if ts.End.Before(ts.Start) {
+		if ts.WeekStart < time.Sunday || ts.WeekStart > time.Saturday {
+			return nil, errors.New("bad week start")
+		}
+		if ts.WeekStart != tickSpecs[0].WeekStart {
+			return nil, errors.New("tick specifications have different week starts")
+		}
+		if ts.End.BeforeInWeekStarting(ts.Start, ts.WeekStart) {
 			return nil, errors.New("end is before start")
 		}
 		if ts.Frequency <= 0 {
 			return nil, errors.New("freq is nonpositive")
 		}
+		if ts.Jitter != nil && (*ts.Jitter < 0 || *ts.Jitter > ts.Frequency) {
+			return nil, errors.New("jitter is negative or greater than freq")
+		}
 		tickers = append(tickers, &ticker{
 			spec: ts,
 			nxt:  nextTick(now, ts),
 		})
 	}
-	sort.Sort(tickers)
-	for i := 1; i < len(tickers); i++ {
-		if tickers[i].spec.Start.Before(tickers[i-1].spec.End) {
+
+	// Check for overlap in the order the periods occur within the week,
+	// which is not necessarily the order of their next ticks.
+	ws := tickSpecs[0].WeekStart
+	sorted := append([]TickSpecification(nil), tickSpecs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.BeforeInWeekStarting(sorted[j].Start, ws) })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Start.BeforeInWeekStarting(sorted[i-1].End, ws) {
 			return nil, errors.New("tick specifications overlap")
 		}
 	}
 	heap.Init(&tickers)
+	return tickers, nil
+}
+
+// next computes the next tick (leaving its Time unset) and advances the ticker
+// that produced it.
+func (h *tickerHeap) next(rnd *rand.Rand) Tick {
+	// Compute the next tick; randomize the actual tick time, without
+	// delaying it past the end of the ticking period.
+	ticker := (*h)[0]
+	nxt := ticker.nxt
+	interval := ticker.spec.End.InWeekStarting(nxt, ticker.spec.WeekStart).Sub(nxt)
+	jitter := ticker.spec.Frequency
+	if ticker.spec.Jitter != nil {
+		jitter = *ticker.spec.Jitter
+	}
+	if jitter < interval {
+		interval = jitter
+	}
+	tck := Tick{
+		Scheduled: nxt.Add(time.Duration(float64(interval) * rnd.Float64())),
+		Spec:      ticker.spec,
+	}
+
+	// Update the ticker & figure out which ticker will tick next.
+	ticker.nxt = nextTick(ticker.nxt, ticker.spec)
+	heap.Fix(h, 0)
+	return tck
+}
+
+// A Clock provides the current time & timers to a ticker. SystemClock is used
+// by default; other clocks allow tickers to be driven by a fake time, e.g. in
+// tests.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// A Timer is a timer created by a Clock. It behaves like time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer
+	// fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing, returning false if it has already
+	// fired or been stopped.
+	Stop() bool
+}
+
+// SystemClock is a Clock using the system's time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                 { return time.Now() }
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+// NewTicker returns a ticker that starts and stops ticking at the same time each week.
+func NewTicker(tickSpecs []TickSpecification) (*Ticker, error) {
+	return TickerOptions{}.NewTicker(tickSpecs)
+}
+
+// NewTickerWithClock is like NewTicker, but uses the given clock rather than
+// the system's.
+func NewTickerWithClock(tickSpecs []TickSpecification, clock Clock) (*Ticker, error) {
+	return TickerOptions{Clock: clock}.NewTicker(tickSpecs)
+}
+
+// ImmediateTickMargin is how soon after a ticker is created its first
+// scheduled tick must be for the ticker to skip the immediate tick requested
+// by TickerOptions, so that the two ticks do not both fire.
+const ImmediateTickMargin = 5 * time.Second
+
+// TickerOptions control the ticks delivered by a ticker. The zero value
+// delivers only the ticks scheduled by the ticker's specifications, using the
+// system's clock.
+type TickerOptions struct {
+	Clock Clock // the clock to tick by; SystemClock if nil
+
+	// If set, and the ticker is created during one of its specifications'
+	// periods, a tick is delivered immediately, before the scheduled ticks.
+	// The tick is skipped if the first scheduled tick is within
+	// ImmediateTickMargin. Unlike scheduled ticks, the immediate tick is
+	// never dropped; it is delivered once the receiver is ready, or the
+	// ticker is stopped.
+	FireImmediatelyIfActive bool
+
+	// FireImmediately is like FireImmediatelyIfActive, but the immediate tick
+	// is delivered even if the ticker is created outside every period, in
+	// which case the tick's Spec is the zero TickSpecification.
+	FireImmediately bool
+}
+
+// NewTicker returns a ticker that starts and stops ticking at the same time
+// each week, as configured by o.
+func (o TickerOptions) NewTicker(tickSpecs []TickSpecification) (*Ticker, error) {
+	st, err := o.NewSpecTicker(tickSpecs)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan time.Time)
+	t := &Ticker{
+		C:    ch,
+		done: make(chan struct{}),
+		st:   st,
+	}
+	go adapt(ch, t.done, st)
+	return t, nil
+}
+
+func adapt(ch chan<- time.Time, done chan struct{}, st *SpecTicker) {
+	defer st.Stop()
+	for {
+		select {
+		case tck := <-st.C:
+			select {
+			case ch <- tck.Scheduled:
+			case <-done:
+				return
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// NewSpecTicker is like NewTicker, but returns a SpecTicker.
+func NewSpecTicker(tickSpecs []TickSpecification) (*SpecTicker, error) {
+	return TickerOptions{}.NewSpecTicker(tickSpecs)
+}
+
+// NewSpecTickerWithClock is like NewTickerWithClock, but returns a SpecTicker.
+func NewSpecTickerWithClock(tickSpecs []TickSpecification, clock Clock) (*SpecTicker, error) {
+	return TickerOptions{Clock: clock}.NewSpecTicker(tickSpecs)
+}
+
+// NewSpecTicker is like o.NewTicker, but returns a SpecTicker.
+func (o TickerOptions) NewSpecTicker(tickSpecs []TickSpecification) (*SpecTicker, error) {
+	clock := o.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	// Create heap of tickers based on tick specifications.
+	now := clock.Now()
+	tickers, err := newTickerHeap(now, tickSpecs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Determine the immediate tick, if any.
+	var immediate *Tick
+	if o.FireImmediately || o.FireImmediatelyIfActive {
+		for _, ts := range tickSpecs {
+			if ts.Contains(now) {
+				immediate = &Tick{Time: now, Scheduled: now, Spec: ts}
+				break
+			}
+		}
+		if immediate == nil && o.FireImmediately {
+			immediate = &Tick{Time: now, Scheduled: now}
+		}
+	}
 
 	// Set up RNG.
 	var buf [8]byte
@@ -86,52 +520,48 @@ func NewTicker(tickSpecs []TickSpecification) (*Ticker, error) {
 	seed := int64(binary.LittleEndian.Uint64(buf[:]))
 	rnd := rand.New(rand.NewSource(seed))
 
-	// Create the last few variables, start ticking, and return channel to user.
-	ch := make(chan time.Time)
-	done := make(chan struct{})
-	go tick(ch, done, rnd, tickers)
-	return &Ticker{
+	// Start ticking, and return channel to user.
+	ch := make(chan Tick)
+	t := &SpecTicker{
 		C:    ch,
-		done: done,
-	}, nil
+		done: make(chan struct{}),
+	}
+	go tick(ch, t.done, &t.dropped, clock, rnd, tickers, immediate)
+	return t, nil
 }
 
-func tick(ch chan<- time.Time, done chan struct{}, rnd *rand.Rand, tickers tickerHeap) {
-	for {
-		// Compute the next tick; randomize the actual tick time.
-		ticker := tickers[0]
-		nxt := ticker.nxt
-		interval := ticker.spec.End.InWeek(nxt).Sub(nxt)
-		if ticker.spec.Frequency < interval {
-			interval = ticker.spec.Frequency
+func tick(ch chan<- Tick, done chan struct{}, dropped *uint64, clock Clock, rnd *rand.Rand, tickers tickerHeap, immediate *Tick) {
+	tck := tickers.next(rnd)
+	if immediate != nil && tck.Scheduled.Sub(immediate.Scheduled) > ImmediateTickMargin {
+		select {
+		case ch <- *immediate:
+		case <-done:
+			return
 		}
-		nxt = nxt.Add(time.Duration(float64(interval) * rnd.Float64()))
-
+	}
+	for ; ; tck = tickers.next(rnd) {
 		// Go to sleep until the next tick occurs.
-		tmr := time.NewTimer(time.Until(nxt))
+		tmr := clock.NewTimer(tck.Scheduled.Sub(clock.Now()))
 		select {
-		case <-tmr.C:
+		case tck.Time = <-tmr.C():
 			// Drop the tick if it is not ready to be received.
 			select {
-			case ch <- nxt:
+			case ch <- tck:
 			default:
+				atomic.AddUint64(dropped, 1)
 			}
 
 		case <-done:
 			if !tmr.Stop() {
-				<-tmr.C
+				<-tmr.C()
 			}
 			return
 		}
-
-		// Update the ticker & figure out which ticker will tick next.
-		ticker.nxt = nextTick(ticker.nxt, ticker.spec)
-		heap.Fix(&tickers, 0)
 	}
 }
 
 func nextTick(tck time.Time, spec TickSpecification) time.Time {
-	s, e := spec.Start.InWeek(tck), spec.End.InWeek(tck)
+	s, e := spec.Start.InWeekStarting(tck, spec.WeekStart), spec.End.InWeekStarting(tck, spec.WeekStart)
 	switch {
 	case tck.Before(s):
 		// We haven't started ticking yet this week.
@@ -148,14 +578,14 @@ func nextTick(tck time.Time, spec TickSpecification) time.Time {
 
 	default:
 		// We are done ticking this week. Wait until we start ticking next week.
-		return s.AddDate(0, 0, 7)
+		return spec.Start.InWeekStarting(s.AddDate(0, 0, 7), spec.WeekStart)
 	}
 }
 
 // Time represents a specific time during a week; weeks start on Sunday and go
-// through the following Saturday. A weekly.Time value represents an instant in
-// time in every week, and may be converted to a specific instant in a specific
-// week.
+// through the following Saturday, unless otherwise specified. A weekly.Time
+// value represents an instant in time in every week, and may be converted to a
+// specific instant in a specific week.
 type Time struct {
 	day       time.Weekday
 	hour, min int
@@ -187,15 +617,84 @@ func MustParse(val string) Time {
 }
 
 // InWeek converts a given weekly.Time to a time.Time in the same week as the
-// given time.Time.
+// given time.Time, in the given time.Time's location.
+//
+// A weekly.Time may not exist in some weeks, when clocks are set forward past
+// it (e.g. at the start of daylight saving time); it then resolves to the
+// first instant after the skipped period. It may also occur twice, when
+// clocks are set back past it; it then resolves to the earlier occurrence.
 func (wt Time) InWeek(tt time.Time) time.Time {
-	return time.Date(tt.Year(), tt.Month(), tt.Day()+int(wt.day)-int(tt.Weekday()), wt.hour, wt.min, 0, 0, tt.Location())
+	return wt.InWeekStarting(tt, time.Sunday)
+}
+
+// InWeekStarting is like InWeek, but weeks begin on the given day rather than
+// on Sunday.
+func (wt Time) InWeekStarting(tt time.Time, start time.Weekday) time.Time {
+	loc := tt.Location()
+	// The wall-clock time wanted, as if in UTC.
+	wall := time.Date(tt.Year(), tt.Month(), tt.Day()+daysFrom(start, wt.day)-daysFrom(start, tt.Weekday()), wt.hour, wt.min, 0, 0, time.UTC)
+
+	// Only the zone offsets in effect a day either side of the wall-clock
+	// time can apply, assuming zone transitions are more than a day apart.
+	// Each gives a candidate instant, which is valid if that offset is
+	// indeed in effect at that instant.
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := wall.Add(24 * time.Hour).In(loc).Zone()
+	early, late := wall.Add(-time.Duration(before)*time.Second), wall.Add(-time.Duration(after)*time.Second)
+	if late.Before(early) {
+		early, late = late, early
+	}
+	if zoneOffset(early, loc) == wall.Sub(early) {
+		return early.In(loc)
+	}
+	if zoneOffset(late, loc) == wall.Sub(late) {
+		return late.In(loc)
+	}
+
+	// Neither candidate is valid: the wall-clock time was skipped. Find the
+	// transition between the candidates, which is when clocks resumed.
+	for late.Sub(early) > time.Second {
+		mid := early.Add(late.Sub(early) / 2).Truncate(time.Second)
+		if zoneOffset(mid, loc) == time.Duration(after)*time.Second {
+			late = mid
+		} else {
+			early = mid
+		}
+	}
+	return late.In(loc)
+}
+
+// StartOfWeek returns the instant the week containing the given time begins,
+// in the given time's location: midnight on the given day, or the first
+// instant after it if clocks were set forward past midnight.
+func StartOfWeek(tt time.Time, start time.Weekday) time.Time {
+	return Time{day: start}.InWeekStarting(tt, start)
+}
+
+// zoneOffset returns the offset from UTC of the given location at the given
+// instant.
+func zoneOffset(t time.Time, loc *time.Location) time.Duration {
+	_, off := t.In(loc).Zone()
+	return time.Duration(off) * time.Second
+}
+
+// daysFrom returns the number of days from the start of a week beginning on
+// start until the given day.
+func daysFrom(start, day time.Weekday) int {
+	return (int(day) - int(start) + 7) % 7
 }
 
 func (wt Time) Before(owt Time) bool {
-	return wt.day < owt.day ||
-		(wt.day == owt.day && wt.hour < owt.hour) ||
-		(wt.day == owt.day && wt.hour == owt.hour && wt.min < owt.min)
+	return wt.BeforeInWeekStarting(owt, time.Sunday)
+}
+
+// BeforeInWeekStarting is like Before, but weeks begin on the given day rather
+// than on Sunday.
+func (wt Time) BeforeInWeekStarting(owt Time, start time.Weekday) bool {
+	d, od := daysFrom(start, wt.day), daysFrom(start, owt.day)
+	return d < od ||
+		(d == od && wt.hour < owt.hour) ||
+		(d == od && wt.hour == owt.hour && wt.min < owt.min)
 }
 
 func (wt Time) String() string {
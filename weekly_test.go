@@ -2,8 +2,11 @@ package weekly
 
 import (
 	"fmt"
+	"math/rand"
+	"sync"
 	"testing"
 	"time"
+	_ "time/tzdata" // for America/New_York, regardless of the system's zone database
 )
 
 func TestNextTick(t *testing.T) {
@@ -96,6 +99,39 @@ func TestNextTick(t *testing.T) {
 			},
 			want: time.Date(2017, 8, 30, 17, 30, 0, 0, time.UTC),
 		},
+		{
+			desc: "monday_start_before_wrap",
+			t:    time.Date(2017, 8, 19, 23, 0, 30, 0, time.UTC),
+			spec: TickSpecification{
+				Start:     MustParse("Sat 10:00PM"),
+				End:       MustParse("Sun 2:00AM"),
+				Frequency: time.Minute,
+				WeekStart: time.Monday,
+			},
+			want: time.Date(2017, 8, 19, 23, 1, 0, 0, time.UTC),
+		},
+		{
+			desc: "monday_start_after_wrap",
+			t:    time.Date(2017, 8, 20, 1, 0, 30, 0, time.UTC),
+			spec: TickSpecification{
+				Start:     MustParse("Sat 10:00PM"),
+				End:       MustParse("Sun 2:00AM"),
+				Frequency: time.Minute,
+				WeekStart: time.Monday,
+			},
+			want: time.Date(2017, 8, 20, 1, 1, 0, 0, time.UTC),
+		},
+		{
+			desc: "monday_start_after_interval",
+			t:    time.Date(2017, 8, 20, 3, 0, 0, 0, time.UTC),
+			spec: TickSpecification{
+				Start:     MustParse("Sat 10:00PM"),
+				End:       MustParse("Sun 2:00AM"),
+				Frequency: time.Minute,
+				WeekStart: time.Monday,
+			},
+			want: time.Date(2017, 8, 26, 22, 0, 0, 0, time.UTC),
+		},
 	} {
 		test := test
 		t.Run(test.desc, func(t *testing.T) {
@@ -107,6 +143,486 @@ func TestNextTick(t *testing.T) {
 	}
 }
 
+func TestFilter(t *testing.T) {
+	t.Parallel()
+
+	ch := make(chan time.Time)
+	src := &Ticker{C: ch, done: make(chan struct{})}
+	skip := time.Date(2017, 12, 25, 0, 0, 0, 0, time.UTC)
+	ft := Filter(src, func(tck time.Time) bool {
+		return tck.Year() != skip.Year() || tck.YearDay() != skip.YearDay()
+	})
+
+	want := time.Date(2017, 12, 26, 19, 30, 0, 0, time.UTC)
+	go func() {
+		ch <- time.Date(2017, 12, 25, 19, 30, 0, 0, time.UTC) // on the skipped date
+		ch <- want
+	}()
+	if got := <-ft.C; !got.Equal(want) {
+		t.Errorf("Got tick %v, want %v", got, want)
+	}
+
+	ft.Stop()
+	select {
+	case <-src.done:
+	case <-time.After(time.Second):
+		t.Errorf("Source ticker not stopped after filtered ticker was stopped")
+	}
+}
+
+func TestManualTicker(t *testing.T) {
+	t.Parallel()
+
+	mt := NewManualTicker()
+	want := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	delivered := make(chan bool)
+	go func() { delivered <- mt.Tick(want) }()
+	if got := <-mt.Ticks(); !got.Equal(want) {
+		t.Errorf("Got tick %v, want %v", got, want)
+	}
+	if !<-delivered {
+		t.Errorf("Tick() = false for received tick, want true")
+	}
+
+	mt.Stop()
+	mt.Stop() // stopping twice is allowed
+	if mt.Tick(want) {
+		t.Errorf("Tick() = true after Stop, want false")
+	}
+}
+
+func TestWithInitialTick(t *testing.T) {
+	t.Parallel()
+
+	mt := NewManualTicker()
+	initial := time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC)
+	later := initial.Add(time.Hour)
+	it := WithInitialTick(mt, initial)
+	if got := <-it.Ticks(); !got.Equal(initial) {
+		t.Errorf("Got first tick %v, want %v", got, initial)
+	}
+	go mt.Tick(later)
+	if got := <-it.Ticks(); !got.Equal(later) {
+		t.Errorf("Got second tick %v, want %v", got, later)
+	}
+
+	// Stopping the returned scheduler stops the underlying scheduler.
+	it.Stop()
+	it.Stop() // stopping twice is allowed
+	stopped := make(chan struct{})
+	go func() {
+		for mt.Tick(later) {
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("Underlying ticker not stopped after returned scheduler was stopped")
+	}
+}
+
+func TestTickSpecificationContains(t *testing.T) {
+	t.Parallel()
+
+	ts := TickSpecification{
+		Start:     MustParse("Tue 12:00PM"),
+		End:       MustParse("Thu 12:00PM"),
+		Frequency: time.Hour,
+	}
+	// 2017-08-23 is a Wednesday.
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2017, 8, 22, 11, 59, 0, 0, time.UTC), false},
+		{time.Date(2017, 8, 22, 12, 0, 0, 0, time.UTC), true},
+		{time.Date(2017, 8, 23, 17, 30, 0, 0, time.UTC), true},
+		{time.Date(2017, 8, 24, 11, 59, 0, 0, time.UTC), true},
+		{time.Date(2017, 8, 24, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2017, 8, 27, 12, 0, 0, 0, time.UTC), false},
+	} {
+		if got := ts.Contains(test.t); got != test.want {
+			t.Errorf("Contains(%v) = %v, want %v", test.t, got, test.want)
+		}
+	}
+}
+
+func TestTickSpecificationContainsBoundaries(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Couldn't load location: %v", err)
+	}
+	week := TickSpecification{Start: MustParse("Sun 12:00AM"), End: MustParse("Sat 11:59PM"), Frequency: time.Hour}
+	gap := TickSpecification{Start: MustParse("Sun 2:30AM"), End: MustParse("Sun 4:00AM"), Frequency: time.Hour}
+	ambiguous := TickSpecification{Start: MustParse("Sun 1:30AM"), End: MustParse("Sun 2:00AM"), Frequency: time.Hour}
+	// 2017-08-20 is a Sunday. In 2021, America/New_York's clocks went forward
+	// from 2:00AM to 3:00AM on Sunday March 14, and back from 2:00AM to 1:00AM
+	// on Sunday November 7.
+	for _, test := range []struct {
+		desc string
+		ts   TickSpecification
+		t    time.Time
+		want bool
+	}{
+		{"start of week", week, time.Date(2017, 8, 20, 0, 0, 0, 0, time.UTC), true},
+		{"before end of week", week, time.Date(2017, 8, 26, 23, 58, 59, 0, time.UTC), true},
+		{"end of week", week, time.Date(2017, 8, 26, 23, 59, 0, 0, time.UTC), false},
+		{"before gap", gap, time.Date(2021, 3, 14, 6, 59, 59, 0, time.UTC).In(loc), false},
+		{"after gap", gap, time.Date(2021, 3, 14, 7, 0, 0, 0, time.UTC).In(loc), true},
+		{"before end after gap", gap, time.Date(2021, 3, 14, 3, 59, 59, 0, loc), true},
+		{"end after gap", gap, time.Date(2021, 3, 14, 4, 0, 0, 0, loc), false},
+		{"first occurrence", ambiguous, time.Date(2021, 11, 7, 5, 30, 0, 0, time.UTC).In(loc), true},
+		{"second occurrence", ambiguous, time.Date(2021, 11, 7, 6, 45, 0, 0, time.UTC).In(loc), true},
+		{"end after ambiguity", ambiguous, time.Date(2021, 11, 7, 7, 0, 0, 0, time.UTC).In(loc), false},
+	} {
+		if got := test.ts.Contains(test.t); got != test.want {
+			t.Errorf("[%s] Contains(%v) = %v, want %v", test.desc, test.t, got, test.want)
+		}
+	}
+}
+
+func TestTickerHeapNext(t *testing.T) {
+	t.Parallel()
+
+	first := TickSpecification{
+		Start:     MustParse("Tue 12:00PM"),
+		End:       MustParse("Tue 1:00PM"),
+		Frequency: 20 * time.Minute,
+	}
+	second := TickSpecification{
+		Start:     MustParse("Tue 1:00PM"),
+		End:       MustParse("Tue 2:00PM"),
+		Frequency: 30 * time.Minute,
+	}
+	h, err := newTickerHeap(time.Date(2017, 8, 22, 12, 30, 0, 0, time.UTC), []TickSpecification{second, first})
+	if err != nil {
+		t.Fatalf("newTickerHeap got unexpected error: %v", err)
+	}
+	rnd := rand.New(rand.NewSource(0))
+
+	for _, want := range []struct {
+		earliest time.Time
+		freq     time.Duration
+		spec     TickSpecification
+	}{
+		{time.Date(2017, 8, 22, 12, 40, 0, 0, time.UTC), 20 * time.Minute, first},
+		{time.Date(2017, 8, 22, 13, 0, 0, 0, time.UTC), 30 * time.Minute, second},
+		{time.Date(2017, 8, 22, 13, 30, 0, 0, time.UTC), 30 * time.Minute, second},
+		{time.Date(2017, 8, 29, 12, 0, 0, 0, time.UTC), 20 * time.Minute, first},
+	} {
+		tck := h.next(rnd)
+		if tck.Spec != want.spec {
+			t.Errorf("Tick scheduled at %v has spec %+v, want %+v", tck.Scheduled, tck.Spec, want.spec)
+		}
+		if tck.Scheduled.Before(want.earliest) || !tck.Scheduled.Before(want.earliest.Add(want.freq)) {
+			t.Errorf("Tick scheduled at %v, want in [%v, %v)", tck.Scheduled, want.earliest, want.earliest.Add(want.freq))
+		}
+	}
+}
+
+// fakeClock is a Clock whose time advances only when a timer is fired. Each
+// timer created is sent on timers.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan *fakeTimer
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	tmr := &fakeTimer{c: make(chan time.Time, 1), clock: c, when: c.Now().Add(d)}
+	c.timers <- tmr
+	return tmr
+}
+
+type fakeTimer struct {
+	c     chan time.Time
+	clock *fakeClock
+	when  time.Time
+
+	mu   sync.Mutex
+	done bool // fired or stopped
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wasDone := t.done
+	t.done = true
+	return !wasDone
+}
+
+// fire advances the clock to the timer's time, and fires the timer.
+func (t *fakeTimer) fire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.clock.mu.Lock()
+	t.clock.now = t.when
+	t.clock.mu.Unlock()
+	t.done = true
+	t.c <- t.when
+}
+
+func TestSpecTickerWithClock(t *testing.T) {
+	t.Parallel()
+
+	first := TickSpecification{
+		Start:     MustParse("Tue 12:00PM"),
+		End:       MustParse("Tue 1:00PM"),
+		Frequency: 20 * time.Minute,
+	}
+	second := TickSpecification{
+		Start:     MustParse("Tue 1:00PM"),
+		End:       MustParse("Tue 2:00PM"),
+		Frequency: 30 * time.Minute,
+	}
+	clock := &fakeClock{now: time.Date(2017, 8, 22, 12, 30, 0, 0, time.UTC), timers: make(chan *fakeTimer)}
+	st, err := NewSpecTickerWithClock([]TickSpecification{second, first}, clock)
+	if err != nil {
+		t.Fatalf("NewSpecTickerWithClock got unexpected error: %v", err)
+	}
+	defer st.Stop()
+
+	for _, want := range []struct {
+		earliest time.Time
+		freq     time.Duration
+		spec     TickSpecification
+	}{
+		{time.Date(2017, 8, 22, 12, 40, 0, 0, time.UTC), 20 * time.Minute, first},
+		{time.Date(2017, 8, 22, 13, 0, 0, 0, time.UTC), 30 * time.Minute, second},
+		{time.Date(2017, 8, 22, 13, 30, 0, 0, time.UTC), 30 * time.Minute, second},
+		{time.Date(2017, 8, 29, 12, 0, 0, 0, time.UTC), 20 * time.Minute, first},
+	} {
+		tmr := <-clock.timers
+		go tmr.fire()
+		tck := <-st.C
+		if tck.Spec != want.spec {
+			t.Errorf("Tick scheduled at %v has spec %+v, want %+v", tck.Scheduled, tck.Spec, want.spec)
+		}
+		if tck.Scheduled.Before(want.earliest) || !tck.Scheduled.Before(want.earliest.Add(want.freq)) {
+			t.Errorf("Tick scheduled at %v, want in [%v, %v)", tck.Scheduled, want.earliest, want.earliest.Add(want.freq))
+		}
+		if !tck.Time.Equal(tck.Scheduled) {
+			t.Errorf("Tick delivered at %v, want %v", tck.Time, tck.Scheduled)
+		}
+	}
+
+	// A tick that is not ready to be received is dropped.
+	(<-clock.timers).fire()
+	<-clock.timers
+	if got := st.DroppedTicks(); got != 1 {
+		t.Errorf("DroppedTicks() = %d, want 1", got)
+	}
+}
+
+func TestSpecTickerJitter(t *testing.T) {
+	t.Parallel()
+
+	jitter := func(d time.Duration) *time.Duration { return &d }
+	for _, test := range []struct {
+		desc      string
+		jitter    *time.Duration
+		maxJitter time.Duration // ticks are expected in [scheduled, scheduled+maxJitter], or exactly on schedule if 0
+	}{
+		{"default", nil, 20 * time.Minute},
+		{"none", jitter(0), 0},
+		{"fixed", jitter(time.Minute), time.Minute},
+		{"frequency", jitter(20 * time.Minute), 20 * time.Minute},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			spec := TickSpecification{
+				Start:     MustParse("Tue 12:00PM"),
+				End:       MustParse("Tue 1:00PM"),
+				Frequency: 20 * time.Minute,
+				Jitter:    test.jitter,
+			}
+			clock := &fakeClock{now: time.Date(2017, 8, 22, 12, 30, 0, 0, time.UTC), timers: make(chan *fakeTimer)}
+			st, err := NewSpecTickerWithClock([]TickSpecification{spec}, clock)
+			if err != nil {
+				t.Fatalf("NewSpecTickerWithClock got unexpected error: %v", err)
+			}
+			defer st.Stop()
+
+			for _, earliest := range []time.Time{
+				time.Date(2017, 8, 22, 12, 40, 0, 0, time.UTC),
+				time.Date(2017, 8, 29, 12, 0, 0, 0, time.UTC),
+				time.Date(2017, 8, 29, 12, 20, 0, 0, time.UTC),
+				time.Date(2017, 8, 29, 12, 40, 0, 0, time.UTC),
+			} {
+				tmr := <-clock.timers
+				go tmr.fire()
+				tck := <-st.C
+				if test.maxJitter == 0 {
+					if !tck.Scheduled.Equal(earliest) {
+						t.Errorf("Tick scheduled at %v, want %v", tck.Scheduled, earliest)
+					}
+					continue
+				}
+				if tck.Scheduled.Before(earliest) || tck.Scheduled.After(earliest.Add(test.maxJitter)) {
+					t.Errorf("Tick scheduled at %v, want in [%v, %v]", tck.Scheduled, earliest, earliest.Add(test.maxJitter))
+				}
+			}
+		})
+	}
+}
+
+func TestSpecTickerFireImmediately(t *testing.T) {
+	t.Parallel()
+
+	noJitter := time.Duration(0)
+	spec := TickSpecification{
+		Start:     MustParse("Tue 12:00PM"),
+		End:       MustParse("Tue 1:00PM"),
+		Frequency: 20 * time.Minute,
+		Jitter:    &noJitter,
+	}
+	inside := time.Date(2017, 8, 22, 12, 30, 0, 0, time.UTC)
+	outside := time.Date(2017, 8, 22, 11, 0, 0, 0, time.UTC)
+	nearTick := time.Date(2017, 8, 22, 12, 39, 57, 0, time.UTC)
+	for _, test := range []struct {
+		desc string
+		now  time.Time
+		opts TickerOptions
+		want *Tick // the immediate tick; nil if none is expected
+	}{
+		{"inside_window", inside, TickerOptions{FireImmediatelyIfActive: true}, &Tick{Time: inside, Scheduled: inside, Spec: spec}},
+		{"outside_window", outside, TickerOptions{FireImmediatelyIfActive: true}, nil},
+		{"near_scheduled_tick", nearTick, TickerOptions{FireImmediatelyIfActive: true}, nil},
+		{"always_inside_window", inside, TickerOptions{FireImmediately: true}, &Tick{Time: inside, Scheduled: inside, Spec: spec}},
+		{"always_outside_window", outside, TickerOptions{FireImmediately: true}, &Tick{Time: outside, Scheduled: outside}},
+		{"always_near_window_start", time.Date(2017, 8, 22, 11, 59, 58, 0, time.UTC), TickerOptions{FireImmediately: true}, nil},
+		{"disabled", inside, TickerOptions{}, nil},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			clock := &fakeClock{now: test.now, timers: make(chan *fakeTimer)}
+			test.opts.Clock = clock
+			st, err := test.opts.NewSpecTicker([]TickSpecification{spec})
+			if err != nil {
+				t.Fatalf("NewSpecTicker got unexpected error: %v", err)
+			}
+			defer st.Stop()
+
+			// The immediate tick, if any, is delivered before the ticker waits
+			// for the first scheduled tick.
+			select {
+			case tck := <-st.C:
+				switch {
+				case test.want == nil:
+					t.Errorf("Got immediate tick at %v, want none", tck.Time)
+				case !tck.Time.Equal(test.want.Time) || !tck.Scheduled.Equal(test.want.Scheduled) || tck.Spec != test.want.Spec:
+					t.Errorf("Got immediate tick %+v, want %+v", tck, *test.want)
+				}
+				<-clock.timers
+			case <-clock.timers:
+				if test.want != nil {
+					t.Errorf("Got no immediate tick, want tick at %v", test.want.Time)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTickerHeapWeekStart(t *testing.T) {
+	t.Parallel()
+
+	// 2017-08-23 is a Wednesday.
+	now := time.Date(2017, 8, 23, 12, 0, 0, 0, time.UTC)
+	spec := func(start, end string, ws time.Weekday) TickSpecification {
+		return TickSpecification{Start: MustParse(start), End: MustParse(end), Frequency: time.Hour, WeekStart: ws}
+	}
+	for _, test := range []struct {
+		desc    string
+		specs   []TickSpecification
+		wantErr bool
+	}{
+		{
+			desc:    "sunday_start_wrap",
+			specs:   []TickSpecification{spec("Sat 10:00PM", "Sun 2:00AM", time.Sunday)},
+			wantErr: true,
+		},
+		{
+			desc:  "monday_start_wrap",
+			specs: []TickSpecification{spec("Sat 10:00PM", "Sun 2:00AM", time.Monday)},
+		},
+		{
+			desc:    "monday_start_before_week",
+			specs:   []TickSpecification{spec("Sun 10:00PM", "Mon 2:00AM", time.Monday)},
+			wantErr: true,
+		},
+		{
+			desc: "monday_start_disjoint",
+			specs: []TickSpecification{
+				spec("Mon 10:00AM", "Tue 10:00AM", time.Monday),
+				spec("Thu 10:00AM", "Fri 10:00AM", time.Monday),
+				spec("Sat 10:00PM", "Sun 2:00AM", time.Monday),
+			},
+		},
+		{
+			desc: "monday_start_overlap",
+			specs: []TickSpecification{
+				spec("Mon 10:00AM", "Tue 10:00AM", time.Monday),
+				spec("Sat 10:00PM", "Sun 2:00AM", time.Monday),
+				spec("Sun 1:00AM", "Sun 3:00AM", time.Monday),
+			},
+			wantErr: true,
+		},
+		{
+			desc: "mixed_week_starts",
+			specs: []TickSpecification{
+				spec("Mon 10:00AM", "Tue 10:00AM", time.Monday),
+				spec("Thu 10:00AM", "Fri 10:00AM", time.Sunday),
+			},
+			wantErr: true,
+		},
+		{
+			desc:    "bad_week_start",
+			specs:   []TickSpecification{spec("Mon 10:00AM", "Tue 10:00AM", 7)},
+			wantErr: true,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			_, err := newTickerHeap(now, test.specs)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Errorf("newTickerHeap got error %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewSpecTickerBadJitter(t *testing.T) {
+	t.Parallel()
+
+	for _, jitter := range []time.Duration{-time.Second, 20*time.Minute + time.Second} {
+		jitter := jitter
+		spec := TickSpecification{
+			Start:     MustParse("Tue 12:00PM"),
+			End:       MustParse("Tue 1:00PM"),
+			Frequency: 20 * time.Minute,
+			Jitter:    &jitter,
+		}
+		if st, err := NewSpecTicker([]TickSpecification{spec}); err == nil {
+			st.Stop()
+			t.Errorf("NewSpecTicker with jitter %v got no error, want error", jitter)
+		}
+	}
+}
+
 func TestParse(t *testing.T) {
 	t.Parallel()
 	for i, test := range []struct {
@@ -152,31 +668,172 @@ func TestInWeek(t *testing.T) {
 			MustParse("Fri 11:59PM"),
 			MustParse("Sat 5:17PM"),
 		} {
-			val, wantWeekTime := val, wantWeekTime
-			t.Run(fmt.Sprintf("TestInWeek-%d-%d", i, j), func(t *testing.T) {
-				t.Parallel()
-				gotTime := wantWeekTime.InWeek(val)
-				if gotTime.Weekday() != wantWeekTime.day {
-					t.Errorf("Want day %s, got %s", wantWeekTime.day, gotTime.Weekday())
-				}
-				if gotTime.Hour() != wantWeekTime.hour {
-					t.Errorf("Want hour %d, got %d", wantWeekTime.hour, gotTime.Hour())
-				}
-				if gotTime.Minute() != wantWeekTime.min {
-					t.Errorf("Want minute %d, got %d", wantWeekTime.min, gotTime.Hour())
-				}
-				if !gotTime.Equal(wantWeekTime.InWeek(gotTime)) {
-					t.Errorf("InWeek not idempotent for time-in-week %+v, starting time %v", wantWeekTime, val)
-				}
-				if !inSameWeek(val, gotTime) {
-					t.Errorf("Got %v, want time in same week as %v", t, val)
-				}
-			})
+			for ws := time.Sunday; ws <= time.Saturday; ws++ {
+				val, wantWeekTime, ws := val, wantWeekTime, ws
+				t.Run(fmt.Sprintf("TestInWeek-%d-%d-%s", i, j, ws), func(t *testing.T) {
+					t.Parallel()
+					gotTime := wantWeekTime.InWeekStarting(val, ws)
+					if gotTime.Weekday() != wantWeekTime.day {
+						t.Errorf("Want day %s, got %s", wantWeekTime.day, gotTime.Weekday())
+					}
+					if gotTime.Hour() != wantWeekTime.hour {
+						t.Errorf("Want hour %d, got %d", wantWeekTime.hour, gotTime.Hour())
+					}
+					if gotTime.Minute() != wantWeekTime.min {
+						t.Errorf("Want minute %d, got %d", wantWeekTime.min, gotTime.Hour())
+					}
+					if !gotTime.Equal(wantWeekTime.InWeekStarting(gotTime, ws)) {
+						t.Errorf("InWeekStarting not idempotent for time-in-week %+v, starting time %v", wantWeekTime, val)
+					}
+					if !inSameWeek(val, gotTime, ws) {
+						t.Errorf("Got %v, want time in same week as %v", gotTime, val)
+					}
+					if ws == time.Sunday && !gotTime.Equal(wantWeekTime.InWeek(val)) {
+						t.Errorf("InWeekStarting(%v, Sunday) = %v, differs from InWeek = %v", val, gotTime, wantWeekTime.InWeek(val))
+					}
+				})
+			}
 
 		}
 	}
 }
 
+func TestInWeekDST(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Couldn't load location: %v", err)
+	}
+	// In 2021, clocks went forward from 2:00AM to 3:00AM on Sunday March 14, and
+	// back from 2:00AM to 1:00AM on Sunday November 7.
+	spring := time.Date(2021, time.March, 17, 12, 0, 0, 0, loc)
+	fall := time.Date(2021, time.November, 10, 12, 0, 0, 0, loc)
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		desc string
+		wt   Time
+		tt   time.Time
+		want time.Time
+	}{
+		{"before gap", MustParse("Sun 1:59AM"), spring, utc(time.March, 14, 6, 59)},
+		{"start of gap", MustParse("Sun 2:00AM"), spring, utc(time.March, 14, 7, 0)},
+		{"in gap", MustParse("Sun 2:30AM"), spring, utc(time.March, 14, 7, 0)},
+		{"after gap", MustParse("Sun 3:00AM"), spring, utc(time.March, 14, 7, 0)},
+		{"later after gap", MustParse("Sun 3:30AM"), spring, utc(time.March, 14, 7, 30)},
+		{"before ambiguity", MustParse("Sun 12:59AM"), fall, utc(time.November, 7, 4, 59)},
+		{"start of ambiguity", MustParse("Sun 1:00AM"), fall, utc(time.November, 7, 5, 0)},
+		{"in ambiguity", MustParse("Sun 1:30AM"), fall, utc(time.November, 7, 5, 30)},
+		{"after ambiguity", MustParse("Sun 2:00AM"), fall, utc(time.November, 7, 7, 0)},
+		{"other day", MustParse("Mon 2:30AM"), spring, utc(time.March, 15, 6, 30)},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			got := test.wt.InWeek(test.tt)
+			if !got.Equal(test.want) {
+				t.Errorf("%v.InWeek(%v) = %v, want %v", test.wt, test.tt, got, test.want.In(loc))
+			}
+			if got.Location() != loc {
+				t.Errorf("%v.InWeek(%v) has location %v, want %v", test.wt, test.tt, got.Location(), loc)
+			}
+		})
+	}
+}
+
+func TestStartOfWeek(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Couldn't load location: %v", err)
+	}
+	for _, test := range []struct {
+		tt    time.Time
+		start time.Weekday
+		want  time.Time
+	}{
+		// Wednesday, October 14, 2026.
+		{time.Date(2026, time.October, 14, 15, 4, 0, 0, loc), time.Sunday, time.Date(2026, time.October, 11, 0, 0, 0, 0, loc)},
+		{time.Date(2026, time.October, 14, 15, 4, 0, 0, loc), time.Monday, time.Date(2026, time.October, 12, 0, 0, 0, 0, loc)},
+		{time.Date(2026, time.October, 14, 15, 4, 0, 0, loc), time.Thursday, time.Date(2026, time.October, 8, 0, 0, 0, 0, loc)},
+		// The start of a week is in that week.
+		{time.Date(2026, time.October, 11, 0, 0, 0, 0, loc), time.Sunday, time.Date(2026, time.October, 11, 0, 0, 0, 0, loc)},
+		{time.Date(2026, time.October, 10, 23, 59, 59, 0, loc), time.Sunday, time.Date(2026, time.October, 4, 0, 0, 0, 0, loc)},
+	} {
+		if got := StartOfWeek(test.tt, test.start); !got.Equal(test.want) {
+			t.Errorf("StartOfWeek(%v, %v) = %v, want %v", test.tt, test.start, got, test.want)
+		}
+	}
+}
+
+func TestNextTickDST(t *testing.T) {
+	t.Parallel()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("Couldn't load location: %v", err)
+	}
+	utc := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		desc  string
+		spec  TickSpecification
+		start time.Time
+		want  []time.Time
+	}{
+		{
+			desc:  "window spans gap",
+			spec:  TickSpecification{Start: MustParse("Sun 1:00AM"), End: MustParse("Sun 4:00AM"), Frequency: 30 * time.Minute},
+			start: time.Date(2021, time.March, 13, 12, 0, 0, 0, loc),
+			want: []time.Time{
+				utc(time.March, 14, 6, 0), // 1:00AM EST
+				utc(time.March, 14, 6, 30),
+				utc(time.March, 14, 7, 0), // 3:00AM EDT
+				utc(time.March, 14, 7, 30),
+				utc(time.March, 21, 5, 0), // 1:00AM EDT, the next week
+			},
+		},
+		{
+			desc:  "window starts in gap",
+			spec:  TickSpecification{Start: MustParse("Sun 2:30AM"), End: MustParse("Sun 5:00AM"), Frequency: time.Hour},
+			start: time.Date(2021, time.March, 13, 12, 0, 0, 0, loc),
+			want: []time.Time{
+				utc(time.March, 14, 7, 0), // 3:00AM EDT
+				utc(time.March, 14, 8, 0),
+				utc(time.March, 21, 6, 30), // 2:30AM EDT, the next week
+			},
+		},
+		{
+			desc:  "window spans ambiguity",
+			spec:  TickSpecification{Start: MustParse("Sun 1:30AM"), End: MustParse("Sun 2:30AM"), Frequency: 30 * time.Minute},
+			start: time.Date(2021, time.November, 6, 12, 0, 0, 0, loc),
+			want: []time.Time{
+				utc(time.November, 7, 5, 30), // 1:30AM EDT
+				utc(time.November, 7, 6, 0),  // 1:00AM EST
+				utc(time.November, 7, 6, 30),
+				utc(time.November, 7, 7, 0),
+				utc(time.November, 14, 6, 30), // 1:30AM EST, the next week
+			},
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+			tck := test.start
+			for i, want := range test.want {
+				tck = nextTick(tck, test.spec)
+				if !tck.Equal(want) {
+					t.Fatalf("Tick %d = %v, want %v", i, tck, want.In(loc))
+				}
+			}
+		})
+	}
+}
+
 func TestBefore(t *testing.T) {
 	t.Parallel()
 
@@ -209,6 +866,33 @@ func TestBefore(t *testing.T) {
 	}
 }
 
+func TestBeforeInWeekStarting(t *testing.T) {
+	t.Parallel()
+
+	// Sorted, for a week starting on Monday.
+	times := []Time{
+		MustParse("Mon 11:43AM"),
+		MustParse("Tue 12:00AM"),
+		MustParse("Wed 12:00PM"),
+		MustParse("Thu 7:30PM"),
+		MustParse("Fri 11:59PM"),
+		MustParse("Sat 5:17PM"),
+		MustParse("Sun 5:13AM"),
+	}
+
+	for i, ti := range times {
+		for j, tj := range times {
+			i, ti, j, tj := i, ti, j, tj
+			t.Run(fmt.Sprintf("TestBeforeInWeekStarting-%d-%d", i, j), func(t *testing.T) {
+				t.Parallel()
+				if got, want := ti.BeforeInWeekStarting(tj, time.Monday), i < j; got != want {
+					t.Errorf("%q.BeforeInWeekStarting(%q, Monday) = %v, want %v", ti, tj, got, want)
+				}
+			})
+		}
+	}
+}
+
 func TestString(t *testing.T) {
 	t.Parallel()
 	for i, want := range []string{
@@ -234,9 +918,9 @@ func TestString(t *testing.T) {
 	}
 }
 
-func inSameWeek(t1, t2 time.Time) bool {
-	t1 = t1.AddDate(0, 0, -int(t1.Weekday()))
-	t2 = t2.AddDate(0, 0, -int(t2.Weekday()))
+func inSameWeek(t1, t2 time.Time, start time.Weekday) bool {
+	t1 = t1.AddDate(0, 0, -daysFrom(start, t1.Weekday()))
+	t2 = t2.AddDate(0, 0, -daysFrom(start, t2.Weekday()))
 	return t1.Year() == t2.Year() &&
 		t1.Month() == t2.Month() &&
 		t1.Day() == t2.Day()